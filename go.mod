@@ -6,6 +6,7 @@ toolchain go1.22.2
 
 require (
 	github.com/NullHypothesis/zoossh v0.0.0-20230915131605-0156201467e2
+	github.com/ProtonMail/go-crypto v1.0.0
 	github.com/aws/aws-sdk-go-v2 v1.26.1
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.53.1
 	github.com/emersion/go-imap v1.2.1
@@ -22,6 +23,7 @@ require (
 	go.mau.fi/whatsmeow v0.0.0-20240507080416-01b0547014dc
 	golang.org/x/oauth2 v0.20.0
 	golang.org/x/text v0.15.0
+	golang.org/x/time v0.5.0
 	google.golang.org/api v0.170.0
 	google.golang.org/protobuf v1.34.0
 	gopkg.in/telebot.v3 v3.2.1
@@ -43,6 +45,7 @@ require (
 	github.com/aws/smithy-go v1.20.2 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/emersion/go-message v0.15.0 // indirect
 	github.com/emersion/go-textwrapper v0.0.0-20200911093747-65d896831594 // indirect
@@ -75,7 +78,6 @@ require (
 	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/net v0.22.0 // indirect
 	golang.org/x/sys v0.18.0 // indirect
-	golang.org/x/time v0.5.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240311132316-a219d84964c2 // indirect
 	google.golang.org/grpc v1.62.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
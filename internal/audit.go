@@ -0,0 +1,62 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// auditRecord represents an admin action in the audit log.
+type auditRecord struct {
+	Time      time.Time  `json:"time"`
+	Admin     string     `json:"admin"`
+	Method    string     `json:"method"`
+	Endpoint  string     `json:"endpoint"`
+	Params    url.Values `json:"params,omitempty"`
+	RequestID string     `json:"request_id,omitempty"`
+}
+
+// audit appends a record of the given admin request to the audit log.  The
+// audit log is a file of newline-delimited JSON records, or our log if no
+// audit log file is configured.
+func (b *BackendContext) audit(admin string, r *http.Request) {
+	record := auditRecord{
+		Time:      time.Now().UTC(),
+		Admin:     admin,
+		Method:    r.Method,
+		Endpoint:  r.URL.Path,
+		Params:    r.URL.Query(),
+		RequestID: requestID(r),
+	}
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Can't encode audit record: %s", err)
+		return
+	}
+
+	auditFile := b.Config.Backend.AuditLogFile
+	if auditFile == "" {
+		logRequest(r, "Audit: %s", encoded)
+		return
+	}
+
+	b.auditLock.Lock()
+	defer b.auditLock.Unlock()
+	file, err := os.OpenFile(auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("Can't open audit log file", auditFile, err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(encoded, '\n')); err != nil {
+		log.Println("Can't write to audit log file", auditFile, err)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestAuditAdminAction(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.AdminTokens = map[string]string{"alice": "secret"}
+	b.Config.Backend.AuditLogFile = filepath.Join(t.TempDir(), "audit.log")
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{})
+
+	before := time.Now().UTC()
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/assignments?format=json", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	b.assignmentsHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+
+	content, err := os.ReadFile(b.Config.Backend.AuditLogFile)
+	if err != nil {
+		t.Fatalf("failed to read the audit log: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one audit record but got %d", len(lines))
+	}
+
+	var record auditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("failed to unmarshal audit record: %s", err)
+	}
+	if record.Admin != "alice" {
+		t.Errorf("expected admin alice but got %q", record.Admin)
+	}
+	if record.Method != http.MethodGet || record.Endpoint != "/assignments" {
+		t.Errorf("unexpected action %s %s", record.Method, record.Endpoint)
+	}
+	if !reflect.DeepEqual(record.Params, url.Values{"format": {"json"}}) {
+		t.Errorf("unexpected parameters %v", record.Params)
+	}
+	if record.Time.Before(before.Add(-time.Second)) || record.Time.After(time.Now().Add(time.Second)) {
+		t.Errorf("unexpected time %s", record.Time)
+	}
+}
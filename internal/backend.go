@@ -5,6 +5,7 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -14,11 +15,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -31,14 +37,47 @@ type BackendContext struct {
 	Resources core.BackendResources
 	rTestPool *ResourceTestPool
 	metrics   *Metrics
+	auditLock sync.Mutex
+	// tokensLock protects the API tokens in Config, which are reloaded
+	// from the tokens file.
+	tokensLock sync.RWMutex
+	// ready is set once the kraken parsed the bridge descriptors for the
+	// first time, and lastReload holds the unix time of the last reload.
+	ready      atomic.Bool
+	lastReload atomic.Int64
+}
+
+// statusRecorder wraps an http.ResponseWriter to capture the status code of
+// the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher, which our resource stream relies on.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
 }
 
 // metricsWrapper keeps track of the number of times each of our API endpoints
-// is called.
+// is called and how long it takes to respond.  Note that for the resource
+// stream the duration is the lifetime of the stream.
 func metricsWrapper(f http.HandlerFunc, endpoint string, metrics *Metrics) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		metrics.Requests.With(prometheus.Labels{"target": endpoint}).Inc()
-		f(w, r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		f(recorder, r)
+		metrics.RequestDuration.
+			With(prometheus.Labels{"endpoint": endpoint, "code": strconv.Itoa(recorder.status)}).
+			Observe(time.Since(start).Seconds())
 	}
 }
 
@@ -54,8 +93,45 @@ func (b *BackendContext) startWebApi(cfg *Config, srv *http.Server) {
 		cfg.Backend.TargetsEndpoint:        b.targetsHandler,
 		cfg.Backend.MetricsEndpoint:        promhttp.Handler().(http.HandlerFunc),
 	}
+	if cfg.Backend.SummaryEndpoint != "" {
+		endpoints[cfg.Backend.SummaryEndpoint] = b.summaryHandler
+	}
+	if cfg.Backend.HealthEndpoint != "" {
+		endpoints[cfg.Backend.HealthEndpoint] = b.healthHandler
+	}
+	if cfg.Backend.MetricsJSONEndpoint != "" {
+		endpoints[cfg.Backend.MetricsJSONEndpoint] = b.metricsJSONHandler
+	}
+	if cfg.Backend.DistributionDecisionEndpoint != "" {
+		endpoints[cfg.Backend.DistributionDecisionEndpoint] = b.distributionDecisionHandler
+	}
+	if cfg.Backend.AssignmentsEndpoint != "" {
+		endpoints[cfg.Backend.AssignmentsEndpoint] = b.assignmentsHandler
+	}
+	if cfg.Backend.BlocklistReloadEndpoint != "" {
+		endpoints[cfg.Backend.BlocklistReloadEndpoint] = b.reloadBlockListHandler
+	}
+	if cfg.Backend.BlockedEndpoint != "" {
+		endpoints[cfg.Backend.BlockedEndpoint] = b.blockedResourcesHandler
+	}
+	if cfg.Backend.SelfTestEndpoint != "" {
+		endpoints[cfg.Backend.SelfTestEndpoint] = b.selfTestHandler
+	}
+	if cfg.Backend.TestResultsEndpoint != "" {
+		endpoints[cfg.Backend.TestResultsEndpoint] = b.testResultsHandler
+	}
+	if cfg.Backend.BridgeResultsEndpoint != "" {
+		endpoints[cfg.Backend.BridgeResultsEndpoint] = b.bridgeResultsHandler
+	}
+	if cfg.Backend.ReassignEndpoint != "" {
+		endpoints[cfg.Backend.ReassignEndpoint] = b.reassignHandler
+	}
+	requestIDHeader := cfg.Backend.RequestIDHeader
+	if requestIDHeader == "" {
+		requestIDHeader = DefaultRequestIDHeader
+	}
 	for endpoint, handler := range endpoints {
-		mux.Handle(endpoint, metricsWrapper(handler, endpoint, b.metrics))
+		mux.Handle(endpoint, metricsWrapper(requestIDWrapper(handler, requestIDHeader), endpoint, b.metrics))
 	}
 	srv.Handler = mux
 	srv.Addr = cfg.Backend.WebApi.ApiAddress
@@ -71,9 +147,8 @@ func (b *BackendContext) startWebApi(cfg *Config, srv *http.Server) {
 
 // stopWebApi stops our Web server.
 func (b *BackendContext) stopWebApi(srv *http.Server) {
-	// Give our Web server five seconds to shut down.
-	t := time.Now().Add(5 * time.Second)
-	ctx, cancel := context.WithDeadline(context.Background(), t)
+	// Give our Web server some time to shut down.
+	ctx, cancel := context.WithTimeout(context.Background(), b.shutdownTimeout())
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
@@ -81,16 +156,81 @@ func (b *BackendContext) stopWebApi(srv *http.Server) {
 	}
 }
 
+// defaultShutdownTimeout is how long our Web API waits for open requests when
+// shutting down, unless configured otherwise.
+const defaultShutdownTimeout = 5 * time.Second
+
+// shutdownTimeout returns how long our Web API waits for open requests when
+// shutting down.
+func (b *BackendContext) shutdownTimeout() time.Duration {
+	if b.Config == nil || b.Config.Backend.ShutdownTimeoutSeconds <= 0 {
+		return defaultShutdownTimeout
+	}
+	return time.Duration(b.Config.Backend.ShutdownTimeoutSeconds) * time.Second
+}
+
+// regionalProportions returns the regional proportions of the given resource
+// type without the distributors that don't get resources of the type.
+func regionalProportions(rType string, regional map[string]map[string]int, proportions map[string]int) map[string]map[string]int {
+	if len(regional) == 0 {
+		return nil
+	}
+
+	filtered := make(map[string]map[string]int)
+	for country, regionalProportion := range regional {
+		countryProportions := make(map[string]int)
+		for distName, proportion := range regionalProportion {
+			if _, exists := proportions[distName]; !exists {
+				log.Printf("Error: Ignoring the %s proportion of %q for %q, it doesn't get %s resources.", country, distName, rType, rType)
+				continue
+			}
+			countryProportions[distName] = proportion
+		}
+		if len(countryProportions) != 0 {
+			filtered[country] = countryProportions
+		}
+	}
+	return filtered
+}
+
+// defaultMaxResourceTypes is the maximum number of resource types a
+// distributor can request at once, unless configured otherwise.
+const defaultMaxResourceTypes = 16
+
+// maxResourceTypes returns the maximum number of resource types a distributor
+// can request at once.
+func (b *BackendContext) maxResourceTypes() int {
+	if b.Config == nil || b.Config.Backend.MaxResourceTypesPerRequest <= 0 {
+		return defaultMaxResourceTypes
+	}
+	return b.Config.Backend.MaxResourceTypesPerRequest
+}
+
+// shutdownSignals are the signals that make the backend shut down gracefully.
+// Besides SIGINT we handle SIGTERM, which is what systemd and Kubernetes send.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// waitForShutdown blocks until a signal is received on the given channel and
+// then cancels the given context and stops our Web API.
+func (b *BackendContext) waitForShutdown(signals <-chan os.Signal, cancel context.CancelFunc, srv *http.Server) {
+	sig := <-signals
+	log.Printf("Received signal %q.", sig)
+	cancel()
+	b.stopWebApi(srv)
+}
+
 // InitBackend initialises our backend.
 func (b *BackendContext) InitBackend(cfg *Config) {
 
 	log.Println("Initialising backend.")
 	b.Config = cfg
-	b.metrics = InitMetrics()
+	b.metrics = InitMetrics(cfg.Backend.MetricsNamespace, cfg.Backend.MetricsSubsystem)
 
 	collectionConfig := core.CollectionConfig{
-		StorageDir: cfg.Backend.StorageDir,
-		Types:      []core.TypeConfig{},
+		StorageDir:         cfg.Backend.StorageDir,
+		Types:              []core.TypeConfig{},
+		GoneGracePeriod:    time.Duration(cfg.Backend.GoneGracePeriodMinutes) * time.Minute,
+		StoreFlushInterval: time.Duration(cfg.Backend.StoreFlushIntervalSeconds) * time.Second,
 	}
 	for rType, conf := range cfg.Backend.Resources {
 		if _, exists := resources.ResourceMap[rType]; !exists {
@@ -105,69 +245,120 @@ func (b *BackendContext) InitBackend(cfg *Config) {
 			}
 		}
 		collectionConfig.Types = append(collectionConfig.Types, core.TypeConfig{
-			Type:          rType,
-			NewResource:   resources.ResourceMap[rType].New,
-			Unpartitioned: conf.Unpartitioned,
-			Proportions:   proportions,
-			Stored:        resources.ResourceMap[rType].NeedsPersistantStore,
+			Type:                rType,
+			NewResource:         resources.ResourceMap[rType].New,
+			Unpartitioned:       conf.Unpartitioned,
+			Proportions:         proportions,
+			RegionalProportions: regionalProportions(rType, conf.RegionalProportions, proportions),
+			Stored:              resources.ResourceMap[rType].NeedsPersistantStore,
+			Expiry:              time.Duration(conf.ExpiryHours * float64(time.Hour)),
+			Quotas:              conf.Quotas,
 		})
 	}
 	b.Resources = *core.NewBackendResources(&collectionConfig)
+	untested, err := core.ParseUntestedPolicy(cfg.Backend.DistributeUntested)
+	if err != nil {
+		log.Printf("Error: %s, distributing untested bridges only if there are few functional ones.", err)
+	}
+	b.Resources.Untested = untested
+
+	if cfg.Backend.ReadOnlyReplica {
+		log.Println("Running as a read-only replica, resources are tested upstream.")
+	} else if cfg.Backend.DisableInternalTesting {
+		log.Println("Internal resource testing is disabled, waiting for test results to be posted.")
+	} else {
+		b.rTestPool = NewResourceTestPool(
+			cfg.Backend.BridgestrapEndpoint,
+			cfg.Backend.BridgestrapToken,
+			cfg.Backend.OnbascaEndpoint,
+			cfg.Backend.OnbascaToken,
+			cfg.Backend.BandwidthRatioThreshold,
+			cfg.Backend.TestBatchSize,
+			time.Duration(cfg.Backend.TestFlushTimeoutSeconds)*time.Second,
+			time.Duration(cfg.Backend.MinRetestIntervalMinutes)*time.Minute,
+			b.metrics,
+		)
+		b.rTestPool.coalesceReachability = cfg.Backend.CoalesceReachabilityTests
+		defer b.rTestPool.Stop()
+		go b.logSelfTest()
+	}
 
-	b.rTestPool = NewResourceTestPool(cfg.Backend.BridgestrapEndpoint, cfg.Backend.BridgestrapToken, cfg.Backend.OnbascaEndpoint, cfg.Backend.OnbascaToken, cfg.Backend.BandwidthRatioThreshold)
-	defer b.rTestPool.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	quit := make(chan bool)
+	if cfg.Backend.TokensFile != "" {
+		go b.watchTokensFile(ctx, cfg.Backend.TokensFile)
+	}
 
 	var wg sync.WaitGroup
 	ready := make(chan bool, 1)
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
-		InitKraken(cfg, quit, ready, b)
+		if cfg.Backend.ReadOnlyReplica {
+			followUpstream(ctx, cfg, ready, &b.Resources)
+		} else {
+			InitKraken(ctx, cfg, ready, b)
+		}
 	}()
 
 	var srv http.Server
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
 		b.startWebApi(cfg, &srv)
 	}()
 
 	// Wait until our data kraken parsed our bridge descriptors.
 	<-ready
+	b.ready.Store(true)
 	log.Println("Kraken finished parsing bridge descriptors.")
 
-	// We're done bootstrapping.  Now wait for a SIGTERM.
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Interrupt)
-	<-sigint
-	log.Println("Received SIGINT.")
-	close(quit)
-	b.stopWebApi(&srv)
+	// We're done bootstrapping.  Now wait for a SIGINT or SIGTERM.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+	b.waitForShutdown(signals, cancel, &srv)
 
 	// Wait for goroutines to finish.
 	wg.Wait()
+	b.Resources.Close()
 	log.Println("All goroutines have finished.  Exiting.")
 }
 
 // extractResourceRequest extracts a ResourceRequest from the given HTTP
-// request.  If an error occurs, the function writes the error to the given
-// response writer and returns an error.
-func extractResourceRequest(w http.ResponseWriter, r *http.Request) (*core.ResourceRequest, error) {
+// request, with its resource types deduplicated.  Requests for more than
+// maxTypes resource types are rejected.  If an error occurs, the function
+// writes the error to the given response writer and returns an error.
+func extractResourceRequest(w http.ResponseWriter, r *http.Request, maxTypes int) (*core.ResourceRequest, error) {
 
 	var req *core.ResourceRequest
 
 	b, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
-		log.Printf("Failed to read HTTP body.")
+		logRequest(r, "Failed to read HTTP body.")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return nil, err
 	}
 
 	if err := json.Unmarshal(b, &req); err != nil {
-		log.Printf("Failed to unmarshal HTTP body %q.", b)
+		logRequest(r, "Failed to unmarshal HTTP body %q.", b)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	rTypes := []string{}
+	for _, rType := range req.ResourceTypes {
+		if !seen[rType] {
+			seen[rType] = true
+			rTypes = append(rTypes, rType)
+		}
+	}
+	req.ResourceTypes = rTypes
+	if len(req.ResourceTypes) > maxTypes {
+		logRequest(r, "Rejecting request for %d resource types, the maximum is %d.", len(req.ResourceTypes), maxTypes)
+		err := fmt.Errorf("too many resource types, the maximum is %d", maxTypes)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return nil, err
 	}
@@ -179,37 +370,81 @@ func extractResourceRequest(w http.ResponseWriter, r *http.Request) (*core.Resou
 // writes an error to the given ResponseWriter and returns false.
 func (b *BackendContext) isAuthenticated(w http.ResponseWriter, r *http.Request) bool {
 
-	// First, we take the bearer token from the 'Authorization' HTTP header.
-	tokenLine := r.Header.Get("Authorization")
-	if tokenLine == "" {
-		log.Printf("Request carries no 'Authorization' HTTP header.")
-		http.Error(w, "request carries no 'Authorization' HTTP header", http.StatusBadRequest)
+	givenToken, ok := b.bearerToken(w, r)
+	if !ok {
 		return false
 	}
-	if !strings.HasPrefix(tokenLine, "Bearer ") {
-		log.Printf("Authorization header contains no bearer token.")
-		http.Error(w, "authorization header contains no bearer token", http.StatusBadRequest)
+
+	// Do we have the given token on record?  Admins may use the distributor
+	// endpoints too.
+	apiTokens, adminTokens := b.tokens()
+	if _, ok := tokenName(apiTokens, givenToken); ok {
+		return true
+	}
+	if _, ok := tokenName(adminTokens, givenToken); ok {
+		return true
+	}
+	logRequest(r, "Invalid authentication token.")
+	b.metrics.AuthFailures.With(prometheus.Labels{"reason": "invalid_token", "endpoint": r.URL.Path}).Inc()
+	http.Error(w, "invalid authentication token", http.StatusUnauthorized)
+
+	return false
+}
+
+// isAdmin authenticates the given HTTP request as coming from an admin.
+// Distributor tokens are not enough for it.  If this fails, it writes an error
+// to the given ResponseWriter and returns false.  Successful requests are
+// recorded in the audit log.
+func (b *BackendContext) isAdmin(w http.ResponseWriter, r *http.Request) bool {
+
+	givenToken, ok := b.bearerToken(w, r)
+	if !ok {
 		return false
 	}
-	fields := strings.Split(tokenLine, " ")
-	givenToken := fields[1]
 
-	// Do we have the given token on record?
-	for _, savedToken := range b.Config.Backend.ApiTokens {
-		if givenToken == savedToken {
-			return true
-		}
+	apiTokens, adminTokens := b.tokens()
+	if name, ok := tokenName(adminTokens, givenToken); ok {
+		b.audit(name, r)
+		return true
+	}
+	if _, ok := tokenName(apiTokens, givenToken); ok {
+		logRequest(r, "Distributor token used for an admin request.")
+		b.metrics.AuthFailures.With(prometheus.Labels{"reason": "not_admin", "endpoint": r.URL.Path}).Inc()
+		http.Error(w, "admin token required", http.StatusForbidden)
+		return false
 	}
-	log.Printf("Invalid authentication token.")
+	logRequest(r, "Invalid authentication token.")
+	b.metrics.AuthFailures.With(prometheus.Labels{"reason": "invalid_token", "endpoint": r.URL.Path}).Inc()
 	http.Error(w, "invalid authentication token", http.StatusUnauthorized)
 
 	return false
 }
 
+// bearerToken takes the bearer token from the 'Authorization' HTTP header of
+// the given request.  If there is none, it writes an error to the given
+// ResponseWriter and returns false.
+func (b *BackendContext) bearerToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+
+	tokenLine := r.Header.Get("Authorization")
+	if tokenLine == "" {
+		logRequest(r, "Request carries no 'Authorization' HTTP header.")
+		b.metrics.AuthFailures.With(prometheus.Labels{"reason": "no_header", "endpoint": r.URL.Path}).Inc()
+		http.Error(w, "request carries no 'Authorization' HTTP header", http.StatusBadRequest)
+		return "", false
+	}
+	if !strings.HasPrefix(tokenLine, "Bearer ") {
+		logRequest(r, "Authorization header contains no bearer token.")
+		b.metrics.AuthFailures.With(prometheus.Labels{"reason": "no_bearer", "endpoint": r.URL.Path}).Inc()
+		http.Error(w, "authorization header contains no bearer token", http.StatusBadRequest)
+		return "", false
+	}
+	fields := strings.Split(tokenLine, " ")
+	return fields[1], true
+}
+
 func (b *BackendContext) getResourceStreamHandler(w http.ResponseWriter, r *http.Request) {
-	req, err := extractResourceRequest(w, r)
+	req, err := extractResourceRequest(w, r, b.maxResourceTypes())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -219,48 +454,46 @@ func (b *BackendContext) getResourceStreamHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	// The stream is newline-delimited JSON: every resource diff is sent as a
+	// single line of compact JSON terminated by a newline.
 	w.Header().Set("Transfer-Encoding", "chunked")
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", "application/x-ndjson")
 	w.WriteHeader(http.StatusOK)
 
 	diffs := make(chan *core.ResourceDiff)
 	b.Resources.RegisterChan(req, diffs)
+	streamConnections := b.metrics.StreamConnections.With(prometheus.Labels{"distributor": req.RequestOrigin})
+	streamConnections.Inc()
+	defer streamConnections.Dec()
 	defer b.Resources.UnregisterChan(req.RequestOrigin, diffs)
 	defer close(diffs)
 
 	sendDiff := func(diff *core.ResourceDiff) error {
-		jsonBlurb, err := json.MarshalIndent(diff, "", "    ")
-		if err != nil {
+		if err := mechanisms.WriteStreamMessage(w, diff); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return err
 		}
-
-		if _, err := fmt.Fprintf(w, string(jsonBlurb)); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return err
-		}
-		fmt.Fprintf(w, "\r") // delimiter
 		flusher.Flush()
 		return nil
 	}
 
 	resourceMap := b.processResourceRequest(req)
-	log.Printf("Sending distributor initial batch: %s", resourceMap)
+	logRequest(r, "Sending distributor initial batch: %s", resourceMap)
 	if err := sendDiff(&core.ResourceDiff{New: resourceMap, FullUpdate: true}); err != nil {
-		log.Printf("Error sending initial diff to distributor: %s.", err)
+		logRequest(r, "Error sending initial diff to distributor: %s.", err)
 	}
 
-	log.Printf("Entering streaming loop for %s.", r.RemoteAddr)
+	logRequest(r, "Entering streaming loop for %s.", r.RemoteAddr)
 	for {
 		select {
 		// Is our HTTP connection done?
 		case <-r.Context().Done():
-			log.Printf("Exiting streaming loop for %s.", r.RemoteAddr)
+			logRequest(r, "Exiting streaming loop for %s.", r.RemoteAddr)
 			// Consume remaining hashring differences.
 			for {
 				select {
 				case diff := <-diffs:
-					log.Printf("Sending remaining hashring diff.")
+					logRequest(r, "Sending remaining hashring diff.")
 					sendDiff(diff)
 				default:
 					return
@@ -268,7 +501,7 @@ func (b *BackendContext) getResourceStreamHandler(w http.ResponseWriter, r *http
 			}
 		case diff := <-diffs:
 			if err := sendDiff(diff); err != nil {
-				log.Printf("Error sending diff to distributor: %s.", err)
+				logRequest(r, "Error sending diff to distributor: %s.", err)
 				break
 			}
 		}
@@ -343,6 +576,135 @@ func (b *BackendContext) statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// healthStatus represents the response of the health endpoint.
+type healthStatus struct {
+	Ready         bool       `json:"ready"`
+	ResourceTypes int        `json:"resource_types"`
+	LastReload    *time.Time `json:"last_reload"`
+}
+
+// markReloaded records that the kraken reloaded the bridge descriptors.
+func (b *BackendContext) markReloaded() {
+	b.lastReload.Store(time.Now().Unix())
+}
+
+// healthHandler lets load balancers know if we are ready to serve requests.
+// It responds with 503 until the kraken parsed the bridge descriptors for the
+// first time.
+func (b *BackendContext) healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{
+		Ready:         b.ready.Load(),
+		ResourceTypes: len(b.Resources.Collection),
+	}
+	if lastReload := b.lastReload.Load(); lastReload != 0 {
+		t := time.Unix(lastReload, 0).UTC()
+		status.LastReload = &t
+	}
+
+	jsonBlurb, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, "error while turning health status into JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, string(jsonBlurb))
+}
+
+// metricsJSONHandler responds with a JSON snapshot of the key metrics of the
+// backend.
+func (b *BackendContext) metricsJSONHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.isAdmin(w, r) {
+		return
+	}
+
+	snapshot := takeMetricsSnapshot(b.Config, &b.Resources)
+	if lastReload := b.lastReload.Load(); lastReload != 0 {
+		t := time.Unix(lastReload, 0).UTC()
+		snapshot.LastDescriptorReload = &t
+	}
+
+	jsonBlurb, err := json.Marshal(snapshot)
+	if err != nil {
+		logRequest(r, "Bug: Failed to marshal metrics snapshot: %s", err)
+		http.Error(w, "failed to marshal metrics", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, string(jsonBlurb))
+}
+
+// distributionDecision explains which resources the backend is distributing,
+// depending on the fraction of functional and accepted resources.
+type distributionDecision struct {
+	FunctionalFraction        float64 `json:"functional_fraction"`
+	MinFunctionalFraction     float64 `json:"min_functional_fraction"`
+	DistributingNonFunctional bool    `json:"distributing_non_functional"`
+	AcceptedFraction          float64 `json:"accepted_fraction"`
+	MinRatioFraction          float64 `json:"min_ratio_fraction"`
+	IgnoringBandwidthRatio    bool    `json:"ignoring_bandwidth_ratio"`
+	DistributeUntested        string  `json:"distribute_untested"`
+}
+
+// distributionDecisionHandler responds with the last decision on which
+// resources to distribute and the fractions behind it.
+func (b *BackendContext) distributionDecisionHandler(w http.ResponseWriter, r *http.Request) {
+	current := b.Resources.GetDistributionDecision()
+	decision := distributionDecision{
+		FunctionalFraction:        current.FunctionalFraction,
+		MinFunctionalFraction:     b.Config.Backend.minFunctionalFraction(),
+		DistributingNonFunctional: !current.OnlyFunctional,
+		AcceptedFraction:          current.AcceptedFraction,
+		MinRatioFraction:          b.Config.Backend.minRatioFraction(),
+		IgnoringBandwidthRatio:    !current.UseBandwidthRatio,
+		DistributeUntested:        "auto",
+	}
+	if b.Config.Backend.DistributeUntested != "" {
+		decision.DistributeUntested = b.Config.Backend.DistributeUntested
+	}
+
+	jsonBlurb, err := json.Marshal(decision)
+	if err != nil {
+		logRequest(r, "Bug: Failed to marshal distribution decision: %s", err)
+		http.Error(w, "failed to marshal distribution decision", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, string(jsonBlurb))
+}
+
+// summaryHandler responds with a JSON object that contains the number of
+// resources of each type in each test state, e.g.:
+// {"obfs4":{"functional":1200,"dysfunctional":30,"untested":5}}
+func (b *BackendContext) summaryHandler(w http.ResponseWriter, r *http.Request) {
+	summary := make(map[string]map[string]int)
+	for rType, hashring := range b.Resources.Collection {
+		counts := map[string]int{
+			core.StateToString(core.StateUntested):      0,
+			core.StateToString(core.StateFunctional):    0,
+			core.StateToString(core.StateDysfunctional): 0,
+		}
+		// GetAll read-locks the hashring and returns a copy of its resources.
+		for _, resource := range hashring.GetAll() {
+			counts[core.StateToString(resource.TestResult().State)]++
+		}
+		summary[rType] = counts
+	}
+
+	jsonBlurb, err := json.Marshal(summary)
+	if err != nil {
+		logRequest(r, "Bug: Failed to marshal resource summary: %s", err)
+		http.Error(w, "failed to marshal summary", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBlurb)
+}
+
 func (b *BackendContext) processResourceRequest(req *core.ResourceRequest) core.ResourceMap {
 
 	resources := make(core.ResourceMap)
@@ -354,11 +716,25 @@ func (b *BackendContext) processResourceRequest(req *core.ResourceRequest) core.
 }
 
 func (b *BackendContext) getResourcesHandler(w http.ResponseWriter, r *http.Request) {
-	req, err := extractResourceRequest(w, r)
+	req, err := extractResourceRequest(w, r, b.maxResourceTypes())
 	if err != nil {
 		return
 	}
-	log.Printf("Distributor %q is asking for %q.", req.RequestOrigin, req.ResourceTypes)
+	sortOrder := r.URL.Query().Get("sort")
+	if sortOrder != "" && sortOrder != "quality" {
+		logRequest(r, "Unsupported sort order %q.", sortOrder)
+		http.Error(w, "unsupported sort order", http.StatusBadRequest)
+		return
+	}
+	// Admins can inspect the resources of any distributor.
+	if distributor := r.URL.Query().Get("distributor"); distributor != "" {
+		if !b.isAdmin(w, r) {
+			return
+		}
+		logRequest(r, "Admin is asking for the resources of distributor %q.", distributor)
+		req.RequestOrigin = distributor
+	}
+	logRequest(r, "Distributor %q is asking for %q.", req.RequestOrigin, req.ResourceTypes)
 
 	var resourceState core.ResourceState
 	for _, rType := range req.ResourceTypes {
@@ -366,9 +742,12 @@ func (b *BackendContext) getResourcesHandler(w http.ResponseWriter, r *http.Requ
 		resourceState.Working = append(resourceState.Working, allResources.Working...)
 		resourceState.Notworking = append(resourceState.Notworking, allResources.Notworking...)
 	}
-	log.Printf("Returning %d Working resources of type %s to distributor %q.",
+	if sortOrder == "quality" {
+		sortByQuality(resourceState.Working)
+	}
+	logRequest(r, "Returning %d Working resources of type %s to distributor %q.",
 		len(resourceState.Working), req.ResourceTypes, req.RequestOrigin)
-	log.Printf("Returning %d Not Working resources of type %s to distributor %q.",
+	logRequest(r, "Returning %d Not Working resources of type %s to distributor %q.",
 		len(resourceState.Notworking), req.ResourceTypes, req.RequestOrigin)
 
 	jsonBlurb, err := json.Marshal(resourceState)
@@ -381,12 +760,52 @@ func (b *BackendContext) getResourcesHandler(w http.ResponseWriter, r *http.Requ
 	fmt.Fprintln(w, string(jsonBlurb))
 }
 
+// sortByQuality sorts the given resources from best to worst: functional
+// resources first, then the ones with accepted bandwidth, and then by
+// decreasing bandwidth ratio.  Resources of the same quality keep their order.
+func sortByQuality(rs []core.Resource) {
+	stateRank := map[int]int{core.StateFunctional: 0, core.StateUntested: 1, core.StateDysfunctional: 2}
+	speedRank := map[int]int{core.SpeedAccepted: 0, core.SpeedUntested: 1, core.SpeedRejected: 2}
+	ratio := func(r core.Resource) float64 {
+		if r.TestResult().Ratio == nil {
+			return 0
+		}
+		return *r.TestResult().Ratio
+	}
+
+	sort.SliceStable(rs, func(i, j int) bool {
+		ti, tj := rs[i].TestResult(), rs[j].TestResult()
+		if stateRank[ti.State] != stateRank[tj.State] {
+			return stateRank[ti.State] < stateRank[tj.State]
+		}
+		if speedRank[ti.Speed] != speedRank[tj.Speed] {
+			return speedRank[ti.Speed] < speedRank[tj.Speed]
+		}
+		return ratio(rs[i]) > ratio(rs[j])
+	})
+}
+
+// testResultResetter is implemented by the resources that carry a test
+// result.
+type testResultResetter interface {
+	ResetTestResult()
+}
+
 // UnmarshalResources unmarshals a slice of raw JSON messages into the
-// corresponding resources.
+// corresponding resources.  Fields that the resource type doesn't have are
+// rejected, so typos don't go unnoticed.  The test results the resources
+// carry are discarded, only our own tests are trusted.
 func UnmarshalResources(rawResources []json.RawMessage) ([]core.Resource, error) {
+	return unmarshalResources(rawResources, false)
+}
+
+// unmarshalResources behaves like UnmarshalResources but keeps the test
+// results of the resources if keepTestResults is set, for the resources that
+// we stored ourselves.
+func unmarshalResources(rawResources []json.RawMessage, keepTestResults bool) ([]core.Resource, error) {
 
 	rs := []core.Resource{}
-	for _, rawResource := range rawResources {
+	for i, rawResource := range rawResources {
 		base := core.ResourceBase{}
 		if err := json.Unmarshal(rawResource, &base); err != nil {
 			return nil, err
@@ -402,51 +821,121 @@ func UnmarshalResources(rawResources []json.RawMessage) ([]core.Resource, error)
 		}
 		r := rInfo.New()
 
-		if err := json.Unmarshal(rawResource, r); err != nil {
+		dec := json.NewDecoder(bytes.NewReader(rawResource))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(r); err != nil {
+			// The decoder doesn't have a typed error for unknown fields.
+			if field, found := strings.CutPrefix(err.Error(), "json: unknown field "); found {
+				return nil, fmt.Errorf("resource %d of type %q has the unknown field %s", i, base.Type(), field)
+			}
 			return nil, errors.New("failed to unmarshal resource struct")
 		}
 
 		if !r.(core.Resource).IsValid() {
 			return nil, fmt.Errorf("resource %q is not valid", base.Type())
 		}
+		if resetter, ok := r.(testResultResetter); ok && !keepTestResults {
+			resetter.ResetTestResult()
+		}
 		rs = append(rs, r.(core.Resource))
 	}
 
 	return rs, nil
 }
 
-// postResourcesHandler handles POST requests that register a resource with our
-// backend.
-func (b *BackendContext) postResourcesHandler(w http.ResponseWriter, req *http.Request) {
+// readResources reads and unmarshals the resources in the body of the given
+// HTTP request.  If an error occurs, the function writes the error to the given
+// response writer and returns an error.
+func readResources(w http.ResponseWriter, req *http.Request) ([]core.Resource, error) {
 
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
-		log.Printf("Error reading %s's request body: %s", req.RemoteAddr, err)
+		logRequest(req, "Error reading %s's request body: %s", req.RemoteAddr, err)
 		http.Error(w, "failed to read request body", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	rawResources := []json.RawMessage{}
 	if err := json.Unmarshal(body, &rawResources); err != nil {
-		log.Printf("Error unmarshalling %s's raw resources: %s", req.RemoteAddr, err)
+		logRequest(req, "Error unmarshalling %s's raw resources: %s", req.RemoteAddr, err)
 		http.Error(w, "failed to unmarshal raw resources", http.StatusBadRequest)
-		return
+		return nil, err
 	}
 
 	rs, err := UnmarshalResources(rawResources)
 	if err != nil {
-		log.Printf("Error unmarshalling %s's resources: %s", req.RemoteAddr, err)
+		logRequest(req, "Error unmarshalling %s's resources: %s", req.RemoteAddr, err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+	return rs, nil
+}
+
+// PostResourcesResponse is the response to a POST request to the resources
+// endpoint.  It lists the resources that were not added to the collection.
+type PostResourcesResponse struct {
+	Rejected []RejectedResource `json:"rejected,omitempty"`
+}
+
+// RejectedResource identifies a rejected resource by its position in the
+// request.
+type RejectedResource struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// postResourcesHandler handles POST requests that register a resource with our
+// backend.
+func (b *BackendContext) postResourcesHandler(w http.ResponseWriter, req *http.Request) {
+
+	rs, err := readResources(w, req)
+	if err != nil {
 		return
 	}
 
-	rTypes := map[string]struct{}{}
-	for _, r := range rs {
+	resp := PostResourcesResponse{}
+	for i, r := range rs {
+		if _, exists := b.Resources.Collection[r.Type()]; !exists {
+			logRequest(req, "Rejected %s's %q resource as the type is not in the collection.", req.RemoteAddr, r.Type())
+			resp.Rejected = append(resp.Rejected, RejectedResource{
+				Index:  i,
+				Reason: fmt.Sprintf("resource type %q is not configured", r.Type()),
+			})
+			continue
+		}
 		b.Resources.Add(r)
-		rTypes[r.Type()] = struct{}{}
-		log.Printf("Added %s's %q resource to collection.", req.RemoteAddr, r.Type())
+		logRequest(req, "Added %s's %q resource to collection.", req.RemoteAddr, r.Type())
 	}
-	b.Resources.Save()
+	b.Resources.SaveSoon()
+
+	jsonBlurb, err := json.Marshal(resp)
+	if err != nil {
+		logRequest(req, "Error marshalling response: %s", err)
+		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, string(jsonBlurb))
+}
+
+// deleteResourcesHandler handles DELETE requests that de-register a resource
+// from our backend.
+func (b *BackendContext) deleteResourcesHandler(w http.ResponseWriter, req *http.Request) {
+
+	rs, err := readResources(w, req)
+	if err != nil {
+		return
+	}
+
+	for _, r := range rs {
+		if err := b.Resources.Remove(r); err != nil {
+			logRequest(req, "Error removing %s's %q resource from collection: %s", req.RemoteAddr, r.Type(), err)
+			continue
+		}
+		logRequest(req, "Removed %s's %q resource from collection.", req.RemoteAddr, r.Type())
+	}
+	b.Resources.SaveSoon()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -454,12 +943,19 @@ func (b *BackendContext) postResourcesHandler(w http.ResponseWriter, req *http.R
 }
 
 // resourcesHandler handles requests coming from distributors (if it's GET
-// requests) and from proxies (if it's POST requests).
+// requests) and from proxies (if it's POST or DELETE requests).
 func (b *BackendContext) resourcesHandler(w http.ResponseWriter, r *http.Request) {
 	if !b.isAuthenticated(w, r) {
 		return
 	}
 
+	// Replicas get their resources from upstream only.
+	if b.Config.Backend.ReadOnlyReplica && r.Method != http.MethodGet {
+		logRequest(r, "Rejected %s's %s request, we are a read-only replica.", r.RemoteAddr, r.Method)
+		http.Error(w, "read-only replica", http.StatusForbidden)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		if r.URL.Path == b.Config.Backend.ResourcesEndpoint {
@@ -471,12 +967,150 @@ func (b *BackendContext) resourcesHandler(w http.ResponseWriter, r *http.Request
 		if r.URL.Path == b.Config.Backend.ResourcesEndpoint {
 			b.postResourcesHandler(w, r)
 		}
+	case http.MethodDelete:
+		if r.URL.Path == b.Config.Backend.ResourcesEndpoint {
+			b.deleteResourcesHandler(w, r)
+		}
 	default:
-		log.Printf("Received unsupported request method %q from %s.", r.Method, r.RemoteAddr)
+		logRequest(r, "Received unsupported request method %q from %s.", r.Method, r.RemoteAddr)
 		http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 	}
 }
 
+// blockedResourcesHandler responds with a JSON list of all resources, of any
+// type, that are known to be blocked in the country given in the 'country'
+// parameter.
+func (b *BackendContext) blockedResourcesHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.isAuthenticated(w, r) {
+		return
+	}
+
+	country := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("country")))
+	if country == "" {
+		http.Error(w, "no 'country' parameter given", http.StatusBadRequest)
+		return
+	}
+
+	blocked := []core.Resource{}
+	for _, hashring := range b.Resources.Collection {
+		blocked = append(blocked, hashring.Filter(func(r core.Resource) bool {
+			return r.BlockedIn()[country]
+		})...)
+	}
+	logRequest(r, "Returning %d resources blocked in %q.", len(blocked), country)
+
+	jsonBlurb, err := json.Marshal(blocked)
+	if err != nil {
+		http.Error(w, "error while turning resources into JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, string(jsonBlurb))
+}
+
+// assignmentsHandler handles admin requests for the distributor that each
+// bridge is currently assigned to.  The response is a JSON list sorted by
+// fingerprint, so exports of the same state can be compared.
+func (b *BackendContext) assignmentsHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.isAdmin(w, r) {
+		return
+	}
+
+	assignments := exportAssignments(b.Config, &b.Resources)
+	logRequest(r, "Exporting %d bridge assignments.", len(assignments))
+
+	jsonBlurb, err := json.Marshal(assignments)
+	if err != nil {
+		http.Error(w, "error while turning assignments into JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, string(jsonBlurb))
+}
+
+// reloadBlockListHandler handles admin requests to reload the blocklist and
+// allowlist right away, instead of waiting for the next kraken run, and apply
+// them to the bridges we have.
+func (b *BackendContext) reloadBlockListHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.isAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if b.Config.Backend.ReadOnlyReplica {
+		http.Error(w, "read-only replica", http.StatusForbidden)
+		return
+	}
+
+	bl, err := newBlockList(b.Config.Backend.BlocklistFile, b.Config.Backend.AllowlistFile)
+	if err != nil {
+		logRequest(r, "Problem loading block list: %s", err)
+		http.Error(w, "error while loading the block list", http.StatusInternalServerError)
+		return
+	}
+	updated := applyBlockList(&b.Resources, bl)
+	b.Resources.SaveSoon()
+	logRequest(r, "Reloaded block list for %d resources.", updated)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "{\"updated_resources\": %d}\n", updated)
+}
+
+// reassignRequest is the body of the requests to reassign a bridge.
+type reassignRequest struct {
+	Fingerprint string `json:"fingerprint"`
+	Distributor string `json:"distributor"`
+}
+
+// reassignHandler handles admin requests to move a bridge, with all its
+// transports, to another distributor, to "none" or to "unallocated".
+func (b *BackendContext) reassignHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.isAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if b.Config.Backend.ReadOnlyReplica {
+		http.Error(w, "read-only replica", http.StatusForbidden)
+		return
+	}
+
+	var req reassignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logRequest(r, "Failed to unmarshal reassign request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Fingerprint == "" {
+		http.Error(w, "missing fingerprint", http.StatusBadRequest)
+		return
+	}
+	if _, exists := b.Config.Backend.DistProportions[req.Distributor]; !exists && req.Distributor != "none" && req.Distributor != resources.DistributorUnallocated {
+		logRequest(r, "Can't reassign to unknown distributor %q.", req.Distributor)
+		http.Error(w, "unknown distributor", http.StatusBadRequest)
+		return
+	}
+
+	moved, err := b.Resources.Reassign(req.Fingerprint, req.Distributor)
+	if err != nil {
+		logRequest(r, "Can't reassign %s: %s", req.Fingerprint, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	logRequest(r, "Reassigned %d resources of %s to %q.", moved, req.Fingerprint, req.Distributor)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "{\"moved_resources\": %d}\n", moved)
+}
+
 // targetsHandler handles requests coming from censorship measurement clients
 // like OONI.
 func (b *BackendContext) targetsHandler(w http.ResponseWriter, r *http.Request) {
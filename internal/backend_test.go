@@ -5,26 +5,95 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
 func TestAuthentication(t *testing.T) {
 
-	b := BackendContext{}
+	b := BackendContext{metrics: metrics}
 	tokens := make(map[string]string)
 	tokens["https"] = "8M4WSTrhwatWYGDWJw1OtS2cDXYfJtAetCcaFP94lYo="
 	b.Config = &Config{BackendConfig{ApiTokens: tokens}, Distributors{}, Updaters{}, true}
 
+	for reason, authHeader := range map[string]string{
+		"no_header":     "",
+		"no_bearer":     "Basic foo",
+		"invalid_token": "Bearer invalid",
+	} {
+		counter := metrics.AuthFailures.With(prometheus.Labels{"reason": reason, "endpoint": "/auth-test"})
+		before := testutil.ToFloat64(counter)
+
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/auth-test", nil)
+		if authHeader != "" {
+			r.Header.Set("Authorization", authHeader)
+		}
+		if b.isAuthenticated(rr, r) {
+			t.Errorf("broken request passed authentication: %q", authHeader)
+		}
+		if after := testutil.ToFloat64(counter); after != before+1 {
+			t.Errorf("expected the %s auth failure counter to increase, got %f", reason, after)
+		}
+	}
+
 	rr := httptest.NewRecorder()
-	r := &http.Request{}
-	if b.isAuthenticated(rr, r) {
-		t.Error("broken request passed authentication")
+	r := httptest.NewRequest(http.MethodGet, "/auth-test", nil)
+	r.Header.Set("Authorization", "Bearer "+tokens["https"])
+	if !b.isAuthenticated(rr, r) {
+		t.Error("valid request failed authentication")
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.ApiTokens = map[string]string{"https": "distributor"}
+	b.Config.Backend.AdminTokens = map[string]string{"admin": "admin"}
+
+	isAdmin := func(token string) int {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/admin-test", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		if b.isAdmin(rr, r) {
+			return http.StatusOK
+		}
+		return rr.Code
+	}
+
+	if code := isAdmin("distributor"); code != http.StatusForbidden {
+		t.Errorf("expected HTTP return code 403 for a distributor token but got %d", code)
+	}
+	if code := isAdmin("invalid"); code != http.StatusUnauthorized {
+		t.Errorf("expected HTTP return code 401 for an invalid token but got %d", code)
+	}
+	if code := isAdmin("admin"); code != http.StatusOK {
+		t.Errorf("admin token failed admin authentication with %d", code)
+	}
+
+	// Admins can use the distributor endpoints too.
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/auth-test", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	if !b.isAuthenticated(rr, r) {
+		t.Error("admin token failed distributor authentication")
 	}
 }
 
@@ -55,9 +124,231 @@ func TestUnmarshalResources(t *testing.T) {
 	}
 }
 
+func TestPostResourcesUnknownField(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Unpartitioned: true}},
+	})
+
+	rr := httptest.NewRecorder()
+	body := strings.NewReader(`[{"type": "obfs4", "address": "1.2.3.4", "port": 1234, "fingerpint": "0123456789ABCDEF0123456789ABCDEF01234567"}]`)
+	req := httptest.NewRequest(http.MethodPost, "/resources", body)
+
+	b.postResourcesHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected HTTP return code 400 but got %d", rr.Code)
+	}
+	expected := `resource 0 of type "obfs4" has the unknown field "fingerpint"`
+	if msg := strings.TrimSpace(rr.Body.String()); msg != expected {
+		t.Errorf("expected the error %q but got %q", expected, msg)
+	}
+	if n := b.Resources.Collection["obfs4"].Len(); n != 0 {
+		t.Errorf("expected no resources to be added but there are %d", n)
+	}
+}
+
+func TestGetResourcesDistributorParam(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.ResourcesEndpoint = "/resources"
+	b.Config.Backend.ApiTokens = map[string]string{"moat": "distributor"}
+	b.Config.Backend.AdminTokens = map[string]string{"admin": "admin"}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Proportions: map[string]int{"https": 1}}},
+	})
+	r := resources.NewTransport()
+	r.SetType("obfs4")
+	r.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	r.Port = 1234
+	b.Resources.Add(r)
+
+	getResources := func(token, query string) (int, int) {
+		body := strings.NewReader(`{"request_origin": "moat", "resource_types": ["obfs4"]}`)
+		req := httptest.NewRequest(http.MethodGet, "/resources"+query, body)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		b.resourcesHandler(rr, req)
+
+		var state struct {
+			Working []json.RawMessage `json:"working"`
+		}
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &state); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr.Code, len(state.Working)
+	}
+
+	if code, working := getResources("admin", ""); code != http.StatusOK || working != 0 {
+		t.Errorf("expected no resources for moat but got %d with code %d", working, code)
+	}
+	if code, working := getResources("admin", "?distributor=https"); code != http.StatusOK || working != 1 {
+		t.Errorf("expected the resource of https but got %d with code %d", working, code)
+	}
+	if code, _ := getResources("distributor", "?distributor=https"); code != http.StatusForbidden {
+		t.Errorf("expected HTTP return code 403 for a distributor token but got %d", code)
+	}
+}
+
+func TestGetResourcesTypeLimit(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.ResourcesEndpoint = "/resources"
+	b.Config.Backend.ApiTokens = map[string]string{"https": "secret"}
+	b.Config.Backend.MaxResourceTypesPerRequest = 2
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Unpartitioned: true}},
+	})
+	r := resources.NewTransport()
+	r.SetType("obfs4")
+	r.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	r.Port = 1234
+	b.Resources.Add(r)
+
+	getResources := func(rTypes string) (int, int) {
+		body := strings.NewReader(`{"request_origin": "https", "resource_types": [` + rTypes + `]}`)
+		req := httptest.NewRequest(http.MethodGet, "/resources", body)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		b.resourcesHandler(rr, req)
+
+		var state struct {
+			Working []json.RawMessage `json:"working"`
+		}
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &state); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr.Code, len(state.Working)
+	}
+
+	if code, working := getResources(`"obfs4", "obfs4", "obfs4"`); code != http.StatusOK || working != 1 {
+		t.Errorf("expected duplicated types to be served once but got %d resources with code %d", working, code)
+	}
+	if code, _ := getResources(`"obfs4", "vanilla", "obfs3"`); code != http.StatusBadRequest {
+		t.Errorf("expected HTTP return code 400 for too many types but got %d", code)
+	}
+}
+
+func TestStreamConnectionsMetric(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.ApiTokens = map[string]string{"stub": "secret"}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Unpartitioned: true}},
+	})
+	gauge := metrics.StreamConnections.With(prometheus.Labels{"distributor": "stub"})
+	before := testutil.ToFloat64(gauge)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	body := strings.NewReader(`{"request_origin": "stub", "resource_types": ["obfs4"]}`)
+	req := httptest.NewRequest(http.MethodGet, "/resource-stream", body).WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer secret")
+	done := make(chan struct{})
+	go func() {
+		b.getResourceStreamHandler(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(gauge) != before+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the stream connections gauge to increase, got %f", testutil.ToFloat64(gauge))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+	if after := testutil.ToFloat64(gauge); after != before {
+		t.Errorf("expected the stream connections gauge to go back to %f, got %f", before, after)
+	}
+}
+
+func TestGetResourcesSortByQuality(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.ResourcesEndpoint = "/resources"
+	b.Config.Backend.ApiTokens = map[string]string{"https": "secret"}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Unpartitioned: true}},
+	})
+
+	low, high := 0.5, 2.0
+	tests := map[uint16]core.ResourceTest{
+		1: {State: core.StateDysfunctional, Speed: core.SpeedAccepted, Ratio: &high},
+		2: {State: core.StateFunctional, Speed: core.SpeedAccepted, Ratio: &low},
+		3: {State: core.StateUntested, Speed: core.SpeedUntested},
+		4: {State: core.StateFunctional, Speed: core.SpeedRejected, Ratio: &high},
+		5: {State: core.StateFunctional, Speed: core.SpeedAccepted, Ratio: &high},
+	}
+	for port, test := range tests {
+		r := resources.NewTransport()
+		r.SetType("obfs4")
+		r.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+		r.Port = port
+		*r.TestResult() = test
+		b.Resources.Add(r)
+	}
+
+	getPorts := func(query string) []uint16 {
+		body := strings.NewReader(`{"request_origin": "https", "resource_types": ["obfs4"]}`)
+		req := httptest.NewRequest(http.MethodGet, "/resources"+query, body)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		b.resourcesHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+		}
+
+		var state struct {
+			Working []struct {
+				Port uint16 `json:"port"`
+			} `json:"working"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &state); err != nil {
+			t.Fatal(err)
+		}
+		ports := []uint16{}
+		for _, r := range state.Working {
+			ports = append(ports, r.Port)
+		}
+		return ports
+	}
+
+	if ports := getPorts("?sort=quality"); !reflect.DeepEqual(ports, []uint16{5, 2, 4, 3, 1}) {
+		t.Errorf("resources are not sorted by quality: %v", ports)
+	}
+
+	// The default order is the hashring one.
+	expected := []uint16{}
+	for _, r := range b.Resources.Get("https", "obfs4").Working {
+		expected = append(expected, r.(*resources.Transport).Port)
+	}
+	if ports := getPorts(""); !reflect.DeepEqual(ports, expected) {
+		t.Errorf("expected resources in hashring order %v but got %v", expected, ports)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/resources?sort=foo", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	b.resourcesHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected HTTP return code 400 for unsupported sort order but got %d", rr.Code)
+	}
+}
+
 func TestPostResourcesHandler(t *testing.T) {
 
-	b := BackendContext{}
+	b := BackendContext{metrics: metrics}
 	b.Config = &Config{}
 	b.Config.Backend.ApiTokens = make(map[string]string)
 	b.Config.Backend.ApiTokens["foo"] = "bar"
@@ -92,3 +383,521 @@ func TestPostResourcesHandler(t *testing.T) {
 		t.Errorf("expected HTTP return code 400 but got %d", rr.Code)
 	}
 }
+
+func TestPostResourcesForgedTestResult(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.ApiTokens = map[string]string{"foo": "bar"}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Unpartitioned: true}},
+	})
+
+	lastTested := time.Now().UTC().Format(time.RFC3339)
+	body := strings.NewReader(`[{"type": "obfs4", "address": "1.2.3.4", "port": 1234, "fingerprint": "0123456789ABCDEF0123456789ABCDEF01234567",
+		"test_result": {"state": 1, "speed": 1, "last_tested": "` + lastTested + `"}}]`)
+	req := httptest.NewRequest(http.MethodPost, "/resources", body)
+	req.Header.Add("Authorization", "Bearer bar")
+	rr := httptest.NewRecorder()
+	b.postResourcesHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+
+	all := b.Resources.Collection["obfs4"].GetAll()
+	if len(all) != 1 {
+		t.Fatalf("expected 1 resource in the collection but got %d", len(all))
+	}
+	if all[0].TestResult().State != core.StateUntested {
+		t.Errorf("the posted test result was kept: %+v", all[0].TestResult())
+	}
+}
+
+func TestPostResourcesRejected(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Unpartitioned: true}},
+	})
+
+	rr := httptest.NewRecorder()
+	body := strings.NewReader(`[{"type": "obfs4", "address": "1.2.3.4", "port": 1234},
+		{"type": "obfs3", "address": "1.2.3.4", "port": 1234}]`)
+	req, err := http.NewRequest("POST", "/resources", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.postResourcesHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+	var resp PostResourcesResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rejected) != 1 || resp.Rejected[0].Index != 1 {
+		t.Errorf("expected the obfs3 resource to be rejected but got %+v", resp.Rejected)
+	}
+	if n := b.Resources.Collection["obfs4"].Len(); n != 1 {
+		t.Errorf("expected the obfs4 resource to be added but there are %d", n)
+	}
+}
+
+func TestDeleteResourcesHandler(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.ResourcesEndpoint = "/resources"
+	b.Config.Backend.ApiTokens = make(map[string]string)
+	b.Config.Backend.ApiTokens["foo"] = "bar"
+
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Proportions: map[string]int{"foo": 1}}},
+	})
+	diffs := make(chan *core.ResourceDiff, 2)
+	b.Resources.RegisterChan(&core.ResourceRequest{RequestOrigin: "foo", ResourceTypes: []string{"obfs4"}}, diffs)
+
+	resource := "[{\"type\": \"obfs4\", \"address\": \"1.2.3.4\", \"port\": 1234}]"
+	sendRequest := func(method string, token string) int {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(method, "/resources", strings.NewReader(resource))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Authorization", "Bearer "+token)
+		b.resourcesHandler(rr, req)
+		return rr.Code
+	}
+
+	if code := sendRequest(http.MethodPost, "bar"); code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", code)
+	}
+	diff := <-diffs
+	if len(diff.New["obfs4"]) != 1 {
+		t.Fatalf("expected a new resource in the diff but got: %s", diff)
+	}
+
+	if code := sendRequest(http.MethodDelete, "invalid"); code != http.StatusUnauthorized {
+		t.Errorf("expected HTTP return code 401 but got %d", code)
+	}
+	if b.Resources.Collection["obfs4"].Len() != 1 {
+		t.Fatal("resource was deleted without authentication")
+	}
+
+	if code := sendRequest(http.MethodDelete, "bar"); code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", code)
+	}
+	if b.Resources.Collection["obfs4"].Len() != 0 {
+		t.Error("resource was not deleted")
+	}
+	select {
+	case diff = <-diffs:
+		if len(diff.Gone["obfs4"]) != 1 {
+			t.Errorf("expected a gone resource in the diff but got: %s", diff)
+		}
+	default:
+		t.Error("distributor didn't receive the gone diff")
+	}
+}
+
+func TestSummaryHandler(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{
+			{Type: "obfs4", Unpartitioned: true},
+			{Type: "vanilla", Unpartitioned: true},
+		},
+	})
+
+	for i, state := range []int{core.StateFunctional, core.StateFunctional, core.StateDysfunctional, core.StateUntested} {
+		r := resources.NewTransport()
+		r.SetType("obfs4")
+		r.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+		r.Port = uint16(1000 + i)
+		r.TestResult().State = state
+		b.Resources.Collection["obfs4"].Add(r)
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/summary", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.summaryHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+
+	var summary map[string]map[string]int
+	if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("failed to unmarshal summary: %s", err)
+	}
+	expected := map[string]map[string]int{
+		"obfs4":   {"functional": 2, "dysfunctional": 1, "untested": 1},
+		"vanilla": {"functional": 0, "dysfunctional": 0, "untested": 0},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("expected summary %v but got %v", expected, summary)
+	}
+}
+
+func TestDistributionDecisionHandler(t *testing.T) {
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.DistributeUntested = "previously_good"
+	b.Resources.SetDistributionDecision(core.DistributionDecision{
+		FunctionalFraction: 0.4,
+		AcceptedFraction:   0.6,
+		UseBandwidthRatio:  true,
+	})
+
+	rr := httptest.NewRecorder()
+	b.distributionDecisionHandler(rr, httptest.NewRequest(http.MethodGet, "/distribution-decision", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+	var decision distributionDecision
+	if err := json.Unmarshal(rr.Body.Bytes(), &decision); err != nil {
+		t.Fatal(err)
+	}
+	expected := distributionDecision{
+		FunctionalFraction:        0.4,
+		MinFunctionalFraction:     DefaultMinFunctionalFraction,
+		DistributingNonFunctional: true,
+		AcceptedFraction:          0.6,
+		MinRatioFraction:          DefaultMinRatioFraction,
+		IgnoringBandwidthRatio:    false,
+		DistributeUntested:        "previously_good",
+	}
+	if decision != expected {
+		t.Errorf("expected decision %+v but got %+v", expected, decision)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Unpartitioned: true}},
+	})
+
+	health := func() (int, healthStatus) {
+		rr := httptest.NewRecorder()
+		b.healthHandler(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var status healthStatus
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return rr.Code, status
+	}
+
+	code, status := health()
+	if code != http.StatusServiceUnavailable || status.Ready {
+		t.Errorf("expected HTTP return code 503 before bootstrapping but got %d", code)
+	}
+	if status.LastReload != nil {
+		t.Errorf("unexpected last reload before bootstrapping: %s", status.LastReload)
+	}
+
+	b.markReloaded()
+	b.ready.Store(true)
+	code, status = health()
+	if code != http.StatusOK || !status.Ready {
+		t.Errorf("expected HTTP return code 200 after bootstrapping but got %d", code)
+	}
+	if status.ResourceTypes != 1 {
+		t.Errorf("expected 1 resource type but got %d", status.ResourceTypes)
+	}
+	if status.LastReload == nil || time.Since(*status.LastReload) > time.Minute {
+		t.Errorf("unexpected last reload: %v", status.LastReload)
+	}
+}
+
+func TestBlockedResourcesHandler(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.ApiTokens = map[string]string{"foo": "bar"}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{
+			{Type: "obfs4", Unpartitioned: true},
+			{Type: "vanilla", Unpartitioned: true},
+		},
+	})
+
+	blockedIn := []core.LocationSet{
+		{"cn": true},
+		{"cn": true, "ir": true},
+		{"ir": true},
+		{},
+	}
+	expected := make(map[uint16]bool)
+	for i, locations := range blockedIn {
+		rType := "obfs4"
+		if i%2 == 1 {
+			rType = "vanilla"
+		}
+		r := resources.NewTransport()
+		r.SetType(rType)
+		r.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+		r.Port = uint16(1000 + i)
+		r.SetBlockedIn(locations)
+		b.Resources.Collection[rType].Add(r)
+		if locations["cn"] {
+			expected[r.Port] = true
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/resources/blocked?country=CN", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "Bearer bar")
+	b.blockedResourcesHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+
+	var blocked []struct {
+		Type string `json:"type"`
+		Port uint16 `json:"port"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &blocked); err != nil {
+		t.Fatalf("failed to unmarshal blocked resources: %s", err)
+	}
+	if len(blocked) != len(expected) {
+		t.Fatalf("expected %d blocked resources but got %d", len(expected), len(blocked))
+	}
+	for _, r := range blocked {
+		if !expected[r.Port] {
+			t.Errorf("resource %s:%d is not blocked in cn", r.Type, r.Port)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer invalid")
+	b.blockedResourcesHandler(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected HTTP return code 401 but got %d", rr.Code)
+	}
+}
+
+func TestReloadBlockListHandler(t *testing.T) {
+
+	blocklist := filepath.Join(t.TempDir(), "blocklist")
+	if err := os.WriteFile(blocklist, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.BlocklistFile = blocklist
+	b.Config.Backend.AdminTokens = map[string]string{"admin": "secret"}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Unpartitioned: true}},
+	})
+
+	lastTested := time.Now().Add(-time.Hour).UTC()
+	r := resources.NewTransport()
+	r.SetType("obfs4")
+	r.Fingerprint = "ABCDEF1234567890"
+	r.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	r.Port = 1234
+	r.TestResult().State = core.StateFunctional
+	r.TestResult().LastTested = lastTested
+	r.SetBlockedIn(core.LocationSet{"ru": true})
+	b.Resources.Collection["obfs4"].Add(r)
+
+	err := os.WriteFile(blocklist, []byte("fingerprint ABCDEF1234567890 country-code cn\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/blocklist/reload", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	b.reloadBlockListHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+
+	all := b.Resources.Collection["obfs4"].GetAll()
+	if len(all) != 1 {
+		t.Fatalf("expected the resource to stay in the collection but got %d resources", len(all))
+	}
+	if !all[0].BlockedIn()["cn"] {
+		t.Errorf("resource is not blocked in cn after the reload: %v", all[0].BlockedIn())
+	}
+	if !all[0].BlockedIn()["ru"] {
+		t.Errorf("the reload dropped the location the resource was blocked in: %v", all[0].BlockedIn())
+	}
+	if all[0].TestResult().State != core.StateFunctional || !all[0].TestResult().LastTested.Equal(lastTested) {
+		t.Error("resource was re-tested by the reload")
+	}
+	// Removing the bridge from the blocklist clears the location.
+	if err := os.WriteFile(blocklist, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	b.reloadBlockListHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+	blockedIn := b.Resources.Collection["obfs4"].GetAll()[0].BlockedIn()
+	if blockedIn["cn"] {
+		t.Errorf("resource is still blocked after being removed from the blocklist: %v", blockedIn)
+	}
+	if !blockedIn["ru"] {
+		t.Errorf("the reload dropped the location the resource was blocked in: %v", blockedIn)
+	}
+}
+
+func TestShutdownOnSIGTERM(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var srv http.Server
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+	defer signal.Stop(signals)
+
+	b := &BackendContext{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.waitForShutdown(signals, cancel, &srv)
+		close(done)
+	}()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM didn't trigger a shutdown")
+	}
+	if ctx.Err() == nil {
+		t.Error("context was not cancelled")
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("expected the Web API to be shut down but got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+
+	b := &BackendContext{Config: &Config{}}
+	if timeout := b.shutdownTimeout(); timeout != defaultShutdownTimeout {
+		t.Errorf("expected the default shutdown timeout but got %s", timeout)
+	}
+
+	// A stream that never ends keeps the Web server from shutting down
+	// before the timeout.
+	b.Config.Backend.ShutdownTimeoutSeconds = 1
+	streaming := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		close(streaming)
+		<-release
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	go http.Get("http://" + l.Addr().String())
+	<-streaming
+
+	start := time.Now()
+	b.stopWebApi(&srv)
+	elapsed := time.Since(start)
+	if elapsed < time.Second || elapsed >= defaultShutdownTimeout {
+		t.Errorf("expected the shutdown to take the configured second but it took %s", elapsed)
+	}
+}
+
+func TestReassignHandler(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.AdminTokens = map[string]string{"admin": "admin"}
+	b.Config.Backend.DistProportions = map[string]int{"https": 1, "moat": 1}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Proportions: b.Config.Backend.DistProportions}},
+	})
+	httpsDiffs := make(chan *core.ResourceDiff, 2)
+	moatDiffs := make(chan *core.ResourceDiff, 2)
+	b.Resources.RegisterChan(&core.ResourceRequest{RequestOrigin: "https", ResourceTypes: []string{"obfs4"}}, httpsDiffs)
+	b.Resources.RegisterChan(&core.ResourceRequest{RequestOrigin: "moat", ResourceTypes: []string{"obfs4"}}, moatDiffs)
+
+	fingerprint := "0123456789ABCDEF0123456789ABCDEF01234567"
+	newTransport := func() *resources.Transport {
+		r := resources.NewTransport()
+		r.SetType("obfs4")
+		r.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+		r.Port = 1234
+		r.Fingerprint = fingerprint
+		r.Distribution = "https"
+		return r
+	}
+	b.Resources.Add(newTransport())
+	<-httpsDiffs
+
+	reassign := func(body string) int {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/reassign", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin")
+		b.reassignHandler(rr, req)
+		return rr.Code
+	}
+
+	if code := reassign(`{"fingerprint": "` + fingerprint + `", "distributor": "salmon"}`); code != http.StatusBadRequest {
+		t.Errorf("expected HTTP return code 400 for an unknown distributor but got %d", code)
+	}
+	if code := reassign(`{"fingerprint": "FFFF", "distributor": "moat"}`); code != http.StatusNotFound {
+		t.Errorf("expected HTTP return code 404 for an unknown bridge but got %d", code)
+	}
+	if code := reassign(`{"fingerprint": "` + fingerprint + `", "distributor": "moat"}`); code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", code)
+	}
+
+	select {
+	case diff := <-httpsDiffs:
+		if len(diff.Gone["obfs4"]) != 1 {
+			t.Errorf("expected the bridge to be gone from https but got %v", diff)
+		}
+	default:
+		t.Error("https wasn't informed that the bridge is gone")
+	}
+	select {
+	case diff := <-moatDiffs:
+		if len(diff.New["obfs4"]) != 1 {
+			t.Errorf("expected the bridge to be new in moat but got %v", diff)
+		}
+	default:
+		t.Error("moat wasn't informed about the new bridge")
+	}
+
+	// Reloading the bridge keeps it in its new distributor.
+	b.Resources.Add(newTransport())
+	if n := len(b.Resources.GetHashring("moat", "obfs4").GetAll()); n != 1 {
+		t.Errorf("expected the bridge to stay in moat but it has %d resources", n)
+	}
+	if n := len(b.Resources.GetHashring("https", "obfs4").GetAll()); n != 0 {
+		t.Errorf("expected no resources in https but it has %d", n)
+	}
+}
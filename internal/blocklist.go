@@ -7,6 +7,7 @@ package internal
 import (
 	"bufio"
 	"log"
+	"maps"
 	"os"
 	"regexp"
 
@@ -103,3 +104,21 @@ func (bl *blocklist) blockedIn(fingerprint string) core.LocationSet {
 
 	return blockCountries
 }
+
+// applyBlockList sets the locations where the given blocklist says each bridge
+// of the collection is blocked, clearing the ones not in the blocklist anymore
+// but keeping the locations the resources had from elsewhere.  The resources
+// are updated in place, so they are not re-tested, and the distributors are
+// informed about the ones whose locations changed.  It returns the number of
+// resources updated.
+func applyBlockList(rcol *core.BackendResources, bl *blocklist) int {
+	return rcol.Update(func(r core.Resource) bool {
+		fingerprint, err := getFingerprint(r)
+		if err != nil {
+			return false
+		}
+		blockedIn := r.BlockedIn()
+		r.ReplaceBlockListedIn(bl.blockedIn(fingerprint))
+		return !maps.Equal(blockedIn, r.BlockedIn())
+	})
+}
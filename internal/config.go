@@ -29,15 +29,118 @@ type BackendConfig struct {
 	ResourcesEndpoint       string            `json:"api_endpoint_resources"`
 	ResourceStreamEndpoint  string            `json:"api_endpoint_resource_stream"`
 	TargetsEndpoint         string            `json:"api_endpoint_targets"`
-	StatusEndpoint          string            `json:"web_endpoint_status"`
-	MetricsEndpoint         string            `json:"web_endpoint_metrics"`
-	BridgestrapEndpoint     string            `json:"bridgestrap_endpoint"`
-	BridgestrapToken        string            `json:"bridgestrap_token"`
-	OnbascaEndpoint         string            `json:"onbasca_endpoint"`
-	OnbascaToken            string            `json:"onbasca_token"`
-	BandwidthRatioThreshold float64           `json:"bandwidth_ratio_threshold"`
-	StorageDir              string            `json:"storage_dir"`
-	AssignmentsFile         string            `json:"assignments_file"`
+	BlockedEndpoint         string            `json:"api_endpoint_blocked_resources"`
+	AssignmentsEndpoint     string            `json:"api_endpoint_assignments"`
+	BlocklistReloadEndpoint string            `json:"api_endpoint_reload_blocklist"`
+	SelfTestEndpoint        string            `json:"api_endpoint_selftest"`
+	TestResultsEndpoint     string            `json:"api_endpoint_test_results"`
+	BridgeResultsEndpoint   string            `json:"api_endpoint_bridge_results"`
+	// ReassignEndpoint lets admins move a bridge to another distributor,
+	// or to "none", overriding its distribution request.
+	ReassignEndpoint string `json:"api_endpoint_reassign"`
+	// RequestIDHeader is the HTTP header carrying the ID of each request, it
+	// defaults to X-Request-ID.
+	RequestIDHeader     string `json:"request_id_header"`
+	StatusEndpoint      string `json:"web_endpoint_status"`
+	MetricsEndpoint     string `json:"web_endpoint_metrics"`
+	SummaryEndpoint     string `json:"web_endpoint_summary"`
+	HealthEndpoint      string `json:"web_endpoint_health"`
+	MetricsJSONEndpoint string `json:"web_endpoint_metrics_json"`
+	// DistributionDecisionEndpoint reports if the backend is distributing
+	// non functional resources or ignoring the bandwidth ratio, and the
+	// fractions that made it decide so.
+	DistributionDecisionEndpoint string  `json:"web_endpoint_distribution_decision"`
+	BridgestrapEndpoint          string  `json:"bridgestrap_endpoint"`
+	BridgestrapToken             string  `json:"bridgestrap_token"`
+	OnbascaEndpoint              string  `json:"onbasca_endpoint"`
+	OnbascaToken                 string  `json:"onbasca_token"`
+	BandwidthRatioThreshold      float64 `json:"bandwidth_ratio_threshold"`
+	// DisableInternalTesting stops the backend from sending resources to
+	// bridgestrap and onbasca.  Their test results are expected to be posted
+	// to TestResultsEndpoint instead.
+	DisableInternalTesting bool `json:"disable_internal_testing"`
+	// TestBatchSize is the number of resources sent together to bridgestrap
+	// and onbasca, and TestFlushTimeoutSeconds the maximum time resources wait
+	// to be sent.  They default to 25 resources and 60 seconds.
+	TestBatchSize           int `json:"test_batch_size"`
+	TestFlushTimeoutSeconds int `json:"test_flush_timeout_seconds"`
+	// CoalesceReachabilityTests tests with bridgestrap only once the
+	// resources of a batch that share their fingerprint and address, like
+	// the vanilla and obfs4 resources of a bridge.
+	CoalesceReachabilityTests bool   `json:"coalesce_reachability_tests"`
+	StorageDir                string `json:"storage_dir"`
+	// StoreFlushIntervalSeconds batches the writes to the stores in
+	// StorageDir, writing the latest changes at most once per interval
+	// instead of on every change.  Changes of the last interval are lost if
+	// the backend crashes.  0 writes every change right away.
+	StoreFlushIntervalSeconds int `json:"store_flush_interval_seconds"`
+	// SnapshotIntervalMinutes is how often all the resources, with their
+	// test results, are written to a snapshot in StorageDir.  The snapshot
+	// is loaded on startup, so we don't have to wait for the bridge
+	// descriptors and the tests to serve requests.  0 disables snapshots.
+	SnapshotIntervalMinutes int    `json:"snapshot_interval_minutes"`
+	AssignmentsFile         string `json:"assignments_file"`
+	// DefaultDistributionRequest is the distribution request of the bridges
+	// that don't set one in their descriptor.  It defaults to "any", which
+	// lets the backend assign them a distributor.
+	DefaultDistributionRequest string `json:"default_distribution_request"`
+	// DistributeUntested decides if untested bridges are distributed:
+	// "yes", "no", "previously_good" (only the ones that passed a test
+	// before) or "auto".  "auto", the default, distributes them while the
+	// fraction of functional bridges is below MinFunctionalFraction.
+	DistributeUntested string `json:"distribute_untested"`
+	// MinFunctionalFraction is the fraction of functional resources above
+	// which only functional resources are distributed, and MinRatioFraction
+	// the fraction of resources with an accepted bandwidth ratio above which
+	// the ratio is used to select the resources.  They default to 0.5 if
+	// unset, 0 always distributes only functional resources and always uses
+	// the ratio.
+	MinFunctionalFraction *float64 `json:"min_functional_fraction"`
+	MinRatioFraction      *float64 `json:"min_ratio_fraction"`
+	// ExtrainfoNewMaxAgeHours is the maximum age of the extrainfo .new file,
+	// if it's older we don't load it.  0 means no maximum age.
+	ExtrainfoNewMaxAgeHours int `json:"extrainfo_new_max_age_hours"`
+	// RequiredFlags are the networkstatus flags (e.g. "Running" and "Valid")
+	// a bridge needs to have to be distributed.  Bridges missing any of them
+	// are excluded when loading the descriptors.
+	RequiredFlags []string `json:"required_flags"`
+	// MinRetestIntervalMinutes is the minimum time between two tests of the
+	// same resource, no matter how often it's added.  0 means no minimum.
+	MinRetestIntervalMinutes int `json:"min_retest_interval_minutes"`
+	// GoneGracePeriodMinutes is how long a bridge has to keep failing tests
+	// before distributors are told it's gone.  0 reports it right away.
+	GoneGracePeriodMinutes int `json:"gone_grace_period_minutes"`
+	// ShutdownTimeoutSeconds is how long the Web API waits for open requests,
+	// like resource streams, when shutting down.  It defaults to 5 seconds.
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds"`
+	// AuditLogFile is where admin actions are recorded.  If empty they are
+	// recorded in the log.
+	AuditLogFile string `json:"audit_log_file"`
+	// MetricsNamespace and MetricsSubsystem prefix the names of the backend
+	// metrics, so several instances can share a Prometheus.  The namespace
+	// defaults to "rdsys_backend".
+	MetricsNamespace string `json:"metrics_namespace"`
+	MetricsSubsystem string `json:"metrics_subsystem"`
+	// MaxResourceTypesPerRequest is the maximum number of resource types a
+	// distributor can ask for in a single request.  It defaults to 16.
+	MaxResourceTypesPerRequest int `json:"max_resource_types_per_request"`
+	// ReadOnlyReplica makes the backend a replica of the backend whose
+	// resource stream is at UpstreamResourceStream, authenticating with
+	// UpstreamToken.  Replicas serve the resources they get from upstream to
+	// distributors, but they don't load bridge descriptors, test resources
+	// or accept resource uploads.
+	ReadOnlyReplica        bool   `json:"read_only_replica"`
+	UpstreamResourceStream string `json:"upstream_resource_stream"`
+	UpstreamToken          string `json:"upstream_token"`
+	// TokensFile is an optional JSON file with "api_tokens" and
+	// "admin_tokens" objects that replace the ones in this configuration.
+	// The file is reloaded when it changes, so tokens can be rotated without
+	// restarting the backend.
+	TokensFile string `json:"tokens_file"`
+	// AdminTokens are the tokens allowed to use the admin endpoints of the
+	// backend, as well as the distributor endpoints.  Distributor tokens from
+	// ApiTokens are not accepted in the admin endpoints.
+	AdminTokens map[string]string `json:"admin_tokens"`
 	// DistProportions contains the proportion of resources that each
 	// distributor should get.  E.g. if the HTTPS distributor is set to x and
 	// the moat distributor is set to y, then HTTPS gets x/(x+y) of all
@@ -45,12 +148,35 @@ type BackendConfig struct {
 	DistProportions map[string]int            `json:"distribution_proportions"`
 	Resources       map[string]ResourceConfig `json:"resources"`
 	WebApi          WebApiConfig              `json:"web_api"`
+	// RebalanceFraction is the fraction of the resources that is moved on
+	// each kraken tick out of the distributors that have more resources
+	// than their proportion, so changes in distribution_proportions also
+	// affect the resources that were already assigned.  If it's 0
+	// resources are never moved.
+	RebalanceFraction float64 `json:"rebalance_fraction"`
 }
 
 type ResourceConfig struct {
 	Unpartitioned bool     `json:"unpartitioned"`
 	Stored        bool     `json:"stored"`
 	Distributors  []string `json:"distributors"`
+	// ExpiryHours overrides how long the resources of this type are kept
+	// after they stop showing up in the descriptors.  If it's not set, the
+	// expiry of each resource is used.
+	ExpiryHours float64 `json:"expiry_hours"`
+	// Quotas maps distributor names to the maximum number of working
+	// resources of this type they get.  Distributors without a quota get
+	// all the resources of their partition.
+	Quotas map[string]int `json:"quotas"`
+	// RegionalProportions maps country codes to the distribution
+	// proportions of the resources of this type that are not blocked in the
+	// country, e.g. to give moat a larger share of the bridges that work
+	// in it.  They replace the global proportions for those resources.
+	RegionalProportions map[string]map[string]int `json:"regional_proportions"`
+	// Parameters is the allowlist of the transport parameters, of the
+	// extra-info transport lines, that are kept and handed out to the users.
+	// If it's empty all the parameters are kept.
+	Parameters []string `json:"parameters"`
 }
 
 type Distributors struct {
@@ -73,6 +199,28 @@ type HttpsDistConfig struct {
 	WebApi           WebApiConfig           `json:"web_api"`
 	TimeDistribution TimeDistributionConfig `json:"time_distribution"`
 	TrustProxy       bool                   `json:"trust_proxy"`
+	GeoipDB          string                 `json:"geoipdb"`
+	Geoip6DB         string                 `json:"geoip6db"`
+	// CountryRequestsPerWindow limits the number of bridge requests from
+	// each country, as resolved by geoip, in every window of
+	// CountryRateLimitWindowMinutes.  0 disables the limit.
+	CountryRequestsPerWindow      int `json:"country_requests_per_window"`
+	CountryRateLimitWindowMinutes int `json:"country_rate_limit_window_minutes"`
+	// PowDifficulty is the number of leading zero bits that the hash of the
+	// proof of work solution needs to have to get bridges.  0 disables the
+	// proof of work.
+	PowDifficulty int `json:"pow_difficulty"`
+	// EnumerationThreshold is the number of distinct bridges a requester
+	// can get in every window of EnumerationWindowMinutes (60 by default)
+	// before it's counted as a suspected enumerator, and throttled if
+	// ThrottleEnumeration is set.  0 disables the detection.
+	EnumerationThreshold     int  `json:"enumeration_threshold"`
+	EnumerationWindowMinutes int  `json:"enumeration_window_minutes"`
+	ThrottleEnumeration      bool `json:"throttle_enumeration"`
+	// Locales offered to the users in the options page.  Locales without a
+	// translation in the bundle are ignored.  If empty all the translated
+	// locales are offered.
+	Locales []string `json:"locales"`
 }
 
 type EmailDistConfig struct {
@@ -82,6 +230,9 @@ type EmailDistConfig struct {
 	AllowedDomains       []string    `json:"allowed_domains"`
 	Email                EmailConfig `json:"email"`
 	MetricsAddress       string      `json:"metrics_address"`
+	// MaxBodyBytes is the maximum size of the body of a reply, longer
+	// responses are split in several replies.  0 means no limit.
+	MaxBodyBytes int `json:"max_body_bytes"`
 }
 
 type GettorDistConfig struct {
@@ -91,17 +242,30 @@ type GettorDistConfig struct {
 }
 
 type MoatDistConfig struct {
-	Resources             []string               `json:"resources"`
-	GeoipDB               string                 `json:"geoipdb"`
-	Geoip6DB              string                 `json:"geoip6db"`
-	CircumventionMap      string                 `json:"circumvention_map"`
-	CircumventionDefaults string                 `json:"circumvention_defaults"`
-	BuiltInBridgesURL     string                 `json:"builtin_bridges_url"`
-	ShimTokens            map[string]string      `json:"shim_tokens"`
-	DummyBridgesFile      string                 `json:"dummy_bridges_file"`
-	TimeDistribution      TimeDistributionConfig `json:"time_distribution"`
-	WebApi                WebApiConfig           `json:"web_api"`
-	TrustProxy            bool                   `json:"trust_proxy"`
+	Resources             []string `json:"resources"`
+	GeoipDB               string   `json:"geoipdb"`
+	Geoip6DB              string   `json:"geoip6db"`
+	CircumventionMap      string   `json:"circumvention_map"`
+	CircumventionDefaults string   `json:"circumvention_defaults"`
+	BuiltInBridgesURL     string   `json:"builtin_bridges_url"`
+	// BuiltInBridgesURLs are more URLs to fetch builtin bridges from, the
+	// bridges of all the URLs are merged by transport type.
+	BuiltInBridgesURLs []string               `json:"builtin_bridges_urls"`
+	ShimTokens         map[string]string      `json:"shim_tokens"`
+	DummyBridgesFile   string                 `json:"dummy_bridges_file"`
+	TimeDistribution   TimeDistributionConfig `json:"time_distribution"`
+	WebApi             WebApiConfig           `json:"web_api"`
+	TrustProxy         bool                   `json:"trust_proxy"`
+	// FallbackToDefaultsOnGeoipMiss makes the circumvention settings endpoint
+	// answer with the circumvention defaults when the country of the user is
+	// unknown, instead of with an error.
+	FallbackToDefaultsOnGeoipMiss bool `json:"fallback_to_defaults_on_geoip_miss"`
+	// CaptchaRequestsPerMinute limits the number of captcha fetch and check
+	// requests per minute from each IP address.  0 disables the limit.
+	CaptchaRequestsPerMinute int `json:"captcha_requests_per_minute"`
+	// CaptchaProvider selects the implementation of the captchas handed out
+	// by moat.  It defaults to "static".
+	CaptchaProvider string `json:"captcha_provider"`
 }
 
 type TelegramDistConfig struct {
@@ -114,6 +278,27 @@ type TelegramDistConfig struct {
 	StorageDir           string            `json:"storage_dir"`
 	ApiAddress           string            `json:"api_address"`
 	LoxServerAddress     string            `json:"lox_server_address"`
+	// LoxRetries is the number of times a failed invitation request to the
+	// Lox server is retried, 0 disables the retries and it defaults to 2 if
+	// unset.  LoxTimeoutSeconds is the timeout of each request.
+	LoxRetries        *int `json:"lox_retries"`
+	LoxTimeoutSeconds int  `json:"lox_timeout_seconds"`
+	// NewBridgeBias makes the bridges of the backend that showed up less than
+	// NewBridgeBiasHours ago that many times more likely to be distributed,
+	// so they build up their reputation faster.  0 disables it.
+	NewBridgeBias      float64 `json:"new_bridge_bias"`
+	NewBridgeBiasHours int     `json:"new_bridge_bias_hours"`
+	// MaxNewBridgesPerUpdater is the maximum number of new bridges kept for
+	// each updater, the oldest ones pushed are evicted first.  0 means no
+	// limit.
+	MaxNewBridgesPerUpdater int `json:"max_new_bridges_per_updater"`
+	// MaxUpdateBytes is the maximum size of the body of an update of new
+	// bridges.  It defaults to 1MB.
+	MaxUpdateBytes int `json:"max_update_bytes"`
+	// TestNewBridges withholds the new bridges pushed by the updaters until
+	// a test result posted to the test-results endpoint marks them as
+	// functional.
+	TestNewBridges bool `json:"test_new_bridges"`
 }
 
 type WebApiConfig struct {
@@ -130,6 +315,9 @@ type EmailConfig struct {
 	ImapServer   string `json:"imap_server"`
 	ImapUsername string `json:"imap_username"`
 	ImapPassword string `json:"imap_password"`
+	// EncryptReplies encrypts the replies to the PGP public key included in
+	// the request, if any.
+	EncryptReplies bool `json:"encrypt_replies"`
 }
 
 type TimeDistributionConfig struct {
@@ -137,6 +325,14 @@ type TimeDistributionConfig struct {
 	RotationPeriodHours  int    `json:"rotation_period_hours"`
 	NumPeriods           int    `json:"num_periods"`
 	StorageDir           string `json:"storage_dir"`
+	// BridgeSetTokenKey is the secret used to encrypt bridge set tokens.  If
+	// it's empty a random one is used, so the tokens are not valid after a
+	// restart.
+	BridgeSetTokenKey string `json:"bridge_set_token_key"`
+	// MaxPeriodAdvances is how many times a requester can ask for the next
+	// set of bridges in a rotation period, e.g. if their bridges got blocked.
+	// It's capped at NumPeriods-1.  0 disables asking for the next set.
+	MaxPeriodAdvances int `json:"max_period_advances"`
 }
 
 type Updaters struct {
@@ -149,6 +345,12 @@ type GettorUpdater struct {
 	S3Updaters         []S3Updater        `json:"s3"`
 	GoogleDriveUpdater GoogleDriveUpdater `json:"gdrive"`
 	MetricsAddress     string             `json:"metrics_address"`
+	// Channels are the Tor Browser update channels to distribute ("release"
+	// and/or "alpha").  It defaults to the release channel.
+	Channels []string `json:"channels"`
+	// UpdateTimeoutMinutes is the maximum duration of an update cycle, a cycle
+	// that takes longer is abandoned.  It defaults to the update frequency.
+	UpdateTimeoutMinutes int `json:"update_timeout_minutes"`
 }
 
 type Github struct {
@@ -160,6 +362,9 @@ type Github struct {
 type Gitlab struct {
 	AuthToken string `json:"auth_token"`
 	Owner     string `json:"owner"`
+	Repo      string `json:"repo"`
+	// BaseURL is the url of the GitLab instance, it defaults to gitlab.com
+	BaseURL string `json:"base_url"`
 }
 
 type S3Updater struct {
@@ -171,6 +376,18 @@ type S3Updater struct {
 	Name                         string `json:"name"`
 	Bucket                       string `json:"bucket"`
 	NameProceduralGenerationSeed string `json:"name_procedural_generation_seed"`
+	// PresignExpiryHours is how long the presigned download links stay valid
+	// for, it can not be longer than 7 days (168 hours).
+	PresignExpiryHours int `json:"presign_expiry_hours"`
+	// LinkExpiryHours is how long the backend keeps distributing the links
+	// before they need to be refreshed.
+	LinkExpiryHours int `json:"link_expiry_hours"`
+	// Files bigger than MultipartThresholdMB (16 MB by default) are uploaded
+	// in parts of MultipartPartSizeMB (8 MB by default, at least 5 MB), with
+	// MultipartConcurrency (4 by default) parts being uploaded at a time.
+	MultipartThresholdMB int `json:"multipart_threshold_mb"`
+	MultipartPartSizeMB  int `json:"multipart_part_size_mb"`
+	MultipartConcurrency int `json:"multipart_concurrency"`
 }
 
 type GoogleDriveUpdater struct {
@@ -182,6 +399,11 @@ type GoogleDriveUpdater struct {
 type WhatsAppConfig struct {
 	SessionFile    string `json:"session_file"`
 	MetricsAddress string `json:"metrics_address"`
+	// MaxLinks is the maximum number of links sent for each request, 0 sends
+	// all of them.  LinksPerMessage is how many links are sent together in
+	// the same message, 0 sends each link in its own message.
+	MaxLinks        int `json:"max_links"`
+	LinksPerMessage int `json:"links_per_message"`
 }
 
 // LoadConfig loads the given JSON configuration file and returns the resulting
@@ -213,6 +435,23 @@ func (config *Config) String() string {
 	return ""
 }
 
+// minFunctionalFraction returns MinFunctionalFraction or its default if it's
+// not set.
+func (bc BackendConfig) minFunctionalFraction() float64 {
+	if bc.MinFunctionalFraction == nil {
+		return DefaultMinFunctionalFraction
+	}
+	return *bc.MinFunctionalFraction
+}
+
+// minRatioFraction returns MinRatioFraction or its default if it's not set.
+func (bc BackendConfig) minRatioFraction() float64 {
+	if bc.MinRatioFraction == nil {
+		return DefaultMinRatioFraction
+	}
+	return *bc.MinRatioFraction
+}
+
 // ResourceStreamURL returns the url to connect to the resource stream endpoint
 func (bc BackendConfig) ResourceStreamURL() string {
 	return bc.urlProto() + bc.WebApi.ApiAddress + bc.ResourceStreamEndpoint
@@ -6,13 +6,16 @@ package internal
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"os"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -24,13 +27,13 @@ import (
 )
 
 const (
-	KrakenTickerInterval  = 30 * time.Minute
-	MinTransportWords     = 3
-	MinFunctionalFraction = 0.5
-	MinRatioFraction      = 0.5
-	TransportPrefix       = "transport"
-	ExtraInfoPrefix       = "extra-info"
-	RecordEndPrefix       = "-----END SIGNATURE-----"
+	KrakenTickerInterval         = 30 * time.Minute
+	MinTransportWords            = 3
+	DefaultMinFunctionalFraction = 0.5
+	DefaultMinRatioFraction      = 0.5
+	TransportPrefix              = "transport"
+	ExtraInfoPrefix              = "extra-info"
+	RecordEndPrefix              = "-----END SIGNATURE-----"
 )
 
 type flicker struct {
@@ -38,29 +41,74 @@ type flicker struct {
 	flickered bool
 }
 
-func InitKraken(cfg *Config, shutdown chan bool, ready chan bool, bCtx *BackendContext) {
+// InitKraken periodically reloads the bridge descriptors until the given
+// context is cancelled, which also aborts an ongoing reload.
+func InitKraken(ctx context.Context, cfg *Config, ready chan bool, bCtx *BackendContext) {
 	log.Println("Initialising resource kraken.")
 	ticker := time.NewTicker(KrakenTickerInterval)
 	defer ticker.Stop()
 
 	rcol := &bCtx.Resources
-	testFunc := bCtx.rTestPool.GetTestFunc()
+	// Without a test pool resources are never tested by us, we wait for their
+	// test results to be posted.
+	var testFunc resources.TestFunc
+	if bCtx.rTestPool != nil {
+		testFunc = bCtx.rTestPool.GetTestFunc(ctx)
+	}
+
+	// With a snapshot of the collection we can serve requests right away,
+	// while the bridge descriptors are parsed.
+	var snapshots <-chan time.Time
+	readySent := false
+	snapshotDir := cfg.Backend.StorageDir
+	if cfg.Backend.SnapshotIntervalMinutes > 0 && snapshotDir != "" {
+		snapshotTicker := time.NewTicker(time.Duration(cfg.Backend.SnapshotIntervalMinutes) * time.Minute)
+		defer snapshotTicker.Stop()
+		snapshots = snapshotTicker.C
+
+		loaded, err := loadSnapshot(snapshotDir, rcol, testFunc)
+		if err != nil {
+			log.Printf("Not recovering from a snapshot of the collection: %s", err)
+		} else if loaded > 0 {
+			log.Printf("Recovered %d resources from the snapshot of the collection.", loaded)
+			calcTestedResources(cfg, bCtx.metrics, nil, rcol)
+			ready <- true
+			readySent = true
+		}
+	}
+
 	// Immediately parse bridge descriptor when we're called, and let caller
 	// know when we're done.
-	reloadBridgeDescriptors(cfg, rcol, testFunc)
-	currentRatios := calcTestedResources(bCtx.metrics, nil, rcol)
-	ready <- true
+	if reloadBridgeDescriptors(ctx, cfg, bCtx.metrics, rcol, testFunc) {
+		bCtx.markReloaded()
+	}
+	currentRatios := calcTestedResources(cfg, bCtx.metrics, nil, rcol)
+	if !readySent {
+		ready <- true
+	}
 	bCtx.metrics.updateDistributors(cfg, rcol)
 	for {
 		select {
-		case <-shutdown:
+		case <-ctx.Done():
+			if snapshots != nil {
+				if err := writeSnapshot(snapshotDir, rcol); err != nil {
+					log.Printf("Error writing the last snapshot of the collection: %s", err)
+				}
+			}
 			log.Printf("Kraken shut down.")
 			return
+		case <-snapshots:
+			if err := writeSnapshot(snapshotDir, rcol); err != nil {
+				log.Printf("Error writing a snapshot of the collection: %s", err)
+			}
 		case <-ticker.C:
 			log.Println("Kraken's ticker is ticking.")
-			reloadBridgeDescriptors(cfg, rcol, testFunc)
+			if reloadBridgeDescriptors(ctx, cfg, bCtx.metrics, rcol, testFunc) {
+				bCtx.markReloaded()
+			}
 			pruneExpiredResources(rcol)
-			currentRatios = calcTestedResources(bCtx.metrics, currentRatios, rcol)
+			rebalancePartitions(cfg, rcol)
+			currentRatios = calcTestedResources(cfg, bCtx.metrics, currentRatios, rcol)
 			bCtx.metrics.updateDistributors(cfg, rcol)
 			log.Printf("Backend resources: %s", rcol)
 		}
@@ -70,8 +118,10 @@ func InitKraken(cfg *Config, shutdown chan bool, ready chan bool, bCtx *BackendC
 // calcTestedResources determines the fraction of each resource state per
 // resource type and exposes them via Prometheus.  The function can tell us
 // that e.g. among all obfs4 bridges, 0.2 are untested, 0.7 are functional, and
-// 0.1 are dysfunctional.
-func calcTestedResources(metrics *Metrics, currentRatios map[core.Hashkey]flicker, rcol *core.BackendResources) map[core.Hashkey]flicker {
+// 0.1 are dysfunctional.  The fractions decide if only functional resources
+// are distributed and if the bandwidth ratio is used, following the minimum
+// fractions of the configuration.
+func calcTestedResources(cfg *Config, metrics *Metrics, currentRatios map[core.Hashkey]flicker, rcol *core.BackendResources) map[core.Hashkey]flicker {
 	metrics.Resources.Reset()
 
 	newRatios := make(map[core.Hashkey]flicker)
@@ -136,9 +186,16 @@ func calcTestedResources(metrics *Metrics, currentRatios map[core.Hashkey]flicke
 	// Distribute only functional resources if the fraction is high enough.
 	// The fraction might be low after a restart as many resources will be
 	// untested or if there is an issue with bridgestrap.
-	functionalFraction := functionalCount / numResources
-	rcol.OnlyFunctional = functionalFraction >= MinFunctionalFraction
-	if rcol.OnlyFunctional {
+	var decision core.DistributionDecision
+	if numResources != 0 {
+		decision.FunctionalFraction = functionalCount / numResources
+		decision.AcceptedFraction = acceptedCount / numResources
+	}
+	metrics.FunctionalFraction.Set(decision.FunctionalFraction)
+	metrics.AcceptedFraction.Set(decision.AcceptedFraction)
+
+	decision.OnlyFunctional = decision.FunctionalFraction >= cfg.Backend.minFunctionalFraction()
+	if decision.OnlyFunctional {
 		metrics.DistributingNonFunctional.Set(0)
 	} else {
 		metrics.DistributingNonFunctional.Set(1)
@@ -146,13 +203,13 @@ func calcTestedResources(metrics *Metrics, currentRatios map[core.Hashkey]flicke
 
 	// Distribute only resources with ratio above the threshold if the
 	// fraction is high enough
-	acceptedFraction := acceptedCount / numResources
-	rcol.UseBandwidthRatio = acceptedFraction >= MinRatioFraction
-	if rcol.UseBandwidthRatio {
+	decision.UseBandwidthRatio = decision.AcceptedFraction >= cfg.Backend.minRatioFraction()
+	if decision.UseBandwidthRatio {
 		metrics.IgnoringBandwidthRatio.Set(0)
 	} else {
 		metrics.IgnoringBandwidthRatio.Set(1)
 	}
+	rcol.SetDistributionDecision(decision)
 
 	return newRatios
 }
@@ -202,32 +259,85 @@ func pruneExpiredResources(rcol *core.BackendResources) {
 	}
 }
 
+// rebalancePartitions moves resources between distributors when their
+// proportions don't match the configured ones.
+func rebalancePartitions(cfg *Config, rcol *core.BackendResources) {
+	if cfg.Backend.RebalanceFraction <= 0 {
+		return
+	}
+	moved := rcol.Rebalance(cfg.Backend.RebalanceFraction)
+	if moved > 0 {
+		log.Printf("Moved %d resources between distributors to match the distribution proportions.", moved)
+	}
+}
+
+// extrainfoFiles returns the extrainfo files to load bridge descriptors from:
+// the cached-extrainfo file and its corresponding cached-extrainfo.new, unless
+// the latter was last modified longer than ExtrainfoNewMaxAgeHours ago.
+func extrainfoFiles(cfg *Config) []string {
+	files := []string{cfg.Backend.ExtrainfoFile}
+
+	newFile := cfg.Backend.ExtrainfoFile + ".new"
+	if cfg.Backend.ExtrainfoNewMaxAgeHours > 0 {
+		maxAge := time.Duration(cfg.Backend.ExtrainfoNewMaxAgeHours) * time.Hour
+		info, err := os.Stat(newFile)
+		if err == nil && time.Since(info.ModTime()) > maxAge {
+			log.Printf("Warning: Skipping %s as it was last modified at %s, it's probably stale.", newFile, info.ModTime())
+			return files
+		}
+	}
+	return append(files, newFile)
+}
+
 // reloadBridgeDescriptors reloads bridge descriptors from the given
-// cached-extrainfo file and its corresponding cached-extrainfo.new.
-func reloadBridgeDescriptors(cfg *Config, rcol *core.BackendResources, testFunc resources.TestFunc) {
+// cached-extrainfo file and its corresponding cached-extrainfo.new.  If the
+// context gets cancelled the reload is aborted and no resources are added.  It
+// returns true if the reload wasn't aborted and all the files were parsed.
+func reloadBridgeDescriptors(ctx context.Context, cfg *Config, metrics *Metrics, rcol *core.BackendResources, testFunc resources.TestFunc) bool {
+
+	succeeded := true
+	failed := func(file string) {
+		succeeded = false
+		metrics.DescriptorReloadFailures.With(prometheus.Labels{"file": file}).Inc()
+	}
 
 	//First load bridge descriptors from network status file
-	bridges, err := loadBridgesFromNetworkstatus(cfg.Backend.NetworkstatusFile)
+	bridges, err := loadBridgesFromNetworkstatus(ctx, cfg.Backend.NetworkstatusFile)
 	if err != nil {
 		log.Printf("Error loading network statuses: %s", err.Error())
+		failed("networkstatus")
+	}
+	excludeBridgesByFlags(bridges, cfg.Backend.RequiredFlags, metrics)
+	if ctx.Err() != nil {
+		log.Printf("Aborting bridge descriptors reload: %s", ctx.Err())
+		return false
 	}
 
 	distributorNames := make([]string, 0, len(cfg.Backend.DistProportions)+1)
-	distributorNames = append(distributorNames, "none")
+	distributorNames = append(distributorNames, "none", resources.DistributorUnallocated)
 	for dist := range cfg.Backend.DistProportions {
 		distributorNames = append(distributorNames, dist)
 	}
 
-	err = getBridgeDistributionRequest(cfg.Backend.DescriptorsFile, distributorNames, bridges)
+	err = getBridgeDistributionRequest(cfg.Backend.DescriptorsFile, cfg.Backend.DefaultDistributionRequest, distributorNames, bridges)
 	if err != nil {
 		log.Printf("Error loading bridge descriptors file: %s", err.Error())
+		failed("descriptors")
 	}
 
 	//Update bridges from extrainfo files
-	for _, filename := range []string{cfg.Backend.ExtrainfoFile, cfg.Backend.ExtrainfoFile + ".new"} {
-		descriptors, err := loadBridgesFromExtrainfo(filename)
+	for _, filename := range extrainfoFiles(cfg) {
+		descriptors, err := loadBridgesFromExtrainfo(ctx, filename, cfg.Backend.Resources)
+		if ctx.Err() != nil {
+			log.Printf("Aborting bridge descriptors reload: %s", ctx.Err())
+			return false
+		}
 		if err != nil {
 			log.Printf("Failed to reload bridge descriptors: %s", err)
+			// The .new file doesn't exist until there are new descriptors.
+			if filename == cfg.Backend.ExtrainfoFile || !errors.Is(err, fs.ErrNotExist) {
+				failed("extrainfo")
+			}
 			continue
 		}
 
@@ -237,7 +347,8 @@ func reloadBridgeDescriptors(cfg *Config, rcol *core.BackendResources, testFunc
 				log.Printf("Received extrainfo descriptor for bridge %s but could not find bridge with that fingerprint", fingerprint)
 				continue
 			}
-			bridge.Transports = desc.Transports
+			// Later files are newer, so their transports take precedence.
+			bridge.Transports = mergeTransports(bridge.Transports, desc.Transports)
 		}
 	}
 
@@ -248,18 +359,27 @@ func reloadBridgeDescriptors(cfg *Config, rcol *core.BackendResources, testFunc
 
 	log.Printf("Adding %d bridges.", len(bridges))
 	for _, bridge := range bridges {
+		if ctx.Err() != nil {
+			log.Printf("Aborting bridge descriptors reload: %s", ctx.Err())
+			break
+		}
 		blockedIn := bl.blockedIn(bridge.Fingerprint)
 
 		for _, t := range bridge.Transports {
-			if !resources.ResourceMap[t.Type()].IsAddressDummy && t.Address.Invalid() {
-				log.Printf("Reject bridge %s transport %s as its IP is not valid: %s", t.Fingerprint, t.Type(), t.Address.String())
-				t.SetTestFunc(setTestResourceInvalidAddress)
+			// The collection has no place for transport types that are not
+			// registered.
+			if !resources.IsTransportType(t.Type()) {
+				continue
+			}
+			if err := t.Validate(); err != nil {
+				log.Printf("Reject bridge %s transport %s as %s", t.Fingerprint, t.Type(), err)
+				t.SetTestFunc(setTestResourceInvalid(err))
 			} else {
 				t.SetTestFunc(testFunc)
 			}
 			t.Flags = bridge.Flags
 			t.Distribution = bridge.Distribution
-			t.SetBlockedIn(blockedIn)
+			t.ReplaceBlockListedIn(blockedIn)
 			rcol.Add(t)
 		}
 
@@ -269,30 +389,103 @@ func reloadBridgeDescriptors(cfg *Config, rcol *core.BackendResources, testFunc
 				log.Printf("Reject vanilla bridge %s s as its IP is not valid: %s", bridge.Fingerprint, bridge.Address.String())
 				continue
 			}
-			bridge.SetBlockedIn(blockedIn)
+			bridge.ReplaceBlockListedIn(blockedIn)
 			bridge.SetTestFunc(testFunc)
 			rcol.Add(bridge)
 		}
 	}
+	// Resources that didn't change are kept in the collection instead of the
+	// ones we just parsed, so we update where they are blocked in place.
+	if bl != nil {
+		applyBlockList(rcol, bl)
+	}
 	rcol.Save()
+
+	if ctx.Err() != nil {
+		return false
+	}
+	if succeeded {
+		metrics.LastDescriptorReload.SetToCurrentTime()
+	}
+	return succeeded
+}
+
+// mergeTransports merges the given lists of transports.  Transports of the
+// same type and address are only kept once, from the newer list if they are in
+// both.
+func mergeTransports(older, newer []*resources.Transport) []*resources.Transport {
+	merged := []*resources.Transport{}
+	index := make(map[string]int)
+	for _, transports := range [][]*resources.Transport{older, newer} {
+		for _, t := range transports {
+			key := fmt.Sprintf("%s %s", t.Type(), net.JoinHostPort(t.Address.String(), strconv.Itoa(int(t.Port))))
+			if i, ok := index[key]; ok {
+				merged[i] = t
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, t)
+		}
+	}
+	return merged
+}
+
+// dedupORAddresses returns the given OR addresses without duplicates.  The IP
+// version of each address is set by its address family, so an IPv4 address
+// in the IPv6 field of the network status is a duplicate of the IPv4 one.
+func dedupORAddresses(orAddresses []resources.ORAddress) []resources.ORAddress {
+	seen := make(map[string]bool)
+	deduped := []resources.ORAddress{}
+	for _, oraddress := range orAddresses {
+		if oraddress.Address.IP.To4() != nil {
+			oraddress.IPVersion = 4
+		} else {
+			oraddress.IPVersion = 6
+		}
+		key := fmt.Sprintf("%d %s %d", oraddress.IPVersion, oraddress.Address.String(), oraddress.Port)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		deduped = append(deduped, oraddress)
+	}
+	return deduped
 }
 
-// learn about available bridges by parsing a network status file
-func loadBridgesFromNetworkstatus(networkstatusFile string) (map[string]*resources.Bridge, error) {
+// learn about available bridges by parsing a network status file.  Cancelling
+// the context closes the file, which unblocks any ongoing read, and aborts the
+// parsing.
+func loadBridgesFromNetworkstatus(ctx context.Context, networkstatusFile string) (map[string]*resources.Bridge, error) {
+	file, err := os.Open(networkstatusFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stop := context.AfterFunc(ctx, func() { file.Close() })
+	defer stop()
+
+	raw, err := io.ReadAll(file)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	bridges := make(map[string]*resources.Bridge)
-	consensus, err := zoossh.ParseUnsafeConsensusFile(networkstatusFile)
+	consensus, err := zoossh.ParseRawUnsafeConsensus(string(raw), false)
 	if err != nil {
 		return nil, err
 	}
 
 	numBridges := 0
-	for obj := range consensus.Iterate(nil) {
-		status, ok := consensus.Get(obj.GetFingerprint())
-		if !ok {
-			log.Printf("Could not retrieve network status for bridge %s",
-				string(obj.GetFingerprint()))
-			continue
+	// Iterate would leak its goroutine if we stopped reading on
+	// cancellation, so we go through the statuses ourselves.
+	for _, getStatus := range consensus.RouterStatuses {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
+		status := getStatus()
 		// create a new bridge for this status
 		b := resources.NewBridge()
 		b.Fingerprint = string(status.GetFingerprint())
@@ -318,6 +511,8 @@ func loadBridgesFromNetworkstatus(networkstatusFile string) (map[string]*resourc
 			b.ORAddresses = append(b.ORAddresses, oraddress)
 		}
 
+		b.ORAddresses = dedupORAddresses(b.ORAddresses)
+
 		b.Flags.Fast = status.Flags.Fast
 		b.Flags.Stable = status.Flags.Stable
 		b.Flags.Running = status.Flags.Running
@@ -329,8 +524,53 @@ func loadBridgesFromNetworkstatus(networkstatusFile string) (map[string]*resourc
 	return bridges, nil
 }
 
-// getBridgeDistributionRequest from the bridge-descriptors file
-func getBridgeDistributionRequest(descriptorsFile string, distributorNames []string, bridges map[string]*resources.Bridge) error {
+// excludeBridgesByFlags removes the bridges that don't have all the required
+// flags.  The excluded bridges are counted by the first flag they miss.
+func excludeBridgesByFlags(bridges map[string]*resources.Bridge, requiredFlags []string, metrics *Metrics) {
+	knownFlags := []string{}
+	for _, flag := range requiredFlags {
+		if _, err := (resources.Flags{}).Has(flag); err != nil {
+			log.Printf("Ignoring required flag: %s", err)
+			continue
+		}
+		knownFlags = append(knownFlags, flag)
+	}
+
+	excluded := make(map[string]int)
+	for fingerprint, bridge := range bridges {
+		if flag := missingFlag(bridge.Flags, knownFlags); flag != "" {
+			delete(bridges, fingerprint)
+			excluded[flag]++
+		}
+	}
+
+	metrics.ExcludedBridges.Reset()
+	for flag, count := range excluded {
+		log.Printf("Excluding %d bridges without the %s flag.", count, flag)
+		metrics.ExcludedBridges.With(prometheus.Labels{"flag": flag}).Set(float64(count))
+	}
+}
+
+// missingFlag returns the first of the given flags that is not set, or an
+// empty string if all of them are set.
+func missingFlag(flags resources.Flags, requiredFlags []string) string {
+	for _, flag := range requiredFlags {
+		if has, err := flags.Has(flag); err != nil || !has {
+			return flag
+		}
+	}
+	return ""
+}
+
+// getBridgeDistributionRequest from the bridge-descriptors file.  Bridges that
+// don't have a distribution request get the given default request, which is
+// "any" if empty.  Bridges with the "any" request are left without distributor
+// so the stencil assigns them one.
+func getBridgeDistributionRequest(descriptorsFile string, defaultRequest string, distributorNames []string, bridges map[string]*resources.Bridge) error {
+	if defaultRequest == "" {
+		defaultRequest = "any"
+	}
+
 	descriptors, err := zoossh.ParseUnsafeDescriptorFile(descriptorsFile)
 	if err != nil {
 		return err
@@ -343,15 +583,19 @@ func getBridgeDistributionRequest(descriptorsFile string, distributorNames []str
 			continue
 		}
 
-		if descriptor.BridgeDistributionRequest != "any" {
+		distributionRequest := descriptor.BridgeDistributionRequest
+		if distributionRequest == "" {
+			distributionRequest = defaultRequest
+		}
+		if distributionRequest != "any" {
 			for _, dist := range distributorNames {
-				if dist == descriptor.BridgeDistributionRequest {
+				if dist == distributionRequest {
 					bridge.Distribution = dist
 					break
 				}
 			}
 			if bridge.Distribution == "" {
-				log.Printf("Bridge %s has an unsupported distribution request: %s. Setting it to none.", fingerprint, descriptor.BridgeDistributionRequest)
+				log.Printf("Bridge %s has an unsupported distribution request: %s. Setting it to none.", fingerprint, distributionRequest)
 				bridge.Distribution = "none"
 			}
 		}
@@ -360,16 +604,20 @@ func getBridgeDistributionRequest(descriptorsFile string, distributorNames []str
 }
 
 // loadBridgesFromExtrainfo loads and returns bridges from Serge's extrainfo
-// files.
-func loadBridgesFromExtrainfo(extrainfoFile string) (map[string]*resources.Bridge, error) {
+// files.  Cancelling the context closes the file, which unblocks any ongoing
+// read.  The transport parameters are filtered by the allowlist of the
+// resources configuration.
+func loadBridgesFromExtrainfo(ctx context.Context, extrainfoFile string, resourcesCfg map[string]ResourceConfig) (map[string]*resources.Bridge, error) {
 
 	file, err := os.Open(extrainfoFile)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	stop := context.AfterFunc(ctx, func() { file.Close() })
+	defer stop()
 
-	extra, err := parseExtrainfoDoc(file)
+	extra, err := parseExtrainfoDoc(file, resourcesCfg)
 	if err != nil {
 		return nil, err
 	}
@@ -380,7 +628,7 @@ func loadBridgesFromExtrainfo(extrainfoFile string) (map[string]*resources.Bridg
 // parseExtrainfoDoc parses the given extra-info document and returns the
 // content as a Bridges object.  Note that the extra-info document format is as
 // it's produced by the bridge authority.
-func parseExtrainfoDoc(r io.Reader) (map[string]*resources.Bridge, error) {
+func parseExtrainfoDoc(r io.Reader, resourcesCfg map[string]ResourceConfig) (map[string]*resources.Bridge, error) {
 
 	bridges := make(map[string]*resources.Bridge)
 
@@ -404,7 +652,7 @@ func parseExtrainfoDoc(r io.Reader) (map[string]*resources.Bridge, error) {
 		if strings.HasPrefix(line, TransportPrefix) {
 			t := resources.NewTransport()
 			t.Fingerprint = b.Fingerprint
-			err := populateTransportInfo(line, t)
+			err := populateTransportInfo(line, t, resourcesCfg)
 			if err != nil {
 				return nil, err
 			}
@@ -429,44 +677,56 @@ func parseExtrainfoDoc(r io.Reader) (map[string]*resources.Bridge, error) {
 //
 //	"transport" transportname address:port [arglist] NL
 //
-// ...and writes it to the given transport object.  See the specification for
-// more details on what transport lines look like:
+// ...and writes it to the given transport object.  Only the arguments in the
+// parameters allowlist of the transport type are kept, if it has one.  See the
+// specification for more details on what transport lines look like:
 // <https://gitweb.torproject.org/torspec.git/tree/dir-spec.txt?id=2b31c63891a63cc2cad0f0710a45989071b84114#n1234>
-func populateTransportInfo(transport string, t *resources.Transport) error {
+func populateTransportInfo(transport string, t *resources.Transport, resourcesCfg map[string]ResourceConfig) error {
 
 	if !strings.HasPrefix(transport, TransportPrefix) {
 		return errors.New("no 'transport' prefix")
 	}
 
-	words := strings.Split(transport, " ")
+	words := strings.Fields(transport)
 	if len(words) < MinTransportWords {
 		return errors.New("not enough arguments in 'transport' line")
 	}
 	t.SetType(words[1])
 
+	// IPv6 addresses are bracketed, like in "[2001:db8::1]:443", and
+	// SplitHostPort removes the brackets.
 	host, port, err := net.SplitHostPort(words[2])
 	if err != nil {
 		return err
 	}
-	addr, err := net.ResolveIPAddr("", host)
-	if err != nil {
-		return err
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address %q in 'transport' line", host)
 	}
-	t.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: addr.IP, Zone: addr.Zone}}
-	p, err := strconv.Atoi(port)
+	t.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: ip}}
+	p, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid port %q in 'transport' line", port)
 	}
 	t.Port = uint16(p)
+	// The OR addresses are part of the object ID, so we only set them for
+	// IPv6 transports, to keep the ID of IPv4 transports unchanged.
+	if ip.To4() == nil {
+		t.ORAddresses = []resources.ORAddress{{IPVersion: 6, Port: t.Port, Address: t.Address}}
+	}
 
 	// We may be dealing with one or more key=value pairs.
 	if len(words) > MinTransportWords {
+		allowedParams := resourcesCfg[t.Type()].Parameters
 		args := strings.Split(words[3], ",")
 		for _, arg := range args {
 			kv := strings.Split(arg, "=")
 			if len(kv) != 2 {
 				return fmt.Errorf("key:value pair in %q not separated by a '='", words[3])
 			}
+			if len(allowedParams) > 0 && !slices.Contains(allowedParams, kv[0]) {
+				continue
+			}
 			t.Parameters[kv[0]] = kv[1]
 		}
 	}
@@ -474,10 +734,14 @@ func populateTransportInfo(transport string, t *resources.Transport) error {
 	return nil
 }
 
-func setTestResourceInvalidAddress(r core.Resource) {
-	rTest := r.TestResult()
-	rTest.State = core.StateDysfunctional
-	rTest.Speed = core.SpeedUntested
-	rTest.LastTested = time.Now()
-	rTest.Error = "Bridge address is not valid"
+// setTestResourceInvalid returns a test function that marks resources as
+// dysfunctional because they are not valid.
+func setTestResourceInvalid(err error) resources.TestFunc {
+	return func(r core.Resource) {
+		rTest := r.TestResult()
+		rTest.State = core.StateDysfunctional
+		rTest.Speed = core.SpeedUntested
+		rTest.LastTested = time.Now()
+		rTest.Error = "Bridge is not valid: " + err.Error()
+	}
 }
@@ -5,8 +5,21 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
@@ -28,7 +41,7 @@ var (
 		"none":  {"7C213E44DF0C74777033B33E3366A8967100B8A5", "B20383C0D841CC31BCECD79C46B786CDE8E807AE", "155F8662F72A330FFBFB373296D44623608FD0AB"},
 		"any":   {"768825A19A46DA68FD72FE9222C66A4E7ADE9CD1", "636314F19ED47A448AA6B54E491EEB822523588F", "C518EC4F6B42AB6EA1F45274B85F4DD72E1E1DD1"},
 	}
-	metrics          = InitMetrics()
+	metrics          = InitMetrics("", "")
 	collectionConfig = core.CollectionConfig{
 		Types: []core.TypeConfig{
 			{Type: "vanilla", Proportions: testCfg.Backend.DistProportions},
@@ -39,7 +52,7 @@ var (
 
 func TestDistributionMechanism(t *testing.T) {
 	rcol := core.NewBackendResources(&collectionConfig)
-	reloadBridgeDescriptors(&testCfg, rcol, nil)
+	reloadBridgeDescriptors(context.Background(), &testCfg, metrics, rcol, nil)
 
 	foundAny := make([]bool, len(distributor["any"]))
 	for distName := range testCfg.Backend.DistProportions {
@@ -87,7 +100,7 @@ func TestUnknownDistributionMethod(t *testing.T) {
 
 	rcol := core.NewBackendResources(&collectionConfig)
 
-	reloadBridgeDescriptors(&testCfg, rcol, nil)
+	reloadBridgeDescriptors(context.Background(), &testCfg, metrics, rcol, nil)
 	rs := rcol.Get(distName, "obfs4")
 	found := false
 	for _, res := range rs.Working {
@@ -103,12 +116,99 @@ func TestUnknownDistributionMethod(t *testing.T) {
 	}
 }
 
+func TestEmptyDistributionRequest(t *testing.T) {
+	// bridge with an https distribution request that we remove
+	fp := "1F8A76D9581D72B9B9D84411463445052A78AB71"
+
+	descriptors, err := os.ReadFile(testCfg.Backend.DescriptorsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptors = bytes.Replace(descriptors, []byte("bridge-distribution-request https\n"), []byte{}, 1)
+	cfg := testCfg
+	cfg.Backend.DescriptorsFile = filepath.Join(t.TempDir(), "bridge-descriptors")
+	if err := os.WriteFile(cfg.Backend.DescriptorsFile, descriptors, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	findBridge := func(cfg *Config) string {
+		rcol := core.NewBackendResources(&collectionConfig)
+		reloadBridgeDescriptors(context.Background(), cfg, metrics, rcol, nil)
+		for distName := range cfg.Backend.DistProportions {
+			for _, res := range rcol.Get(distName, "obfs4").Working {
+				transport, ok := res.(*resources.Transport)
+				if ok && transport.Fingerprint == fp {
+					return distName
+				}
+			}
+		}
+		return "none"
+	}
+
+	// The stencil assigns all the bridges without distributor to moat.
+	if distName := findBridge(&cfg); distName != "moat" {
+		t.Errorf("bridge with empty distribution request found in %s instead of moat", distName)
+	}
+
+	cfg.Backend.DefaultDistributionRequest = "email"
+	if distName := findBridge(&cfg); distName != "email" {
+		t.Errorf("bridge with empty distribution request found in %s instead of email", distName)
+	}
+}
+
+func TestUnallocatedDistributionRequest(t *testing.T) {
+	// bridge with an https distribution request that we make unallocated
+	fp := "1F8A76D9581D72B9B9D84411463445052A78AB71"
+
+	descriptors, err := os.ReadFile(testCfg.Backend.DescriptorsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptors = bytes.Replace(descriptors, []byte("bridge-distribution-request https\n"), []byte("bridge-distribution-request unallocated\n"), 1)
+	cfg := testCfg
+	cfg.Backend.DescriptorsFile = filepath.Join(t.TempDir(), "bridge-descriptors")
+	if err := os.WriteFile(cfg.Backend.DescriptorsFile, descriptors, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Backend.Resources = map[string]ResourceConfig{"obfs4": {}}
+
+	rcol := core.NewBackendResources(&collectionConfig)
+	reloadBridgeDescriptors(context.Background(), &cfg, metrics, rcol, nil)
+
+	isBridge := func(res core.Resource) bool {
+		transport, ok := res.(*resources.Transport)
+		return ok && transport.Fingerprint == fp
+	}
+	for _, distName := range append(distributorNames(&cfg), "none") {
+		for _, res := range rcol.GetHashring(distName, "obfs4").GetAll() {
+			if isBridge(res) {
+				t.Errorf("unallocated bridge found in %s", distName)
+			}
+		}
+	}
+
+	// The bridge is not distributed but it's still counted.
+	found := false
+	forEachAssignment(&cfg, rcol, func(res core.Resource, distName string, distributed bool) {
+		if !isBridge(res) {
+			return
+		}
+		if distName != resources.DistributorUnallocated || distributed {
+			t.Errorf("unallocated bridge assigned to %s, distributed %v", distName, distributed)
+		}
+		found = true
+	})
+	if !found {
+		t.Error("unallocated bridge is not in the assignments")
+	}
+}
+
 func TestDistributionMechanismUpdated(t *testing.T) {
 	fp := "56E04AE5C0F64F22206A49939B33FB597BFE1AA7"
 
 	rcol := core.NewBackendResources(&collectionConfig)
 
-	reloadBridgeDescriptors(&testCfg, rcol, nil)
+	reloadBridgeDescriptors(context.Background(), &testCfg, metrics, rcol, nil)
 	rs := rcol.Get("email", "obfs4")
 	found := false
 	for _, res := range rs.Working {
@@ -125,7 +225,7 @@ func TestDistributionMechanismUpdated(t *testing.T) {
 
 	cfg := testCfg
 	cfg.Backend.DescriptorsFile = "./test_assets/bridge-descriptors_update"
-	reloadBridgeDescriptors(&cfg, rcol, nil)
+	reloadBridgeDescriptors(context.Background(), &cfg, metrics, rcol, nil)
 	rs = rcol.Get("moat", "obfs4")
 	found = false
 	for _, res := range rs.Working {
@@ -140,15 +240,86 @@ func TestDistributionMechanismUpdated(t *testing.T) {
 	}
 }
 
+// newFractionsCollection returns a collection where 3 of 4 resources are
+// functional and 1 of 4 has an accepted ratio.
+func newFractionsCollection() *core.BackendResources {
+	rcol := core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "dummy", Unpartitioned: true}},
+	})
+	for i, state := range []int{core.StateFunctional, core.StateFunctional, core.StateFunctional, core.StateUntested} {
+		d := core.NewDummy(core.Hashkey(i), core.Hashkey(i))
+		d.TestResult().State = state
+		d.TestResult().Speed = core.SpeedUntested
+		if i == 0 {
+			d.TestResult().Speed = core.SpeedAccepted
+		}
+		rcol.Add(d)
+	}
+	return rcol
+}
+
+func TestDistributionFractions(t *testing.T) {
+	rcol := newFractionsCollection()
+	calcTestedResources(&testCfg, metrics, nil, rcol)
+	if f := testutil.ToFloat64(metrics.FunctionalFraction); f != 0.75 {
+		t.Errorf("Expected a functional fraction of 0.75 but got %f", f)
+	}
+	if f := testutil.ToFloat64(metrics.AcceptedFraction); f != 0.25 {
+		t.Errorf("Expected an accepted fraction of 0.25 but got %f", f)
+	}
+	if rcol.GetDistributionDecision().FunctionalFraction != 0.75 || rcol.GetDistributionDecision().AcceptedFraction != 0.25 {
+		t.Errorf("The collection has the fractions %f and %f", rcol.GetDistributionDecision().FunctionalFraction, rcol.GetDistributionDecision().AcceptedFraction)
+	}
+	if !rcol.GetDistributionDecision().OnlyFunctional || rcol.GetDistributionDecision().UseBandwidthRatio {
+		t.Errorf("Wrong decision for the fractions: only functional %v, use bandwidth ratio %v", rcol.GetDistributionDecision().OnlyFunctional, rcol.GetDistributionDecision().UseBandwidthRatio)
+	}
+}
+
+func TestConfiguredMinFractions(t *testing.T) {
+	rcol := newFractionsCollection()
+	cfg := Config{}
+	fraction := func(f float64) *float64 { return &f }
+	cfg.Backend.MinFunctionalFraction = fraction(0.8)
+	cfg.Backend.MinRatioFraction = fraction(0.2)
+	calcTestedResources(&cfg, metrics, nil, rcol)
+	if rcol.GetDistributionDecision().OnlyFunctional {
+		t.Error("OnlyFunctional flag enabled with less functional resources than the configured fraction")
+	}
+	if !rcol.GetDistributionDecision().UseBandwidthRatio {
+		t.Error("UseBandwidthRatio flag disabled with more accepted resources than the configured fraction")
+	}
+
+	cfg.Backend.MinFunctionalFraction = fraction(0.7)
+	cfg.Backend.MinRatioFraction = fraction(0.3)
+	calcTestedResources(&cfg, metrics, nil, rcol)
+	if !rcol.GetDistributionDecision().OnlyFunctional {
+		t.Error("OnlyFunctional flag disabled with more functional resources than the configured fraction")
+	}
+	if rcol.GetDistributionDecision().UseBandwidthRatio {
+		t.Error("UseBandwidthRatio flag enabled with less accepted resources than the configured fraction")
+	}
+
+	// A configured 0 is not replaced by the default.
+	cfg.Backend.MinFunctionalFraction = fraction(0)
+	cfg.Backend.MinRatioFraction = fraction(0)
+	calcTestedResources(&cfg, metrics, nil, rcol)
+	if !rcol.GetDistributionDecision().OnlyFunctional {
+		t.Error("OnlyFunctional flag disabled with a configured fraction of 0")
+	}
+	if !rcol.GetDistributionDecision().UseBandwidthRatio {
+		t.Error("UseBandwidthRatio flag disabled with a configured fraction of 0")
+	}
+}
+
 func TestOnlyFunctional(t *testing.T) {
 	fpDysfucntional := "56E04AE5C0F64F22206A49939B33FB597BFE1AA7"
 	fpFunctional := "439B8DF324C99FBEBE49344D61C93244C773E402"
 
 	rcol := core.NewBackendResources(&collectionConfig)
 
-	reloadBridgeDescriptors(&testCfg, rcol, nil)
-	currentRatios := calcTestedResources(metrics, nil, rcol)
-	if rcol.OnlyFunctional {
+	reloadBridgeDescriptors(context.Background(), &testCfg, metrics, rcol, nil)
+	currentRatios := calcTestedResources(&testCfg, metrics, nil, rcol)
+	if rcol.GetDistributionDecision().OnlyFunctional {
 		t.Errorf("OnlyFunctional flag enabled when most resources are untested")
 	}
 
@@ -182,8 +353,8 @@ func TestOnlyFunctional(t *testing.T) {
 			r.TestResult().State = core.StateFunctional
 		}
 	}
-	calcTestedResources(metrics, currentRatios, rcol)
-	if !rcol.OnlyFunctional {
+	calcTestedResources(&testCfg, metrics, currentRatios, rcol)
+	if !rcol.GetDistributionDecision().OnlyFunctional {
 		t.Errorf("OnlyFunctional flag disabled when most resources are functional")
 	}
 
@@ -229,3 +400,323 @@ func TestOnlyFunctional(t *testing.T) {
 		t.Errorf("Not found dysfunctional bridge %s in Not Working email", fpDysfucntional)
 	}
 }
+
+func TestKrakenCancelReload(t *testing.T) {
+	// Use a named pipe as extrainfo file, so reading it blocks until the
+	// context gets cancelled.
+	extrainfoFile := filepath.Join(t.TempDir(), "cached-extrainfo")
+	if err := syscall.Mkfifo(extrainfoFile, 0600); err != nil {
+		t.Fatalf("failed to create named pipe: %s", err)
+	}
+	// Keep a writer open so opening the pipe for reading doesn't block.
+	writer, err := os.OpenFile(extrainfoFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open named pipe: %s", err)
+	}
+	defer writer.Close()
+
+	cfg := testCfg
+	cfg.Backend.ExtrainfoFile = extrainfoFile
+
+	bCtx := &BackendContext{metrics: metrics}
+	bCtx.Resources = *core.NewBackendResources(&collectionConfig)
+	bCtx.rTestPool = NewResourceTestPool("", "", "", "", 1, 0, 0, 0, metrics)
+	defer bCtx.rTestPool.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan bool, 1)
+	done := make(chan struct{})
+	go func() {
+		InitKraken(ctx, &cfg, ready, bCtx)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("kraken returned before the context was cancelled")
+	default:
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("kraken didn't return after the context was cancelled")
+	}
+	if !<-ready {
+		t.Error("kraken didn't signal that it's ready")
+	}
+	if bCtx.Resources.Collection["obfs4"].Len() != 0 {
+		t.Error("aborted reload added resources")
+	}
+}
+
+func TestStaleExtrainfoNew(t *testing.T) {
+	extrainfoFile := filepath.Join(t.TempDir(), "cached-extrainfo")
+	for _, filename := range []string{extrainfoFile, extrainfoFile + ".new"} {
+		if err := os.WriteFile(filename, []byte{}, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := testCfg
+	cfg.Backend.ExtrainfoFile = extrainfoFile
+	cfg.Backend.ExtrainfoNewMaxAgeHours = 24
+	if files := extrainfoFiles(&cfg); len(files) != 2 {
+		t.Errorf("fresh .new file was skipped: %v", files)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(extrainfoFile+".new", old, old); err != nil {
+		t.Fatal(err)
+	}
+	files := extrainfoFiles(&cfg)
+	if len(files) != 1 || files[0] != extrainfoFile {
+		t.Errorf("stale .new file was not skipped: %v", files)
+	}
+
+	// Without a maximum age the .new file is always loaded.
+	cfg.Backend.ExtrainfoNewMaxAgeHours = 0
+	if files := extrainfoFiles(&cfg); len(files) != 2 {
+		t.Errorf("stale .new file was skipped without a maximum age: %v", files)
+	}
+}
+
+func TestDedupORAddresses(t *testing.T) {
+	// The IPv6 OR address is the IPv4-mapped version of the IPv4 one.
+	networkstatus := `published 2021-09-29 15:11:52
+fingerprint BA44A889E64B93FAA2B114E02C2A279A8555C533
+r Unnamed365955763580 H4p22Vgdcrm52EQRRjRFBSp4q3E aShPGk5jQ8/6SL3Z7MbR1TdOdCs 2021-05-16 11:18:37 143.117.2.216 18972 0
+s Fast Running Stable Valid
+w Bandwidth=2193096841
+a [::ffff:143.117.2.216]:18972
+`
+	networkstatusFile := filepath.Join(t.TempDir(), "networkstatus-bridges")
+	if err := os.WriteFile(networkstatusFile, []byte(networkstatus), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	bridges, err := loadBridgesFromNetworkstatus(context.Background(), networkstatusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge, ok := bridges["1F8A76D9581D72B9B9D84411463445052A78AB71"]
+	if !ok {
+		t.Fatal("bridge not found in the network status")
+	}
+	if len(bridge.ORAddresses) != 1 {
+		t.Fatalf("expected duplicated OR addresses to be collapsed but got %v", bridge.ORAddresses)
+	}
+	if oraddress := bridge.ORAddresses[0]; oraddress.IPVersion != 4 || oraddress.Port != 18972 {
+		t.Errorf("unexpected OR address %v", oraddress)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := loadBridgesFromNetworkstatus(ctx, networkstatusFile); err != context.Canceled {
+		t.Errorf("expected the load to be cancelled but got %v", err)
+	}
+}
+
+func TestExcludeBridgesByFlags(t *testing.T) {
+	testCases := []struct {
+		flags    resources.Flags
+		included bool
+	}{
+		{resources.Flags{Running: true, Valid: true}, true},
+		{resources.Flags{Fast: true, Stable: true, Running: true, Valid: true}, true},
+		{resources.Flags{Running: true}, false},
+		{resources.Flags{Valid: true}, false},
+		{resources.Flags{Fast: true, Stable: true}, false},
+	}
+
+	bridges := make(map[string]*resources.Bridge)
+	for i, testCase := range testCases {
+		b := resources.NewBridge()
+		b.Fingerprint = fmt.Sprintf("%040d", i)
+		b.Flags = testCase.flags
+		bridges[b.Fingerprint] = b
+	}
+
+	excludeBridgesByFlags(bridges, []string{"Running", "Valid", "Unknown"}, metrics)
+	for i, testCase := range testCases {
+		_, ok := bridges[fmt.Sprintf("%040d", i)]
+		if ok != testCase.included {
+			t.Errorf("bridge with flags %+v included: %v", testCase.flags, ok)
+		}
+	}
+	if excluded := testutil.ToFloat64(metrics.ExcludedBridges.WithLabelValues("Running")); excluded != 2 {
+		t.Errorf("expected 2 bridges excluded without Running, got %v", excluded)
+	}
+	if excluded := testutil.ToFloat64(metrics.ExcludedBridges.WithLabelValues("Valid")); excluded != 1 {
+		t.Errorf("expected 1 bridge excluded without Valid, got %v", excluded)
+	}
+
+	excludeBridgesByFlags(bridges, nil, metrics)
+	if len(bridges) != 2 {
+		t.Errorf("bridges were excluded without required flags: %v", bridges)
+	}
+}
+
+func TestMergeExtrainfoTransports(t *testing.T) {
+	fp := "B12C52642EA222F6612AD622BF76581BE118061E"
+	extrainfo := "extra-info Unnamed " + fp + "\n" +
+		"transport obfs4 1.2.3.4:1000 cert=old,iat-mode=0\n" +
+		"transport obfs4 1.2.3.4:2000 cert=old,iat-mode=0\n" +
+		"-----END SIGNATURE-----\n"
+	extrainfoNew := "extra-info Unnamed " + fp + "\n" +
+		"transport obfs4 1.2.3.4:1000 cert=new,iat-mode=0\n" +
+		"transport obfs4 1.2.3.4:3000 cert=new,iat-mode=0\n" +
+		"-----END SIGNATURE-----\n"
+
+	cfg := testCfg
+	cfg.Backend.ExtrainfoFile = filepath.Join(t.TempDir(), "cached-extrainfo")
+	if err := os.WriteFile(cfg.Backend.ExtrainfoFile, []byte(extrainfo), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.Backend.ExtrainfoFile+".new", []byte(extrainfoNew), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rcol := core.NewBackendResources(&collectionConfig)
+	reloadBridgeDescriptors(context.Background(), &cfg, metrics, rcol, nil)
+
+	certs := make(map[uint16]string)
+	for _, r := range rcol.Collection["obfs4"].GetAll() {
+		transport, ok := r.(*resources.Transport)
+		if ok && transport.Fingerprint == fp {
+			certs[transport.Port] = transport.Parameters["cert"]
+		}
+	}
+	expected := map[uint16]string{1000: "new", 2000: "old", 3000: "new"}
+	if !reflect.DeepEqual(certs, expected) {
+		t.Errorf("expected transports %v but got %v", expected, certs)
+	}
+}
+
+func TestPopulateTransportInfoIPv6(t *testing.T) {
+	transport := resources.NewTransport()
+	err := populateTransportInfo("transport obfs4 [2001:db8::1]:443 cert=foo,iat-mode=0", transport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !transport.Address.IP.Equal(net.ParseIP("2001:db8::1")) || transport.Port != 443 {
+		t.Errorf("wrong transport address %s port %d", transport.Address, transport.Port)
+	}
+	expected := []resources.ORAddress{{IPVersion: 6, Port: 443, Address: transport.Address}}
+	if !reflect.DeepEqual(transport.ORAddresses, expected) {
+		t.Errorf("expected OR addresses %v but got %v", expected, transport.ORAddresses)
+	}
+	if transport.Parameters["cert"] != "foo" || transport.Parameters["iat-mode"] != "0" {
+		t.Errorf("wrong transport parameters %v", transport.Parameters)
+	}
+
+	ipv4 := resources.NewTransport()
+	if err := populateTransportInfo("transport obfs4 1.2.3.4:443 cert=foo,iat-mode=0", ipv4, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(ipv4.ORAddresses) != 0 {
+		t.Errorf("expected no OR addresses for an IPv4 transport but got %v", ipv4.ORAddresses)
+	}
+
+	for _, line := range []string{
+		"transport obfs4 2001:db8::1:443",
+		"transport obfs4 [2001:db8::1]:70000",
+		"transport obfs4 example.com:443",
+	} {
+		if err := populateTransportInfo(line, resources.NewTransport(), nil); err == nil {
+			t.Errorf("invalid transport line %q was parsed", line)
+		}
+	}
+}
+
+func TestPopulateTransportInfoAllowedParameters(t *testing.T) {
+	resourcesCfg := map[string]ResourceConfig{
+		"obfs4": {Parameters: []string{"cert", "iat-mode"}},
+	}
+	transport := resources.NewTransport()
+	err := populateTransportInfo("transport obfs4 1.2.3.4:443 cert=foo,iat-mode=0,debug-flag=1", transport, resourcesCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"cert": "foo", "iat-mode": "0"}
+	if !reflect.DeepEqual(transport.Parameters, expected) {
+		t.Errorf("expected parameters %v but got %v", expected, transport.Parameters)
+	}
+
+	// Transport types without an allowlist keep all their parameters.
+	transport = resources.NewTransport()
+	err = populateTransportInfo("transport webtunnel 1.2.3.4:443 url=https://example.com,debug-flag=1", transport, resourcesCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.Parameters) != 2 {
+		t.Errorf("expected all the parameters but got %v", transport.Parameters)
+	}
+}
+
+func TestDescriptorReloadMetrics(t *testing.T) {
+	metrics.LastDescriptorReload.Set(0)
+	failures := metrics.DescriptorReloadFailures.With(prometheus.Labels{"file": "networkstatus"})
+	before := testutil.ToFloat64(failures)
+
+	cfg := testCfg
+	cfg.Backend.NetworkstatusFile = filepath.Join(t.TempDir(), "missing")
+	rcol := core.NewBackendResources(&collectionConfig)
+	if reloadBridgeDescriptors(context.Background(), &cfg, metrics, rcol, nil) {
+		t.Error("reload with a missing network status succeeded")
+	}
+	if reload := testutil.ToFloat64(metrics.LastDescriptorReload); reload != 0 {
+		t.Errorf("failed reload updated the last reload time to %f", reload)
+	}
+	if after := testutil.ToFloat64(failures); after != before+1 {
+		t.Errorf("expected the network status failure counter to increase, got %f", after)
+	}
+
+	if !reloadBridgeDescriptors(context.Background(), &testCfg, metrics, rcol, nil) {
+		t.Error("reload failed")
+	}
+	if reload := testutil.ToFloat64(metrics.LastDescriptorReload); time.Since(time.Unix(int64(reload), 0)) > time.Minute {
+		t.Errorf("successful reload didn't update the last reload time: %f", reload)
+	}
+}
+
+func TestRegisteredTransportType(t *testing.T) {
+	// Turn the scramblesuit transports of our extrainfo descriptors into a
+	// custom transport.
+	resources.RegisterTransportType("customtransport", resources.TransportTypeOptions{
+		Validate: func(t *resources.Transport) error {
+			if t.Parameters["password"] == "" {
+				return errors.New("missing password")
+			}
+			return nil
+		},
+	})
+	defer resources.UnregisterTransportType("customtransport")
+	extrainfo, err := os.ReadFile(testCfg.Backend.ExtrainfoFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom := strings.ReplaceAll(string(extrainfo), "transport scramblesuit ", "transport customtransport ")
+	extrainfoFile := filepath.Join(t.TempDir(), "cached-extrainfo")
+	if err := os.WriteFile(extrainfoFile, []byte(custom), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testCfg
+	cfg.Backend.ExtrainfoFile = extrainfoFile
+	rcol := core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{
+			{Type: "customtransport", Proportions: map[string]int{"moat": 1}},
+		},
+	})
+	reloadBridgeDescriptors(context.Background(), &cfg, metrics, rcol, nil)
+
+	if rcol.Collection["customtransport"].Len() == 0 {
+		t.Fatal("no custom transports were parsed")
+	}
+	if rs := rcol.Get("moat", "customtransport"); len(rs.Working)+len(rs.Notworking) == 0 {
+		t.Error("custom transports were not distributed")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -15,6 +16,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
@@ -25,21 +27,36 @@ const (
 type Metrics struct {
 	DistributingNonFunctional prometheus.Gauge
 	IgnoringBandwidthRatio    prometheus.Gauge
+	FunctionalFraction        prometheus.Gauge
+	AcceptedFraction          prometheus.Gauge
 	FlickeringBandwidth       *prometheus.CounterVec
 	RatiosSeen                prometheus.Histogram
 	Resources                 *prometheus.GaugeVec
 	DistributorResources      *prometheus.GaugeVec
+	PartitionResources        *prometheus.GaugeVec
 	Requests                  *prometheus.CounterVec
+	RequestDuration           *prometheus.HistogramVec
+	AuthFailures              *prometheus.CounterVec
+	BridgestrapFailures       prometheus.Counter
+	LastDescriptorReload      prometheus.Gauge
+	DescriptorReloadFailures  *prometheus.CounterVec
+	ExcludedBridges           *prometheus.GaugeVec
+	StreamConnections         *prometheus.GaugeVec
 }
 
-// InitMetrics initialises our Prometheus metrics.
-func InitMetrics() *Metrics {
+// InitMetrics initialises our Prometheus metrics under the given namespace and
+// subsystem.  If the namespace is empty PrometheusNamespace is used.
+func InitMetrics(namespace, subsystem string) *Metrics {
+	if namespace == "" {
+		namespace = PrometheusNamespace
+	}
 
 	metrics := &Metrics{}
 
 	metrics.DistributingNonFunctional = promauto.NewGauge(
 		prometheus.GaugeOpts{
-			Namespace: PrometheusNamespace,
+			Namespace: namespace,
+			Subsystem: subsystem,
 			Name:      "distributing_non_functional_resources",
 			Help:      "If rdsys is distributing non functional bridges",
 		},
@@ -47,15 +64,35 @@ func InitMetrics() *Metrics {
 
 	metrics.IgnoringBandwidthRatio = promauto.NewGauge(
 		prometheus.GaugeOpts{
-			Namespace: PrometheusNamespace,
+			Namespace: namespace,
+			Subsystem: subsystem,
 			Name:      "ignoring_resource_bandwidth_ratio",
 			Help:      "If rdsys is ignoring the resource bandwidth ratio",
 		},
 	)
 
+	metrics.FunctionalFraction = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "functional_resources_fraction",
+			Help:      "The fraction of resources that are functional, rdsys distributes non functional bridges if it's below the minimum",
+		},
+	)
+
+	metrics.AcceptedFraction = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "accepted_resources_fraction",
+			Help:      "The fraction of resources with an accepted bandwidth ratio, rdsys ignores the ratio if it's below the minimum",
+		},
+	)
+
 	metrics.FlickeringBandwidth = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: PrometheusNamespace,
+			Namespace: namespace,
+			Subsystem: subsystem,
 			Name:      "flickering_bandwidth",
 			Help:      "The number of resources that have changed from acceptable to rejected bandwidths",
 		},
@@ -64,7 +101,8 @@ func InitMetrics() *Metrics {
 
 	metrics.RatiosSeen = promauto.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: PrometheusNamespace,
+			Namespace: namespace,
+			Subsystem: subsystem,
 			Name:      "ratio_seen",
 			Buckets:   prometheus.LinearBuckets(0.0, 0.1, 30),
 			Help:      "The different bandwidth ratios that were observed",
@@ -73,7 +111,8 @@ func InitMetrics() *Metrics {
 
 	metrics.Resources = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: PrometheusNamespace,
+			Namespace: namespace,
+			Subsystem: subsystem,
 			Name:      "resources",
 			Help:      "The number of resources we have by their type, functionality, ratio and running state",
 		},
@@ -82,22 +121,105 @@ func InitMetrics() *Metrics {
 
 	metrics.DistributorResources = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: PrometheusNamespace,
+			Namespace: namespace,
+			Subsystem: subsystem,
 			Name:      "distributor_resources",
 			Help:      "The number of resources we have per distributor",
 		},
 		[]string{"distributor", "type"},
 	)
 
+	metrics.PartitionResources = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "partition_resources",
+			Help:      "The number of resources assigned to each distributor partition, distributed or not",
+		},
+		[]string{"distributor", "type"},
+	)
+
 	metrics.Requests = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: PrometheusNamespace,
+			Namespace: namespace,
+			Subsystem: subsystem,
 			Name:      "requests_total",
 			Help:      "The number of API requests",
 		},
 		[]string{"target"},
 	)
 
+	metrics.RequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "request_duration_seconds",
+			Buckets:   prometheus.DefBuckets,
+			Help:      "The time it took to respond to API requests",
+		},
+		[]string{"endpoint", "code"},
+	)
+
+	metrics.AuthFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "auth_failures_total",
+			Help:      "The number of API requests that failed authentication by reason",
+		},
+		[]string{"reason", "endpoint"},
+	)
+
+	metrics.BridgestrapFailures = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "bridgestrap_failures_total",
+			Help:      "The number of failed requests to bridgestrap",
+		},
+	)
+
+	metrics.LastDescriptorReload = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "last_descriptor_reload_timestamp",
+			Help:      "The unix time of the last reload of the bridge descriptors that parsed all the files",
+		},
+	)
+
+	metrics.DescriptorReloadFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "descriptor_reload_failures_total",
+			Help:      "The number of bridge descriptor files that failed to parse by file",
+		},
+		[]string{"file"},
+	)
+
+	metrics.ExcludedBridges = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "excluded_bridges",
+			Help:      "The number of bridges excluded in the last descriptor reload by the first required flag they miss",
+		},
+		[]string{"flag"},
+	)
+
+	metrics.StreamConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "stream_connections",
+			Help:      "The number of open resource stream connections per distributor",
+		},
+		[]string{"distributor"},
+	)
+
+	persistence.InitMetrics(namespace, subsystem)
+
 	return metrics
 }
 
@@ -110,27 +232,136 @@ func (m *Metrics) updateDistributors(cfg *Config, rcol *core.BackendResources) {
 	defer file.Close()
 
 	fmt.Fprintln(file, "bridge-pool-assignment", time.Now().UTC().Format("2006-01-02 15:04:05"))
+	counts := make(map[string]map[string]int)
+	for _, distributor := range append(distributorNames(cfg), "none", resources.DistributorUnallocated) {
+		counts[distributor] = make(map[string]int)
+		for transport := range cfg.Backend.Resources {
+			counts[distributor][transport] = 0
+		}
+	}
+	forEachAssignment(cfg, rcol, func(resource core.Resource, distributor string, distributed bool) {
+		appendAssingment(file, resource, distributor, distributed)
+		if distributed || distributor == "none" || distributor == resources.DistributorUnallocated {
+			counts[distributor][resource.Type()]++
+		}
+	})
+
+	for distributor, transports := range counts {
+		for transport, count := range transports {
+			m.DistributorResources.
+				With(prometheus.Labels{"distributor": distributor, "type": transport}).
+				Set(float64(count))
+		}
+	}
+
+	for transport := range cfg.Backend.Resources {
+		for distributor, count := range rcol.PartitionSizes(transport) {
+			m.PartitionResources.
+				With(prometheus.Labels{"distributor": distributor, "type": transport}).
+				Set(float64(count))
+		}
+	}
+}
+
+// metricsSnapshot holds the key metrics of the backend, for operators that
+// don't scrape our Prometheus metrics.
+type metricsSnapshot struct {
+	// Resources maps each resource type to the number of resources in each
+	// test state and speed, and in total.
+	Resources map[string]map[string]int `json:"resources"`
+	// Distributors maps each distributor to the number of resources of each
+	// type it's handing out.
+	Distributors              map[string]map[string]int `json:"distributors"`
+	FunctionalFraction        float64                   `json:"functional_fraction"`
+	AcceptedFraction          float64                   `json:"accepted_fraction"`
+	DistributingNonFunctional bool                      `json:"distributing_non_functional"`
+	IgnoringBandwidthRatio    bool                      `json:"ignoring_bandwidth_ratio"`
+	LastDescriptorReload      *time.Time                `json:"last_descriptor_reload"`
+}
+
+// takeMetricsSnapshot counts the resources of the collection like the
+// Resources and DistributorResources metrics do.
+func takeMetricsSnapshot(cfg *Config, rcol *core.BackendResources) *metricsSnapshot {
+	decision := rcol.GetDistributionDecision()
+	snapshot := &metricsSnapshot{
+		Resources:                 make(map[string]map[string]int),
+		Distributors:              make(map[string]map[string]int),
+		DistributingNonFunctional: !decision.OnlyFunctional,
+		IgnoringBandwidthRatio:    !decision.UseBandwidthRatio,
+	}
+
+	functionalCount, acceptedCount, numResources := 0, 0, 0
+	for rType, hashring := range rcol.Collection {
+		counts := map[string]int{"total": 0}
+		for _, state := range []int{core.StateUntested, core.StateFunctional, core.StateDysfunctional} {
+			counts[core.StateToString(state)] = 0
+		}
+		for _, speed := range []int{core.SpeedUntested, core.SpeedAccepted, core.SpeedRejected} {
+			counts["speed_"+core.SpeedToString(speed)] = 0
+		}
+
+		for _, r := range hashring.GetAll() {
+			rTest := r.TestResult()
+			counts["total"]++
+			counts[core.StateToString(rTest.State)]++
+			counts["speed_"+core.SpeedToString(rTest.Speed)]++
+			if rTest.State == core.StateFunctional {
+				functionalCount++
+			}
+			if rTest.Speed == core.SpeedAccepted {
+				acceptedCount++
+			}
+			numResources++
+		}
+		snapshot.Resources[rType] = counts
+	}
+	if numResources != 0 {
+		snapshot.FunctionalFraction = float64(functionalCount) / float64(numResources)
+		snapshot.AcceptedFraction = float64(acceptedCount) / float64(numResources)
+	}
+
+	for _, distributor := range distributorNames(cfg) {
+		snapshot.Distributors[distributor] = make(map[string]int)
+	}
+	forEachAssignment(cfg, rcol, func(resource core.Resource, distributor string, distributed bool) {
+		if !distributed {
+			return
+		}
+		snapshot.Distributors[distributor][resource.Type()]++
+	})
+	return snapshot
+}
+
+// distributorNames returns the names of the distributors that get resources.
+func distributorNames(cfg *Config) []string {
 	distributors := []string{}
 	for distributor := range cfg.Backend.DistProportions {
 		distributors = append(distributors, distributor)
+	}
+	return distributors
+}
+
+// forEachAssignment calls fn for every resource in the collection together
+// with the distributor it's assigned to, and if the distributor is handing it
+// out.  Resources assigned to unknown distributors are reported as assigned to
+// "none", and the ones kept for future distributors as "unallocated".
+func forEachAssignment(cfg *Config, rcol *core.BackendResources, fn func(resource core.Resource, distributor string, distributed bool)) {
+	distributors := distributorNames(cfg)
+	for _, distributor := range distributors {
 		for transport := range cfg.Backend.Resources {
 			rs := rcol.Get(distributor, transport)
 			for _, resource := range rs.Working {
-				appendAssingment(file, resource, distributor, true)
+				fn(resource, distributor, true)
 			}
 			for _, resource := range rs.Notworking {
-				appendAssingment(file, resource, distributor, false)
+				fn(resource, distributor, false)
 			}
-
-			m.DistributorResources.
-				With(prometheus.Labels{"distributor": distributor, "type": transport}).
-				Set(float64(len(rs.Working)))
 		}
 	}
 
 	filterNone := func(r core.Resource) bool {
 		distributor := r.Distributor()
-		if distributor == "" {
+		if distributor == "" || distributor == resources.DistributorUnallocated {
 			return false
 		}
 
@@ -141,18 +372,70 @@ func (m *Metrics) updateDistributors(cfg *Config, rcol *core.BackendResources) {
 		}
 		return true
 	}
+	filterUnallocated := func(r core.Resource) bool {
+		return r.Distributor() == resources.DistributorUnallocated
+	}
 	for transport := range cfg.Backend.Resources {
-		rs := rcol.Collection[transport].Filter(filterNone)
-		for _, resource := range rs {
-			appendAssingment(file, resource, "none", false)
+		for _, resource := range rcol.Collection[transport].Filter(filterNone) {
+			fn(resource, "none", false)
+		}
+		for _, resource := range rcol.Collection[transport].Filter(filterUnallocated) {
+			fn(resource, resources.DistributorUnallocated, false)
 		}
-
-		m.DistributorResources.
-			With(prometheus.Labels{"distributor": "none", "type": transport}).
-			Set(float64(len(rs)))
 	}
 }
 
+// assignment represents the distributor a bridge is assigned to in the
+// assignments export.
+type assignment struct {
+	Fingerprint string   `json:"fingerprint"`
+	Distributor string   `json:"distributor"`
+	Transport   string   `json:"transport"`
+	Distributed bool     `json:"distributed"`
+	BlockedIn   []string `json:"blocked_in"`
+	State       string   `json:"state"`
+}
+
+// exportAssignments returns the assignment of every bridge in the collection,
+// sorted by fingerprint, transport and distributor, so the same collection
+// always produces the same export.
+func exportAssignments(cfg *Config, rcol *core.BackendResources) []assignment {
+	assignments := []assignment{}
+	forEachAssignment(cfg, rcol, func(resource core.Resource, distributor string, distributed bool) {
+		bridgeBase, ok := getBridgeBase(resource)
+		if !ok {
+			return
+		}
+		blockedIn := []string{}
+		for country, blocked := range resource.BlockedIn() {
+			if blocked {
+				blockedIn = append(blockedIn, country)
+			}
+		}
+		sort.Strings(blockedIn)
+		assignments = append(assignments, assignment{
+			Fingerprint: bridgeBase.Fingerprint,
+			Distributor: distributor,
+			Transport:   resource.Type(),
+			Distributed: distributed,
+			BlockedIn:   blockedIn,
+			State:       core.StateToString(resource.TestResult().State),
+		})
+	})
+
+	sort.Slice(assignments, func(i, j int) bool {
+		a, b := assignments[i], assignments[j]
+		if a.Fingerprint != b.Fingerprint {
+			return a.Fingerprint < b.Fingerprint
+		}
+		if a.Transport != b.Transport {
+			return a.Transport < b.Transport
+		}
+		return a.Distributor < b.Distributor
+	})
+	return assignments
+}
+
 func appendAssingment(file *os.File, resource core.Resource, distributor string, distributed bool) {
 	bridgeBase, ok := getBridgeBase(resource)
 	if ok {
@@ -0,0 +1,173 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestInitMetricsNamespace(t *testing.T) {
+	m := InitMetrics("rdsys_test", "tenant")
+	m.DistributingNonFunctional.Set(1)
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %s", err)
+	}
+
+	expected := "rdsys_test_tenant_distributing_non_functional_resources"
+	for _, family := range families {
+		if family.GetName() == expected {
+			return
+		}
+	}
+	t.Errorf("Metric %s is not registered", expected)
+}
+
+func TestMetricsWrapperLatency(t *testing.T) {
+	endpoint := "/latency-test"
+	handler := metricsWrapper(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "teapot", http.StatusTeapot)
+	}, endpoint, metrics)
+
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest(http.MethodGet, endpoint, nil))
+	if rr.Code != http.StatusTeapot {
+		t.Fatalf("Unexpected status code %d", rr.Code)
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %s", err)
+	}
+	for _, family := range families {
+		if family.GetName() != PrometheusNamespace+"_request_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["endpoint"] != endpoint {
+				continue
+			}
+			if labels["code"] != "418" {
+				t.Errorf("Unexpected code label %s", labels["code"])
+			}
+			if count := metric.GetHistogram().GetSampleCount(); count != 1 {
+				t.Errorf("Expected one observation, got %d", count)
+			}
+			return
+		}
+	}
+	t.Errorf("No latency observed for %s", endpoint)
+}
+
+func TestExportAssignments(t *testing.T) {
+	cfg := &Config{}
+	cfg.Backend.DistProportions = map[string]int{"https": 1}
+	cfg.Backend.Resources = map[string]ResourceConfig{"obfs4": {}}
+	rcol := core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Proportions: cfg.Backend.DistProportions}},
+	})
+	rcol.SetDistributionDecision(core.DistributionDecision{OnlyFunctional: true})
+
+	for i, fingerprint := range []string{"CCCC", "AAAA", "BBBB"} {
+		r := resources.NewTransport()
+		r.SetType("obfs4")
+		r.Fingerprint = fingerprint
+		r.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+		r.Port = uint16(1000 + i)
+		switch fingerprint {
+		case "AAAA":
+			r.TestResult().State = core.StateFunctional
+			r.SetBlockedIn(core.LocationSet{"ir": true, "cn": true})
+		case "BBBB":
+			r.TestResult().State = core.StateDysfunctional
+		case "CCCC":
+			r.TestResult().State = core.StateFunctional
+		}
+		rcol.Collection["obfs4"].Add(r)
+	}
+
+	jsonBlurb, err := json.Marshal(exportAssignments(cfg, rcol))
+	if err != nil {
+		t.Fatalf("Failed to marshal assignments: %s", err)
+	}
+	expected := `[` +
+		`{"fingerprint":"AAAA","distributor":"https","transport":"obfs4","distributed":true,"blocked_in":["cn","ir"],"state":"functional"},` +
+		`{"fingerprint":"BBBB","distributor":"https","transport":"obfs4","distributed":false,"blocked_in":[],"state":"dysfunctional"},` +
+		`{"fingerprint":"CCCC","distributor":"https","transport":"obfs4","distributed":true,"blocked_in":[],"state":"functional"}` +
+		`]`
+	if string(jsonBlurb) != expected {
+		t.Errorf("Unexpected assignments:\n%s\nexpected:\n%s", jsonBlurb, expected)
+	}
+}
+
+func TestMetricsJSONHandler(t *testing.T) {
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.AdminTokens = map[string]string{"admin": "secret"}
+	b.Config.Backend.DistProportions = map[string]int{"https": 1}
+	b.Config.Backend.Resources = map[string]ResourceConfig{"obfs4": {}}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Proportions: b.Config.Backend.DistProportions}},
+	})
+	b.Resources.SetDistributionDecision(core.DistributionDecision{OnlyFunctional: true})
+
+	for i, state := range []int{core.StateFunctional, core.StateFunctional, core.StateDysfunctional, core.StateUntested} {
+		r := resources.NewTransport()
+		r.SetType("obfs4")
+		r.Fingerprint = "AAAA"
+		r.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+		r.Port = uint16(1000 + i)
+		r.TestResult().State = state
+		b.Resources.Collection["obfs4"].Add(r)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics.json", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	b.metricsJSONHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", rr.Code)
+	}
+
+	var snapshot metricsSnapshot
+	if err := json.Unmarshal(rr.Body.Bytes(), &snapshot); err != nil {
+		t.Fatalf("Failed to unmarshal metrics: %s", err)
+	}
+	counts := snapshot.Resources["obfs4"]
+	if counts["total"] != 4 || counts["functional"] != 2 || counts["dysfunctional"] != 1 || counts["untested"] != 1 {
+		t.Errorf("Unexpected resource counts: %v", counts)
+	}
+	if snapshot.FunctionalFraction != 0.5 {
+		t.Errorf("Unexpected functional fraction %f", snapshot.FunctionalFraction)
+	}
+	if snapshot.DistributingNonFunctional || !snapshot.IgnoringBandwidthRatio {
+		t.Errorf("Unexpected distribution flags: %+v", snapshot)
+	}
+	if snapshot.Distributors["https"]["obfs4"] != 2 {
+		t.Errorf("Unexpected distributor counts: %v", snapshot.Distributors)
+	}
+	if snapshot.LastDescriptorReload != nil {
+		t.Errorf("Unexpected last descriptor reload %s", snapshot.LastDescriptorReload)
+	}
+
+	rr = httptest.NewRecorder()
+	b.metricsJSONHandler(rr, httptest.NewRequest(http.MethodGet, "/metrics.json", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a rejected request but got %d", rr.Code)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+)
+
+// followUpstream keeps the collection of a read-only replica in sync with the
+// upstream backend, until the given context is cancelled.  It subscribes to the
+// upstream resource stream on behalf of each of our distributors, so each
+// distributor gets the same resources from the replica as from the upstream
+// backend.  We write to ready once every distributor got its initial batch of
+// resources.
+func followUpstream(ctx context.Context, cfg *Config, ready chan bool, rcol *core.BackendResources) {
+	log.Printf("Following the resource stream at %s as a read-only replica.", cfg.Backend.UpstreamResourceStream)
+
+	rTypes := []string{}
+	for rType := range rcol.Collection {
+		rTypes = append(rTypes, rType)
+	}
+	sort.Strings(rTypes)
+
+	// The collection is otherwise only modified by a single goroutine, so we
+	// apply the diffs of our distributors one at a time.
+	var applyLock sync.Mutex
+	holders := make(upstreamHolders)
+	var wg, initialised sync.WaitGroup
+	for _, distName := range distributorNames(cfg) {
+		wg.Add(1)
+		initialised.Add(1)
+		go func(distName string) {
+			defer wg.Done()
+			followDistributor(ctx, cfg, rcol, holders, distName, rTypes, &applyLock, initialised.Done)
+		}(distName)
+	}
+	go func() {
+		initialised.Wait()
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case ready <- true:
+		case <-ctx.Done():
+		}
+	}()
+	wg.Wait()
+}
+
+// followDistributor applies the diffs of the upstream resource stream of the
+// given distributor to the collection, holding applyLock while doing so.
+// initialised is called after the first diff, or when we stop following the
+// stream if there was none.
+func followDistributor(ctx context.Context, cfg *Config, rcol *core.BackendResources, holders upstreamHolders, distName string, rTypes []string, applyLock *sync.Mutex, initialised func()) {
+	ipc := mechanisms.NewHttpsIpc(cfg.Backend.UpstreamResourceStream, "GET", cfg.Backend.UpstreamToken)
+	rStream := make(chan *core.ResourceDiff)
+	ipc.StartStream(&core.ResourceRequest{
+		RequestOrigin: distName,
+		ResourceTypes: rTypes,
+		Receiver:      rStream,
+	})
+	defer close(rStream)
+	defer ipc.StopStream()
+
+	var once sync.Once
+	defer once.Do(initialised)
+	for {
+		select {
+		case diff := <-rStream:
+			applyLock.Lock()
+			applyUpstreamDiff(rcol, holders, distName, diff)
+			applyLock.Unlock()
+			once.Do(initialised)
+		case <-ctx.Done():
+			log.Printf("Stopped following the resource stream of %s.", distName)
+			return
+		}
+	}
+}
+
+// upstreamHolders maps the resource types and unique IDs of the resources of
+// unpartitioned types to the distributors that got them from upstream.  Quotas
+// give distributors different views of the same resources, so a resource is
+// only removed once none of them has it anymore.
+type upstreamHolders map[string]map[core.Hashkey]map[string]bool
+
+func (h upstreamHolders) add(r core.Resource, distName string) {
+	if _, ok := h[r.Type()]; !ok {
+		h[r.Type()] = make(map[core.Hashkey]map[string]bool)
+	}
+	if _, ok := h[r.Type()][r.Uid()]; !ok {
+		h[r.Type()][r.Uid()] = make(map[string]bool)
+	}
+	h[r.Type()][r.Uid()][distName] = true
+}
+
+// remove drops the distributor from the holders of the resource and returns
+// true if no other distributor has it.
+func (h upstreamHolders) remove(r core.Resource, distName string) bool {
+	distNames := h[r.Type()][r.Uid()]
+	delete(distNames, distName)
+	if len(distNames) != 0 {
+		return false
+	}
+	delete(h[r.Type()], r.Uid())
+	return true
+}
+
+// applyUpstreamDiff applies a diff that the upstream backend sent for the given
+// distributor to the collection.  Bridges are assigned to the distributor, so
+// they end up in its partition.  Resources of unpartitioned types are shared by
+// all distributors and only removed once they are gone from all of them.
+func applyUpstreamDiff(rcol *core.BackendResources, holders upstreamHolders, distName string, diff *core.ResourceDiff) {
+	remove := func(r core.Resource) error {
+		if !rcol.IsPartitioned(r.Type()) && !holders.remove(r, distName) {
+			return nil
+		}
+		return rcol.Remove(r)
+	}
+
+	if diff.FullUpdate {
+		for rType := range rcol.Collection {
+			keep := make(map[core.Hashkey]bool)
+			for _, r := range diff.New[rType] {
+				keep[r.Uid()] = true
+			}
+			for _, r := range rcol.GetHashring(distName, rType).GetAll() {
+				if !keep[r.Uid()] {
+					remove(r)
+				}
+			}
+		}
+	}
+
+	for _, rs := range []core.ResourceMap{diff.New, diff.Changed} {
+		for _, resources := range rs {
+			for _, r := range resources {
+				assignToDistributor(rcol, r, distName)
+				if !rcol.IsPartitioned(r.Type()) {
+					holders.add(r, distName)
+				}
+				rcol.Add(r)
+			}
+		}
+	}
+	for _, resources := range diff.Gone {
+		for _, r := range resources {
+			assignToDistributor(rcol, r, distName)
+			if err := remove(r); err != nil {
+				log.Printf("Error removing a resource gone from %s: %s", distName, err)
+			}
+		}
+	}
+}
+
+// assignToDistributor sets the distribution request of bridges of partitioned
+// types to the given distributor.
+func assignToDistributor(rcol *core.BackendResources, r core.Resource, distName string) {
+	if !rcol.IsPartitioned(r.Type()) {
+		return
+	}
+	if bridge, ok := getBridgeBase(r); ok {
+		bridge.Distribution = distName
+	}
+}
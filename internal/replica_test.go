@@ -0,0 +1,170 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestReadOnlyReplica(t *testing.T) {
+	upstream := BackendContext{metrics: metrics}
+	upstream.Config = &Config{Backend: testCfg.Backend}
+	upstream.Config.Backend.ResourceStreamEndpoint = "/resource-stream"
+	upstream.Config.Backend.ApiTokens = map[string]string{"replica": "secret"}
+	upstream.Resources = *core.NewBackendResources(&collectionConfig)
+	reloadBridgeDescriptors(context.Background(), &testCfg, metrics, &upstream.Resources, nil)
+	ts := httptest.NewServer(http.HandlerFunc(upstream.resourcesHandler))
+	defer ts.Close()
+
+	replica := BackendContext{metrics: metrics}
+	replica.Config = &Config{}
+	replica.Config.Backend.DistProportions = testCfg.Backend.DistProportions
+	replica.Config.Backend.ReadOnlyReplica = true
+	replica.Config.Backend.UpstreamResourceStream = ts.URL + "/resource-stream"
+	replica.Config.Backend.UpstreamToken = "secret"
+	replica.Config.Backend.ResourcesEndpoint = "/resources"
+	replica.Config.Backend.ApiTokens = map[string]string{"moat": "moat-secret"}
+	replica.Config.Backend.AdminTokens = map[string]string{"admin": "admin-secret"}
+	replica.Resources = *core.NewBackendResources(&collectionConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan bool, 1)
+	done := make(chan bool)
+	go func() {
+		followUpstream(ctx, replica.Config, ready, &replica.Resources)
+		close(done)
+	}()
+	select {
+	case <-ready:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The replica didn't get the initial resources")
+	}
+
+	fingerprints := func(rcol *core.BackendResources, distName string) []string {
+		fps := []string{}
+		for _, rType := range resourceTypes {
+			for _, r := range rcol.Get(distName, rType).Working {
+				bridge, _ := getBridgeBase(r)
+				fps = append(fps, rType+" "+bridge.Fingerprint)
+			}
+		}
+		sort.Strings(fps)
+		return fps
+	}
+	for distName := range testCfg.Backend.DistProportions {
+		expected := fingerprints(&upstream.Resources, distName)
+		got := fingerprints(&replica.Resources, distName)
+		if strings.Join(expected, ",") != strings.Join(got, ",") {
+			t.Errorf("The replica serves %v to %s instead of %v", got, distName, expected)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/resources", strings.NewReader(`{"request_origin": "moat", "resource_types": ["obfs4"]}`))
+	req.Header.Add("Authorization", "Bearer moat-secret")
+	replica.resourcesHandler(rr, req)
+	var resourceState struct {
+		Working []json.RawMessage `json:"working"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resourceState); err != nil {
+		t.Fatal(err)
+	}
+	if len(resourceState.Working) == 0 || len(resourceState.Working) != len(upstream.Resources.Get("moat", "obfs4").Working) {
+		t.Errorf("The replica returned %d resources to moat", len(resourceState.Working))
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/resources", strings.NewReader(`[{"type": "obfs4", "address": "1.2.3.4", "port": 1234}]`))
+	req.Header.Add("Authorization", "Bearer moat-secret")
+	replica.resourcesHandler(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected HTTP return code 403 for a POST to the replica but got %d", rr.Code)
+	}
+
+	adminHandlers := map[string]http.HandlerFunc{
+		"/reassign":         replica.reassignHandler,
+		"/blocklist/reload": replica.reloadBlockListHandler,
+		"/bridge-results":   replica.bridgeResultsHandler,
+	}
+	for path, handler := range adminHandlers {
+		rr = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{}`))
+		req.Header.Add("Authorization", "Bearer admin-secret")
+		handler(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("Expected HTTP return code 403 for a POST to %s of the replica but got %d", path, rr.Code)
+		}
+	}
+
+	ts.CloseClientConnections()
+	cancel()
+	<-done
+}
+
+func TestReadOnlyReplicaCancelledBeforeReady(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	cfg := &Config{}
+	cfg.Backend.DistProportions = testCfg.Backend.DistProportions
+	cfg.Backend.ReadOnlyReplica = true
+	cfg.Backend.UpstreamResourceStream = ts.URL + "/resource-stream"
+	rcol := core.NewBackendResources(&collectionConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan bool, 1)
+	done := make(chan bool)
+	go func() {
+		followUpstream(ctx, cfg, ready, rcol)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("followUpstream didn't return after the context was cancelled")
+	}
+	select {
+	case <-ready:
+		t.Error("The replica reported it's ready without the initial resources")
+	default:
+	}
+}
+
+func TestReplicaUnpartitionedViews(t *testing.T) {
+	rcol := core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "dummy", Unpartitioned: true}},
+	})
+	holders := make(upstreamHolders)
+	d1 := core.NewDummy(1, 1)
+	d2 := core.NewDummy(2, 2)
+
+	// A distributor with a quota gets only some of the resources.
+	applyUpstreamDiff(rcol, holders, "moat", &core.ResourceDiff{New: core.ResourceMap{"dummy": {d1, d2}}, FullUpdate: true})
+	applyUpstreamDiff(rcol, holders, "https", &core.ResourceDiff{New: core.ResourceMap{"dummy": {d1}}, FullUpdate: true})
+	if n := rcol.Collection["dummy"].Len(); n != 2 {
+		t.Fatalf("The full update of https removed resources of moat: %d resources left", n)
+	}
+
+	applyUpstreamDiff(rcol, holders, "https", &core.ResourceDiff{Gone: core.ResourceMap{"dummy": {d1}}})
+	if n := rcol.Collection["dummy"].Len(); n != 2 {
+		t.Fatalf("A resource gone from https was removed while moat has it: %d resources left", n)
+	}
+	applyUpstreamDiff(rcol, holders, "moat", &core.ResourceDiff{Gone: core.ResourceMap{"dummy": {d1}}})
+	if n := rcol.Collection["dummy"].Len(); n != 1 {
+		t.Fatalf("A resource gone from every distributor was kept: %d resources left", n)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultRequestIDHeader is the HTTP header that carries request IDs if
+	// none is configured.
+	DefaultRequestIDHeader = "X-Request-ID"
+)
+
+// validRequestID matches the incoming request IDs that we honor.  Anything
+// else is replaced, so request IDs can't be used to inject content into our
+// logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// requestIDWrapper gives each request an ID, so it can be traced across the
+// backend and distributors.  If the request carries a valid ID in the given
+// header we use it, otherwise we generate one.  The ID is echoed in the same
+// header of the response.
+func requestIDWrapper(f http.HandlerFunc, header string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if !validRequestID.MatchString(id) {
+			var err error
+			id, err = GetRandBase32(10)
+			if err != nil {
+				log.Printf("Failed to generate request ID: %s", err)
+				f(w, r)
+				return
+			}
+			id = strings.ToLower(id)
+		}
+
+		w.Header().Set(header, id)
+		f(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// requestID returns the ID of the given request, or an empty string if it
+// has none.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// logRequest logs the given message prefixed by the ID of the given request.
+func logRequest(r *http.Request, format string, v ...interface{}) {
+	if id := requestID(r); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Printf(format, v...)
+}
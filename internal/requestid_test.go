@@ -0,0 +1,47 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	handler := requestIDWrapper(b.blockedResourcesHandler, DefaultRequestIDHeader)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/resources/blocked?country=cn", nil)
+	req.Header.Set(DefaultRequestIDHeader, "trace-1234")
+	handler(rr, req)
+
+	if id := rr.Header().Get(DefaultRequestIDHeader); id != "trace-1234" {
+		t.Errorf("expected the request ID trace-1234 in the response but got %q", id)
+	}
+	if !strings.Contains(logs.String(), "[trace-1234] Request carries no 'Authorization' HTTP header.") {
+		t.Errorf("request ID missing from the logs: %q", logs.String())
+	}
+
+	// Invalid request IDs are replaced.
+	rr = httptest.NewRecorder()
+	req.Header.Set(DefaultRequestIDHeader, "bad\nid")
+	handler(rr, req)
+	id := rr.Header().Get(DefaultRequestIDHeader)
+	if id == "" || id == "bad\nid" {
+		t.Errorf("expected a generated request ID but got %q", id)
+	}
+}
@@ -5,7 +5,10 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"log"
+	"sort"
 	"sync"
 	"time"
 
@@ -18,9 +21,20 @@ const (
 	// FarInTheFuture determines a time span that's far enough in the future to
 	// practically count as infinity.
 	FarInTheFuture = time.Hour * 24 * 365 * 100
-	// MaxResources determines the maximum number of resources that we're
-	// willing to buffer before sending a request to bridgestrap.
+	// MaxResources determines the default maximum number of resources that
+	// we're willing to buffer before sending a request to bridgestrap.
 	MaxResources = 25
+	// DefaultFlushTimeout determines the default time that resources wait in
+	// the pool before being sent to bridgestrap.
+	DefaultFlushTimeout = time.Minute
+)
+
+var (
+	// testRetryDelay is the time we wait before re-queueing a batch of
+	// resources after bridgestrap failed to test them.  It doubles with each
+	// consecutive failure up to maxTestRetryDelay.
+	testRetryDelay    = time.Minute
+	maxTestRetryDelay = time.Hour
 )
 
 // BridgeTestRequest represents requests for bridgestrap and onbasca.  Here's what its
@@ -46,58 +60,187 @@ type BridgeTestResponse struct {
 }
 
 // ResourceTestPool implements a pool to which we add resources until it's time
-// to send them to bridgestrap for testing.
+// to send them to bridgestrap and onbasca for testing.  Bridgestrap and
+// onbasca have independent pipelines, so a slow or unavailable onbasca doesn't
+// delay the functionality tests and vice versa.
 type ResourceTestPool struct {
-	sync.Mutex
+	batchSize               int
 	flushTimeout            time.Duration
+	minRetestInterval       time.Duration
 	shutdown                chan bool
 	pending                 chan core.Resource
 	bridgestrap             delivery.Mechanism
 	onbasca                 delivery.Mechanism
 	bandwidthRatioThreshold float64
-	inProgress              map[string]bool
+	metrics                 *Metrics
+	bridgestrapTests        *testPipeline
+	onbascaTests            *testPipeline
+	// coalesceReachability makes bridgestrap test once the resources of a
+	// batch that share their fingerprint and address, e.g. the vanilla and
+	// obfs4 resources of a bridge, and apply the result to all of them.
+	// Onbasca still tests each of them.
+	coalesceReachability bool
+	// scheduleLock protects the LastScheduled time of the resources' tests.
+	scheduleLock sync.Mutex
+}
+
+// testPipeline batches resources and sends them to a single testing service.
+type testPipeline struct {
+	sync.Mutex
+	name       string
+	pool       *ResourceTestPool
+	pending    chan core.Resource
+	inProgress map[string]bool
+	test       func(rMap map[string]core.Resource) error
+	// retry determines if failed batches are re-queued, and failures counts
+	// the consecutive failures of the testing service.
+	retry    bool
+	failures int
 }
 
-// NewResourceTestPool returns a new resource test pool.
-func NewResourceTestPool(bridgestrapEndpoint string, bridgestrapToken string, onbascaEndpoint string, onbascaToken string, bandwidthRatioThreshold float64) *ResourceTestPool {
+// NewResourceTestPool returns a new resource test pool.  The pool sends its
+// resources for testing once it holds batchSize resources or flushTimeout has
+// passed since the first one was added.  If they are not positive MaxResources
+// and DefaultFlushTimeout are used.  A resource is not sent for testing again
+// until minRetestInterval has passed.
+func NewResourceTestPool(bridgestrapEndpoint string, bridgestrapToken string, onbascaEndpoint string, onbascaToken string, bandwidthRatioThreshold float64, batchSize int, flushTimeout time.Duration, minRetestInterval time.Duration, metrics *Metrics) *ResourceTestPool {
 	p := &ResourceTestPool{}
-	p.flushTimeout = time.Minute
+	p.batchSize = batchSize
+	if p.batchSize <= 0 {
+		p.batchSize = MaxResources
+	}
+	p.flushTimeout = flushTimeout
+	if p.flushTimeout <= 0 {
+		p.flushTimeout = DefaultFlushTimeout
+	}
+	p.minRetestInterval = minRetestInterval
 	p.shutdown = make(chan bool)
 	p.pending = make(chan core.Resource)
 	p.bridgestrap = mechanisms.NewHttpsIpc(bridgestrapEndpoint, "GET", bridgestrapToken)
 	p.onbasca = mechanisms.NewHttpsIpc(onbascaEndpoint, "GET", onbascaToken)
 	p.bandwidthRatioThreshold = bandwidthRatioThreshold
-	p.inProgress = make(map[string]bool)
+	p.metrics = metrics
+	p.bridgestrapTests = p.newTestPipeline("bridgestrap", p.testBridgestrap, true)
+	p.onbascaTests = p.newTestPipeline("onbasca", p.testOnbasca, false)
 	go p.dispatch()
 
 	return p
 }
 
+func (p *ResourceTestPool) newTestPipeline(name string, test func(rMap map[string]core.Resource) error, retry bool) *testPipeline {
+	pl := &testPipeline{
+		name:       name,
+		pool:       p,
+		pending:    make(chan core.Resource),
+		inProgress: make(map[string]bool),
+		test:       test,
+		retry:      retry,
+	}
+	go pl.dispatch()
+	return pl
+}
+
 // GetTestFunc returns a function that's executed when a new resource is added
 // to rdsys's backend.  The function takes as input a resource and submits it
-// to our testing pool.
-func (p *ResourceTestPool) GetTestFunc() func(r core.Resource) {
+// to our testing pool.  Resources are dropped instead once the given context
+// is cancelled or the pool is stopped, or if they were sent for testing less
+// than the pool's minimum retest interval ago.
+func (p *ResourceTestPool) GetTestFunc(ctx context.Context) func(r core.Resource) {
 	return func(r core.Resource) {
-		p.pending <- r
+		previous, ok := p.reserveSchedule(r)
+		if !ok {
+			return
+		}
+		select {
+		case p.pending <- r:
+		case <-ctx.Done():
+			p.cancelSchedule(r, previous)
+		case <-p.shutdown:
+			p.cancelSchedule(r, previous)
+		}
+	}
+}
+
+// reserveSchedule marks the given resource as sent for testing now, so
+// concurrent calls don't send it too, and returns when it was sent before.  It
+// returns false if the resource was sent for testing less than
+// minRetestInterval ago.
+func (p *ResourceTestPool) reserveSchedule(r core.Resource) (time.Time, bool) {
+	if p.minRetestInterval <= 0 {
+		return time.Time{}, true
+	}
+
+	p.scheduleLock.Lock()
+	defer p.scheduleLock.Unlock()
+	previous := r.TestResult().LastScheduled
+	if time.Since(previous) < p.minRetestInterval {
+		return previous, false
 	}
+	r.TestResult().LastScheduled = time.Now().UTC()
+	return previous, true
 }
 
-// Stop stops the test pool by signalling to the dispatcher that it's time to
+// cancelSchedule restores the time the given resource was sent for testing
+// before reserveSchedule, as it was dropped instead.
+func (p *ResourceTestPool) cancelSchedule(r core.Resource, previous time.Time) {
+	if p.minRetestInterval <= 0 {
+		return
+	}
+
+	p.scheduleLock.Lock()
+	defer p.scheduleLock.Unlock()
+	r.TestResult().LastScheduled = previous
+}
+
+// Stop stops the test pool by signalling to the dispatchers that it's time to
 // shut down.
 func (p *ResourceTestPool) Stop() {
 	close(p.shutdown)
 }
 
+// shutdownContext returns a context that is cancelled when the pool is
+// stopped, so the requests to the testing services don't outlive it.
+func (p *ResourceTestPool) shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-p.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// dispatch hands incoming resources to each of our test pipelines until the
+// pool is stopped.
+func (p *ResourceTestPool) dispatch() {
+	for {
+		select {
+		case r := <-p.pending:
+			for _, pl := range []*testPipeline{p.bridgestrapTests, p.onbascaTests} {
+				select {
+				case pl.pending <- r:
+				case <-p.shutdown:
+					return
+				}
+			}
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
 // alreadyInProgress returns 'true' if the given bridge line is being tested
 // right now.
-func (p *ResourceTestPool) alreadyInProgress(bridgeLine string) bool {
-	p.Lock()
-	defer p.Unlock()
+func (pl *testPipeline) alreadyInProgress(bridgeLine string) bool {
+	pl.Lock()
+	defer pl.Unlock()
 
-	if _, exists := p.inProgress[bridgeLine]; exists {
+	if _, exists := pl.inProgress[bridgeLine]; exists {
 		return true
 	}
-	p.inProgress[bridgeLine] = true
+	pl.inProgress[bridgeLine] = true
 	return false
 }
 
@@ -105,107 +248,171 @@ func (p *ResourceTestPool) alreadyInProgress(bridgeLine string) bool {
 // 1) Incoming resources to be tested
 // 2) A timer whose expiry signals that it's time to test bridges
 // 3) A shutdown signal, indicating that the function should return
-func (p *ResourceTestPool) dispatch() {
-	defer log.Printf("Shutting down resource pool ticker.")
-	log.Printf("Starting resource pool ticker.")
+func (pl *testPipeline) dispatch() {
+	defer log.Printf("Shutting down %s test pool ticker.", pl.name)
+	log.Printf("Starting %s test pool ticker.", pl.name)
 
 	ticker := time.NewTicker(FarInTheFuture)
 	rMap := make(map[string]core.Resource)
 	for {
 		select {
 		case <-ticker.C:
-			log.Println("Test pool timer expired.  Testing resources.")
-			go p.testResources(rMap)
+			log.Printf("The %s test pool timer expired.  Testing resources.", pl.name)
+			// The timer is restarted by the next resource that we get.
+			ticker.Reset(FarInTheFuture)
+			go pl.testResources(rMap)
 			rMap = make(map[string]core.Resource)
-		case r := <-p.pending:
-			if p.alreadyInProgress(r.String()) {
+		case r := <-pl.pending:
+			if pl.alreadyInProgress(r.TestString()) {
 				break
 			}
 
 			// We got a new resource to test.  Start timer if our pool was
 			// empty.
 			if len(rMap) == 0 {
-				log.Println("Starting test pool timer.")
-				ticker.Reset(p.flushTimeout)
+				log.Printf("Starting %s test pool timer.", pl.name)
+				ticker.Reset(pl.pool.flushTimeout)
 			}
-			rMap[r.String()] = r
+			rMap[r.TestString()] = r
 
 			// Test resources if our pool is full.
-			if len(rMap) == MaxResources {
-				log.Println("Test pool reached capacity.  Resetting timer and testing resources.")
+			if len(rMap) >= pl.pool.batchSize {
+				log.Printf("The %s test pool reached capacity.  Resetting timer and testing resources.", pl.name)
 				ticker.Reset(FarInTheFuture)
-				go p.testResources(rMap)
+				go pl.testResources(rMap)
 				rMap = make(map[string]core.Resource)
 			}
-		case <-p.shutdown:
+		case <-pl.pool.shutdown:
 			return
 		}
 	}
 }
 
-// testResources puts all resources that are currently in our pool into a
-// bridgestrap request and an onbasca request and sends them to our
-// bridgestrap and onbasca instances for testing.
-// The testing results are then added to each resource's state.
-func (p *ResourceTestPool) testResources(rMap map[string]core.Resource) {
-	defer func() {
-		p.Lock()
-		for bridgeLine := range rMap {
-			delete(p.inProgress, bridgeLine)
-		}
-		p.Unlock()
-	}()
-
+// testResources sends all resources that are currently in the pipeline's pool
+// for testing.  The testing results are then added to each resource's state.
+// If the test fails and the pipeline retries, the resources are re-queued
+// after an exponential backoff.
+func (pl *testPipeline) testResources(rMap map[string]core.Resource) {
 	if len(rMap) == 0 {
 		return
 	}
 
-	p.testBridgestrap(rMap)
-	p.testOnbasca(rMap)
+	err := pl.test(rMap)
+
+	pl.Lock()
+	// The resources are not in flight anymore, even if we re-queue them.
+	for bridgeLine := range rMap {
+		delete(pl.inProgress, bridgeLine)
+	}
+	if err == nil {
+		pl.failures = 0
+	} else {
+		pl.failures++
+	}
+	failures := pl.failures
+	pl.Unlock()
+
+	if err != nil && pl.retry && pl.pool.metrics != nil {
+		pl.pool.metrics.BridgestrapFailures.Inc()
+	}
+	if err == nil || !pl.retry {
+		return
+	}
+
+	delay := testRetryDelay
+	for i := 1; i < failures && delay < maxTestRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxTestRetryDelay {
+		delay = maxTestRetryDelay
+	}
+	log.Printf("Re-queueing %d resources for %s in %s.", len(rMap), pl.name, delay)
+	select {
+	case <-time.After(delay):
+	case <-pl.pool.shutdown:
+		return
+	}
+	for _, r := range rMap {
+		select {
+		case pl.pending <- r:
+		case <-pl.pool.shutdown:
+			return
+		}
+	}
 }
 
-func (p *ResourceTestPool) testBridgestrap(rMap map[string]core.Resource) {
+// testBridgestrap sends the given resources to bridgestrap and sets their
+// state.
+func (p *ResourceTestPool) testBridgestrap(rMap map[string]core.Resource) error {
 	req := BridgeTestRequest{}
 	resp := BridgeTestResponse{}
-	for bridgeLine := range rMap {
-		req.BridgeLines = append(req.BridgeLines, bridgeLine)
+	// testedLines maps the bridge lines we send to bridgestrap to the bridge
+	// lines of all the resources that get their result.
+	testedLines := make(map[string][]string)
+	for _, group := range p.reachabilityGroups(rMap) {
+		sort.Strings(group)
+		testedLines[group[0]] = group
+		req.BridgeLines = append(req.BridgeLines, group[0])
 	}
 
-	if err := p.bridgestrap.MakeJsonRequest(req, &resp); err != nil {
+	ctx, cancel := p.shutdownContext()
+	defer cancel()
+	if err := p.bridgestrap.MakeJsonRequest(ctx, req, &resp); err != nil {
 		log.Printf("Bridgestrap request failed: %s", err)
-		return
+		return err
 	}
 	if resp.Error != "" {
 		log.Printf("Bridgestrap test failed: %s", resp.Error)
-		return
+		return errors.New(resp.Error)
 	}
 
 	numFunctional, numDysfunctional := 0, 0
 	for bridgeLine, bridgeTest := range resp.Bridges {
-		r, exists := rMap[bridgeLine]
+		group, exists := testedLines[bridgeLine]
 		if !exists {
 			log.Printf("Bug: %q not in our resource test pool.", bridgeLine)
 			continue
 		}
 
-		rTest := r.TestResult()
-		if bridgeTest.LastTested != nil {
-			rTest.LastTested = *bridgeTest.LastTested
+		for _, line := range group {
+			setBridgestrapResult(rMap[line].TestResult(), bridgeTest)
+			if bridgeTest.Functional {
+				numFunctional++
+			} else {
+				numDysfunctional++
+			}
 		}
-		rTest.Error = bridgeTest.Error
-		if bridgeTest.Functional {
-			numFunctional++
-			rTest.State = core.StateFunctional
-		} else {
-			numDysfunctional++
-			rTest.State = core.StateDysfunctional
+	}
+	log.Printf("Tested %d resources with %d bridge lines: %d functional and %d dysfunctional.",
+		numFunctional+numDysfunctional, len(resp.Bridges), numFunctional, numDysfunctional)
+	return nil
+}
+
+// reachabilityGroups groups the bridge lines of the resources that share
+// their reachability, so bridgestrap only needs to test one of each group.
+// Unless coalesceReachability is set each resource is in its own group.
+func (p *ResourceTestPool) reachabilityGroups(rMap map[string]core.Resource) map[string][]string {
+	groups := make(map[string][]string)
+	for bridgeLine, r := range rMap {
+		key := bridgeLine
+		if bridge, ok := getBridgeBase(r); ok && p.coalesceReachability && bridge.Fingerprint != "" {
+			key = bridge.Fingerprint + " " + bridge.Address.String()
 		}
+		groups[key] = append(groups[key], bridgeLine)
 	}
-	log.Printf("Tested %d resources: %d functional and %d dysfunctional.",
-		len(resp.Bridges), numFunctional, numDysfunctional)
+	return groups
 }
 
-func (p *ResourceTestPool) testOnbasca(rMap map[string]core.Resource) {
+// testOnbasca sends the given resources to onbasca and sets their bandwidth
+// ratio and speed.
+func (p *ResourceTestPool) testOnbasca(rMap map[string]core.Resource) error {
+	// Don't bother onbasca if we're shutting down.
+	select {
+	case <-p.shutdown:
+		return nil
+	default:
+	}
+
 	req := BridgeTestRequest{}
 	resp := BridgeTestResponse{}
 	for bridgeLine := range rMap {
@@ -213,13 +420,15 @@ func (p *ResourceTestPool) testOnbasca(rMap map[string]core.Resource) {
 	}
 
 	numSpeedAccepted, numSpeedRejected := 0, 0
-	if err := p.onbasca.MakeJsonRequest(req, &resp); err != nil {
+	ctx, cancel := p.shutdownContext()
+	defer cancel()
+	if err := p.onbasca.MakeJsonRequest(ctx, req, &resp); err != nil {
 		log.Printf("Onbasca request failed: %s", err)
-		return
+		return err
 	}
 	if resp.Error != "" {
 		log.Printf("Onbasca test failed: %s", resp.Error)
-		return
+		return errors.New(resp.Error)
 	}
 
 	for bridgeLine, bridgeTest := range resp.Bridges {
@@ -230,29 +439,52 @@ func (p *ResourceTestPool) testOnbasca(rMap map[string]core.Resource) {
 		}
 
 		rTest := r.TestResult()
-		if bridgeTest.Error != "" {
-			//Onbasca sends an error message for bridges that are not available at the moment they are tested
-			// or else have timed out. We count these are having SpeedRejected
-			log.Println("Onbasca gave an error testing the bridge:", bridgeTest.Error)
-			rTest.Ratio = nil
-			rTest.Speed = core.SpeedUntested
+		setOnbascaResult(rTest, bridgeTest, p.bandwidthRatioThreshold)
+		if bridgeTest.Error != "" || rTest.Speed == core.SpeedRejected {
 			numSpeedRejected++
-		} else if bridgeTest.Ratio != nil && *bridgeTest.Ratio == 0 && bridgeTest.Functional {
-			// Since onbasca doesn't test bridges when a request is sent, but rather adds them to a queue to be tested later,
-			// a Functional bridge with Ratio set to 0 indicates an untested bridge that should not be rejected.
-			rTest.Ratio = nil
-			rTest.Speed = core.SpeedUntested
-		} else {
-			if *bridgeTest.Ratio < p.bandwidthRatioThreshold {
-				rTest.Speed = core.SpeedRejected
-				numSpeedRejected++
-			} else {
-				rTest.Speed = core.SpeedAccepted
-				numSpeedAccepted++
-			}
-			rTest.Ratio = bridgeTest.Ratio
+		} else if rTest.Speed == core.SpeedAccepted {
+			numSpeedAccepted++
 		}
 	}
 	log.Printf("Tested %d resources: %d have acceptable bandwidth and %d have unacceptable bandwidth.",
 		len(resp.Bridges), numSpeedAccepted, numSpeedRejected)
+	return nil
+}
+
+// setBridgestrapResult sets the state of a resource from bridgestrap's test
+// result.
+func setBridgestrapResult(rTest *core.ResourceTest, bridgeTest *BridgeTest) {
+	if bridgeTest.LastTested != nil {
+		rTest.LastTested = *bridgeTest.LastTested
+	}
+	rTest.Error = bridgeTest.Error
+	if bridgeTest.Functional {
+		rTest.State = core.StateFunctional
+	} else {
+		rTest.State = core.StateDysfunctional
+	}
+}
+
+// setOnbascaResult sets the bandwidth ratio and speed of a resource from
+// onbasca's test result.
+func setOnbascaResult(rTest *core.ResourceTest, bridgeTest *BridgeTest, bandwidthRatioThreshold float64) {
+	if bridgeTest.Error != "" {
+		//Onbasca sends an error message for bridges that are not available at the moment they are tested
+		// or else have timed out. We count these are having SpeedRejected
+		log.Println("Onbasca gave an error testing the bridge:", bridgeTest.Error)
+		rTest.Ratio = nil
+		rTest.Speed = core.SpeedUntested
+	} else if bridgeTest.Ratio == nil || (*bridgeTest.Ratio == 0 && bridgeTest.Functional) {
+		// Since onbasca doesn't test bridges when a request is sent, but rather adds them to a queue to be tested later,
+		// a Functional bridge with Ratio set to 0 indicates an untested bridge that should not be rejected.
+		rTest.Ratio = nil
+		rTest.Speed = core.SpeedUntested
+	} else {
+		if *bridgeTest.Ratio < bandwidthRatioThreshold {
+			rTest.Speed = core.SpeedRejected
+		} else {
+			rTest.Speed = core.SpeedAccepted
+		}
+		rTest.Ratio = bridgeTest.Ratio
+	}
 }
@@ -5,10 +5,17 @@
 package internal
 
 import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
 // DummyDelivery is a drop-in replacement for our HTTPS interface and
@@ -18,7 +25,7 @@ type DummyBridgeTestDelivery struct{}
 func (d *DummyBridgeTestDelivery) StartStream(*core.ResourceRequest) {}
 func (d *DummyBridgeTestDelivery) StopStream()                       {}
 
-func (d *DummyBridgeTestDelivery) MakeJsonRequest(req interface{}, resp interface{}) error {
+func (d *DummyBridgeTestDelivery) MakeJsonRequest(ctx context.Context, req interface{}, resp interface{}) error {
 	var x float64 = 5.0
 	resp.(*BridgeTestResponse).Bridges = make(map[string]*BridgeTest)
 	for _, bridgeLine := range req.(BridgeTestRequest).BridgeLines {
@@ -27,18 +34,171 @@ func (d *DummyBridgeTestDelivery) MakeJsonRequest(req interface{}, resp interfac
 	return nil
 }
 
+// recordingBridgeTestDelivery behaves like DummyBridgeTestDelivery but keeps
+// the bridge lines it was asked to test.
+type recordingBridgeTestDelivery struct {
+	DummyBridgeTestDelivery
+	sync.Mutex
+	bridgeLines []string
+}
+
+func (d *recordingBridgeTestDelivery) MakeJsonRequest(ctx context.Context, req interface{}, resp interface{}) error {
+	d.Lock()
+	d.bridgeLines = append(d.bridgeLines, req.(BridgeTestRequest).BridgeLines...)
+	d.Unlock()
+	return d.DummyBridgeTestDelivery.MakeJsonRequest(ctx, req, resp)
+}
+
+// waitForTests waits until the delivery was asked to test n bridge lines and
+// the pipeline has no test in flight anymore, which means that the test results
+// were set to the resources.  It returns false if that didn't happen in time.
+func waitForTests(pl *testPipeline, delivery *recordingBridgeTestDelivery, n int) bool {
+	done := func() bool {
+		delivery.Lock()
+		requested := len(delivery.bridgeLines)
+		delivery.Unlock()
+		pl.Lock()
+		defer pl.Unlock()
+		return requested >= n && len(pl.inProgress) == 0
+	}
+	deadline := time.Now().Add(time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// testLineDummy is a resource that is tested with a different line than the
+// one given to users.
+type testLineDummy struct {
+	*core.Dummy
+}
+
+func (d *testLineDummy) TestString() string {
+	return d.String() + " test-only"
+}
+
+func TestTestString(t *testing.T) {
+	p := NewResourceTestPool("", "", "", "", 1, 1, 0, 0, metrics)
+	bridgestrap := &recordingBridgeTestDelivery{}
+	onbasca := &recordingBridgeTestDelivery{}
+	p.bridgestrap = bridgestrap
+	p.onbasca = onbasca
+	defer p.Stop()
+
+	d := &testLineDummy{core.NewDummy(1, 1)}
+	d.TestResult().State = core.StateUntested
+	d.TestResult().Speed = core.SpeedUntested
+	p.GetTestFunc(context.Background())(d)
+	// the resources are tested in the background, wait until both pipelines
+	// are done with it
+	for i := 0; i < 100; i++ {
+		tested := true
+		for _, pl := range []*testPipeline{p.bridgestrapTests, p.onbascaTests} {
+			pl.Lock()
+			tested = tested && len(pl.inProgress) == 0
+			pl.Unlock()
+		}
+		bridgestrap.Lock()
+		tested = tested && len(bridgestrap.bridgeLines) > 0
+		bridgestrap.Unlock()
+		onbasca.Lock()
+		tested = tested && len(onbasca.bridgeLines) > 0
+		onbasca.Unlock()
+		if tested {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for name, delivery := range map[string]*recordingBridgeTestDelivery{"bridgestrap": bridgestrap, "onbasca": onbasca} {
+		delivery.Lock()
+		if len(delivery.bridgeLines) != 1 || delivery.bridgeLines[0] != d.TestString() {
+			t.Errorf("%s got %v instead of the test line %q", name, delivery.bridgeLines, d.TestString())
+		}
+		delivery.Unlock()
+	}
+	if d.TestResult().State != core.StateFunctional || d.TestResult().Speed != core.SpeedAccepted {
+		t.Errorf("the test result was not set to the resource: %+v", d.TestResult())
+	}
+}
+
+func TestCoalesceReachability(t *testing.T) {
+	p := NewResourceTestPool("", "", "", "", 1, 2, time.Hour, 0, metrics)
+	bridgestrap := &recordingBridgeTestDelivery{}
+	onbasca := &recordingBridgeTestDelivery{}
+	p.bridgestrap = bridgestrap
+	p.onbasca = onbasca
+	p.coalesceReachability = true
+	defer p.Stop()
+
+	address := resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	fingerprint := "439B8DF324C99FBEBE49344D61C93244C773E402"
+	vanilla := resources.NewBridge()
+	vanilla.Address = address
+	vanilla.Port = 443
+	vanilla.Fingerprint = fingerprint
+	obfs4 := resources.NewTransport()
+	obfs4.SetType("obfs4")
+	obfs4.Address = address
+	obfs4.Port = 1234
+	obfs4.Fingerprint = fingerprint
+	obfs4.Parameters = map[string]string{"cert": "cert", "iat-mode": "0"}
+
+	f := p.GetTestFunc(context.Background())
+	f(vanilla)
+	f(obfs4)
+	for i := 0; i < 100; i++ {
+		onbasca.Lock()
+		tested := len(onbasca.bridgeLines) == 2
+		onbasca.Unlock()
+		bridgestrap.Lock()
+		tested = tested && len(bridgestrap.bridgeLines) > 0
+		bridgestrap.Unlock()
+		p.bridgestrapTests.Lock()
+		tested = tested && len(p.bridgestrapTests.inProgress) == 0
+		p.bridgestrapTests.Unlock()
+		p.onbascaTests.Lock()
+		tested = tested && len(p.onbascaTests.inProgress) == 0
+		p.onbascaTests.Unlock()
+		if tested {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	bridgestrap.Lock()
+	if len(bridgestrap.bridgeLines) != 1 {
+		t.Errorf("Expected a single reachability test but bridgestrap got %v", bridgestrap.bridgeLines)
+	}
+	bridgestrap.Unlock()
+	onbasca.Lock()
+	if len(onbasca.bridgeLines) != 2 {
+		t.Errorf("Expected a speed test for each transport but onbasca got %v", onbasca.bridgeLines)
+	}
+	onbasca.Unlock()
+	for _, r := range []core.Resource{vanilla, obfs4} {
+		if r.TestResult().State != core.StateFunctional || r.TestResult().Speed != core.SpeedAccepted {
+			t.Errorf("The test result was not set to %s: %+v", r.Type(), r.TestResult())
+		}
+	}
+}
+
 func TestInProgress(t *testing.T) {
 
 	bridgeLine := "dummy"
-	p := NewResourceTestPool("", "", "", "", 1)
+	p := NewResourceTestPool("", "", "", "", 1, 0, 0, 0, metrics)
 
-	if p.alreadyInProgress(bridgeLine) == true {
+	if p.bridgestrapTests.alreadyInProgress(bridgeLine) == true {
 		t.Fatal("bridge line isn't currently being tested")
 	}
 
-	p.inProgress[bridgeLine] = true
+	p.bridgestrapTests.inProgress[bridgeLine] = true
 
-	if p.alreadyInProgress(bridgeLine) != true {
+	if p.bridgestrapTests.alreadyInProgress(bridgeLine) != true {
 		t.Fatal("bridge line is currently being tested")
 	}
 }
@@ -46,16 +206,17 @@ func TestInProgress(t *testing.T) {
 func TestDispatch(t *testing.T) {
 
 	d := core.NewDummy(0, 0)
-	p := NewResourceTestPool("", "", "", "", 1)
+	d.TestResult().State = core.StateUntested
+	d.TestResult().Speed = core.SpeedUntested
+	// Set flush timeout to a nanosecond, so it triggers practically instantly.
+	p := NewResourceTestPool("", "", "", "", 1, 0, time.Nanosecond, 0, metrics)
 	p.bridgestrap = &DummyBridgeTestDelivery{}
 	p.onbasca = &DummyBridgeTestDelivery{}
-	// Set flush timeout to a nanosecond, so it triggers practically instantly.
-	p.flushTimeout = time.Nanosecond
 	defer p.Stop()
 
+	// The second submission is dropped if the first one is still being
+	// tested.
 	p.pending <- d
-	d.TestResult().State = core.StateUntested
-	d.TestResult().Speed = core.SpeedUntested
 	p.pending <- d
 	time.Sleep(10 * time.Millisecond)
 
@@ -66,12 +227,12 @@ func TestDispatch(t *testing.T) {
 
 func TestTestFunc(t *testing.T) {
 
-	p := NewResourceTestPool("", "", "", "", 1)
+	p := NewResourceTestPool("", "", "", "", 1, 0, 0, 0, metrics)
 	p.bridgestrap = &DummyBridgeTestDelivery{}
 	p.onbasca = &DummyBridgeTestDelivery{}
 	defer p.Stop()
 
-	f := p.GetTestFunc()
+	f := p.GetTestFunc(context.Background())
 	dummies := [25]*core.Dummy{}
 	for i := 0; i < len(dummies); i++ {
 		k := core.Hashkey(i)
@@ -92,3 +253,234 @@ func TestTestFunc(t *testing.T) {
 		}
 	}
 }
+
+func TestDispatchBatchSize(t *testing.T) {
+
+	p := NewResourceTestPool("", "", "", "", 1, 3, time.Hour, 0, metrics)
+	bridgestrap := &recordingBridgeTestDelivery{}
+	p.bridgestrap = bridgestrap
+	p.onbasca = &DummyBridgeTestDelivery{}
+	defer p.Stop()
+
+	dummies := [3]*core.Dummy{}
+	for i := 0; i < len(dummies); i++ {
+		k := core.Hashkey(i)
+		dummies[i] = core.NewDummy(k, k)
+		p.pending <- dummies[i]
+	}
+
+	// The flush timeout is an hour, so the resources can only be tested
+	// because the pool reached its batch size.
+	if !waitForTests(p.bridgestrapTests, bridgestrap, len(dummies)) {
+		t.Fatal("resources were not tested")
+	}
+	for i := 0; i < len(dummies); i++ {
+		if dummies[i].TestResult().State != core.StateFunctional {
+			t.Fatal("resource should have been tested", dummies[i].TestResult().State)
+		}
+	}
+}
+
+// HangingBridgeTestDelivery is a testing service that never answers until it's
+// released or the request is cancelled.
+type HangingBridgeTestDelivery struct {
+	release chan struct{}
+}
+
+func (d *HangingBridgeTestDelivery) StartStream(*core.ResourceRequest) {}
+func (d *HangingBridgeTestDelivery) StopStream()                       {}
+
+func (d *HangingBridgeTestDelivery) MakeJsonRequest(ctx context.Context, req interface{}, resp interface{}) error {
+	select {
+	case <-d.release:
+		return errors.New("released")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestStopCancelsTestRequests(t *testing.T) {
+	p := &ResourceTestPool{shutdown: make(chan bool)}
+	p.bridgestrap = &HangingBridgeTestDelivery{release: make(chan struct{})}
+
+	done := make(chan error)
+	go func() {
+		done <- p.testBridgestrap(map[string]core.Resource{"dummy": core.NewDummy(1, 1)})
+	}()
+	p.Stop()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Expected the request to be cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The request to bridgestrap was not cancelled when the pool stopped")
+	}
+}
+
+func TestHangingOnbasca(t *testing.T) {
+
+	onbasca := &HangingBridgeTestDelivery{release: make(chan struct{})}
+	defer close(onbasca.release)
+
+	p := NewResourceTestPool("", "", "", "", 1, 3, time.Hour, 0, metrics)
+	bridgestrap := &recordingBridgeTestDelivery{}
+	p.bridgestrap = bridgestrap
+	p.onbasca = onbasca
+	defer p.Stop()
+
+	f := p.GetTestFunc(context.Background())
+	dummies := [6]*core.Dummy{}
+	for i := 0; i < len(dummies); i++ {
+		k := core.Hashkey(i)
+		dummies[i] = core.NewDummy(k, k)
+		dummies[i].TestResult().State = core.StateUntested
+		dummies[i].TestResult().Speed = core.SpeedUntested
+		f(dummies[i])
+	}
+
+	// Bridgestrap results land even though onbasca never answers.
+	if !waitForTests(p.bridgestrapTests, bridgestrap, len(dummies)) {
+		t.Fatal("resources were not tested by bridgestrap")
+	}
+	for i := 0; i < len(dummies); i++ {
+		if dummies[i].TestResult().State != core.StateFunctional {
+			t.Fatal("resource state was not set", dummies[i].TestResult().State)
+		}
+		if dummies[i].TestResult().Speed != core.SpeedUntested {
+			t.Fatal("resource speed should not be set", dummies[i].TestResult().Speed)
+		}
+	}
+}
+
+// FlakyBridgeTestDelivery is a testing service that fails a number of times
+// before answering like DummyBridgeTestDelivery.
+type FlakyBridgeTestDelivery struct {
+	DummyBridgeTestDelivery
+	failures int32
+	requests int32
+}
+
+func (d *FlakyBridgeTestDelivery) MakeJsonRequest(ctx context.Context, req interface{}, resp interface{}) error {
+	if atomic.AddInt32(&d.requests, 1) <= d.failures {
+		return errors.New("bridgestrap is unreachable")
+	}
+	return d.DummyBridgeTestDelivery.MakeJsonRequest(ctx, req, resp)
+}
+
+func TestBridgestrapBackoff(t *testing.T) {
+
+	oldDelay := testRetryDelay
+	testRetryDelay = time.Millisecond
+	defer func() { testRetryDelay = oldDelay }()
+
+	failuresBefore := testutil.ToFloat64(metrics.BridgestrapFailures)
+	bridgestrap := &FlakyBridgeTestDelivery{failures: 2}
+	p := NewResourceTestPool("", "", "", "", 1, 1, time.Hour, 0, metrics)
+	p.bridgestrap = bridgestrap
+	p.onbasca = &DummyBridgeTestDelivery{}
+	defer p.Stop()
+
+	d := core.NewDummy(0, 0)
+	d.TestResult().State = core.StateUntested
+	p.GetTestFunc(context.Background())(d)
+
+	// The resource is in progress until its test result is set, so once the
+	// third request is done we can read the result.
+	done := func() bool {
+		if atomic.LoadInt32(&bridgestrap.requests) < 3 {
+			return false
+		}
+		p.bridgestrapTests.Lock()
+		defer p.bridgestrapTests.Unlock()
+		return len(p.bridgestrapTests.inProgress) == 0
+	}
+	deadline := time.Now().Add(time.Second)
+	for !done() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !done() {
+		t.Fatal("resource was not tested after bridgestrap recovered")
+	}
+	if d.TestResult().State != core.StateFunctional {
+		t.Fatal("resource was not tested after bridgestrap recovered", d.TestResult().State)
+	}
+	if requests := atomic.LoadInt32(&bridgestrap.requests); requests != 3 {
+		t.Errorf("expected 3 bridgestrap requests but got %d", requests)
+	}
+	if failures := testutil.ToFloat64(metrics.BridgestrapFailures) - failuresBefore; failures != 2 {
+		t.Errorf("expected 2 bridgestrap failures but got %f", failures)
+	}
+}
+
+func TestMinRetestInterval(t *testing.T) {
+
+	bridgestrap := &FlakyBridgeTestDelivery{}
+	p := NewResourceTestPool("", "", "", "", 1, 1, time.Hour, time.Hour, metrics)
+	p.bridgestrap = bridgestrap
+	p.onbasca = &DummyBridgeTestDelivery{}
+	defer p.Stop()
+
+	// The bridge is dysfunctional, so it would be tested each time it's added
+	// without a minimum retest interval.
+	d := core.NewDummy(0, 0)
+	d.TestResult().State = core.StateDysfunctional
+	f := p.GetTestFunc(context.Background())
+	for i := 0; i < 5; i++ {
+		f(d)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if requests := atomic.LoadInt32(&bridgestrap.requests); requests != 1 {
+		t.Fatalf("expected 1 bridgestrap request but got %d", requests)
+	}
+
+	// Once the interval is over the bridge is tested again.
+	d.TestResult().LastScheduled = time.Now().Add(-2 * time.Hour)
+	f(d)
+	time.Sleep(5 * time.Millisecond)
+	if requests := atomic.LoadInt32(&bridgestrap.requests); requests != 2 {
+		t.Errorf("expected 2 bridgestrap requests but got %d", requests)
+	}
+}
+
+func TestDroppedTestNotScheduled(t *testing.T) {
+
+	// Nothing reads the pending resources, so they can't be queued.
+	p := &ResourceTestPool{
+		minRetestInterval: time.Hour,
+		pending:           make(chan core.Resource),
+		shutdown:          make(chan bool),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	d := core.NewDummy(0, 0)
+	p.GetTestFunc(ctx)(d)
+	if !d.TestResult().LastScheduled.IsZero() {
+		t.Errorf("the dropped resource was marked as scheduled at %s", d.TestResult().LastScheduled)
+	}
+}
+
+func TestConcurrentTestScheduledOnce(t *testing.T) {
+
+	p := &ResourceTestPool{
+		minRetestInterval: time.Hour,
+		pending:           make(chan core.Resource, 10),
+		shutdown:          make(chan bool),
+	}
+	f := p.GetTestFunc(context.Background())
+
+	d := core.NewDummy(0, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f(d)
+		}()
+	}
+	wg.Wait()
+	if len(p.pending) != 1 {
+		t.Errorf("expected the resource to be queued once but it was queued %d times", len(p.pending))
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// selfTestTimeout is the maximum time we wait for each testing service to
+// answer a self-test request.
+var selfTestTimeout = 10 * time.Second
+
+// selfTestResult represents the outcome of a self-test request to one of our
+// testing services.
+type selfTestResult struct {
+	Service       string  `json:"service"`
+	Endpoint      string  `json:"endpoint"`
+	Reachable     bool    `json:"reachable"`
+	Authenticated bool    `json:"authenticated"`
+	StatusCode    int     `json:"status_code,omitempty"`
+	LatencyMs     float64 `json:"latency_ms"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// selfTest sends an empty test request to bridgestrap and onbasca and reports
+// if they can be reached and accept our tokens.
+func (b *BackendContext) selfTest() []selfTestResult {
+	return []selfTestResult{
+		selfTestService("bridgestrap", b.Config.Backend.BridgestrapEndpoint, b.Config.Backend.BridgestrapToken),
+		selfTestService("onbasca", b.Config.Backend.OnbascaEndpoint, b.Config.Backend.OnbascaToken),
+	}
+}
+
+func selfTestService(service, endpoint, token string) selfTestResult {
+	result := selfTestResult{Service: service, Endpoint: endpoint}
+	if endpoint == "" {
+		result.Error = "no endpoint configured"
+		return result
+	}
+
+	encoded, err := json.Marshal(BridgeTestRequest{BridgeLines: []string{}})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req, err := http.NewRequest("GET", endpoint, bytes.NewBuffer(encoded))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Token", token)
+	}
+
+	client := &http.Client{Timeout: selfTestTimeout}
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+
+	// The service may not like our empty request, but any answer other than
+	// an authentication error means that it accepted our token.
+	result.Reachable = true
+	result.StatusCode = resp.StatusCode
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		result.Error = fmt.Sprintf("token rejected with HTTP status code %d", resp.StatusCode)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		result.Authenticated = true
+		result.Error = fmt.Sprintf("got HTTP status code %d", resp.StatusCode)
+	default:
+		result.Authenticated = true
+	}
+	return result
+}
+
+// logSelfTest runs the self-test and logs its results.
+func (b *BackendContext) logSelfTest() {
+	for _, result := range b.selfTest() {
+		if result.Reachable && result.Authenticated && result.Error == "" {
+			log.Printf("Self-test: %s at %s is reachable (%.1f ms).", result.Service, result.Endpoint, result.LatencyMs)
+		} else {
+			log.Printf("Self-test: %s at %s failed: %s", result.Service, result.Endpoint, result.Error)
+		}
+	}
+}
+
+// selfTestHandler handles admin requests to check that bridgestrap and
+// onbasca can be reached.
+func (b *BackendContext) selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.isAdmin(w, r) {
+		return
+	}
+
+	results := b.selfTest()
+	jsonBlurb, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, "error while turning self-test results into JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, string(jsonBlurb))
+}
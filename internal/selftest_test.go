@@ -0,0 +1,79 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSelfTestHandler(t *testing.T) {
+
+	// bridgestrap accepts our token and onbasca rejects it.
+	bridgestrap := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer bridgestrap-token" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"bridge_results": {}}`))
+	}))
+	defer bridgestrap.Close()
+	onbasca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+	}))
+	defer onbasca.Close()
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.AdminTokens = map[string]string{"admin": "admin"}
+	b.Config.Backend.BridgestrapEndpoint = bridgestrap.URL
+	b.Config.Backend.BridgestrapToken = "bridgestrap-token"
+	b.Config.Backend.OnbascaEndpoint = onbasca.URL
+	b.Config.Backend.OnbascaToken = "onbasca-token"
+
+	selfTest := func() map[string]selfTestResult {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/selftest", nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		b.selfTestHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+		}
+
+		var results []selfTestResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		resultMap := make(map[string]selfTestResult)
+		for _, result := range results {
+			resultMap[result.Service] = result
+		}
+		return resultMap
+	}
+
+	results := selfTest()
+	if r := results["bridgestrap"]; !r.Reachable || !r.Authenticated || r.Error != "" || r.LatencyMs <= 0 {
+		t.Errorf("unexpected bridgestrap result: %+v", r)
+	}
+	if r := results["onbasca"]; !r.Reachable || r.Authenticated || r.Error == "" {
+		t.Errorf("unexpected onbasca result: %+v", r)
+	}
+
+	// An unreachable service.
+	onbasca.Close()
+	if r := selfTest()["onbasca"]; r.Reachable || r.Authenticated || r.Error == "" {
+		t.Errorf("unexpected result for unreachable onbasca: %+v", r)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/selftest", nil)
+	req.Header.Set("Authorization", "Bearer invalid")
+	b.selfTestHandler(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected HTTP return code 401 but got %d", rr.Code)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"log"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// snapshotName is the name of the snapshot file in the storage dir, without
+// its extension.
+const snapshotName = "snapshot"
+
+// testFuncSetter is implemented by the resources that we test ourselves.
+type testFuncSetter interface {
+	SetTestFunc(resources.TestFunc)
+}
+
+// writeSnapshot writes all the resources of the collection, with their test
+// results, to the snapshot in the given directory.
+func writeSnapshot(dir string, rcol *core.BackendResources) error {
+	snapshot := make(map[string][]core.Resource)
+	for rType, rg := range rcol.Collection {
+		snapshot[rType] = rg.GetAll()
+	}
+	return pjson.New(snapshotName, dir).Save(snapshot)
+}
+
+// loadSnapshot adds the resources of the snapshot in the given directory to
+// the collection, keeping their test results.  The resources get the given
+// test function, so they are tested again once their test results expire.  It
+// returns the number of loaded resources.
+func loadSnapshot(dir string, rcol *core.BackendResources, testFunc resources.TestFunc) (int, error) {
+	var snapshot map[string][]json.RawMessage
+	if err := pjson.New(snapshotName, dir).Load(&snapshot); err != nil {
+		return 0, err
+	}
+
+	loaded := 0
+	for rType, rawResources := range snapshot {
+		if _, exists := rcol.Collection[rType]; !exists {
+			log.Printf("Ignoring the %s resources of the snapshot, they are not in our collection.", rType)
+			continue
+		}
+		rs, err := unmarshalResources(rawResources, true)
+		if err != nil {
+			log.Printf("Ignoring the %s resources of the snapshot: %s", rType, err)
+			continue
+		}
+		for _, r := range rs {
+			if setter, ok := r.(testFuncSetter); ok && testFunc != nil {
+				setter.SetTestFunc(testFunc)
+			}
+			rcol.Add(r)
+			loaded++
+		}
+	}
+	return loaded, nil
+}
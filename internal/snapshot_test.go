@@ -0,0 +1,102 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	newCollection := func() *core.BackendResources {
+		return core.NewBackendResources(&core.CollectionConfig{
+			Types: []core.TypeConfig{
+				{Type: "obfs4", Proportions: map[string]int{"https": 1}},
+				{Type: "vanilla", Unpartitioned: true},
+			},
+		})
+	}
+
+	ratio := 1.5
+	lastTested := time.Now().UTC().Truncate(time.Second)
+	rcol := newCollection()
+	for port, state := range map[uint16]int{1: core.StateFunctional, 2: core.StateDysfunctional} {
+		r := resources.NewTransport()
+		r.SetType("obfs4")
+		r.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+		r.Port = port
+		r.Fingerprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+		r.Distribution = "https"
+		*r.TestResult() = core.ResourceTest{State: state, Speed: core.SpeedAccepted, Ratio: &ratio, LastTested: lastTested}
+		rcol.Add(r)
+	}
+	bridge := resources.NewBridge()
+	bridge.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.5")}}
+	bridge.Port = 443
+	bridge.Fingerprint = "89ABCDEF0123456789ABCDEF0123456789ABCDEF"
+	bridge.TestResult().State = core.StateFunctional
+	rcol.Add(bridge)
+
+	if err := writeSnapshot(dir, rcol); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart with an empty collection.
+	restored := newCollection()
+	tested := make(chan core.Resource, 3)
+	loaded, err := loadSnapshot(dir, restored, func(r core.Resource) { tested <- r })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 3 {
+		t.Fatalf("expected 3 resources from the snapshot but got %d", loaded)
+	}
+
+	for rType, rg := range rcol.Collection {
+		expected := make(map[core.Hashkey]core.Resource)
+		for _, r := range rg.GetAll() {
+			expected[r.Uid()] = r
+		}
+		got := restored.Collection[rType].GetAll()
+		if len(got) != len(expected) {
+			t.Errorf("expected %d %s resources but got %d", len(expected), rType, len(got))
+		}
+		for _, r := range got {
+			old, ok := expected[r.Uid()]
+			if !ok {
+				t.Errorf("unexpected %s resource %s", rType, r)
+				continue
+			}
+			if r.Oid() != old.Oid() {
+				t.Errorf("resource %s was not restored as it was: %s", old, r)
+			}
+			oldTest, test := old.TestResult(), r.TestResult()
+			if test.State != oldTest.State || test.Speed != oldTest.Speed || !test.LastTested.Equal(oldTest.LastTested) {
+				t.Errorf("test result of %s was not restored: %+v instead of %+v", r, test, oldTest)
+			}
+			if (oldTest.Ratio == nil) != (test.Ratio == nil) || (test.Ratio != nil && *test.Ratio != *oldTest.Ratio) {
+				t.Errorf("bandwidth ratio of %s was not restored", r)
+			}
+		}
+	}
+	if n := len(restored.Get("https", "obfs4").Working); n != 2 {
+		t.Errorf("expected the obfs4 resources to be back in the https partition but it has %d", n)
+	}
+
+	// Resources that didn't pass their test recently are tested again.
+	select {
+	case r := <-tested:
+		if r.TestResult().State == core.StateFunctional && r.Type() == "obfs4" {
+			t.Errorf("resource %s that passed its test was tested again", r)
+		}
+	case <-time.After(time.Second):
+		t.Error("the resources that failed their test were not tested again")
+	}
+}
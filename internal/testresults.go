@@ -0,0 +1,206 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+// externalTestResults holds the bridgestrap and onbasca test results posted by
+// an external testing pipeline.  Both map bridge lines to their test result,
+// like the responses of bridgestrap and onbasca.
+type externalTestResults struct {
+	Bridgestrap map[string]*BridgeTest `json:"bridgestrap"`
+	Onbasca     map[string]*BridgeTest `json:"onbasca"`
+}
+
+// testResultsHandler sets the test results of our resources from the results
+// posted by an external testing pipeline, and informs the distributors about
+// the updated resources.  It's meant for deployments that disable our own
+// testing with disable_internal_testing.
+func (b *BackendContext) testResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.isAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if b.Config.Backend.ReadOnlyReplica {
+		http.Error(w, "read-only replica", http.StatusForbidden)
+		return
+	}
+
+	var results externalTestResults
+	if err := json.NewDecoder(r.Body).Decode(&results); err != nil {
+		logRequest(r, "Failed to decode test results: %s", err)
+		http.Error(w, "invalid test results", http.StatusBadRequest)
+		return
+	}
+
+	rMap := make(map[string]core.Resource)
+	for _, hashring := range b.Resources.Collection {
+		for _, resource := range hashring.GetAll() {
+			rMap[resource.TestString()] = resource
+		}
+	}
+
+	updated := make(map[string]core.Resource)
+	for bridgeLine, bridgeTest := range results.Bridgestrap {
+		resource, exists := rMap[bridgeLine]
+		if !exists || bridgeTest == nil {
+			continue
+		}
+		setBridgestrapResult(resource.TestResult(), bridgeTest)
+		updated[bridgeLine] = resource
+	}
+	for bridgeLine, bridgeTest := range results.Onbasca {
+		resource, exists := rMap[bridgeLine]
+		if !exists || bridgeTest == nil {
+			continue
+		}
+		setOnbascaResult(resource.TestResult(), bridgeTest, b.Config.Backend.BandwidthRatioThreshold)
+		updated[bridgeLine] = resource
+	}
+	for _, resource := range updated {
+		b.Resources.PropagateTestResult(resource)
+	}
+	logRequest(r, "Set external test results for %d resources.", len(updated))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "{\"updated_resources\": %d}\n", len(updated))
+}
+
+// bridgeResult is the test result of a bridge posted by an external testing
+// pipeline.  It applies to all the transports of the bridge.
+type bridgeResult struct {
+	Functional *bool      `json:"functional"`
+	Ratio      *float64   `json:"ratio"`
+	LastTested *time.Time `json:"last_tested"`
+}
+
+// bridgeResultsResponse is the response of the bridge results endpoint.
+type bridgeResultsResponse struct {
+	UpdatedResources    int      `json:"updated_resources"`
+	UnknownFingerprints []string `json:"unknown_fingerprints"`
+}
+
+// validateBridgeResults returns an error if any of the given results is not
+// valid.
+func validateBridgeResults(results map[string]*bridgeResult) error {
+	for fingerprint, result := range results {
+		if raw, err := hex.DecodeString(fingerprint); err != nil || len(raw) != 20 {
+			return fmt.Errorf("invalid fingerprint %q", fingerprint)
+		}
+		if result == nil || result.Functional == nil {
+			return fmt.Errorf("missing functional for %s", fingerprint)
+		}
+		if result.Ratio != nil && *result.Ratio < 0 {
+			return fmt.Errorf("negative ratio for %s", fingerprint)
+		}
+	}
+	return nil
+}
+
+// bridgeResultsHandler sets the test results of the bridges posted by an
+// external testing pipeline, mapped by their fingerprint, and informs the
+// distributors about the updated resources.
+func (b *BackendContext) bridgeResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.isAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if b.Config.Backend.ReadOnlyReplica {
+		http.Error(w, "read-only replica", http.StatusForbidden)
+		return
+	}
+
+	var results map[string]*bridgeResult
+	if err := json.NewDecoder(r.Body).Decode(&results); err != nil {
+		logRequest(r, "Failed to decode bridge results: %s", err)
+		http.Error(w, "invalid bridge results", http.StatusBadRequest)
+		return
+	}
+	normalized := make(map[string]*bridgeResult)
+	for fingerprint, result := range results {
+		normalized[strings.ToUpper(fingerprint)] = result
+	}
+	if err := validateBridgeResults(normalized); err != nil {
+		logRequest(r, "Invalid bridge results: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	found := make(map[string]bool)
+	var updated []core.Resource
+	for _, hashring := range b.Resources.Collection {
+		for _, resource := range hashring.GetAll() {
+			fingerprint, err := getFingerprint(resource)
+			if err != nil {
+				continue
+			}
+			result, exists := normalized[strings.ToUpper(fingerprint)]
+			if !exists {
+				continue
+			}
+			found[strings.ToUpper(fingerprint)] = true
+			b.setBridgeResult(resource.TestResult(), result)
+			updated = append(updated, resource)
+		}
+	}
+	for _, resource := range updated {
+		b.Resources.PropagateTestResult(resource)
+	}
+
+	response := bridgeResultsResponse{
+		UpdatedResources:    len(updated),
+		UnknownFingerprints: []string{},
+	}
+	for fingerprint := range normalized {
+		if !found[fingerprint] {
+			response.UnknownFingerprints = append(response.UnknownFingerprints, fingerprint)
+		}
+	}
+	sort.Strings(response.UnknownFingerprints)
+	logRequest(r, "Set bridge results for %d resources, %d unknown fingerprints.",
+		response.UpdatedResources, len(response.UnknownFingerprints))
+
+	jsonBlurb, err := json.Marshal(response)
+	if err != nil {
+		logRequest(r, "Bug: Failed to marshal bridge results response: %s", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, string(jsonBlurb))
+}
+
+// setBridgeResult sets the state, the bandwidth ratio and speed of a resource
+// from an external test result, like the results of bridgestrap and onbasca.
+func (b *BackendContext) setBridgeResult(rTest *core.ResourceTest, result *bridgeResult) {
+	lastTested := time.Now().UTC()
+	if result.LastTested != nil {
+		lastTested = *result.LastTested
+	}
+	bridgeTest := &BridgeTest{
+		Functional: *result.Functional,
+		LastTested: &lastTested,
+		Ratio:      result.Ratio,
+	}
+	setBridgestrapResult(rTest, bridgeTest)
+	setOnbascaResult(rTest, bridgeTest, b.Config.Backend.BandwidthRatioThreshold)
+}
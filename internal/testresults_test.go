@@ -0,0 +1,163 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestTestResultsHandler(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.DisableInternalTesting = true
+	b.Config.Backend.BandwidthRatioThreshold = 0.75
+	b.Config.Backend.AdminTokens = map[string]string{"admin": "secret"}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Proportions: map[string]int{"https": 1}}},
+	})
+	diffs := make(chan *core.ResourceDiff, 10)
+	b.Resources.RegisterChan(&core.ResourceRequest{RequestOrigin: "https", ResourceTypes: []string{"obfs4"}}, diffs)
+
+	r := resources.NewTransport()
+	r.SetType("obfs4")
+	r.Fingerprint = "ABCDEF1234567890"
+	r.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	r.Port = 1234
+	b.Resources.Add(r)
+	<-diffs
+	if r.TestResult().State != core.StateUntested {
+		t.Fatalf("resource was tested without a test pool: %d", r.TestResult().State)
+	}
+
+	body := `{"bridgestrap": {"` + r.String() + `": {"functional": true, "last_tested": "2024-01-02T03:04:05Z"}},
+		"onbasca": {"` + r.String() + `": {"functional": true, "ratio": 0.5}, "unknown": {"functional": true}}}`
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/test-results", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	b.testResultsHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), `"updated_resources": 1`) {
+		t.Errorf("unexpected response %q", rr.Body.String())
+	}
+
+	rTest := r.TestResult()
+	if rTest.State != core.StateFunctional {
+		t.Errorf("expected the resource to be functional but got %d", rTest.State)
+	}
+	if rTest.LastTested.Year() != 2024 {
+		t.Errorf("unexpected last tested time %s", rTest.LastTested)
+	}
+	if rTest.Speed != core.SpeedRejected || rTest.Ratio == nil || *rTest.Ratio != 0.5 {
+		t.Errorf("unexpected bandwidth result %d %v", rTest.Speed, rTest.Ratio)
+	}
+	// The rejected bandwidth makes the resource gone for the distributors.
+	if len(diffs) != 1 {
+		t.Fatalf("expected 1 diff for the updated resource but got %d", len(diffs))
+	}
+	if diff := <-diffs; len(diff.Gone["obfs4"]) != 1 {
+		t.Errorf("expected the rejected resource to be gone: %+v", diff)
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/test-results", strings.NewReader("not json"))
+	req.Header.Set("Authorization", "Bearer secret")
+	b.testResultsHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected HTTP return code 400 but got %d", rr.Code)
+	}
+}
+
+func TestBridgeResultsHandler(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.BandwidthRatioThreshold = 0.75
+	b.Config.Backend.AdminTokens = map[string]string{"admin": "secret"}
+	b.Resources = *core.NewBackendResources(&core.CollectionConfig{
+		Types: []core.TypeConfig{{Type: "obfs4", Proportions: map[string]int{"https": 1}}},
+	})
+	diffs := make(chan *core.ResourceDiff, 10)
+	b.Resources.RegisterChan(&core.ResourceRequest{RequestOrigin: "https", ResourceTypes: []string{"obfs4"}}, diffs)
+
+	newTransport := func(fingerprint string, port uint16) *resources.Transport {
+		r := resources.NewTransport()
+		r.SetType("obfs4")
+		r.Fingerprint = fingerprint
+		r.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+		r.Port = port
+		b.Resources.Add(r)
+		<-diffs
+		return r
+	}
+	functional := newTransport("1F8A76D9581D72B9B9D84411463445052A78AB71", 1234)
+	dysfunctional := newTransport("ABCDEF1234567890ABCDEF1234567890ABCDEF12", 4321)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/bridge-results", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		b.bridgeResultsHandler(rr, req)
+		return rr
+	}
+
+	rr := post(`{
+		"1F8A76D9581D72B9B9D84411463445052A78AB71": {"functional": true, "ratio": 1.5, "last_tested": "2024-01-02T03:04:05Z"},
+		"abcdef1234567890abcdef1234567890abcdef12": {"functional": false},
+		"0000000000000000000000000000000000000000": {"functional": true}
+	}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+	var response bridgeResultsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	if response.UpdatedResources != 2 {
+		t.Errorf("expected 2 updated resources but got %d", response.UpdatedResources)
+	}
+	if len(response.UnknownFingerprints) != 1 || response.UnknownFingerprints[0] != "0000000000000000000000000000000000000000" {
+		t.Errorf("unexpected unknown fingerprints %v", response.UnknownFingerprints)
+	}
+
+	rTest := functional.TestResult()
+	if rTest.State != core.StateFunctional || rTest.Speed != core.SpeedAccepted || rTest.LastTested.Year() != 2024 {
+		t.Errorf("unexpected test result for the functional bridge: %+v", rTest)
+	}
+	if dysfunctional.TestResult().State != core.StateDysfunctional {
+		t.Errorf("unexpected state for the dysfunctional bridge: %d", dysfunctional.TestResult().State)
+	}
+
+	changed, gone := 0, 0
+	for len(diffs) > 0 {
+		diff := <-diffs
+		changed += len(diff.Changed["obfs4"])
+		gone += len(diff.Gone["obfs4"])
+	}
+	if changed != 1 || gone != 1 {
+		t.Errorf("expected a changed and a gone resource but got %d and %d", changed, gone)
+	}
+
+	for _, body := range []string{
+		`{"1234": {"functional": true}}`,
+		`{"1F8A76D9581D72B9B9D84411463445052A78AB71": {"ratio": 1}}`,
+		`{"1F8A76D9581D72B9B9D84411463445052A78AB71": {"functional": true, "ratio": -1}}`,
+		`not json`,
+	} {
+		if rr := post(body); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected HTTP return code 400 for %s but got %d", body, rr.Code)
+		}
+	}
+}
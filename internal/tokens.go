@@ -0,0 +1,126 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// hashedTokenPrefix marks the saved tokens that are the hex-encoded SHA-256
+// digest of the token instead of the token itself.
+const hashedTokenPrefix = "sha256:"
+
+// tokensFilePollInterval determines how often we check the tokens file for
+// changes.
+var tokensFilePollInterval = 10 * time.Second
+
+// tokensFile represents the content of the tokens file.  The tokens it holds
+// replace the ones in the main configuration.
+type tokensFile struct {
+	ApiTokens   map[string]string `json:"api_tokens"`
+	AdminTokens map[string]string `json:"admin_tokens"`
+}
+
+// tokenName returns the name of the given token if it's one of the saved
+// tokens.
+func tokenName(savedTokens map[string]string, givenToken string) (string, bool) {
+	for name, savedToken := range savedTokens {
+		if tokenMatches(savedToken, givenToken) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// tokenMatches compares in constant time the given token with the saved one,
+// which can be either in plaintext or hashed with hashedTokenPrefix.
+func tokenMatches(savedToken, givenToken string) bool {
+	givenDigest := sha256.Sum256([]byte(givenToken))
+
+	var savedDigest []byte
+	if strings.HasPrefix(savedToken, hashedTokenPrefix) {
+		var err error
+		savedDigest, err = hex.DecodeString(strings.TrimPrefix(savedToken, hashedTokenPrefix))
+		if err != nil || len(savedDigest) != sha256.Size {
+			log.Printf("Ignoring malformed hashed token.")
+			return false
+		}
+	} else {
+		// We hash plaintext tokens too, so the comparison doesn't leak their
+		// length.
+		digest := sha256.Sum256([]byte(savedToken))
+		savedDigest = digest[:]
+	}
+	return subtle.ConstantTimeCompare(givenDigest[:], savedDigest) == 1
+}
+
+// tokens returns the distributor and admin tokens currently accepted.
+func (b *BackendContext) tokens() (apiTokens, adminTokens map[string]string) {
+	b.tokensLock.RLock()
+	defer b.tokensLock.RUnlock()
+	return b.Config.Backend.ApiTokens, b.Config.Backend.AdminTokens
+}
+
+// loadTokens parses the given content of the tokens file and replaces our
+// tokens with the ones it has.
+func (b *BackendContext) loadTokens(content []byte) error {
+	var tf tokensFile
+	if err := json.Unmarshal(content, &tf); err != nil {
+		return err
+	}
+
+	b.tokensLock.Lock()
+	defer b.tokensLock.Unlock()
+	if tf.ApiTokens != nil {
+		b.Config.Backend.ApiTokens = tf.ApiTokens
+	}
+	if tf.AdminTokens != nil {
+		b.Config.Backend.AdminTokens = tf.AdminTokens
+	}
+	return nil
+}
+
+// watchTokensFile loads the tokens file and reloads it every time it changes,
+// until the given context is cancelled.
+func (b *BackendContext) watchTokensFile(ctx context.Context, filename string) {
+	var loaded []byte
+	reload := func() {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			log.Printf("Failed to read tokens file %s: %s", filename, err)
+			return
+		}
+		if bytes.Equal(content, loaded) {
+			return
+		}
+		if err := b.loadTokens(content); err != nil {
+			log.Printf("Failed to load tokens file %s: %s", filename, err)
+			return
+		}
+		loaded = content
+		log.Printf("Loaded API tokens from %s.", filename)
+	}
+
+	reload()
+	ticker := time.NewTicker(tokensFilePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
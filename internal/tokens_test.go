@@ -0,0 +1,118 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokensFileReload(t *testing.T) {
+
+	oldInterval := tokensFilePollInterval
+	tokensFilePollInterval = time.Millisecond
+	defer func() { tokensFilePollInterval = oldInterval }()
+
+	filename := filepath.Join(t.TempDir(), "tokens.json")
+	writeTokens := func(token string) {
+		content := []byte(`{"api_tokens": {"https": "` + token + `"}}`)
+		if err := os.WriteFile(filename, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTokens("old-token")
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.ApiTokens = map[string]string{"https": "config-token"}
+	b.Config.Backend.AdminTokens = map[string]string{"admin": "admin"}
+
+	isAuthenticated := func(token string) bool {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/auth-test", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return b.isAuthenticated(rr, r)
+	}
+	waitFor := func(token string) {
+		deadline := time.Now().Add(time.Second)
+		for !isAuthenticated(token) {
+			if time.Now().After(deadline) {
+				t.Fatalf("token %q was not loaded from the tokens file", token)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.watchTokensFile(ctx, filename)
+
+	waitFor("old-token")
+	if isAuthenticated("config-token") {
+		t.Error("the tokens file should replace the tokens of the config")
+	}
+	if !isAuthenticated("admin") {
+		t.Error("admin tokens missing from the tokens file should be kept")
+	}
+
+	writeTokens("new-token")
+	waitFor("new-token")
+	if isAuthenticated("old-token") {
+		t.Error("rotated token is still accepted")
+	}
+}
+
+func TestTokenMatches(t *testing.T) {
+
+	// echo -n token | sha256sum
+	hashed := hashedTokenPrefix + "3c469e9d6c5875d37a43f353d4f88e61fcf812c66eee3457465a40b0da4153e0"
+
+	for _, test := range []struct {
+		saved, given string
+		matches      bool
+	}{
+		{"token", "token", true},
+		{"token", "tokeN", false},
+		{"token", "token-with-another-length", false},
+		{"token", "", false},
+		{hashed, "token", true},
+		{hashed, "tokeN", false},
+		{hashed, hashed, false},
+		{hashedTokenPrefix + "not-hex", "not-hex", false},
+		{hashedTokenPrefix + "3c469e9d", "token", false},
+	} {
+		if matches := tokenMatches(test.saved, test.given); matches != test.matches {
+			t.Errorf("token %q compared with %q: expected %t but got %t", test.given, test.saved, test.matches, matches)
+		}
+	}
+}
+
+func TestHashedTokenAuthentication(t *testing.T) {
+
+	b := BackendContext{metrics: metrics}
+	b.Config = &Config{}
+	b.Config.Backend.ApiTokens = map[string]string{
+		"https": hashedTokenPrefix + "3c469e9d6c5875d37a43f353d4f88e61fcf812c66eee3457465a40b0da4153e0",
+		"moat":  "plaintext",
+	}
+
+	for token, expected := range map[string]bool{
+		"token":     true,
+		"plaintext": true,
+		"invalid":   false,
+	} {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/auth-test", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		if authenticated := b.isAuthenticated(rr, r); authenticated != expected {
+			t.Errorf("token %q: expected authentication %t but got %t", token, expected, authenticated)
+		}
+	}
+}
@@ -5,8 +5,11 @@
 package core
 
 import (
+	"fmt"
 	"log"
+	"math"
 	"sync"
+	"time"
 )
 
 const (
@@ -23,11 +26,15 @@ const (
 type BackendResources struct {
 	Collection
 
-	// OnlyFunctional resources will be provided to distributors
-	OnlyFunctional bool
+	// decision is set by the kraken while the distributors read
+	// it, so it's accessed with SetDistributionDecision and
+	// GetDistributionDecision, which hold decisionLock.
+	decision     DistributionDecision
+	decisionLock sync.RWMutex
 
-	// UseBandwidthRatio to decide wich bridges to distribute
-	UseBandwidthRatio bool
+	// Untested decides if untested resources are provided to distributors.
+	// It defaults to UntestedAuto, which follows OnlyFunctional.
+	Untested UntestedPolicy
 
 	// The mutex us used to protect the access to EventRecipients.
 	// The hashrings in the Collection have their own mutex and the entries
@@ -37,6 +44,72 @@ type BackendResources struct {
 	// recipient struct that helps us keep track of notifying distributors when
 	// their resources change.
 	EventRecipients map[string]*EventRecipient
+
+	// GoneGracePeriod is how long a resource has to keep failing tests
+	// before we inform distributors that it's gone.  It avoids flapping
+	// bridges from being removed and added again on every test.
+	GoneGracePeriod time.Duration
+	// failingSince maps the unique ID of the resources that are failing
+	// tests to the first time we saw them failing.
+	failingSince     map[Hashkey]time.Time
+	failingSinceLock sync.Mutex
+
+	// expiries maps the resource types to the expiry that overrides the one
+	// of their resources.
+	expiries map[string]time.Duration
+
+	// quotas maps the resource types to the maximum number of working
+	// resources of that type each distributor gets.
+	quotas map[string]map[string]int
+	// quotaViews maps the distributors and resource types with a quota to
+	// the resources they were last given, so updates only tell them about
+	// the resources that enter or leave their quota.
+	quotaViews map[string]map[string]map[Hashkey]Resource
+	quotaLock  sync.Mutex
+
+	// SaveSoon coalesces the saves requested within saveDelay into a single
+	// call to save.  saveTimer is set while a save is pending and pendingSave
+	// tracks it, so Close can wait for it.
+	save        func()
+	saveDelay   time.Duration
+	saveTimer   *time.Timer
+	saveLock    sync.Mutex
+	pendingSave sync.WaitGroup
+}
+
+// defaultSaveDelay is how long SaveSoon waits before saving the collection.
+const defaultSaveDelay = time.Second
+
+// UntestedPolicy decides if untested resources are distributed.
+type UntestedPolicy int
+
+const (
+	// UntestedAuto distributes untested resources unless OnlyFunctional
+	// is set.
+	UntestedAuto UntestedPolicy = iota
+	// UntestedDistribute always distributes untested resources.
+	UntestedDistribute
+	// UntestedHold never distributes untested resources.
+	UntestedHold
+	// UntestedIfPreviouslyGood distributes untested resources only if they
+	// passed a test before, e.g. before the backend restarted.
+	UntestedIfPreviouslyGood
+)
+
+// ParseUntestedPolicy returns the policy of the given name: "auto", "yes",
+// "no" or "previously_good".  An empty name is "auto".
+func ParseUntestedPolicy(name string) (UntestedPolicy, error) {
+	switch name {
+	case "", "auto":
+		return UntestedAuto, nil
+	case "yes":
+		return UntestedDistribute, nil
+	case "no":
+		return UntestedHold, nil
+	case "previously_good":
+		return UntestedIfPreviouslyGood, nil
+	}
+	return UntestedAuto, fmt.Errorf("unknown untested policy %q", name)
 }
 
 // EventRecipient represents the recipient of a resource event, i.e. a
@@ -57,9 +130,57 @@ func NewBackendResources(cfg *CollectionConfig) *BackendResources {
 		}
 	}
 	r.EventRecipients = make(map[string]*EventRecipient)
+	r.GoneGracePeriod = cfg.GoneGracePeriod
+	r.failingSince = make(map[Hashkey]time.Time)
+	r.expiries = make(map[string]time.Duration)
+	r.quotas = make(map[string]map[string]int)
+	r.quotaViews = make(map[string]map[string]map[Hashkey]Resource)
+	for _, rc := range cfg.Types {
+		if rc.Expiry > 0 {
+			r.expiries[rc.Type] = rc.Expiry
+		}
+		if len(rc.Quotas) != 0 {
+			r.quotas[rc.Type] = rc.Quotas
+		}
+	}
+	r.save = r.Collection.Save
+	r.saveDelay = defaultSaveDelay
 	return r
 }
 
+// SaveSoon saves the collection after a short delay.  The calls made while a
+// save is pending don't trigger another save, so bursts of changes are saved
+// only once.
+func (ctx *BackendResources) SaveSoon() {
+	ctx.saveLock.Lock()
+	defer ctx.saveLock.Unlock()
+	if ctx.saveTimer != nil {
+		return
+	}
+
+	ctx.pendingSave.Add(1)
+	ctx.saveTimer = time.AfterFunc(ctx.saveDelay, func() {
+		defer ctx.pendingSave.Done()
+		ctx.saveLock.Lock()
+		ctx.saveTimer = nil
+		ctx.saveLock.Unlock()
+		ctx.save()
+	})
+}
+
+// Close saves the changes pending from SaveSoon and closes the stores of the
+// collection.
+func (ctx *BackendResources) Close() {
+	ctx.saveLock.Lock()
+	if ctx.saveTimer != nil && ctx.saveTimer.Stop() {
+		ctx.saveTimer = nil
+		ctx.pendingSave.Done()
+	}
+	ctx.saveLock.Unlock()
+	ctx.pendingSave.Wait()
+	ctx.Collection.Close()
+}
+
 // Add adds the given resource to the resource collection.  If the resource
 // already exists but has changed (i.e. its unique ID remains the same but its
 // object ID changed), we update the existing resource.
@@ -70,17 +191,101 @@ func (ctx *BackendResources) Add(r1 Resource) {
 	}
 
 	event := hashring.AddOrUpdate(r1)
-	if event != ResourceUnchanged {
+	if ctx.goneGraceElapsed(r1, event) && event != ResourceUnchanged {
 		ctx.propagateUpdate(r1, event)
 	}
 }
 
-// Prune removes expired resources.
+// goneGraceElapsed returns false if the event is a ResourceIsGone for a
+// resource that started failing tests less than GoneGracePeriod ago.  Any
+// other event means the resource is not failing anymore and resets its grace
+// period.
+func (ctx *BackendResources) goneGraceElapsed(r Resource, event int) bool {
+	ctx.failingSinceLock.Lock()
+	defer ctx.failingSinceLock.Unlock()
+
+	if event != ResourceIsGone {
+		delete(ctx.failingSince, r.Uid())
+		return true
+	}
+	if ctx.GoneGracePeriod <= 0 {
+		return true
+	}
+
+	since, exists := ctx.failingSince[r.Uid()]
+	if !exists {
+		since = time.Now()
+		ctx.failingSince[r.Uid()] = since
+	}
+	return time.Since(since) >= ctx.GoneGracePeriod
+}
+
+// PropagateTestResult informs the distributors about a resource whose test
+// result was set outside of the collection.
+func (ctx *BackendResources) PropagateTestResult(r Resource) {
+	ctx.propagateChange(r)
+}
+
+// Update calls f on every resource of the collection, holding the lock of its
+// hashring so f can modify it, and informs the distributors about the
+// resources for which f returned true.  It returns the number of updated
+// resources.
+func (ctx *BackendResources) Update(f func(Resource) bool) int {
+	updated := 0
+	for _, hashring := range ctx.Collection {
+		for _, r := range hashring.Update(f) {
+			ctx.propagateChange(r)
+			updated++
+		}
+	}
+	return updated
+}
+
+// propagateChange informs the distributors about a resource that was modified
+// in place.  Resources failing their tests are reported as gone, once their
+// GoneGracePeriod is over, and the rest as changed.
+func (ctx *BackendResources) propagateChange(r Resource) {
+	event := ResourceChanged
+	if r.TestResult().State == StateDysfunctional || r.TestResult().Speed == SpeedRejected {
+		event = ResourceIsGone
+	}
+	if ctx.goneGraceElapsed(r, event) {
+		ctx.propagateUpdate(r, event)
+	}
+}
+
+// forgetFailing drops the grace period of the given resource.
+func (ctx *BackendResources) forgetFailing(r Resource) {
+	ctx.failingSinceLock.Lock()
+	defer ctx.failingSinceLock.Unlock()
+	delete(ctx.failingSince, r.Uid())
+}
+
+// Remove removes the given resource from the resource collection and informs
+// the distributors that the resource is gone.  If the resource type is not
+// part of the collection or the resource can't be found, an error is returned.
+func (ctx *BackendResources) Remove(r Resource) error {
+	hashring, exists := ctx.Collection[r.Type()]
+	if !exists {
+		return fmt.Errorf("No resource type %s in collection", r.Type())
+	}
+
+	if err := hashring.Remove(r); err != nil {
+		return err
+	}
+	ctx.forgetFailing(r)
+	ctx.propagateUpdate(r, ResourceIsGone)
+	return nil
+}
+
+// Prune removes expired resources.  If the resource type has its own expiry
+// configured, it's used instead of the expiry of the resources.
 func (ctx *BackendResources) Prune(rName string) []Resource {
 
 	hashring := ctx.Collection[rName]
-	prunedResources := hashring.Prune()
+	prunedResources := hashring.PruneWithExpiry(ctx.expiries[rName])
 	for _, resource := range prunedResources {
+		ctx.forgetFailing(resource)
 		ctx.propagateUpdate(resource, ResourceIsGone)
 	}
 	return prunedResources
@@ -93,10 +298,24 @@ func (ctx *BackendResources) propagateUpdate(r Resource, event int) {
 	ctx.RLock()
 	defer ctx.RUnlock()
 
-	if _, exists := ctx.Collection[r.Type()]; !exists {
+	hashring, exists := ctx.Collection[r.Type()]
+	if !exists {
 		return
 	}
+	ctx.sendUpdate(hashring.getPartitionName(r), r, event)
+}
 
+// propagateUpdateTo sends the update about the resource to the given
+// distributor.
+func (ctx *BackendResources) propagateUpdateTo(distName string, r Resource, event int) {
+	ctx.RLock()
+	defer ctx.RUnlock()
+	ctx.sendUpdate(distName, r, event)
+}
+
+// sendUpdate sends the update about the resource to the event channels of the
+// given distributor.  The caller must hold the read lock.
+func (ctx *BackendResources) sendUpdate(distName string, r Resource, event int) {
 	// Prepare the hashring difference that we're about to send.
 	diff := &ResourceDiff{}
 	rm := ResourceMap{r.Type(): []Resource{r}}
@@ -111,7 +330,6 @@ func (ctx *BackendResources) propagateUpdate(r Resource, event int) {
 		return
 	}
 
-	distName := ctx.Collection[r.Type()].getPartitionName(r)
 	eventRecipient, ok := ctx.EventRecipients[distName]
 	if !ok {
 		// no recipients for that resource
@@ -120,12 +338,86 @@ func (ctx *BackendResources) propagateUpdate(r Resource, event int) {
 	if !ctx.EventRecipients[distName].Request.HasResourceType(r.Type()) {
 		return
 	}
+	if _, ok := ctx.quota(distName, r.Type()); ok {
+		diff = ctx.quotaDiff(distName, r, event)
+		if len(diff.New) == 0 && len(diff.Changed) == 0 && len(diff.Gone) == 0 {
+			return
+		}
+	}
 
 	for _, c := range eventRecipient.EventChans {
 		c <- diff
 	}
 }
 
+// Rebalance moves up to the given fraction of the resources of each
+// partitioned type out of the partitions that have more resources than their
+// proportion, into the partition the stencil assigns them.  The distributors
+// are informed that the moved resources are gone from their old partition and
+// new in the new one.  It returns the number of moved resources.
+func (ctx *BackendResources) Rebalance(fraction float64) int {
+	moved := 0
+	for _, rg := range ctx.Collection {
+		p, ok := rg.(*partitionedWithDistributors)
+		if !ok {
+			continue
+		}
+
+		maxMoves := int(math.Ceil(fraction * float64(p.Len())))
+		for _, move := range p.rebalance(maxMoves) {
+			ctx.propagateUpdateTo(move.from, move.resource, ResourceIsGone)
+			ctx.propagateUpdateTo(move.to, move.resource, ResourceIsNew)
+			moved++
+		}
+	}
+	return moved
+}
+
+// Reassign moves the resources with the given relation identifier, like the
+// fingerprint of a bridge, to the partition of the given distributor, or to
+// "none" to stop distributing them.  The reassignment overrides the
+// distribution request of the resources and is kept in the stores, so the
+// resources stay there when they are added again.  The distributors are
+// informed that the moved resources are gone from their old partition and new
+// in the new one.  It returns the number of moved resources, or an error if no
+// resource has the identifier.
+func (ctx *BackendResources) Reassign(identifier string, distName string) (int, error) {
+	found := false
+	for _, rg := range ctx.Collection {
+		if _, ok := rg.(*partitionedWithDistributors); !ok {
+			continue
+		}
+		if len(rg.Filter(func(r Resource) bool { return hasRelationIdentifier(r, identifier) })) != 0 {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("no resource with identifier %q", identifier)
+	}
+
+	moved := 0
+	for _, rg := range ctx.Collection {
+		p, ok := rg.(*partitionedWithDistributors)
+		if !ok {
+			continue
+		}
+		// Resource types that are not handed to the distributor stay
+		// where they are.
+		if _, exists := p.partitions[distName]; !exists {
+			continue
+		}
+
+		for _, move := range p.reassign(identifier, distName) {
+			ctx.propagateUpdateTo(move.from, move.resource, ResourceIsGone)
+			ctx.propagateUpdateTo(move.to, move.resource, ResourceIsNew)
+			moved++
+		}
+	}
+	ctx.SaveSoon()
+	return moved, nil
+}
+
 // RegisterChan registers a channel to be informed about resource updates.
 func (ctx *BackendResources) RegisterChan(req *ResourceRequest, recipient chan *ResourceDiff) {
 	ctx.Lock()
@@ -165,27 +457,162 @@ func (ctx *BackendResources) UnregisterChan(distName string, recipient chan *Res
 	ctx.EventRecipients[distName].EventChans = newSlice
 }
 
+// DistributionDecision holds which resources are provided to distributors and
+// the fractions of resources it was decided from.
+type DistributionDecision struct {
+	// OnlyFunctional resources will be provided to distributors
+	OnlyFunctional bool
+
+	// UseBandwidthRatio to decide wich bridges to distribute
+	UseBandwidthRatio bool
+
+	// FunctionalFraction and AcceptedFraction are the fractions of
+	// resources that are functional and that have an accepted bandwidth
+	// ratio, used to decide OnlyFunctional and UseBandwidthRatio.
+	FunctionalFraction float64
+	AcceptedFraction   float64
+}
+
+// SetDistributionDecision sets which resources are provided to distributors.
+func (ctx *BackendResources) SetDistributionDecision(decision DistributionDecision) {
+	ctx.decisionLock.Lock()
+	defer ctx.decisionLock.Unlock()
+	ctx.decision = decision
+}
+
+// GetDistributionDecision returns which resources are provided to
+// distributors.
+func (ctx *BackendResources) GetDistributionDecision() DistributionDecision {
+	ctx.decisionLock.RLock()
+	defer ctx.decisionLock.RUnlock()
+	return ctx.decision
+}
+
 // Get returns a struct that contains the state of resources
 // distributor.
 func (ctx *BackendResources) Get(distName string, rType string) ResourceState {
+	resourceState := ctx.get(distName, rType)
+	if _, ok := ctx.quota(distName, rType); ok {
+		ctx.quotaLock.Lock()
+		ctx.setQuotaView(distName, rType, resourceState.Working)
+		ctx.quotaLock.Unlock()
+	}
+	return resourceState
+}
+
+func (ctx *BackendResources) get(distName string, rType string) ResourceState {
 	hashring := ctx.GetHashring(distName, rType)
 	if hashring == nil {
 		log.Printf("Failed to get resources for distributor %q", distName)
 		return ResourceState{}
 	}
 
+	decision := ctx.GetDistributionDecision()
 	var resourceState = ResourceState{}
 	for _, resource := range hashring.GetAll() {
 		rTest := resource.TestResult()
-		if (!ctx.OnlyFunctional || rTest.State == StateFunctional) && (!ctx.UseBandwidthRatio || rTest.Speed != SpeedRejected) {
+		if ctx.isDistributable(rTest, decision.OnlyFunctional) && (!decision.UseBandwidthRatio || rTest.Speed != SpeedRejected) {
 			resourceState.Working = append(resourceState.Working, resource)
 		} else {
 			resourceState.Notworking = append(resourceState.Notworking, resource)
 		}
 	}
+
+	// Distributors with a quota get the first working resources in the
+	// hashring, so they keep getting the same ones.
+	if quota, ok := ctx.quota(distName, rType); ok && len(resourceState.Working) > quota {
+		resourceState.Working = resourceState.Working[:quota]
+	}
 	return resourceState
 }
 
+// quota returns the maximum number of working resources of the given type the
+// distributor gets, and false if it has no quota.
+func (ctx *BackendResources) quota(distName string, rType string) (int, bool) {
+	quota, ok := ctx.quotas[rType][distName]
+	return quota, ok && quota >= 0
+}
+
+// setQuotaView records the working resources the distributor was given.  The
+// caller must hold quotaLock.
+func (ctx *BackendResources) setQuotaView(distName string, rType string, working []Resource) {
+	view := make(map[Hashkey]Resource, len(working))
+	for _, r := range working {
+		view[r.Uid()] = r
+	}
+	if _, ok := ctx.quotaViews[distName]; !ok {
+		ctx.quotaViews[distName] = make(map[string]map[Hashkey]Resource)
+	}
+	ctx.quotaViews[distName][rType] = view
+}
+
+// quotaDiff returns the update to send to a distributor with a quota after an
+// event about the given resource.  Adding or removing a resource can move
+// other resources in or out of the quota, so we compare the resources the
+// distributor was last given with the ones it gets now.
+func (ctx *BackendResources) quotaDiff(distName string, r Resource, event int) *ResourceDiff {
+	ctx.quotaLock.Lock()
+	defer ctx.quotaLock.Unlock()
+
+	rType := r.Type()
+	old := ctx.quotaViews[distName][rType]
+	working := ctx.get(distName, rType).Working
+	ctx.setQuotaView(distName, rType, working)
+	current := ctx.quotaViews[distName][rType]
+
+	diff := &ResourceDiff{}
+	for _, resource := range working {
+		if _, ok := old[resource.Uid()]; !ok {
+			diff.New = appendToMap(diff.New, resource)
+		}
+	}
+	for uid, resource := range old {
+		if _, ok := current[uid]; !ok {
+			diff.Gone = appendToMap(diff.Gone, resource)
+		}
+	}
+	_, inOld := old[r.Uid()]
+	_, inCurrent := current[r.Uid()]
+	if event == ResourceChanged && inOld && inCurrent {
+		diff.Changed = appendToMap(diff.Changed, r)
+	}
+	return diff
+}
+
+// appendToMap appends the resource to the list of its type, creating the map
+// if needed.
+func appendToMap(m ResourceMap, r Resource) ResourceMap {
+	if m == nil {
+		m = make(ResourceMap)
+	}
+	m[r.Type()] = append(m[r.Type()], r)
+	return m
+}
+
+// isDistributable returns true if the test state of the resource allows
+// providing it to distributors.
+func (ctx *BackendResources) isDistributable(rTest *ResourceTest, onlyFunctional bool) bool {
+	switch rTest.State {
+	case StateFunctional:
+		return true
+	case StateUntested:
+		switch ctx.Untested {
+		case UntestedDistribute:
+			return true
+		case UntestedHold:
+			return false
+		case UntestedIfPreviouslyGood:
+			return !rTest.LastPassed.IsZero()
+		}
+	}
+	return !onlyFunctional
+}
+
+// partitionedWithDistributors is a partitioned hashring with a partition for
+// each distributor.  Resources requesting an unknown distributor go to the
+// "none" partition and the ones requesting "unallocated", which is reserved
+// for future distributors, to the "unallocated" partition.  No distributor
+// gets the resources of these two partitions.
 type partitionedWithDistributors struct {
 	*partitionedHashring
 }
@@ -193,29 +620,52 @@ type partitionedWithDistributors struct {
 func newPartitionedWithDistributors(rg ResourceGroup) *partitionedWithDistributors {
 	p := rg.(*partitionedHashring)
 	p.partitions["none"] = NewHashring()
+	p.partitions["unallocated"] = NewHashring()
 	return &partitionedWithDistributors{p}
 }
 
 func (p partitionedWithDistributors) Add(resource Resource) error {
-	name := p.getPartitionName(resource)
+	p.relationsLock.Lock()
+	defer p.relationsLock.Unlock()
+
+	name := p.partitionName(resource)
 	p.addRelationIdentifiers(resource, name)
 	hashring := p.partitions[name]
 	return hashring.Add(resource)
 }
 
 func (p partitionedWithDistributors) AddOrUpdate(resource Resource) int {
-	name := p.getPartitionName(resource)
+	p.relationsLock.Lock()
+	defer p.relationsLock.Unlock()
+
+	name := p.partitionName(resource)
 	p.addRelationIdentifiers(resource, name)
 	hashring := p.partitions[name]
 	return hashring.AddOrUpdate(resource)
 }
 
 func (p partitionedWithDistributors) Remove(resource Resource) error {
-	hashring := p.partitions[p.getPartitionName(resource)]
+	p.relationsLock.RLock()
+	defer p.relationsLock.RUnlock()
+
+	hashring := p.partitions[p.partitionName(resource)]
 	return hashring.Remove(resource)
 }
 
 func (p partitionedWithDistributors) getPartitionName(resource Resource) string {
+	p.relationsLock.RLock()
+	defer p.relationsLock.RUnlock()
+	return p.partitionName(resource)
+}
+
+// partitionName returns the partition of the resource.  The caller must hold
+// relationsLock.
+func (p partitionedWithDistributors) partitionName(resource Resource) string {
+	if distName, ok := p.reassignedPartition(resource); ok {
+		if _, exists := p.partitions[distName]; exists {
+			return distName
+		}
+	}
 	distName := resource.Distributor()
 	if distName != "" {
 		if _, ok := p.partitions[distName]; !ok {
@@ -223,11 +673,11 @@ func (p partitionedWithDistributors) getPartitionName(resource Resource) string
 		}
 		return distName
 	}
-	return p.partitionedHashring.getPartitionName(resource)
+	return p.partitionedHashring.partitionName(resource)
 }
 
 func (p partitionedWithDistributors) addRelationIdentifiers(resource Resource, partitionName string) {
-	if partitionName == "none" {
+	if partitionName == "none" || partitionName == "unallocated" {
 		return
 	}
 	p.partitionedHashring.addRelationIdentifiers(resource, partitionName)
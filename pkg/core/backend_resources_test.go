@@ -5,8 +5,16 @@
 package core
 
 import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/batched"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
 )
 
 var (
@@ -244,3 +252,471 @@ func TestUnknownDistributor(t *testing.T) {
 		t.Errorf("got unexpected element")
 	}
 }
+
+func TestGoneGracePeriod(t *testing.T) {
+	d := NewDummy(1, 1)
+	c := NewBackendResources(&CollectionConfig{
+		Types:           collectionConfig.Types,
+		GoneGracePeriod: time.Hour,
+	})
+	diffs := make(chan *ResourceDiff, 10)
+	c.RegisterChan(&ResourceRequest{RequestOrigin: partitionName, ResourceTypes: []string{d.Type()}}, diffs)
+
+	c.Add(d)
+	if diff := <-diffs; len(diff.New) != 1 {
+		t.Fatalf("expected a new resource but got %v", diff)
+	}
+
+	// The bridge fails a test and recovers within the grace period.
+	d.TestResult().State = StateDysfunctional
+	c.Add(d)
+	d.TestResult().State = StateFunctional
+	c.Add(d)
+	if len(diffs) != 0 {
+		t.Fatalf("a bridge that recovered was propagated: %v", <-diffs)
+	}
+
+	// Once the grace period is over the bridge is reported as gone.
+	d.TestResult().State = StateDysfunctional
+	c.Add(d)
+	if len(diffs) != 0 {
+		t.Fatalf("a bridge was propagated as gone before the grace period: %v", <-diffs)
+	}
+	c.failingSince[d.Uid()] = time.Now().Add(-2 * time.Hour)
+	c.Add(d)
+	if len(diffs) != 1 {
+		t.Fatalf("expected the bridge to be propagated as gone")
+	}
+	if diff := <-diffs; len(diff.Gone) != 1 {
+		t.Errorf("expected a gone resource but got %v", diff)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	d1 := NewDummy(1, 1)
+	d2 := NewDummy(2, 2)
+	c := NewBackendResources(&collectionConfig)
+	c.Add(d1)
+	c.Add(d2)
+	diffs := make(chan *ResourceDiff, 10)
+	c.RegisterChan(&ResourceRequest{RequestOrigin: partitionName, ResourceTypes: []string{d1.Type()}}, diffs)
+
+	updated := c.Update(func(r Resource) bool {
+		return r.Uid() == d1.Uid()
+	})
+	if updated != 1 {
+		t.Fatalf("expected 1 updated resource but got %d", updated)
+	}
+	if len(diffs) != 1 {
+		t.Fatalf("expected 1 diff but got %d", len(diffs))
+	}
+	diff := <-diffs
+	if len(diff.Changed[d1.Type()]) != 1 || diff.Changed[d1.Type()][0].Uid() != d1.Uid() {
+		t.Errorf("expected the updated resource to be changed but got %v", diff)
+	}
+}
+
+func TestPruneExpiryOverride(t *testing.T) {
+	for _, expiry := range []time.Duration{0, 10 * time.Minute} {
+		d := NewDummy(1, 1)
+		d.ExpiryTime = time.Hour
+		c := NewBackendResources(&CollectionConfig{
+			Types: []TypeConfig{
+				{Type: d.Type(), Proportions: proportions, Expiry: expiry},
+			},
+		})
+		c.Add(d)
+
+		// The resource was last updated 20 minutes ago, so it's only expired
+		// with the shorter expiry of its type.
+		hashring := c.GetHashring(partitionName, d.Type())
+		i, err := hashring.getIndex(d.Uid())
+		if err != nil {
+			t.Fatalf("failed to retrieve existing resource: %s", err)
+		}
+		hashring.hashnodes[i].lastUpdate = time.Now().UTC().Add(-20 * time.Minute)
+
+		pruned := c.Prune(d.Type())
+		if expiry == 0 && len(pruned) != 0 {
+			t.Errorf("resource was pruned before its own expiry")
+		}
+		if expiry != 0 && len(pruned) != 1 {
+			t.Errorf("resource was not pruned after the expiry of its type")
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	c := NewBackendResources(&CollectionConfig{
+		Types: []TypeConfig{
+			{Type: "dummy", Proportions: map[string]int{"a": 1, "b": 1}},
+		},
+	})
+	p := c.Collection["dummy"].(*partitionedWithDistributors)
+
+	// Pin all the resources to partition a, as if it was the only
+	// partition when they were added.
+	const numResources = 100
+	for i := 0; i < numResources; i++ {
+		d := NewDummy(Hashkey(i), Hashkey(i))
+		d.RelationIds = []string{fmt.Sprintf("relation-%d", i)}
+		p.relations[d.RelationIds[0]] = "a"
+		c.Add(d)
+	}
+	// A related resource has to follow the other one to partition b.
+	related := NewDummy(Hashkey(numResources), Hashkey(numResources))
+	related.RelationIds = []string{"relation-0"}
+	c.Add(related)
+	if p.getHashring("a").Len() != numResources+1 {
+		t.Fatalf("Expected all the resources in partition a, got %d", p.getHashring("a").Len())
+	}
+
+	recipient := make(chan *ResourceDiff, 2*numResources)
+	c.RegisterChan(&ResourceRequest{RequestOrigin: "b", ResourceTypes: []string{"dummy"}}, recipient)
+
+	fraction := 0.1
+	maxMoves := int(math.Ceil(fraction * float64(numResources+1)))
+	previousLen := 0
+	for {
+		moved := c.Rebalance(fraction)
+		if moved == 0 {
+			break
+		}
+		// related resources can go over the limit
+		if moved > maxMoves+1 {
+			t.Errorf("Moved %d resources, expected at most %d", moved, maxMoves)
+		}
+		bLen := p.getHashring("b").Len()
+		if bLen != previousLen+moved {
+			t.Errorf("Partition b has %d resources, expected %d", bLen, previousLen+moved)
+		}
+		previousLen = bLen
+	}
+
+	aLen := p.getHashring("a").Len()
+	bLen := p.getHashring("b").Len()
+	if aLen+bLen != numResources+1 {
+		t.Errorf("Lost resources rebalancing: %d + %d", aLen, bLen)
+	}
+	if bLen < numResources/4 || aLen < numResources/4 {
+		t.Errorf("Partitions are not balanced: %d and %d", aLen, bLen)
+	}
+	for _, r := range p.getHashring("b").GetAll() {
+		if p.getPartitionName(r) != "b" {
+			t.Errorf("Resource %s moved to b but related to %s", r, p.getPartitionName(r))
+		}
+	}
+	if len(recipient) != bLen {
+		t.Errorf("Distributor b was informed of %d new resources, expected %d", len(recipient), bLen)
+	}
+
+	inB := p.getHashring("b").Filter(func(r Resource) bool { return r.Uid() == Hashkey(0) })
+	relatedInB := p.getHashring("b").Filter(func(r Resource) bool { return r.Uid() == related.Uid() })
+	if len(inB) != len(relatedInB) {
+		t.Error("Related resources were placed in different partitions")
+	}
+}
+
+func TestSaveSoon(t *testing.T) {
+	cfg := &CollectionConfig{
+		StorageDir: t.TempDir(),
+		Types: []TypeConfig{
+			{Type: "dummy", NewResource: newDummy, Proportions: proportions, Stored: true},
+		},
+	}
+	c := NewBackendResources(cfg)
+	c.saveDelay = 10 * time.Millisecond
+	var saves int64
+	c.save = func() {
+		atomic.AddInt64(&saves, 1)
+		c.Collection.Save()
+	}
+
+	numAdds := 100
+	for i := 1; i <= numAdds; i++ {
+		c.Add(NewDummy(Hashkey(i), Hashkey(i)))
+		c.SaveSoon()
+		if i%25 == 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	c.Close()
+
+	n := atomic.LoadInt64(&saves)
+	if n == 0 || n >= int64(numAdds) {
+		t.Errorf("Expected between 1 and %d saves, got %d", numAdds-1, n)
+	}
+	if l := NewCollection(cfg)["dummy"].Len(); l != numAdds {
+		t.Errorf("Expected %d stored resources, got %d", numAdds, l)
+	}
+}
+
+func TestCloseFlushesSaveSoon(t *testing.T) {
+	cfg := &CollectionConfig{
+		StorageDir: t.TempDir(),
+		Types: []TypeConfig{
+			{Type: "dummy", NewResource: newDummy, Proportions: proportions, Stored: true},
+		},
+	}
+	c := NewBackendResources(cfg)
+	c.saveDelay = time.Hour
+	c.Add(NewDummy(1, 1))
+	c.SaveSoon()
+	c.Close()
+
+	if l := NewCollection(cfg)["dummy"].Len(); l != 1 {
+		t.Errorf("Expected the pending save to be written on close, got %d stored resources", l)
+	}
+}
+
+// countingStore counts the saves to the wrapped store.
+type countingStore struct {
+	persistence.Mechanism
+	saves int64
+}
+
+func (s *countingStore) Save(i interface{}) error {
+	atomic.AddInt64(&s.saves, 1)
+	return s.Mechanism.Save(i)
+}
+
+func TestBatchedSaves(t *testing.T) {
+	cfg := &CollectionConfig{
+		StorageDir:         t.TempDir(),
+		StoreFlushInterval: time.Hour,
+		Types: []TypeConfig{
+			{Type: "dummy", NewResource: newDummy, Proportions: proportions, Stored: true},
+		},
+	}
+	c := NewBackendResources(cfg)
+	p := c.Collection["dummy"].(*partitionedWithDistributors)
+	p.closeStore()
+	store := &countingStore{Mechanism: pjson.New("dummy", cfg.StorageDir)}
+	p.store = batched.New(store, cfg.StoreFlushInterval)
+
+	numAdds := 100
+	for i := 1; i <= numAdds; i++ {
+		c.Add(NewDummy(Hashkey(i), Hashkey(i)))
+		c.Save()
+	}
+	c.Close()
+
+	if n := atomic.LoadInt64(&store.saves); n != 1 {
+		t.Errorf("Expected the saves to be written once, got %d writes", n)
+	}
+	if l := NewCollection(cfg)["dummy"].Len(); l != numAdds {
+		t.Errorf("Expected %d stored resources, got %d", numAdds, l)
+	}
+}
+
+func TestUntestedPolicy(t *testing.T) {
+	distName := "distributor"
+	c := NewBackendResources(&CollectionConfig{
+		Types: []TypeConfig{
+			{Type: "dummy", Proportions: map[string]int{distName: 1}},
+		},
+	})
+	states := map[Hashkey]func(*ResourceTest){
+		1: func(rt *ResourceTest) { rt.State = StateFunctional },
+		2: func(rt *ResourceTest) { rt.State = StateDysfunctional },
+		3: func(rt *ResourceTest) { rt.State = StateUntested },
+		4: func(rt *ResourceTest) {
+			rt.State = StateUntested
+			rt.LastPassed = time.Now().UTC()
+		},
+	}
+	for k, setState := range states {
+		d := NewDummy(k, k)
+		setState(d.TestResult())
+		c.Add(d)
+	}
+
+	for _, test := range []struct {
+		policy         string
+		onlyFunctional bool
+		working        []Hashkey
+	}{
+		{"auto", false, []Hashkey{1, 2, 3, 4}},
+		{"auto", true, []Hashkey{1}},
+		{"yes", true, []Hashkey{1, 3, 4}},
+		{"yes", false, []Hashkey{1, 2, 3, 4}},
+		{"no", false, []Hashkey{1, 2}},
+		{"no", true, []Hashkey{1}},
+		{"previously_good", true, []Hashkey{1, 4}},
+		{"previously_good", false, []Hashkey{1, 2, 4}},
+	} {
+		policy, err := ParseUntestedPolicy(test.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Untested = policy
+		c.SetDistributionDecision(DistributionDecision{OnlyFunctional: test.onlyFunctional})
+
+		working := map[Hashkey]bool{}
+		for _, r := range c.Get(distName, "dummy").Working {
+			working[r.Uid()] = true
+		}
+		if len(working) != len(test.working) {
+			t.Errorf("Policy %q with only functional %v distributes %v instead of %v", test.policy, test.onlyFunctional, working, test.working)
+			continue
+		}
+		for _, k := range test.working {
+			if !working[k] {
+				t.Errorf("Policy %q with only functional %v doesn't distribute %d", test.policy, test.onlyFunctional, k)
+			}
+		}
+	}
+
+	if _, err := ParseUntestedPolicy("maybe"); err == nil {
+		t.Error("Unknown policy was accepted")
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	distName := "distributor"
+	c := NewBackendResources(&CollectionConfig{
+		Types: []TypeConfig{
+			{
+				Type:        "dummy",
+				Proportions: map[string]int{distName: 1},
+				Quotas:      map[string]int{distName: 3},
+			},
+		},
+	})
+	for i := Hashkey(1); i <= 10; i++ {
+		c.Add(NewDummy(i, i))
+	}
+
+	all := c.GetHashring(distName, "dummy").GetAll()
+	if len(all) != 10 {
+		t.Fatalf("Expected 10 resources in the partition but got %d", len(all))
+	}
+	working := c.Get(distName, "dummy").Working
+	if len(working) != 3 {
+		t.Fatalf("Expected the quota of 3 resources but got %d", len(working))
+	}
+	for i, r := range working {
+		if r.Uid() != all[i].Uid() {
+			t.Errorf("Resource %d is not in hashring order: %v instead of %v", i, r, all[i])
+		}
+	}
+
+	// Updates only include the resources that enter or leave the quota.
+	diffs := make(chan *ResourceDiff, 10)
+	c.RegisterChan(&ResourceRequest{RequestOrigin: distName, ResourceTypes: []string{"dummy"}}, diffs)
+	c.Add(NewDummy(11, 11))
+	if len(diffs) != 0 {
+		t.Fatalf("A resource out of the quota was propagated: %v", <-diffs)
+	}
+	c.Add(NewDummy(0, 0))
+	if len(diffs) != 1 {
+		t.Fatalf("Expected 1 diff but got %d", len(diffs))
+	}
+	diff := <-diffs
+	if len(diff.New["dummy"]) != 1 || diff.New["dummy"][0].Uid() != 0 {
+		t.Errorf("Expected the new resource to enter the quota but got %v", diff)
+	}
+	if len(diff.Gone["dummy"]) != 1 || diff.Gone["dummy"][0].Uid() != working[2].Uid() {
+		t.Errorf("Expected the last resource to leave the quota but got %v", diff)
+	}
+}
+
+func TestReassignStored(t *testing.T) {
+	cfg := &CollectionConfig{
+		StorageDir: t.TempDir(),
+		Types: []TypeConfig{
+			{Type: "dummy", Proportions: map[string]int{"a": 1, "b": 1}},
+		},
+	}
+	newDummy := func() *Dummy {
+		d := NewDummy(1, 1)
+		d.RelationIds = []string{"fingerprint"}
+		return d
+	}
+
+	c := NewBackendResources(cfg)
+	c.Add(newDummy())
+	to := "a"
+	if len(c.GetHashring("a", "dummy").GetAll()) == 1 {
+		to = "b"
+	}
+	if _, err := c.Reassign("unknown", to); err == nil {
+		t.Error("Expected an error reassigning an unknown identifier")
+	}
+	moved, err := c.Reassign("fingerprint", to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 || len(c.GetHashring(to, "dummy").GetAll()) != 1 {
+		t.Fatalf("Expected the dummy to be moved to %q, moved %d", to, moved)
+	}
+	c.Close()
+
+	c = NewBackendResources(cfg)
+	defer c.Close()
+	c.Add(newDummy())
+	if len(c.GetHashring(to, "dummy").GetAll()) != 1 {
+		t.Errorf("The reassignment to %q was not kept in the store", to)
+	}
+}
+
+func TestReassignRelations(t *testing.T) {
+	c := NewBackendResources(&CollectionConfig{
+		Types: []TypeConfig{
+			{Type: "dummy", Proportions: map[string]int{"a": 1, "b": 1}},
+		},
+	})
+	defer c.Close()
+
+	d := NewDummy(1, 1)
+	d.RelationIds = []string{"fingerprint", "address"}
+	c.Add(d)
+	to := "a"
+	if len(c.GetHashring("a", "dummy").GetAll()) == 1 {
+		to = "b"
+	}
+	if _, err := c.Reassign("fingerprint", to); err != nil {
+		t.Fatal(err)
+	}
+
+	related := NewDummy(2, 2)
+	related.RelationIds = []string{"address"}
+	c.Add(related)
+	if len(c.GetHashring(to, "dummy").GetAll()) != 2 {
+		t.Errorf("The related resource was not added to the reassigned partition %q", to)
+	}
+}
+
+func TestReassignConcurrently(t *testing.T) {
+	c := NewBackendResources(&CollectionConfig{
+		Types: []TypeConfig{
+			{Type: "dummy", Proportions: map[string]int{"a": 1, "b": 1}},
+		},
+	})
+	defer c.Close()
+
+	d := NewDummy(1, 1)
+	d.RelationIds = []string{"fingerprint"}
+	c.Add(d)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			c.Reassign("fingerprint", []string{"a", "b"}[i%2])
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			c.Add(d)
+			c.Rebalance(1)
+		}
+	}()
+	wg.Wait()
+
+	if c.Collection["dummy"].Len() != 1 {
+		t.Errorf("Expected a single resource after the concurrent reassignments, got %d", c.Collection["dummy"].Len())
+	}
+}
@@ -6,9 +6,14 @@ package core
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"sort"
 	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/batched"
 )
 
 // Collection maps a resource type (e.g. "obfs4") to its corresponding
@@ -24,11 +29,14 @@ type ResourceGroup interface {
 	Clear()
 	Filter(FilterFunc) []Resource
 	GetAll() []Resource
+	Update(func(Resource) bool) []Resource
 	Prune() []Resource
+	PruneWithExpiry(expiry time.Duration) []Resource
 
 	getHashring(partitionName string) *Hashring
 	getPartitionName(resource Resource) string
 	save() error
+	closeStore() error
 }
 
 // CollectionConfig holds the configuration to create a Collection
@@ -38,6 +46,14 @@ type CollectionConfig struct {
 
 	// Types is the list of Resource types that will be stored in the collection
 	Types []TypeConfig
+
+	// GoneGracePeriod is how long a resource has to keep failing tests
+	// before it's reported as gone to the distributors
+	GoneGracePeriod time.Duration
+
+	// StoreFlushInterval batches the saves to the persistant store, writing
+	// them at most once per interval, if it's positive
+	StoreFlushInterval time.Duration
 }
 
 // TypeConfig holds the configuration of one Resource type
@@ -55,8 +71,21 @@ type TypeConfig struct {
 	// of each partition and it's proportion of resources that should be asigned to it
 	Proportions map[string]int
 
+	// RegionalProportions maps country codes to the proportions used for the
+	// resources that are not blocked in the country, instead of Proportions.
+	// If a resource is not blocked in several of them the first country code
+	// in alphabetical order is used
+	RegionalProportions map[string]map[string]int
+
 	// Stored indicates if the resources of this type should be persistant stored in StoreDir
 	Stored bool
+
+	// Expiry overrides the expiry of the resources of this type if it's positive
+	Expiry time.Duration
+
+	// Quotas maps distributor names to the maximum number of working
+	// resources of this type they get
+	Quotas map[string]int
 }
 
 // NewCollection creates and returns a new resource collection
@@ -68,12 +97,14 @@ func NewCollection(cfg *CollectionConfig) Collection {
 			h := NewHashring()
 			if rc.Stored && cfg.StorageDir != "" {
 				h.initStore(rc.Type, cfg.StorageDir, rc.NewResource)
+				h.store = batchStore(h.store, cfg.StoreFlushInterval)
 			}
 			c[rc.Type] = h
 		} else {
-			h := newPartitionedHashring(rc.Proportions)
+			h := newPartitionedHashring(rc.Proportions, rc.RegionalProportions)
 			if cfg.StorageDir != "" {
 				h.initStore(rc.Type, cfg.StorageDir, rc.Stored, rc.NewResource)
+				h.store = batchStore(h.store, cfg.StoreFlushInterval)
 			}
 			c[rc.Type] = h
 		}
@@ -92,6 +123,34 @@ func (c Collection) Save() {
 	return
 }
 
+// Close writes the pending saves of batched stores and stops flushing them
+func (c Collection) Close() {
+	c.Save()
+	for rType, h := range c {
+		err := h.closeStore()
+		if err != nil {
+			log.Println("Error closing", rType, "store:", err)
+		}
+	}
+}
+
+// batchStore wraps the store to batch its saves if flushInterval is positive
+func batchStore(store persistence.Mechanism, flushInterval time.Duration) persistence.Mechanism {
+	if flushInterval <= 0 {
+		return store
+	}
+	return batched.New(store, flushInterval)
+}
+
+// closeStore closes the store if it needs to be closed
+func closeStore(store persistence.Mechanism) error {
+	closer, ok := store.(io.Closer)
+	if !ok {
+		return nil
+	}
+	return closer.Close()
+}
+
 // Add resource to the collection
 func (c Collection) Add(resource Resource) error {
 	rt, ok := c[resource.Type()]
@@ -117,6 +176,27 @@ func (c Collection) String() string {
 	return strings.Join(s, ", ")
 }
 
+// PartitionSizes returns the number of resources of the requested type in
+// each partition, or nil if the type is not partitioned.
+func (c Collection) PartitionSizes(rType string) map[string]int {
+	p, ok := c[rType].(interface{ PartitionSizes() map[string]int })
+	if !ok {
+		return nil
+	}
+	return p.PartitionSizes()
+}
+
+// IsPartitioned returns true if the resources of the requested type are split
+// in partitions.
+func (c Collection) IsPartitioned(rType string) bool {
+	rt, exists := c[rType]
+	if !exists {
+		return false
+	}
+	_, unpartitioned := rt.(*Hashring)
+	return !unpartitioned
+}
+
 // GetHashring returns the hashring of the requested type for the given
 // distributor.
 func (c Collection) GetHashring(partitionName string, rType string) *Hashring {
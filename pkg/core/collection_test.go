@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"os"
 	"testing"
+	"time"
 )
 
 var (
@@ -172,3 +173,26 @@ func TestStoreUnpartitionedResources(t *testing.T) {
 		t.Error("Not the same resource:", d.Uid(), resources[0].Uid())
 	}
 }
+
+func TestBatchedStore(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &CollectionConfig{
+		StorageDir:         tmpDir,
+		StoreFlushInterval: time.Hour,
+		Types: []TypeConfig{
+			{Type: "dummy", NewResource: newDummy, Proportions: multipleProportions, Stored: true},
+		},
+	}
+
+	c := NewCollection(cfg)
+	c.Add(NewDummy(1, 1))
+	c.Save()
+	if NewCollection(cfg)["dummy"].Len() != 0 {
+		t.Error("The store was written before flushing")
+	}
+
+	c.Close()
+	if NewCollection(cfg)["dummy"].Len() != 1 {
+		t.Error("The store was not written when closing the collection")
+	}
+}
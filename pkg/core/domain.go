@@ -37,9 +37,17 @@ const (
 type Resource interface {
 	Type() string
 	String() string
+	// TestString returns the line sent to bridgestrap and onbasca to test
+	// the resource.  Most resources return the same as String, but some
+	// transports need a different line to be tested than the one handed
+	// out to users.
+	TestString() string
 	IsValid() bool
 	BlockedIn() LocationSet
 	SetBlockedIn(LocationSet)
+	// ReplaceBlockListedIn replaces the set of locations where the blocklist
+	// says the resource is blocked, keeping the other locations that block it.
+	ReplaceBlockListedIn(LocationSet)
 	SetLastPassed(time.Time)
 	// Uid returns the resource's unique identifier.  Bridges with different
 	// fingerprints have different unique identifiers.
@@ -70,13 +78,28 @@ type Resource interface {
 // https://gitlab.torproject.org/tpo/anti-censorship/bridgestrap
 // And onbasca to test it's speed ratio:
 // https://gitlab.torproject.org/tpo/network-health/onbasca/
+//
+// The test result is serialized with the resource, so resources loaded from a
+// persistent store keep their state and don't need to be tested again.
 type ResourceTest struct {
-	State      int       `json:"-"`
-	Speed      int       `json:"-"`
-	Ratio      *float64  `json:"-"`
-	LastTested time.Time `json:"-"`
+	State      int       `json:"state"`
+	Speed      int       `json:"speed"`
+	Ratio      *float64  `json:"ratio,omitempty"`
+	LastTested time.Time `json:"last_tested"`
 	LastPassed time.Time `json:"last_passed"`
 	Error      string    `json:"-"`
+	// LastScheduled is when the resource was last sent for testing
+	LastScheduled time.Time `json:"-"`
+}
+
+// RecentlyPassed returns true if the test passed and it was done in less than
+// the given duration.
+func (t *ResourceTest) RecentlyPassed(d time.Duration) bool {
+	if t == nil {
+		return false
+	}
+	return t.State == StateFunctional && t.Speed == SpeedAccepted &&
+		time.Now().UTC().Sub(t.LastTested) < d
 }
 
 // ResourceMap maps a resource type to a slice of respective resources.
@@ -270,8 +293,13 @@ func (s1 LocationSet) HasLocationsNotIn(s2 LocationSet) bool {
 type ResourceBase struct {
 	RType      string      `json:"type"`
 	RBlockedIn LocationSet `json:"blocked_in"`
-	Location   *Location
-	Test       *ResourceTest `json:"test_result"`
+	// RBlockListedIn are the locations of RBlockedIn that come from the
+	// blocklist.  It's not serialized, so posted resources can't set it and
+	// distributors don't get it.  Stored resources are loaded without it, so
+	// their blocklisted locations are kept like the posted ones.
+	RBlockListedIn LocationSet `json:"-"`
+	Location       *Location
+	Test           *ResourceTest `json:"test_result"`
 }
 
 // NewResourceBase returns a new ResourceBase.
@@ -295,6 +323,12 @@ func (r *ResourceBase) TestResult() *ResourceTest {
 	return r.Test
 }
 
+// ResetTestResult discards the resource's test result, so the resource is
+// tested again.
+func (r *ResourceBase) ResetTestResult() {
+	r.Test = &ResourceTest{State: StateUntested}
+}
+
 // BlockedIn returns the set of locations that block the resource.
 func (r *ResourceBase) BlockedIn() LocationSet {
 	return r.RBlockedIn
@@ -308,6 +342,25 @@ func (r *ResourceBase) SetBlockedIn(l LocationSet) {
 	}
 }
 
+// ReplaceBlockListedIn replaces the locations that the blocklist set with a
+// copy of the given location set.  The locations the resource was blocked in
+// for other reasons, like the ones it was posted with, are kept.
+func (r *ResourceBase) ReplaceBlockListedIn(l LocationSet) {
+	blockedIn := make(LocationSet, len(r.RBlockedIn)+len(l))
+	for key, value := range r.RBlockedIn {
+		if !r.RBlockListedIn[key] {
+			blockedIn[key] = value
+		}
+	}
+	blockListedIn := make(LocationSet, len(l))
+	for key, value := range l {
+		blockedIn[key] = value
+		blockListedIn[key] = value
+	}
+	r.RBlockedIn = blockedIn
+	r.RBlockListedIn = blockListedIn
+}
+
 // SetLastPassed sets the resource's last passed time to the time the test last passed
 func (r *ResourceBase) SetLastPassed(lptime time.Time) {
 	r.Test.LastPassed = lptime
@@ -5,6 +5,8 @@
 package core
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 )
@@ -169,6 +171,53 @@ func TestResourceBase(t *testing.T) {
 	b.SetLastPassed(lptime)
 }
 
+func TestReplaceBlockListedIn(t *testing.T) {
+
+	b := NewResourceBase()
+	b.SetBlockedIn(LocationSet{"ru": true})
+
+	b.ReplaceBlockListedIn(LocationSet{"cn": true, "ir": true})
+	if len(b.BlockedIn()) != 3 {
+		t.Errorf("failed to merge the blocklisted locations: %v", b.BlockedIn())
+	}
+
+	b.ReplaceBlockListedIn(LocationSet{"ir": true})
+	if len(b.BlockedIn()) != 2 || !b.BlockedIn()["ir"] || !b.BlockedIn()["ru"] {
+		t.Errorf("failed to replace the blocklisted locations: %v", b.BlockedIn())
+	}
+}
+
+func TestBlockListedInNotSerialized(t *testing.T) {
+
+	b := NewResourceBase()
+	ls := LocationSet{"ir": true}
+	b.ReplaceBlockListedIn(ls)
+
+	// The resource keeps its own copy of the location set.
+	ls["ru"] = true
+	if b.BlockedIn()["ru"] {
+		t.Errorf("location set shared with the caller")
+	}
+
+	blob, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(blob), "blocklisted") {
+		t.Errorf("the blocklisted locations were serialized: %s", blob)
+	}
+	var decoded ResourceBase
+	if err := json.Unmarshal(blob, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.RBlockedIn) != 1 || !decoded.RBlockedIn["ir"] {
+		t.Errorf("blocked_in didn't serialize the blocklisted locations: %s", blob)
+	}
+	if decoded.RBlockListedIn != nil {
+		t.Errorf("the blocklisted locations were deserialized: %v", decoded.RBlockListedIn)
+	}
+}
+
 func TestHasResourceType(t *testing.T) {
 
 	rr := ResourceRequest{ResourceTypes: []string{"obfs3", "obfs4"}}
@@ -18,6 +18,7 @@ type Dummy struct {
 	testFunc     func(Resource)
 	Distribution string
 	RelationIds  []string
+	Blocked      LocationSet
 }
 
 func NewDummy(oid Hashkey, uid Hashkey) *Dummy {
@@ -41,6 +42,9 @@ func (d *Dummy) RelationIdentifiers() []string {
 func (d *Dummy) String() string {
 	return fmt.Sprintf("dummy-%d-%d", d.UniqueId, d.ObjectId)
 }
+func (d *Dummy) TestString() string {
+	return d.String()
+}
 func (d *Dummy) Type() string {
 	return "dummy"
 }
@@ -76,7 +80,12 @@ func (d *Dummy) IsValid() bool {
 	return true
 }
 func (d *Dummy) BlockedIn() LocationSet {
-	return make(LocationSet)
+	if d.Blocked == nil {
+		return make(LocationSet)
+	}
+	return d.Blocked
 }
 func (d *Dummy) SetBlockedIn(LocationSet) {
 }
+func (d *Dummy) ReplaceBlockListedIn(LocationSet) {
+}
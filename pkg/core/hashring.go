@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"hash/crc64"
 	"log"
+	"math"
 	"sort"
 	"strings"
 	"sync"
@@ -49,12 +50,19 @@ type hashnode struct {
 	hashkey    Hashkey
 	elem       Resource
 	lastUpdate time.Time
+	// firstSeen is when the resource was added to the hashring, it's zero if
+	// we don't know, e.g. for the resources of the first full update
+	firstSeen time.Time
 }
 
 // Hashring represents a hashring consisting of resources.
 type Hashring struct {
 	hashnodes []*hashnode
 	store     persistence.Mechanism
+	// newBias and newBiasWindow configure how GetMany favours new resources,
+	// see SetNewResourceBias
+	newBias       float64
+	newBiasWindow time.Duration
 	sync.RWMutex
 }
 
@@ -76,10 +84,11 @@ func NewHashkey(id string) Hashkey {
 	return Hashkey(crc64.Checksum([]byte(id), crc64Table))
 }
 
-// NewHashnode returns a new hash node and sets its LastUpdate field to the
-// current UTC time.
+// NewHashnode returns a new hash node and sets its LastUpdate and FirstSeen
+// fields to the current UTC time.
 func NewHashnode(k Hashkey, r Resource) *hashnode {
-	return &hashnode{hashkey: k, elem: r, lastUpdate: time.Now().UTC()}
+	now := time.Now().UTC()
+	return &hashnode{hashkey: k, elem: r, lastUpdate: now, firstSeen: now}
 }
 
 // NewHashring returns a new hashring.
@@ -153,10 +162,33 @@ func (h *Hashring) ApplyDiff(d *ResourceDiff) {
 	if d.FullUpdate {
 		h.Lock()
 		defer h.Unlock()
+		// Keep when we first saw the resources we already had.  If we didn't
+		// have any, this is the first update and we don't know how new they
+		// are.
+		firstSeen := make(map[Hashkey]time.Time)
+		for _, node := range h.hashnodes {
+			firstSeen[node.hashkey] = node.firstSeen
+		}
+		for _, node := range hashring.hashnodes {
+			if seen, ok := firstSeen[node.hashkey]; ok || len(h.hashnodes) == 0 {
+				node.firstSeen = seen
+			}
+		}
 		h.hashnodes = hashring.hashnodes
 	}
 }
 
+// SetNewResourceBias makes GetMany select the resources that were added to the
+// hashring less than window ago bias times more often than the rest, so new
+// resources build up their reputation faster.  Once the window is over they
+// are selected like any other resource.  A bias of 1 or less disables it.
+func (h *Hashring) SetNewResourceBias(window time.Duration, bias float64) {
+	h.Lock()
+	defer h.Unlock()
+	h.newBiasWindow = window
+	h.newBias = bias
+}
+
 // Add adds the given resource to the hashring.  If the resource is already
 // present, we update its timestamp and return an error.
 func (h *Hashring) Add(r Resource) error {
@@ -179,29 +211,26 @@ func (h *Hashring) Add(r Resource) error {
 // maybeTestResource may test the given resource.  The resource is *not* tested
 // if all of the following conditions are met:
 //
-//   - The resource (as identified by its UID *and* OID) already exists.
+//   - The resource (as identified by its UID *and* OID) already exists, or it
+//     is new but carries its own test result (e.g. it was loaded from the
+//     persistent store).
 //   - The resource has been last tested before the resource's expiry.
+//   - The resource passed its last test.
 func (h *Hashring) maybeTestResource(r Resource) {
 
-	var oldR Resource
 	// Does the resource already exist in our hashring?
 	if i, err := h.getIndex(r.Uid()); err == nil {
-		oldR = h.hashnodes[i].elem
+		oldR := h.hashnodes[i].elem
 		// And is it exactly the same as the one we're dealing with?
 		if oldR.Oid() == r.Oid() {
-			rTest := oldR.TestResult()
 			r = oldR
-			// Is the resource already tested?
-			if rTest != nil && rTest.State != StateUntested && rTest.Speed != SpeedUntested {
-				// And if so, has it been tested recently?
-				if time.Now().UTC().Sub(rTest.LastTested) < oldR.Expiry() {
-					// And if so, are its tests passing?
-					if rTest.State == StateFunctional && rTest.Speed == SpeedAccepted { // Also check for Ratio greater than threshold
-						return
-					}
-				}
+			// Has it been tested recently and are its tests passing?
+			if oldR.TestResult().RecentlyPassed(oldR.Expiry()) {
+				return
 			}
 		}
+	} else if r.TestResult().RecentlyPassed(r.Expiry()) {
+		return
 	}
 	go r.Test()
 }
@@ -318,7 +347,8 @@ func (h *Hashring) GetExact(k Hashkey) (Resource, error) {
 // GetMany behaves like Get with the exception that it attempts to return the
 // given number of elements.  If the number of desired elements exceeds the
 // number of elements in the hashring all the resources in the hashring will
-// be returned.
+// be returned.  If a new resource bias is set, the selection favours the new
+// resources.
 func (h *Hashring) GetMany(k Hashkey, num int) (resources []Resource, err error) {
 	h.RLock()
 	defer h.RUnlock()
@@ -330,6 +360,16 @@ func (h *Hashring) GetMany(k Hashkey, num int) (resources []Resource, err error)
 		num = h.Len()
 	}
 
+	if h.newBias > 1 && h.newBiasWindow > 0 {
+		now := time.Now().UTC()
+		return h.getManyByWeight(k, num, func(node *hashnode) float64 {
+			if !node.firstSeen.IsZero() && now.Sub(node.firstSeen) < h.newBiasWindow {
+				return h.newBias
+			}
+			return 1
+		}), nil
+	}
+
 	i, err := h.getIndex(k)
 	if err != nil && i == -1 {
 		return nil, err
@@ -341,6 +381,9 @@ func (h *Hashring) GetMany(k Hashkey, num int) (resources []Resource, err error)
 	return resources, nil
 }
 
+// GetManyFiltered behaves like GetMany but only returns the resources for
+// which the filter returns true.  It walks the whole hashring at most once, so
+// it returns fewer than num resources only if not enough of them match.
 func (h *Hashring) GetManyFiltered(k Hashkey, f FilterFunc, num int) (resources []Resource, err error) {
 	h.RLock()
 	defer h.RUnlock()
@@ -357,18 +400,94 @@ func (h *Hashring) GetManyFiltered(k Hashkey, f FilterFunc, num int) (resources
 		return nil, err
 	}
 
-	var skipped int
-	for j := i; j < num+i+skipped && skipped < h.Len(); j++ {
+	for j := i; j < i+h.Len() && len(resources) < num; j++ {
 		item := h.hashnodes[j%h.Len()].elem
-		if !f(item) {
-			skipped++
-			continue
+		if f(item) {
+			resources = append(resources, item)
 		}
-		resources = append(resources, h.hashnodes[j%h.Len()].elem)
 	}
 	return resources, nil
 }
 
+// GetManyWeighted behaves like GetMany but biases the selection toward the
+// resources with a higher bandwidth ratio.  We use weighted rendezvous
+// hashing, so the same key keeps returning the same resources as long as the
+// hashring doesn't change.  Resources without a ratio get the average ratio of
+// the hashring.
+func (h *Hashring) GetManyWeighted(k Hashkey, num int) ([]Resource, error) {
+	h.RLock()
+	defer h.RUnlock()
+
+	if h.Len() == 0 {
+		return nil, errors.New("Hashring is empty")
+	}
+	if num >= h.Len() {
+		num = h.Len()
+	}
+
+	var ratioSum float64
+	var numRatios int
+	for _, node := range h.hashnodes {
+		if ratio := node.elem.TestResult().Ratio; ratio != nil {
+			ratioSum += *ratio
+			numRatios++
+		}
+	}
+	avgRatio := 1.0
+	if numRatios > 0 && ratioSum > 0 {
+		avgRatio = ratioSum / float64(numRatios)
+	}
+
+	return h.getManyByWeight(k, num, func(node *hashnode) float64 {
+		if ratio := node.elem.TestResult().Ratio; ratio != nil {
+			return *ratio
+		}
+		return avgRatio
+	}), nil
+}
+
+// getManyByWeight selects num resources with a chance proportional to the
+// weight of their node, using weighted rendezvous hashing.
+// This function is unsafe and needs a mutex lock before being used
+func (h *Hashring) getManyByWeight(k Hashkey, num int, weightOf func(*hashnode) float64) []Resource {
+	type scoredNode struct {
+		score float64
+		elem  Resource
+	}
+	scored := make([]scoredNode, h.Len())
+	for i, node := range h.hashnodes {
+		// Resources with no weight at all are still selected if there is
+		// nothing better.
+		weight := math.Max(weightOf(node), minWeight)
+
+		// The lowest scores are selected.  -ln(u)/weight is exponentially
+		// distributed, so each resource has a chance of being selected
+		// proportional to its weight.
+		u := (float64(mixHashkeys(k, node.hashkey)>>11) + 0.5) / (1 << 53)
+		scored[i] = scoredNode{score: -math.Log(u) / weight, elem: node.elem}
+	}
+	sort.SliceStable(scored, func(i, j int) bool { return scored[i].score < scored[j].score })
+
+	resources := make([]Resource, num)
+	for i := range resources {
+		resources[i] = scored[i].elem
+	}
+	return resources
+}
+
+// minWeight is the weight used by getManyByWeight for resources without
+// weight.
+const minWeight = 1e-6
+
+// mixHashkeys combines the given keys into a uniformly distributed number
+// using the finalizer of splitmix64.
+func mixHashkeys(k1, k2 Hashkey) uint64 {
+	x := uint64(k1) ^ (uint64(k2) * 0x9e3779b97f4a7c15)
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
 // GetAll returns all of the hashring's resources.
 func (h *Hashring) GetAll() []Resource {
 	h.RLock()
@@ -381,6 +500,22 @@ func (h *Hashring) GetAll() []Resource {
 	return elems
 }
 
+// Update calls f on every resource of the hashring, holding the lock of the
+// hashring so f can modify them, and returns the resources for which f returned
+// true.
+func (h *Hashring) Update(f func(Resource) bool) []Resource {
+	h.Lock()
+	defer h.Unlock()
+
+	updated := []Resource{}
+	for _, n := range h.hashnodes {
+		if f(n.elem) {
+			updated = append(updated, n.elem)
+		}
+	}
+	return updated
+}
+
 // Filter filters the resources of this hashring with the given filter function
 // and returns the remaining resources as another hashring.
 func (h *Hashring) Filter(f FilterFunc) []Resource {
@@ -398,6 +533,12 @@ func (h *Hashring) Filter(f FilterFunc) []Resource {
 
 // Prune prunes and returns expired resources from the hashring.
 func (h *Hashring) Prune() []Resource {
+	return h.PruneWithExpiry(0)
+}
+
+// PruneWithExpiry prunes and returns expired resources from the hashring.  If
+// expiry is positive it overrides the expiry of the resources.
+func (h *Hashring) PruneWithExpiry(expiry time.Duration) []Resource {
 	h.Lock()
 	defer h.Unlock()
 
@@ -405,7 +546,11 @@ func (h *Hashring) Prune() []Resource {
 	pruned := []Resource{}
 
 	for _, node := range h.hashnodes {
-		if now.Sub(node.lastUpdate) > node.elem.Expiry() {
+		nodeExpiry := expiry
+		if nodeExpiry <= 0 {
+			nodeExpiry = node.elem.Expiry()
+		}
+		if now.Sub(node.lastUpdate) > nodeExpiry {
 			pruned = append(pruned, node.elem)
 			h.remove(node.elem)
 		}
@@ -450,6 +595,10 @@ func (h *Hashring) initStore(name string, dir string, newResource func() Resourc
 	}
 }
 
+func (h *Hashring) closeStore() error {
+	return closeStore(h.store)
+}
+
 func (h *Hashring) save() error {
 	if h.store == nil {
 		return nil
@@ -5,6 +5,8 @@
 package core
 
 import (
+	"fmt"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -152,6 +154,162 @@ func TestGetMany(t *testing.T) {
 	}
 }
 
+func TestGetManyFiltered(t *testing.T) {
+	h := NewHashring()
+	for i := 1; i <= 10; i++ {
+		h.Add(NewDummy(Hashkey(i), Hashkey(i)))
+	}
+	// the first K resources from the key are rejected, so the matching ones
+	// are either after them or before the key in the ring
+	for k := 0; k < 10; k++ {
+		rejected := map[Hashkey]bool{}
+		for i := 0; i < k; i++ {
+			rejected[Hashkey(7+i)%10+1] = true
+		}
+		filter := func(r Resource) bool { return !rejected[r.Uid()] }
+
+		elems, err := h.GetManyFiltered(8, filter, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := 3
+		if 10-k < expected {
+			expected = 10 - k
+		}
+		if len(elems) != expected {
+			t.Errorf("rejecting %d resources got %d elements but expected %d", k, len(elems), expected)
+		}
+		seen := map[Hashkey]bool{}
+		for _, elem := range elems {
+			if rejected[elem.Uid()] {
+				t.Errorf("rejecting %d resources got the rejected element %d", k, elem.Uid())
+			}
+			if seen[elem.Uid()] {
+				t.Errorf("rejecting %d resources got element %d twice", k, elem.Uid())
+			}
+			seen[elem.Uid()] = true
+		}
+	}
+
+	// the matching resources are returned once, even if more are requested
+	twoMatching := func(r Resource) bool { return r.Uid() == 8 || r.Uid() == 1 }
+	elems, err := h.GetManyFiltered(8, twoMatching, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elems) != 2 || elems[0].Uid() != 8 || elems[1].Uid() != 1 {
+		t.Errorf("expected the elements 8 and 1 but got %v", elems)
+	}
+}
+
+func TestGetManyWeighted(t *testing.T) {
+	h := NewHashring()
+	if _, err := h.GetManyWeighted(0, 1); err == nil {
+		t.Error("requesting elements from empty hashring should result in error")
+	}
+
+	// Half of the resources have a high ratio, the other half a low ratio,
+	// and one has no ratio at all.
+	high, low := 2.0, 0.5
+	for i := 0; i < 20; i++ {
+		d := NewDummy(Hashkey(i), Hashkey(i))
+		if i%2 == 0 {
+			d.TestResult().Ratio = &high
+		} else {
+			d.TestResult().Ratio = &low
+		}
+		h.Add(d)
+	}
+	noRatio := NewDummy(100, 100)
+	h.Add(noRatio)
+
+	if elems, _ := h.GetManyWeighted(0, 30); len(elems) != h.Len() {
+		t.Error("requesting more elements than present should return all the elements in the hashring")
+	}
+
+	var highCount, lowCount, noRatioCount int
+	for k := 0; k < 10000; k++ {
+		key := NewHashkey(fmt.Sprintf("user-%d", k))
+		elems, err := h.GetManyWeighted(key, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(elems) != 3 {
+			t.Fatalf("got %d elements but expected 3", len(elems))
+		}
+
+		// The selection is deterministic for a given key.
+		again, _ := h.GetManyWeighted(key, 3)
+		if !reflect.DeepEqual(elems, again) {
+			t.Fatal("got different elements for the same key")
+		}
+
+		for _, elem := range elems {
+			switch elem.TestResult().Ratio {
+			case &high:
+				highCount++
+			case &low:
+				lowCount++
+			case nil:
+				noRatioCount++
+			}
+		}
+	}
+
+	if highCount <= 2*lowCount {
+		t.Errorf("high ratio resources were selected %d times and low ratio %d times", highCount, lowCount)
+	}
+	// The resource without ratio counts as average, so it should be selected
+	// less than each high ratio resource and more than each low ratio one.
+	if noRatioCount >= highCount/10 || noRatioCount <= lowCount/10 {
+		t.Errorf("resource without ratio was selected %d times (high %d, low %d)", noRatioCount, highCount, lowCount)
+	}
+}
+
+func TestGetManyNewResourceBias(t *testing.T) {
+	h := NewHashring()
+	// The first full update doesn't count as new resources.
+	diff := NewResourceDiff()
+	diff.FullUpdate = true
+	for i := 0; i < 90; i++ {
+		diff.New["dummy"] = append(diff.New["dummy"], NewDummy(Hashkey(i), Hashkey(i)))
+	}
+	h.ApplyDiff(diff)
+	for i := 90; i < 100; i++ {
+		h.Add(NewDummy(Hashkey(i), Hashkey(i)))
+	}
+	h.SetNewResourceBias(time.Hour, 4)
+
+	newFraction := func() float64 {
+		var newCount int
+		for k := 0; k < 10000; k++ {
+			elems, err := h.GetMany(NewHashkey(fmt.Sprintf("user-%d", k)), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elems[0].Uid() >= 90 {
+				newCount++
+			}
+		}
+		return float64(newCount) / 10000
+	}
+
+	// The 10 new resources weight 4 times more than the 90 old ones, so they
+	// should be selected 40/130 of the times instead of 10/100.
+	if fraction := newFraction(); fraction < 0.25 || fraction > 0.37 {
+		t.Errorf("new resources were selected %f of the times during the window", fraction)
+	}
+
+	for _, node := range h.hashnodes {
+		if !node.firstSeen.IsZero() {
+			node.firstSeen = node.firstSeen.Add(-2 * time.Hour)
+		}
+	}
+	if fraction := newFraction(); fraction < 0.07 || fraction > 0.13 {
+		t.Errorf("new resources were selected %f of the times after the window", fraction)
+	}
+}
+
 func TestRemove(t *testing.T) {
 	d1 := NewDummy(1, 1)
 	d2 := NewDummy(2, 2)
@@ -340,3 +498,72 @@ func TestMaybeTestResource(t *testing.T) {
 		t.Fatal("resource state was not set corrected by testing")
 	}
 }
+
+// storedDummy is a resource that keeps its test result when serialized.
+type storedDummy struct {
+	ResourceBase
+	ID     Hashkey `json:"id"`
+	tested chan bool
+}
+
+func (d *storedDummy) Uid() Hashkey                  { return d.ID }
+func (d *storedDummy) Oid() Hashkey                  { return d.ID }
+func (d *storedDummy) String() string                { return fmt.Sprintf("stored-dummy-%d", d.ID) }
+func (d *storedDummy) TestString() string            { return d.String() }
+func (d *storedDummy) IsValid() bool                 { return true }
+func (d *storedDummy) RelationIdentifiers() []string { return []string{} }
+func (d *storedDummy) Expiry() time.Duration         { return time.Hour }
+func (d *storedDummy) Distributor() string           { return "" }
+func (d *storedDummy) Test()                         { d.tested <- true }
+
+func TestMaybeTestStoredResource(t *testing.T) {
+	dir := t.TempDir()
+	newResource := func(tested chan bool) func() Resource {
+		return func() Resource {
+			return &storedDummy{ResourceBase: *NewResourceBase(), tested: tested}
+		}
+	}
+
+	storedTested := make(chan bool, 2)
+	functional := newResource(storedTested)().(*storedDummy)
+	functional.ID = 1
+	functional.TestResult().State = StateFunctional
+	functional.TestResult().Speed = SpeedAccepted
+	functional.TestResult().LastTested = time.Now().UTC()
+
+	outdated := newResource(storedTested)().(*storedDummy)
+	outdated.ID = 2
+	outdated.TestResult().State = StateFunctional
+	outdated.TestResult().Speed = SpeedAccepted
+	outdated.TestResult().LastTested = time.Now().UTC().Add(-2 * time.Hour)
+
+	h := NewHashring()
+	h.initStore("dummy", dir, newResource(storedTested))
+	h.Add(functional)
+	h.Add(outdated)
+	if err := h.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tested := make(chan bool, 2)
+	reloaded := NewHashring()
+	reloaded.initStore("dummy", dir, newResource(tested))
+	if reloaded.Len() != 2 {
+		t.Fatalf("expected 2 resources in the reloaded hashring but got %d", reloaded.Len())
+	}
+	r, err := reloaded.GetExact(functional.Uid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.TestResult().State != StateFunctional || r.TestResult().Speed != SpeedAccepted {
+		t.Errorf("test result was not persisted: %+v", r.TestResult())
+	}
+
+	// Only the resource with the outdated test result should be tested.
+	<-tested
+	select {
+	case <-tested:
+		t.Fatal("recently tested resource was tested again after reload")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
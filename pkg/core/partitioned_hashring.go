@@ -3,6 +3,9 @@ package core
 import (
 	"encoding/json"
 	"log"
+	"maps"
+	"sync"
+	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
 	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
@@ -19,45 +22,82 @@ type partitionedHashring struct {
 	// the same fingerprint should be in the same partition always.
 	relations map[string]string
 
+	// reassignments are the resource identifiers that an operator assigned
+	// to a partition, overriding the relations and the distribution request
+	// of the resources.
+	reassignments map[string]string
+
+	// relationsLock protects relations and reassignments, and keeps the
+	// resources that are moved between partitions from being added or
+	// removed halfway through the move.
+	relationsLock sync.RWMutex
+
 	stencil *stencil
+	// regional partitions the resources that are not blocked in some
+	// regions with their own proportions, instead of the ones of stencil.
+	regional *regionalStencils
 
 	store          persistence.Mechanism
 	storeResources bool
 }
 
-func newPartitionedHashring(proportions map[string]int) *partitionedHashring {
+// newPartitionedHashring creates a partitioned hashring with the given
+// proportions.  The resources that are not blocked in the regions of
+// regionalProportions, keyed by country code, are partitioned with the
+// proportions of the region instead.
+func newPartitionedHashring(proportions map[string]int, regionalProportions map[string]map[string]int) *partitionedHashring {
 	stencil := buildStencil(proportions)
-	p := partitionedHashring{
-		partitions: make(map[string]*Hashring),
-		relations:  make(map[string]string),
-		stencil:    stencil,
+	p := &partitionedHashring{
+		partitions:    make(map[string]*Hashring),
+		relations:     make(map[string]string),
+		reassignments: make(map[string]string),
+		stencil:       stencil,
 	}
 	for partitionName := range proportions {
 		p.partitions[partitionName] = NewHashring()
 	}
-	return &p
+	if len(regionalProportions) != 0 {
+		p.regional = buildRegionalStencils(regionalProportions)
+		for _, regionalProportion := range regionalProportions {
+			for partitionName := range regionalProportion {
+				if _, exists := p.partitions[partitionName]; !exists {
+					p.partitions[partitionName] = NewHashring()
+				}
+			}
+		}
+	}
+	return p
 }
 
-func (p partitionedHashring) Add(resource Resource) error {
-	name := p.getPartitionName(resource)
+func (p *partitionedHashring) Add(resource Resource) error {
+	p.relationsLock.Lock()
+	defer p.relationsLock.Unlock()
+
+	name := p.partitionName(resource)
 	p.addRelationIdentifiers(resource, name)
 	hashring := p.partitions[name]
 	return hashring.Add(resource)
 }
 
-func (p partitionedHashring) AddOrUpdate(resource Resource) int {
-	name := p.getPartitionName(resource)
+func (p *partitionedHashring) AddOrUpdate(resource Resource) int {
+	p.relationsLock.Lock()
+	defer p.relationsLock.Unlock()
+
+	name := p.partitionName(resource)
 	p.addRelationIdentifiers(resource, name)
 	hashring := p.partitions[name]
 	return hashring.AddOrUpdate(resource)
 }
 
-func (p partitionedHashring) Remove(resource Resource) error {
-	hashring := p.partitions[p.getPartitionName(resource)]
+func (p *partitionedHashring) Remove(resource Resource) error {
+	p.relationsLock.RLock()
+	defer p.relationsLock.RUnlock()
+
+	hashring := p.partitions[p.partitionName(resource)]
 	return hashring.Remove(resource)
 }
 
-func (p partitionedHashring) Filter(f FilterFunc) []Resource {
+func (p *partitionedHashring) Filter(f FilterFunc) []Resource {
 	resources := []Resource{}
 	for _, h := range p.partitions {
 		resources = append(resources, h.Filter(f)...)
@@ -65,7 +105,7 @@ func (p partitionedHashring) Filter(f FilterFunc) []Resource {
 	return resources
 }
 
-func (p partitionedHashring) GetAll() []Resource {
+func (p *partitionedHashring) GetAll() []Resource {
 	resources := []Resource{}
 	for _, h := range p.partitions {
 		resources = append(resources, h.GetAll()...)
@@ -73,15 +113,27 @@ func (p partitionedHashring) GetAll() []Resource {
 	return resources
 }
 
-func (p partitionedHashring) Prune() []Resource {
+func (p *partitionedHashring) Update(f func(Resource) bool) []Resource {
 	resources := []Resource{}
 	for _, h := range p.partitions {
-		resources = append(resources, h.Prune()...)
+		resources = append(resources, h.Update(f)...)
 	}
 	return resources
 }
 
-func (p partitionedHashring) Len() int {
+func (p *partitionedHashring) Prune() []Resource {
+	return p.PruneWithExpiry(0)
+}
+
+func (p *partitionedHashring) PruneWithExpiry(expiry time.Duration) []Resource {
+	resources := []Resource{}
+	for _, h := range p.partitions {
+		resources = append(resources, h.PruneWithExpiry(expiry)...)
+	}
+	return resources
+}
+
+func (p *partitionedHashring) Len() int {
 	count := 0
 	for _, partition := range p.partitions {
 		count += partition.Len()
@@ -89,13 +141,30 @@ func (p partitionedHashring) Len() int {
 	return count
 }
 
-func (p partitionedHashring) Clear() {
+// PartitionSizes returns the number of resources in each partition.
+func (p *partitionedHashring) PartitionSizes() map[string]int {
+	sizes := make(map[string]int)
+	for name, partition := range p.partitions {
+		sizes[name] = partition.Len()
+	}
+	return sizes
+}
+
+func (p *partitionedHashring) Clear() {
 	for name := range p.partitions {
 		p.partitions[name] = NewHashring()
 	}
 }
 
-func (p partitionedHashring) getPartitionName(resource Resource) (partitionName string) {
+func (p *partitionedHashring) getPartitionName(resource Resource) string {
+	p.relationsLock.RLock()
+	defer p.relationsLock.RUnlock()
+	return p.partitionName(resource)
+}
+
+// partitionName returns the partition of the resource.  The caller must hold
+// relationsLock.
+func (p *partitionedHashring) partitionName(resource Resource) (partitionName string) {
 	identifiers := resource.RelationIdentifiers()
 	for _, id := range identifiers {
 		name, ok := p.relations[id]
@@ -105,24 +174,187 @@ func (p partitionedHashring) getPartitionName(resource Resource) (partitionName
 	}
 
 	if partitionName == "" {
-		partitionName = p.stencil.GetPartitionName(resource)
+		partitionName = p.stencilFor(resource).GetPartitionName(resource)
 	}
 	return
 }
 
-func (p partitionedHashring) getHashring(partitionName string) *Hashring {
+// stencilFor returns the stencil that partitions the given resource.
+func (p *partitionedHashring) stencilFor(resource Resource) *stencil {
+	return p.regional.stencilFor(resource, p.stencil)
+}
+
+func (p *partitionedHashring) getHashring(partitionName string) *Hashring {
 	return p.partitions[partitionName]
 }
 
-func (p partitionedHashring) addRelationIdentifiers(resource Resource, partitionName string) {
+func (p *partitionedHashring) addRelationIdentifiers(resource Resource, partitionName string) {
 	for _, identifier := range resource.RelationIdentifiers() {
 		p.relations[identifier] = partitionName
 	}
 }
 
+// partitionMove is a resource that was moved between partitions.
+type partitionMove struct {
+	resource Resource
+	from     string
+	to       string
+}
+
+// rebalance moves up to maxMoves resources out of the partitions that hold
+// more resources than their proportion into the partition that the stencil
+// assigns them.  The relations keep resources in the partition they were first
+// placed, so a change of the proportions would only affect new resources
+// otherwise.  Related resources are moved together.  The excess of each
+// partition is calculated with the proportions that are not regional.
+func (p *partitionedHashring) rebalance(maxMoves int) []partitionMove {
+	p.relationsLock.Lock()
+	defer p.relationsLock.Unlock()
+
+	upperEnd, err := p.stencil.GetUpperEnd()
+	if err != nil || maxMoves <= 0 {
+		return nil
+	}
+	total := 0
+	for _, i := range p.stencil.intervals {
+		total += p.partitions[i.Name].Len()
+	}
+
+	moves := []partitionMove{}
+	moved := make(map[Hashkey]bool)
+	for _, i := range p.stencil.intervals {
+		hashring := p.partitions[i.Name]
+		target := total * (i.End - i.Begin + 1) / (upperEnd + 1)
+		excess := hashring.Len() - target
+
+		all := hashring.GetAll()
+		index := newRelationIndex(all)
+		for _, resource := range all {
+			if excess <= 0 || len(moves) >= maxMoves {
+				break
+			}
+			if moved[resource.Uid()] || resource.Distributor() != "" {
+				continue
+			}
+			if _, reassigned := p.reassignedPartition(resource); reassigned {
+				continue
+			}
+			to := p.stencilFor(resource).GetPartitionName(resource)
+			if to == i.Name || to == "" {
+				continue
+			}
+			// Only move related resources if the stencil places all of them
+			// in the same partition, otherwise they would bounce between
+			// partitions.
+			related := index.related(resource)
+			if !p.sameStencilPartition(related, to) {
+				continue
+			}
+
+			for _, r := range related {
+				hashring.Remove(r)
+				p.partitions[to].Add(r)
+				p.addRelationIdentifiers(r, to)
+				moved[r.Uid()] = true
+				moves = append(moves, partitionMove{r, i.Name, to})
+				excess--
+			}
+		}
+	}
+	return moves
+}
+
+// relationIndex maps the relation identifiers to the resources that have them.
+type relationIndex map[string][]Resource
+
+func newRelationIndex(resources []Resource) relationIndex {
+	index := make(relationIndex)
+	for _, r := range resources {
+		for _, id := range r.RelationIdentifiers() {
+			index[id] = append(index[id], r)
+		}
+	}
+	return index
+}
+
+// related returns the resources of the index that share any relation
+// identifier with the given one, including itself.
+func (index relationIndex) related(resource Resource) []Resource {
+	related := []Resource{resource}
+	seen := map[Hashkey]bool{resource.Uid(): true}
+	for _, id := range resource.RelationIdentifiers() {
+		for _, r := range index[id] {
+			if seen[r.Uid()] {
+				continue
+			}
+			seen[r.Uid()] = true
+			related = append(related, r)
+		}
+	}
+	return related
+}
+
+func (p *partitionedHashring) sameStencilPartition(resources []Resource, partitionName string) bool {
+	for _, r := range resources {
+		if p.stencilFor(r).GetPartitionName(r) != partitionName {
+			return false
+		}
+	}
+	return true
+}
+
+// reassignedPartition returns the partition that an operator assigned the
+// resource to, if any.  The caller must hold relationsLock.
+func (p *partitionedHashring) reassignedPartition(resource Resource) (string, bool) {
+	for _, id := range resource.RelationIdentifiers() {
+		if name, ok := p.reassignments[id]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// reassign moves the resources that have the given relation identifier to the
+// given partition and remembers it, so they are placed there when they are
+// added again.  The relations of the moved resources follow them, so their
+// related resources are placed in the new partition too.
+func (p *partitionedHashring) reassign(identifier string, to string) []partitionMove {
+	p.relationsLock.Lock()
+	defer p.relationsLock.Unlock()
+
+	p.reassignments[identifier] = to
+
+	moves := []partitionMove{}
+	for name, hashring := range p.partitions {
+		if name == to {
+			continue
+		}
+		for _, resource := range hashring.GetAll() {
+			if !hasRelationIdentifier(resource, identifier) {
+				continue
+			}
+			hashring.Remove(resource)
+			p.partitions[to].Add(resource)
+			p.addRelationIdentifiers(resource, to)
+			moves = append(moves, partitionMove{resource, name, to})
+		}
+	}
+	return moves
+}
+
+func hasRelationIdentifier(resource Resource, identifier string) bool {
+	for _, id := range resource.RelationIdentifiers() {
+		if id == identifier {
+			return true
+		}
+	}
+	return false
+}
+
 type storeData struct {
-	Relations map[string]string
-	Resources []Resource
+	Relations     map[string]string
+	Reassignments map[string]string
+	Resources     []Resource
 }
 
 func (p *partitionedHashring) initStore(name string, dir string, storeResources bool, newResource func() Resource) {
@@ -130,8 +362,9 @@ func (p *partitionedHashring) initStore(name string, dir string, storeResources
 	p.storeResources = storeResources
 
 	var data struct {
-		Relations map[string]string
-		Resources []json.RawMessage
+		Relations     map[string]string
+		Reassignments map[string]string
+		Resources     []json.RawMessage
 	}
 
 	err := p.store.Load(&data)
@@ -140,6 +373,9 @@ func (p *partitionedHashring) initStore(name string, dir string, storeResources
 		return
 	}
 	p.relations = data.Relations
+	if data.Reassignments != nil {
+		p.reassignments = data.Reassignments
+	}
 	if storeResources {
 		for _, rawResource := range data.Resources {
 			resource := newResource()
@@ -153,7 +389,11 @@ func (p *partitionedHashring) initStore(name string, dir string, storeResources
 	}
 }
 
-func (p partitionedHashring) save() error {
+func (p *partitionedHashring) closeStore() error {
+	return closeStore(p.store)
+}
+
+func (p *partitionedHashring) save() error {
 	if p.store == nil {
 		return nil
 	}
@@ -162,6 +402,9 @@ func (p partitionedHashring) save() error {
 	if p.storeResources {
 		data.Resources = p.GetAll()
 	}
-	data.Relations = p.relations
+	p.relationsLock.RLock()
+	data.Relations = maps.Clone(p.relations)
+	data.Reassignments = maps.Clone(p.reassignments)
+	p.relationsLock.RUnlock()
 	return p.store.Save(data)
 }
@@ -9,6 +9,7 @@ import (
 	"log"
 	"math/rand"
 	"sort"
+	"strings"
 )
 
 // stencil is a list of intervals to partition hashrings.
@@ -45,6 +46,59 @@ func buildStencil(proportions map[string]int) *stencil {
 	return stencil
 }
 
+// regionalStencils holds the stencils that partition the resources that are
+// not blocked in a region, keyed by the region's country code.
+type regionalStencils struct {
+	// countries are the country codes of the regions, in alphabetical
+	// order.
+	countries []string
+	stencils  map[string]*stencil
+}
+
+// buildRegionalStencils turns the regional proportions, keyed by country
+// code, into stencils.
+func buildRegionalStencils(regionalProportions map[string]map[string]int) *regionalStencils {
+	r := &regionalStencils{stencils: make(map[string]*stencil)}
+	for country, proportions := range regionalProportions {
+		if len(proportions) == 0 {
+			continue
+		}
+		country = strings.ToLower(country)
+		r.countries = append(r.countries, country)
+		r.stencils[country] = buildStencil(proportions)
+	}
+	sort.Strings(r.countries)
+	return r
+}
+
+// stencilFor returns the stencil of the first region, in alphabetical order,
+// where the resource is not blocked, or the given default stencil if it's
+// blocked in all of them.
+func (r *regionalStencils) stencilFor(resource Resource, defaultStencil *stencil) *stencil {
+	if r == nil {
+		return defaultStencil
+	}
+	for _, country := range r.countries {
+		if !blockedInCountry(resource, country) {
+			return r.stencils[country]
+		}
+	}
+	return defaultStencil
+}
+
+// blockedInCountry returns true if any of the locations blocking the resource
+// is in the given country.
+func blockedInCountry(resource Resource, country string) bool {
+	for location := range resource.BlockedIn() {
+		// Locations look like "ru" or "ru (1234)".
+		cc, _, _ := strings.Cut(location, " ")
+		if strings.EqualFold(cc, country) {
+			return true
+		}
+	}
+	return false
+}
+
 // Contains returns 'true' if the given number n falls into the interval [a, b]
 // so that a <= n <= b.
 func (i *interval) Contains(n int) bool {
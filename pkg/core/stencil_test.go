@@ -84,3 +84,72 @@ func TestGetPartitionName(t *testing.T) {
 		t.Errorf("got unexpectedly large number of hits")
 	}
 }
+
+func TestPartitionSizes(t *testing.T) {
+	proportions := map[string]int{"foo": 1, "bar": 3, "baz": 6}
+	p := newPartitionedHashring(proportions, nil)
+
+	runs := 10000
+	for i := 0; i < runs; i++ {
+		p.Add(NewDummy(Hashkey(i), Hashkey(rand.Uint64())))
+	}
+
+	sizes := p.PartitionSizes()
+	total := 0
+	for name, proportion := range proportions {
+		total += sizes[name]
+		expected := runs * proportion / 10
+		tolerance := 300
+		if sizes[name] < expected-tolerance || sizes[name] > expected+tolerance {
+			t.Errorf("partition %s has %d resources, expected %d±%d", name, sizes[name], expected, tolerance)
+		}
+	}
+	if total != runs {
+		t.Errorf("expected %d resources in the partitions but got %d", runs, total)
+	}
+}
+
+func TestRegionalPartitionSizes(t *testing.T) {
+	proportions := map[string]int{"https": 1, "moat": 1}
+	// Moat gets three quarters of the resources that are not blocked in
+	// Russia.
+	regional := map[string]map[string]int{"RU": {"https": 1, "moat": 3}}
+	p := newPartitionedHashring(proportions, regional)
+
+	runs := 20000
+	blocked := make(map[Hashkey]bool)
+	for i := 0; i < runs; i++ {
+		d := NewDummy(Hashkey(i), Hashkey(rand.Uint64()))
+		if i%2 == 0 {
+			d.Blocked = LocationSet{"ru": true}
+			blocked[d.UniqueId] = true
+		}
+		p.Add(d)
+	}
+
+	// Count the partitions of the blocked and unblocked resources
+	// separately, each of them has to follow its own split.
+	counts := map[bool]map[string]int{true: {}, false: {}}
+	for name, hashring := range p.partitions {
+		for _, r := range hashring.GetAll() {
+			counts[blocked[r.Uid()]][name]++
+		}
+	}
+
+	tolerance := 300
+	for _, test := range []struct {
+		blocked  bool
+		name     string
+		expected int
+	}{
+		{true, "https", runs / 4},
+		{true, "moat", runs / 4},
+		{false, "https", runs / 8},
+		{false, "moat", runs * 3 / 8},
+	} {
+		got := counts[test.blocked][test.name]
+		if got < test.expected-tolerance || got > test.expected+tolerance {
+			t.Errorf("partition %s has %d resources blocked %v, expected %d±%d", test.name, got, test.blocked, test.expected, tolerance)
+		}
+	}
+}
@@ -7,8 +7,10 @@ package mechanisms
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -20,7 +22,10 @@ import (
 )
 
 const (
-	InterMessageDelimiter  = '\r'
+	// InterMessageDelimiter separates the messages of the resource stream.
+	// The stream is newline-delimited JSON: each message is a single line of
+	// compact JSON.
+	InterMessageDelimiter  = '\n'
 	DefaultTimeBeforeRetry = time.Second * 1
 	MaxTimeBeforeRetry     = time.Hour
 )
@@ -63,10 +68,10 @@ func (ctx *HttpsIpcContext) StopStream() {
 // MakeJsonRequest marshalls the given request into JSON, sends it to the
 // destination that's set in the given context, and writes the resulting
 // response to the given return interface.  If an error occurs, the function
-// returns an error.
-func (ctx *HttpsIpcContext) MakeJsonRequest(req interface{}, ret interface{}) error {
+// returns an error.  Cancelling reqCtx aborts the request.
+func (ctx *HttpsIpcContext) MakeJsonRequest(reqCtx context.Context, req interface{}, ret interface{}) error {
 
-	resp, err := ctx.sendRequest(req)
+	resp, err := ctx.sendRequest(reqCtx, req)
 	if err != nil {
 		return err
 	}
@@ -108,10 +113,10 @@ func (ctx *HttpsIpcContext) expBackoff() time.Duration {
 func (ctx *HttpsIpcContext) handleStream(req *core.ResourceRequest) {
 
 	defer ctx.wg.Done()
+	// The channels are not closed, setupConn may still be reading from the
+	// backend when we stop.  It returns once it notices that we are done.
 	retChan := make(chan error)
-	defer close(retChan)
 	incoming := make(chan []byte)
-	defer close(incoming)
 
 	// setupConn tries to create a persistent HTTP connection to our backend.
 	// If that fails, the function continues to try again, indefinitely.  Once
@@ -124,11 +129,15 @@ func (ctx *HttpsIpcContext) handleStream(req *core.ResourceRequest) {
 		var resp *http.Response
 		for success := false; !success; success = (err == nil) {
 			log.Printf("Making HTTP request to initiate resource stream.")
-			resp, err = ctx.sendRequest(req)
+			resp, err = ctx.sendRequest(context.Background(), req)
 			if err != nil {
 				log.Printf("Error making HTTP request: %s", err.Error())
 				log.Printf("Trying again in %s.", ctx.timeBeforeRetry)
-				time.Sleep(ctx.expBackoff())
+				select {
+				case <-time.After(ctx.expBackoff()):
+				case <-ctx.done:
+					return
+				}
 			}
 		}
 		defer resp.Body.Close()
@@ -136,12 +145,19 @@ func (ctx *HttpsIpcContext) handleStream(req *core.ResourceRequest) {
 
 		reader := bufio.NewReader(resp.Body)
 		for {
-			line, err := reader.ReadBytes(InterMessageDelimiter)
+			msg, err := ReadStreamMessage(reader)
 			if err != nil {
-				retChan <- err
+				select {
+				case retChan <- err:
+				case <-ctx.done:
+				}
+				return
+			}
+			select {
+			case incoming <- msg:
+			case <-ctx.done:
 				return
 			}
-			incoming <- bytes.TrimSpace(line)
 		}
 	}
 
@@ -173,16 +189,40 @@ func (ctx *HttpsIpcContext) handleStream(req *core.ResourceRequest) {
 	}
 }
 
+// WriteStreamMessage marshals the given message into a single line of compact
+// JSON and writes it to the resource stream.  The JSON encoder escapes control
+// characters within strings, so the delimiter can't show up inside of a
+// message.
+func WriteStreamMessage(w io.Writer, msg interface{}) error {
+	// Encode terminates each message with a newline, which is our delimiter.
+	return json.NewEncoder(w).Encode(msg)
+}
+
+// ReadStreamMessage reads the next message from the resource stream, skipping
+// empty lines.  The returned message doesn't include the delimiter.
+func ReadStreamMessage(reader *bufio.Reader) ([]byte, error) {
+	for {
+		line, err := reader.ReadBytes(InterMessageDelimiter)
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) != 0 {
+			return line, nil
+		}
+	}
+}
+
 // sendRequest marshalls the given request into JSON and sends it to the API
 // endpoint that's part of the given context.
-func (ctx *HttpsIpcContext) sendRequest(req interface{}) (*http.Response, error) {
+func (ctx *HttpsIpcContext) sendRequest(reqCtx context.Context, req interface{}) (*http.Response, error) {
 
 	encoded, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
 
-	httpReq, err := http.NewRequest(ctx.method, ctx.apiEndpoint, bytes.NewBuffer(encoded))
+	httpReq, err := http.NewRequestWithContext(reqCtx, ctx.method, ctx.apiEndpoint, bytes.NewBuffer(encoded))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,73 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mechanisms
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	diffs := []*core.ResourceDiff{}
+	for i, param := range []string{"foo", "carriage\rreturn", "new\nline"} {
+		transport := resources.NewTransport()
+		transport.SetType("obfs4")
+		transport.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+		transport.Port = uint16(1000 + i)
+		transport.Fingerprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+		transport.Parameters["cert"] = param
+		diffs = append(diffs, &core.ResourceDiff{New: core.ResourceMap{"obfs4": []core.Resource{transport}}})
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		for _, diff := range diffs {
+			if err := WriteStreamMessage(pw, diff); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	reader := bufio.NewReader(pr)
+	for i, diff := range diffs {
+		msg, err := ReadStreamMessage(reader)
+		if err != nil {
+			t.Fatalf("failed to read message %d: %s", i, err)
+		}
+
+		helper := resources.TmpResourceDiff{}
+		if err := json.Unmarshal(msg, &helper); err != nil {
+			t.Fatalf("failed to unmarshal message %d: %s", i, err)
+		}
+		received, err := resources.UnmarshalTmpResourceDiff(&helper)
+		if err != nil {
+			t.Fatalf("failed to unmarshal diff %d: %s", i, err)
+		}
+
+		if len(received.New["obfs4"]) != 1 {
+			t.Fatalf("expected a single resource in diff %d but got %d", i, len(received.New["obfs4"]))
+		}
+		sent := diff.New["obfs4"][0].(*resources.Transport)
+		got, ok := received.New["obfs4"][0].(*resources.Transport)
+		if !ok {
+			t.Fatalf("resource of diff %d is not a transport", i)
+		}
+		if got.Port != sent.Port || got.Parameters["cert"] != sent.Parameters["cert"] {
+			t.Errorf("resource of diff %d doesn't match: %v != %v", i, got, sent)
+		}
+	}
+
+	if _, err := ReadStreamMessage(reader); err != io.EOF {
+		t.Errorf("expected EOF at the end of the stream but got %v", err)
+	}
+}
@@ -7,6 +7,7 @@ package locales
 import (
 	"embed"
 	"encoding/json"
+	"sort"
 
 	"github.com/nicksnyder/go-i18n/v2/i18n"
 	"golang.org/x/text/language"
@@ -32,3 +33,19 @@ func NewBundle() (*i18n.Bundle, error) {
 	}
 	return bundle, nil
 }
+
+// AvailableLocales returns the sorted list of locales that have a translation
+// in the bundle.
+func AvailableLocales() ([]string, error) {
+	bundle, err := NewBundle()
+	if err != nil {
+		return nil, err
+	}
+
+	available := []string{}
+	for _, tag := range bundle.LanguageTags() {
+		available = append(available, tag.String())
+	}
+	sort.Strings(available)
+	return available, nil
+}
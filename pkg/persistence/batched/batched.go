@@ -0,0 +1,121 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package batched
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+)
+
+const (
+	PersistenceMethod = "batched"
+)
+
+// BatchedPersistence wraps another persistence mechanism and batches the
+// saves to it.  Save only encodes the state and keeps it in memory, the latest
+// version of the state is written to the wrapped mechanism at most once per
+// flush interval.  This avoids rewriting big stores on every change, at the
+// cost of losing the changes of the last interval if we crash.
+type BatchedPersistence struct {
+	sync.Mutex
+	store persistence.Mechanism
+
+	// pending is the encoded state waiting to be written, or nil if the
+	// wrapped mechanism is up to date.
+	pending json.RawMessage
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns a BatchedPersistence that writes to store every flushInterval.
+// Close must be called to write the pending state and stop flushing.
+func New(store persistence.Mechanism, flushInterval time.Duration) *BatchedPersistence {
+	b := &BatchedPersistence{
+		store: store,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go b.flushLoop(flushInterval)
+	return b
+}
+
+// Load decodes the pending state if there is one, or loads the state of the
+// wrapped mechanism otherwise.
+func (b *BatchedPersistence) Load(i interface{}) error {
+	b.Lock()
+	pending := b.pending
+	b.Unlock()
+
+	if pending != nil {
+		return json.Unmarshal(pending, i)
+	}
+	return b.store.Load(i)
+}
+
+// Save encodes the given interface, it will be written to the wrapped
+// mechanism on the next flush.  The state is encoded right away, so the
+// caller can keep modifying it.
+func (b *BatchedPersistence) Save(i interface{}) error {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.pending = data
+	return nil
+}
+
+// Flush writes the pending state, if any, to the wrapped mechanism.
+func (b *BatchedPersistence) Flush() error {
+	b.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.Unlock()
+
+	if pending == nil {
+		return nil
+	}
+	err := b.store.Save(pending)
+	if err != nil {
+		b.Lock()
+		// keep the state for the next flush, unless there is a newer one
+		if b.pending == nil {
+			b.pending = pending
+		}
+		b.Unlock()
+	}
+	return err
+}
+
+// Close stops the periodic flushes and writes the pending state.
+func (b *BatchedPersistence) Close() error {
+	close(b.stop)
+	<-b.done
+	return b.Flush()
+}
+
+func (b *BatchedPersistence) flushLoop(flushInterval time.Duration) {
+	defer close(b.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(); err != nil {
+				log.Println("Error flushing the batched store:", err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package batched
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+)
+
+type resource struct {
+	Fingerprint string
+	Address     string
+	Port        int
+	Params      map[string]string
+}
+
+func newResources(n int) []resource {
+	resources := make([]resource, n)
+	for i := range resources {
+		resources[i] = resource{
+			Fingerprint: fmt.Sprintf("%040X", i),
+			Address:     fmt.Sprintf("192.0.2.%d", i%256),
+			Port:        1000 + i,
+			Params:      map[string]string{"cert": "ssH+9rP8dG2NLDN2XuFw63hIO/9MNNinLmxQDpVa+7kTOa9/m+tGWT1SmSYpQ9uTBGa6Hw", "iat-mode": "0"},
+		}
+	}
+	return resources
+}
+
+func TestBatchedSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	b := New(pjson.New("batched", dir), time.Hour)
+
+	if err := b.Save(newResources(3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save(newResources(5)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pending state is loaded before it's flushed
+	var loaded []resource
+	if err := b.Load(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 5 {
+		t.Errorf("expected 5 pending resources but got %d", len(loaded))
+	}
+	if err := pjson.New("batched", dir).Load(&loaded); err == nil {
+		t.Error("the state was written before flushing")
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	loaded = nil
+	if err := pjson.New("batched", dir).Load(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 5 || loaded[4].Port != 1004 {
+		t.Errorf("the latest state was not flushed: %v", loaded)
+	}
+}
+
+func TestBatchedPeriodicFlush(t *testing.T) {
+	dir := t.TempDir()
+	b := New(pjson.New("periodic", dir), 10*time.Millisecond)
+	defer b.Close()
+
+	if err := b.Save(newResources(2)); err != nil {
+		t.Fatal(err)
+	}
+	var loaded []resource
+	for i := 0; i < 100; i++ {
+		if err := pjson.New("periodic", dir).Load(&loaded); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(loaded) != 2 {
+		t.Errorf("the state was not flushed: %v", loaded)
+	}
+}
+
+const benchmarkResources = 10000
+
+// BenchmarkFullRewrite saves the whole state to the JSON store on every
+// change, like we do without batching.
+func BenchmarkFullRewrite(b *testing.B) {
+	store := pjson.New("full", b.TempDir())
+	resources := newResources(benchmarkResources)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.Save(resources); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBatchedSave saves the state on every change but only writes it
+// once.
+func BenchmarkBatchedSave(b *testing.B) {
+	store := New(pjson.New("batched", b.TempDir()), time.Hour)
+	resources := newResources(benchmarkResources)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.Save(resources); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"log"
 	"os"
 	"path"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
 )
 
 const (
@@ -49,7 +51,11 @@ func (f *FilePersistence) Save(i interface{}) error {
 	defer fh.Close()
 
 	enc := gob.NewEncoder(fh)
-	return enc.Encode(i)
+	if err := enc.Encode(i); err != nil {
+		return err
+	}
+	persistence.RecordStoreSize(f.filename)
+	return nil
 }
 
 // New returns a new FilePersistence instance.
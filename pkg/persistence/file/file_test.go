@@ -8,6 +8,9 @@ import (
 	"log"
 	"os"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
 )
 
 type Struct struct {
@@ -41,3 +44,24 @@ func TestSaveLoad(t *testing.T) {
 		log.Fatal("failed to save/load struct")
 	}
 }
+
+func TestStoreSize(t *testing.T) {
+	persistence.InitMetrics("test", "")
+
+	p := New("size", ".")
+	defer func() {
+		os.Remove(p.filename)
+	}()
+
+	if err := p.Save(&Struct{Foo: "foo", Bar: 1234}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(p.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := testutil.ToFloat64(persistence.StoreSize.WithLabelValues(p.filename))
+	if size != float64(info.Size()) {
+		t.Errorf("expected a store size of %d but got %f", info.Size(), size)
+	}
+}
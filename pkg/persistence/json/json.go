@@ -10,10 +10,17 @@ import (
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
 )
 
 const (
 	PersistenceMethod = "json"
+
+	// tempSuffix is added to the name of the temporary files we write the
+	// state to before moving them into place
+	tempSuffix = ".tmp-"
 )
 
 type JsonPersistence struct {
@@ -25,6 +32,14 @@ type JsonPersistence struct {
 func (f *JsonPersistence) Load(i interface{}) error {
 	log.Printf("Attempting to load state from %q.", f.filename)
 
+	// Temporary files are left behind if we crashed while saving, the state
+	// in them might be incomplete so we ignore them.
+	leftovers, _ := filepath.Glob(f.filename + tempSuffix + "*")
+	for _, leftover := range leftovers {
+		log.Printf("Removing the incomplete state file %q.", leftover)
+		os.Remove(leftover)
+	}
+
 	fh, err := os.Open(f.filename)
 	if err != nil {
 		return err
@@ -35,21 +50,54 @@ func (f *JsonPersistence) Load(i interface{}) error {
 	return dec.Decode(i)
 }
 
-// Save encodes the given interface to f.filename.
+// Save encodes the given interface to f.filename.  The state is written to a
+// temporary file that replaces f.filename once it's complete, so a failed
+// save never leaves f.filename half written.
 func (f *JsonPersistence) Save(i interface{}) error {
 	log.Printf("Attempting to save state to %q.", f.filename)
 
 	dirPath := path.Dir(f.filename)
 	os.MkdirAll(dirPath, 0700)
 
-	fh, err := os.Create(f.filename)
+	fh, err := os.CreateTemp(dirPath, path.Base(f.filename)+tempSuffix+"*")
 	if err != nil {
 		return err
 	}
-	defer fh.Close()
+	tempName := fh.Name()
+	defer os.Remove(tempName)
 
 	enc := json.NewEncoder(fh)
-	return enc.Encode(i)
+	if err := enc.Encode(i); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempName, f.filename); err != nil {
+		return err
+	}
+	syncDir(dirPath)
+
+	persistence.RecordStoreSize(f.filename)
+	return nil
+}
+
+// syncDir flushes the directory entries, so the rename of the state file
+// survives a crash.
+func syncDir(dirPath string) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		log.Printf("Error syncing the directory %q: %s", dirPath, err)
+	}
 }
 
 // New returns a new JsonPersistence instance.
@@ -7,7 +7,11 @@ package json
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
 )
 
 type Struct struct {
@@ -41,3 +45,58 @@ func TestSaveLoad(t *testing.T) {
 		log.Fatal("failed to save/load struct")
 	}
 }
+
+func TestStoreSize(t *testing.T) {
+	persistence.InitMetrics("test", "")
+
+	p := New("size", ".")
+	defer func() {
+		os.Remove(p.filename)
+	}()
+
+	if err := p.Save(&Struct{Foo: "foo", Bar: 1234}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(p.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := testutil.ToFloat64(persistence.StoreSize.WithLabelValues(p.filename))
+	if size != float64(info.Size()) {
+		t.Errorf("expected a store size of %d but got %f", info.Size(), size)
+	}
+}
+
+func TestPartialSave(t *testing.T) {
+
+	p := New("partial", t.TempDir())
+	good := &Struct{Foo: "foo", Bar: 1234}
+	if err := p.Save(good); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash while saving leaves a half written temporary file behind.
+	leftover := p.filename + tempSuffix + "1234"
+	if err := os.WriteFile(leftover, []byte(`{"Foo": "ba`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A failed save doesn't touch the stored state.
+	if err := p.Save(map[string]interface{}{"Foo": make(chan int)}); err == nil {
+		t.Fatal("expected an error saving a channel")
+	}
+
+	loaded := &Struct{}
+	if err := p.Load(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if *loaded != *good {
+		t.Errorf("expected %v but got %v", good, loaded)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("the leftover temporary file was not removed: %v", err)
+	}
+	temps, _ := filepath.Glob(p.filename + tempSuffix + "*")
+	if len(temps) != 0 {
+		t.Errorf("the failed save left temporary files behind: %v", temps)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persistence
+
+import (
+	"log"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// StoreSize is the size on disk of each store file, it helps to notice
+	// stores that keep growing.  It's nil until InitMetrics is called.
+	StoreSize *prometheus.GaugeVec
+)
+
+// InitMetrics registers the persistence metrics with the given namespace and
+// subsystem.  The sizes of the stores are only recorded once it's called.
+func InitMetrics(namespace, subsystem string) {
+	StoreSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "persistence_store_size_bytes",
+		Help:      "The size on disk of the persistence store files",
+	},
+		[]string{"file"},
+	)
+}
+
+// RecordStoreSize updates the StoreSize metric of the given file.
+func RecordStoreSize(filename string) {
+	if StoreSize == nil {
+		return
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		log.Printf("Can't get the size of %q: %s", filename, err)
+		return
+	}
+	StoreSize.WithLabelValues(filename).Set(float64(info.Size()))
+}
@@ -32,12 +32,23 @@ var (
 	},
 		[]string{"status", "type"},
 	)
+	imapConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "email_imap_connected",
+		Help: "If the distributor is connected to the imap server (1) or not (0)",
+	})
 )
 
 const (
 	durationIgnoreEmails = 24 * time.Hour
 )
 
+var (
+	// minImapRetryDelay and maxImapRetryDelay bound the time to wait before
+	// reconnecting to the imap server
+	minImapRetryDelay = time.Second
+	maxImapRetryDelay = 5 * time.Minute
+)
+
 type SendFunction func(subject, body string) error
 type IncomingEmailHandler func(msg *mail.Message, send SendFunction) error
 
@@ -47,6 +58,7 @@ type emailClient struct {
 	dist            distributors.Distributor
 	incomingHandler IncomingEmailHandler
 	smtpAuth        *smtp.Auth
+	timeBeforeRetry time.Duration
 }
 
 func StartEmail(emailCfg *internal.EmailConfig, distCfg *internal.Config,
@@ -74,28 +86,58 @@ func StartEmail(emailCfg *internal.EmailConfig, distCfg *internal.Config,
 		e.dist.Shutdown()
 
 		close(stop)
-		e.imap.Logout()
+		if e.imap != nil {
+			e.imap.Logout()
+		}
 	}()
 
-	stopped := false
-	for !stopped {
+	e.listenImap(stop)
+}
+
+// listenImap connects to the imap server and processes the incoming emails
+// until stop is closed.  If the connection fails it reconnects after an
+// exponential backoff.
+func (e *emailClient) listenImap(stop <-chan struct{}) {
+	e.timeBeforeRetry = minImapRetryDelay
+	for {
 		var err error
-		e.imap, err = initImap(emailCfg)
+		e.imap, err = initImap(e.cfg)
 		if err != nil {
-			log.Println("Can't init the imap client:", err)
-			time.Sleep(time.Second)
+			imapConnected.Set(0)
+			delay := e.expBackoff()
+			log.Printf("Can't init the imap client, retrying in %s: %s", delay, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
 			continue
 		}
+		imapConnected.Set(1)
+		e.timeBeforeRetry = minImapRetryDelay
 
-		if err := e.listenImapUpdates(stop); err != nil {
-			log.Println("Error listening emails:", err)
-		} else {
-			stopped = true
-		}
+		err = e.listenImapUpdates(stop)
+		imapConnected.Set(0)
 		e.imap.Logout()
+		if err == nil {
+			return
+		}
+		log.Println("Error listening emails:", err)
 	}
 }
 
+// expBackoff returns an exponentially increasing time duration with each
+// subsequent call; starting at minImapRetryDelay and maxing out at
+// maxImapRetryDelay.
+func (e *emailClient) expBackoff() time.Duration {
+	ret := e.timeBeforeRetry
+	e.timeBeforeRetry *= 2
+	if e.timeBeforeRetry > maxImapRetryDelay {
+		e.timeBeforeRetry = maxImapRetryDelay
+	}
+	return ret
+}
+
 func initImap(emailCfg *internal.EmailConfig) (c *client.Client, err error) {
 	splitedAddress := strings.Split(emailCfg.ImapServer, "://")
 	if len(splitedAddress) != 2 {
@@ -149,6 +191,8 @@ func (e *emailClient) waitForMailboxUpdate() (mboxUpdate *client.MailboxUpdate,
 	// Start idling
 	done := make(chan error, 1)
 	stop := make(chan struct{})
+	// go-imap restarts the IDLE command every 25 minutes by default, before
+	// servers drop idle connections after 30 minutes
 	go func() {
 		done <- e.imap.Idle(stop, &client.IdleOptions{})
 	}()
@@ -275,18 +319,32 @@ func dropEmail(msg *mail.Message) bool {
 }
 
 func (e *emailClient) reply(originalMessage *mail.Message, subject, body string) error {
-	sender, err := originalMessage.Header.AddressList("From")
+	to, msg, err := e.replyMessage(originalMessage, subject, body)
 	if err != nil {
 		return err
 	}
+	return e.send(to, msg)
+}
+
+// replyMessage composes a reply to originalMessage and returns the address
+// to send it to.  Several replies to the same message get the same threading
+// headers, so they are displayed in the same thread.
+func (e *emailClient) replyMessage(originalMessage *mail.Message, subject, body string) (string, string, error) {
+	sender, err := originalMessage.Header.AddressList("From")
+	if err != nil {
+		return "", "", err
+	}
 	if len(sender) != 1 {
-		return fmt.Errorf("Unexpected email from: %s", originalMessage.Header.Get("From"))
+		return "", "", fmt.Errorf("Unexpected email from: %s", originalMessage.Header.Get("From"))
 	}
 
+	messageID := originalMessage.Header.Get("Message-ID")
+	references := strings.TrimSpace(originalMessage.Header.Get("References") + " " + messageID)
 	msg := fmt.Sprintf("From: %s\r\n"+
 		"To: %s\r\n"+
 		"Subject: %s\r\n"+
 		"In-Reply-To: %s\r\n"+
+		"References: %s\r\n"+
 		"Auto-Submitted: auto-replied\r\n"+
 		"MIME-version: 1.0\r\n"+
 		"Content-Type: text/plain; charset=\"utf-8\"\r\n"+
@@ -294,13 +352,14 @@ func (e *emailClient) reply(originalMessage *mail.Message, subject, body string)
 		e.cfg.Address,
 		sender[0].String(),
 		subject,
-		originalMessage.Header.Get("Message-ID"),
+		messageID,
+		references,
 	)
 	scanner := bufio.NewScanner(strings.NewReader(body))
 	for scanner.Scan() {
 		msg += scanner.Text() + "\r\n"
 	}
-	return e.send(sender[0].Address, msg)
+	return sender[0].Address, msg, nil
 }
 
 func (e *emailClient) send(to string, msg string) error {
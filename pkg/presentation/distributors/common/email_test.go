@@ -5,8 +5,10 @@
 package common
 
 import (
+	"net"
 	"net/mail"
 	"os"
+	"reflect"
 	"strings"
 	"syscall"
 	"testing"
@@ -44,6 +46,7 @@ type testEmailDistributor struct{}
 
 func (ted *testEmailDistributor) Init(cfg *internal.Config) {}
 func (ted *testEmailDistributor) Shutdown()                 {}
+func (ted *testEmailDistributor) SupportedTypes() []string  { return []string{"obfs4"} }
 
 func testImapServer() (*server.Server, backend.Mailbox) {
 	be := memory.New()
@@ -102,3 +105,101 @@ func checkInboxEmptyAndExit(t *testing.T, mbox backend.Mailbox) {
 	}
 	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
 }
+
+func TestImapReconnectBackoff(t *testing.T) {
+	defer func(min, max time.Duration) {
+		minImapRetryDelay = min
+		maxImapRetryDelay = max
+	}(minImapRetryDelay, maxImapRetryDelay)
+	minImapRetryDelay = time.Millisecond
+	maxImapRetryDelay = 8 * time.Millisecond
+
+	// the imap server closes every connection, so every connection attempt
+	// fails
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	e := emailClient{cfg: &internal.EmailConfig{ImapServer: "imap://" + ln.Addr().String()}}
+	e.timeBeforeRetry = minImapRetryDelay
+	delays := []time.Duration{}
+	for i := 0; i < 5; i++ {
+		delays = append(delays, e.expBackoff())
+	}
+	expected := []time.Duration{
+		time.Millisecond,
+		2 * time.Millisecond,
+		4 * time.Millisecond,
+		8 * time.Millisecond,
+		8 * time.Millisecond,
+	}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("unexpected backoff delays %v", delays)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		e.listenImap(stop)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listenImap didn't stop")
+	}
+	if e.timeBeforeRetry != maxImapRetryDelay {
+		t.Errorf("backoff didn't grow to the maximum: %s", e.timeBeforeRetry)
+	}
+}
+
+func TestReplyThreading(t *testing.T) {
+	original, err := mail.ReadMessage(strings.NewReader("From: test@example.org\r\n" +
+		"Message-ID: <second@localhost>\r\n" +
+		"References: <first@localhost>\r\n" +
+		"\r\n" +
+		"get bridges"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := emailClient{cfg: &testEmailCfg}
+	headers := []mail.Header{}
+	for _, subject := range []string{"Re: bridges (1/2)", "Re: bridges (2/2)"} {
+		to, msg, err := e.replyMessage(original, subject, "bridges")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if to != "test@example.org" {
+			t.Errorf("unexpected recipient %q", to)
+		}
+		reply, err := mail.ReadMessage(strings.NewReader(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, reply.Header)
+	}
+
+	for _, header := range headers {
+		if inReplyTo := header.Get("In-Reply-To"); inReplyTo != "<second@localhost>" {
+			t.Errorf("unexpected In-Reply-To %q", inReplyTo)
+		}
+		if references := header.Get("References"); references != "<first@localhost> <second@localhost>" {
+			t.Errorf("unexpected References %q", references)
+		}
+	}
+}
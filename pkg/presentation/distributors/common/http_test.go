@@ -1,7 +1,10 @@
 package common
 
 import (
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
 )
 
@@ -22,3 +25,16 @@ func TestIpFromRequest(t *testing.T) {
 		t.Errorf("Wrong ip with proxy trust: %s", ip.String())
 	}
 }
+
+func TestSupportedTypesHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	SupportedTypesHandler(&testEmailDistributor{})(rec, httptest.NewRequest(http.MethodGet, SupportedTypesEndpoint, nil))
+
+	var types []string
+	if err := json.NewDecoder(rec.Body).Decode(&types); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(types, []string{"obfs4"}) {
+		t.Errorf("Wrong supported types: %v", types)
+	}
+}
@@ -6,6 +6,7 @@ package common
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"net/http"
 	"os"
@@ -19,8 +20,23 @@ import (
 
 const (
 	maxBytes = 100 * 1024 // 100KB
+
+	// SupportedTypesEndpoint lists the resource types that the distributor
+	// hands out, it's served by all the Web frontends.
+	SupportedTypesEndpoint = "/supported-types"
 )
 
+// SupportedTypesHandler returns a handler that answers with a JSON list of the
+// resource types that the given distributor hands out.
+func SupportedTypesHandler(dist distributors.Distributor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(dist.SupportedTypes()); err != nil {
+			log.Printf("Error encoding the supported types: %s", err)
+		}
+	}
+}
+
 // StartWebServer helps distributor frontends start a Web server and configure
 // handlers.  This function does not return until it receives a SIGINT or
 // SIGTERM.  When that happens, the function calls the distributor's Shutdown
@@ -54,6 +70,9 @@ func StartWebServer(apiCfg *internal.WebApiConfig, distCfg *internal.Config,
 	for endpoint, handlerFunc := range handlers {
 		mux.Handle(endpoint, handlerFunc)
 	}
+	if _, exists := handlers[SupportedTypesEndpoint]; !exists {
+		mux.Handle(SupportedTypesEndpoint, SupportedTypesHandler(dist))
+	}
 	srv.Handler = http.MaxBytesHandler(mux, maxBytes)
 
 	// srv.Addr = cfg.Distributors.Salmon.ApiAddress
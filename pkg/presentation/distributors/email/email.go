@@ -5,6 +5,7 @@
 package email
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -25,6 +26,7 @@ import (
 func InitFrontend(cfg *internal.Config) {
 	dist := &email.EmailDistributor{}
 	dist.Init(cfg)
+	help := commandsHelp(dist.SupportedTypes())
 
 	handler := func(msg *mail.Message, send common.SendFunction) error {
 		address, err := dist.ParseAddress(msg.Header.Get("From"))
@@ -36,8 +38,13 @@ func InitFrontend(cfg *internal.Config) {
 		}
 
 		subject := msg.Header.Get("Subject")
-		msgBody := io.MultiReader(strings.NewReader(subject+"\n"), msg.Body)
+		requestBody, err := io.ReadAll(msg.Body)
+		if err != nil {
+			return err
+		}
+		msgBody := io.MultiReader(strings.NewReader(subject+"\n"), bytes.NewReader(requestBody))
 		command := dist.ParseCommand(msgBody)
+		key := dist.ParsePublicKey(msg.Header, requestBody)
 
 		resources := dist.GetResources(address, command)
 		bridgeLines := []string{}
@@ -48,8 +55,27 @@ func InitFrontend(cfg *internal.Config) {
 			bridgeLines = append(bridgeLines, noBridges)
 		}
 
-		replyBody := fmt.Sprintf(body, strings.Join(bridgeLines, joinLines))
-		return send("Re: "+subject, replyBody)
+		replyBody := fmt.Sprintf(body, strings.Join(bridgeLines, joinLines), help)
+		var parts []string
+		if key != nil {
+			parts, err = dist.SplitEncryptedReply(key, replyBody)
+			if err != nil {
+				log.Println("Can't encrypt the reply, sending it unencrypted:", err)
+			}
+		}
+		if parts == nil {
+			parts = dist.SplitReply(replyBody)
+		}
+		for i, part := range parts {
+			replySubject := "Re: " + subject
+			if len(parts) > 1 {
+				replySubject += fmt.Sprintf(" (%d/%d)", i+1, len(parts))
+			}
+			if err := send(replySubject, part); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
 	http.Handle("/metrics", promhttp.Handler())
@@ -63,6 +89,26 @@ func InitFrontend(cfg *internal.Config) {
 	)
 }
 
+// commandsHelp lists the commands to request each of the given resource types,
+// in the format of the reply body.
+func commandsHelp(types []string) string {
+	var help strings.Builder
+	command := func(cmd, description string) {
+		fmt.Fprintf(&help, "  %-22s (%s)\n", cmd, description)
+	}
+
+	command("get bridges", "Request default Tor bridges.")
+	command("get ipv6", "Request IPv6 bridges.")
+	for _, rType := range types {
+		if rType == "vanilla" {
+			command("get vanilla", "Request unobfuscated Tor bridges.")
+		} else {
+			command("get transport "+rType, "Request "+rType+" obfuscated bridges.")
+		}
+	}
+	return help.String()
+}
+
 const (
 	body = `[This is an automated email.]
 
@@ -81,11 +127,7 @@ If you are using Tails, enter your bridge in the Tor Connection assistant.
 If these bridges are not what you need, reply to this email with one of
 the following commands in the message body:
 
-  get bridges            (Request default Tor bridges.)
-  get ipv6               (Request IPv6 bridges.)
-  get transport obfs4    (Request obfs4 obfuscated bridges.)
-  get vanilla            (Request unobfuscated Tor bridges.)
-`
+%s`
 	joinLines = `
 
 If it doesn't work, you can try this other bridge:
@@ -0,0 +1,20 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"testing"
+)
+
+func TestCommandsHelp(t *testing.T) {
+	const expected = `  get bridges            (Request default Tor bridges.)
+  get ipv6               (Request IPv6 bridges.)
+  get transport obfs4    (Request obfs4 obfuscated bridges.)
+  get vanilla            (Request unobfuscated Tor bridges.)
+`
+	if help := commandsHelp([]string{"obfs4", "vanilla"}); help != expected {
+		t.Errorf("Unexpected help:\n%s", help)
+	}
+}
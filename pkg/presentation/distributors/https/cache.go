@@ -0,0 +1,78 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"bytes"
+	"sync"
+
+	"golang.org/x/text/language"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/locales"
+)
+
+// pageCache keeps the static pages rendered for each language, so they don't
+// need to be rendered on every request
+type pageCache struct {
+	sync.RWMutex
+	languages []language.Tag
+	pages     map[string][]byte
+
+	render func(page string, lang string, input map[string]interface{}) ([]byte, error)
+}
+
+func newPageCache() (*pageCache, error) {
+	c := &pageCache{render: renderForLanguage}
+	return c, c.invalidate()
+}
+
+// invalidate drops all the rendered pages and reloads the languages of the
+// locale bundle.  It should be called when the templates or the locales
+// change.
+func (c *pageCache) invalidate() error {
+	bundle, err := locales.NewBundle()
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.languages = bundle.LanguageTags()
+	c.pages = make(map[string][]byte)
+	return nil
+}
+
+// get returns the page rendered in the language that best matches the
+// preferences, rendering it if it's not in the cache yet.
+func (c *pageCache) get(page string, langs []string, input map[string]interface{}) ([]byte, error) {
+	c.RLock()
+	lang := getPrimaryLanguage(langs, c.languages)
+	key := page + "|" + lang
+	content, ok := c.pages[key]
+	c.RUnlock()
+	if ok {
+		return content, nil
+	}
+
+	content, err := c.render(page, lang, input)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.pages[key] = content
+	return content, nil
+}
+
+func renderForLanguage(page string, lang string, input map[string]interface{}) ([]byte, error) {
+	context, err := newRenderingContextWithOpts([]string{lang})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = context.render(page, input, &buf)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPageCache(t *testing.T) {
+	var err error
+	staticPages, err = newPageCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	renders := 0
+	staticPages.render = func(page string, lang string, input map[string]interface{}) ([]byte, error) {
+		renders++
+		return renderForLanguage(page, lang, input)
+	}
+
+	handler := RequestHandleWith("homepage.html")
+	request := func(lang string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", lang)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Unexpected status code %d", rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	first := request("en")
+	if renders != 1 {
+		t.Fatalf("Expected the page to be rendered once, got %d", renders)
+	}
+	if second := request("en-US,en;q=0.5"); second != first {
+		t.Error("The cached page is different from the rendered one")
+	}
+	if renders != 1 {
+		t.Errorf("The second request rendered the page again")
+	}
+
+	err = staticPages.invalidate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request("en")
+	if renders != 2 {
+		t.Errorf("The page was not rendered again after invalidating the cache")
+	}
+}
@@ -1,10 +1,18 @@
 package https
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
+var (
+	errMissingBridgeType = errors.New("no bridge type was requested")
+	errTooManyNextSets   = errors.New("no more sets of bridges are available until the bridges rotate")
+)
+
 type requestInfo struct {
 	LanguagePreference []string
 	Path               string
@@ -13,6 +21,9 @@ type requestInfo struct {
 func extractRequestInfo(r *http.Request) (*requestInfo, error) {
 	var ri requestInfo
 	ri.LanguagePreference = getLanguagePreferenceFromHTTPHeaderAcceptLanguage(r.Header["Accept-Language"])
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		ri.LanguagePreference = append([]string{lang}, ri.LanguagePreference...)
+	}
 	ri.Path = r.URL.Path
 	return &ri, nil
 }
@@ -20,13 +31,43 @@ func extractRequestInfo(r *http.Request) (*requestInfo, error) {
 type requestInfoForBridge struct {
 	BridgeType    string
 	IPv6Requested bool
+	// NextSet is how many sets of bridges after the current one the
+	// requester is asking for
+	NextSet int
+	// Token identifies a set of bridges that the requester got before
+	Token string
 }
 
-func extractRequestInfoForBridge(r *http.Request) (*requestInfoForBridge, error) {
+// extractRequestInfoForBridge parses the bridge request and checks that the
+// requested bridge type is one of the supported types.
+func extractRequestInfoForBridge(r *http.Request, supportedTypes []string) (*requestInfoForBridge, error) {
 	var ri requestInfoForBridge
 	ri.BridgeType = r.URL.Query().Get("transport")
 	ri.IPv6Requested = r.URL.Query().Get("ipv6") == "yes"
-	return &ri, nil
+	if next := r.URL.Query().Get("next"); next != "" {
+		var err error
+		ri.NextSet, err = strconv.Atoi(next)
+		if err != nil || ri.NextSet < 0 {
+			return nil, fmt.Errorf("invalid next set of bridges %q", next)
+		}
+	}
+	ri.Token = r.URL.Query().Get("token")
+
+	switch ri.BridgeType {
+	case "":
+		return nil, errMissingBridgeType
+	case "0", "none":
+		// the options page requests "0" for bridges without pluggable
+		// transport
+		ri.BridgeType = "vanilla"
+	}
+	for _, t := range supportedTypes {
+		if t == ri.BridgeType {
+			return &ri, nil
+		}
+	}
+	return nil, fmt.Errorf("the bridge type %q is not supported, the supported types are: %s",
+		ri.BridgeType, strings.Join(supportedTypes, ", "))
 }
 
 func getLanguagePreferenceFromHTTPHeaderAcceptLanguage(headerValue []string) []string {
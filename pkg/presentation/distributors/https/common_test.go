@@ -0,0 +1,87 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+var supportedTypes = []string{"obfs4", "vanilla"}
+
+func TestExtractRequestInfoForBridge(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/bridges?transport=obfs4&ipv6=yes", nil)
+	ri, err := extractRequestInfoForBridge(r, supportedTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ri.BridgeType != "obfs4" || !ri.IPv6Requested {
+		t.Errorf("Wrong request info: %+v", ri)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/bridges?transport=0", nil)
+	ri, err = extractRequestInfoForBridge(r, supportedTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ri.BridgeType != "vanilla" || ri.IPv6Requested {
+		t.Errorf("Wrong request info for bridges without transport: %+v", ri)
+	}
+}
+
+func TestExtractRequestInfoForUnknownBridge(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/bridges?transport=webtunnel", nil)
+	_, err := extractRequestInfoForBridge(r, supportedTypes)
+	if err == nil {
+		t.Fatal("Unknown bridge type was accepted")
+	}
+	if !strings.Contains(err.Error(), "webtunnel") {
+		t.Errorf("The error doesn't mention the requested type: %s", err)
+	}
+
+	b := bridgeRequestHandler{cfg: &internal.Config{}}
+	b.cfg.Distributors.Https.Resources = supportedTypes
+	rec := httptest.NewRecorder()
+	b.RequestHandler(rec, r)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "bridgedb-request-error") {
+		t.Error("The response is not the error page")
+	}
+}
+
+func TestExtractRequestInfoForMissingBridge(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/bridges", nil)
+	_, err := extractRequestInfoForBridge(r, supportedTypes)
+	if err != errMissingBridgeType {
+		t.Errorf("Expected %q, got %v", errMissingBridgeType, err)
+	}
+}
+
+func TestExtractRequestInfoForNextSet(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/bridges?transport=obfs4&next=1", nil)
+	ri, err := extractRequestInfoForBridge(r, supportedTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ri.NextSet != 1 {
+		t.Errorf("Wrong next set: %+v", ri)
+	}
+	if url := nextSetURL(r, 2); url != "/bridges?next=2&transport=obfs4" {
+		t.Errorf("Wrong next set URL: %s", url)
+	}
+
+	for _, next := range []string{"-1", "one"} {
+		r = httptest.NewRequest(http.MethodGet, "/bridges?transport=obfs4&next="+next, nil)
+		if _, err := extractRequestInfoForBridge(r, supportedTypes); err == nil {
+			t.Errorf("Invalid next set %q was accepted", next)
+		}
+	}
+}
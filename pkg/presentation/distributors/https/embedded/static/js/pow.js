@@ -0,0 +1,47 @@
+// Solves the proof of work challenge of the bridges page and requests the
+// bridges again with the solution.  A solution is a nonce such that the
+// SHA-256 of "<challenge>:<nonce>" starts with at least `difficulty` zero
+// bits.
+
+function leadingZeroBits(hash) {
+  'use strict';
+  let zeros = 0;
+  for (const b of hash) {
+    if (b === 0) {
+      zeros += 8;
+      continue;
+    }
+    zeros += Math.clz32(b) - 24;
+    break;
+  }
+  return zeros;
+}
+
+async function solveChallenge() {
+  'use strict';
+  const element = document.getElementById('bridgedb-pow');
+  if (!element) {
+    return;
+  }
+  const challenge = element.dataset.challenge;
+  const difficulty = parseInt(element.dataset.difficulty, 10);
+  const encoder = new TextEncoder();
+
+  for (let nonce = 0; ; nonce++) {
+    const solution = challenge + ':' + nonce;
+    const digest = await crypto.subtle.digest('SHA-256', encoder.encode(solution));
+    if (leadingZeroBits(new Uint8Array(digest)) >= difficulty) {
+      const url = new URL(window.location.href);
+      url.searchParams.set('pow', solution);
+      window.location.replace(url.toString());
+      return;
+    }
+  }
+}
+
+document.addEventListener('DOMContentLoaded', function () {
+  'use strict';
+  solveChallenge().catch(function (e) {
+    console.log(e);
+  });
+});
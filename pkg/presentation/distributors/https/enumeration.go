@@ -0,0 +1,115 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+// defaultEnumerationWindow is the window in which the distinct bridges served
+// to each requester are counted, unless configured otherwise.
+const defaultEnumerationWindow = time.Hour
+
+// maxTrackedRequesters is the number of requesters that the enumeration
+// detector remembers, the least recently seen ones are forgotten first.
+const maxTrackedRequesters = 10000
+
+var enumerationSuspects = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "https_enumeration_suspects_total",
+	Help: "The number of times a requester got more distinct bridges than the enumeration threshold in a window",
+})
+
+// enumerationDetector keeps track of the distinct bridges served to the most
+// recent requesters, to detect requesters that cycle through the next sets
+// or retry to enumerate bridges.
+type enumerationDetector struct {
+	sync.Mutex
+	threshold  int
+	window     time.Duration
+	maxEntries int
+	suspects   prometheus.Counter
+
+	// lru has the most recently seen requesters at the front, and
+	// requesters maps their keys to their element of lru.
+	lru        *list.List
+	requesters map[core.Hashkey]*list.Element
+}
+
+// requesterRecord holds the distinct bridges served to a requester since
+// windowStart.
+type requesterRecord struct {
+	key         core.Hashkey
+	windowStart time.Time
+	bridges     map[string]bool
+}
+
+func newEnumerationDetector(threshold int, window time.Duration) *enumerationDetector {
+	return &enumerationDetector{
+		threshold:  threshold,
+		window:     window,
+		maxEntries: maxTrackedRequesters,
+		suspects:   enumerationSuspects,
+		lru:        list.New(),
+		requesters: make(map[core.Hashkey]*list.Element),
+	}
+}
+
+// record records the bridges served to the requester with the given key.  The
+// suspects metric is increased when the requester goes over the threshold of
+// distinct bridges in the current window.
+func (d *enumerationDetector) record(key core.Hashkey, bridges []string) {
+	d.Lock()
+	defer d.Unlock()
+
+	record := d.get(key)
+	wasOver := len(record.bridges) > d.threshold
+	for _, bridge := range bridges {
+		record.bridges[bridge] = true
+	}
+	if !wasOver && len(record.bridges) > d.threshold {
+		d.suspects.Inc()
+	}
+}
+
+// exceeded returns true if the requester with the given key got more
+// distinct bridges than the threshold in the current window.
+func (d *enumerationDetector) exceeded(key core.Hashkey) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	return len(d.get(key).bridges) > d.threshold
+}
+
+// get returns the record of the requester with the given key, creating it
+// if we don't remember the requester or its window is over.  The caller must
+// hold the lock.
+func (d *enumerationDetector) get(key core.Hashkey) *requesterRecord {
+	now := time.Now()
+	if elem, ok := d.requesters[key]; ok {
+		d.lru.MoveToFront(elem)
+		record := elem.Value.(*requesterRecord)
+		if now.Sub(record.windowStart) >= d.window {
+			record.windowStart = now
+			record.bridges = make(map[string]bool)
+		}
+		return record
+	}
+
+	record := &requesterRecord{key: key, windowStart: now, bridges: make(map[string]bool)}
+	d.requesters[key] = d.lru.PushFront(record)
+	if d.lru.Len() > d.maxEntries {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.requesters, oldest.Value.(*requesterRecord).key)
+	}
+	return record
+}
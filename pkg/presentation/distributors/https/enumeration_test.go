@@ -0,0 +1,90 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/https"
+)
+
+func newTestEnumerationDetector(threshold int) *enumerationDetector {
+	d := newEnumerationDetector(threshold, time.Hour)
+	d.suspects = prometheus.NewCounter(prometheus.CounterOpts{Name: "test_enumeration_suspects_total"})
+	return d
+}
+
+func TestEnumerationDetector(t *testing.T) {
+	d := newTestEnumerationDetector(6)
+	enumerator := https.RequesterKey(net.ParseIP("192.0.2.1"))
+	normal := https.RequesterKey(net.ParseIP("198.51.100.1"))
+
+	// The normal requester asks again and again for the same bridges, while
+	// the enumerator gets a new set every time.
+	for i := 0; i < 10; i++ {
+		d.record(normal, []string{"bridge 1", "bridge 2"})
+		d.record(enumerator, []string{fmt.Sprintf("bridge %d", 2*i), fmt.Sprintf("bridge %d", 2*i+1)})
+	}
+
+	if suspects := testutil.ToFloat64(d.suspects); suspects != 1 {
+		t.Errorf("Expected the enumerator to be counted once, got %v", suspects)
+	}
+	if !d.exceeded(enumerator) {
+		t.Error("The enumerator didn't exceed the threshold")
+	}
+	if d.exceeded(normal) {
+		t.Error("The normal requester exceeded the threshold")
+	}
+
+	// The enumerator starts from scratch in the next window.
+	d.requesters[enumerator].Value.(*requesterRecord).windowStart = time.Now().Add(-time.Hour)
+	if d.exceeded(enumerator) {
+		t.Error("The enumerator still exceeds the threshold in the next window")
+	}
+}
+
+func TestEnumerationDetectorBounded(t *testing.T) {
+	d := newTestEnumerationDetector(1)
+	d.maxEntries = 2
+
+	keys := []core.Hashkey{1, 2, 3}
+	for _, key := range keys {
+		d.record(key, []string{"bridge 1"})
+	}
+	if d.lru.Len() != 2 || len(d.requesters) != 2 {
+		t.Fatalf("Expected 2 tracked requesters, got %d", d.lru.Len())
+	}
+	if _, ok := d.requesters[keys[0]]; ok {
+		t.Error("The least recently seen requester was not forgotten")
+	}
+}
+
+func TestEnumerationThrottled(t *testing.T) {
+	b := bridgeRequestHandler{
+		cfg:         &internal.Config{},
+		enumeration: newTestEnumerationDetector(1),
+	}
+	b.cfg.Distributors.Https.Resources = supportedTypes
+	b.cfg.Distributors.Https.ThrottleEnumeration = true
+	b.enumeration.record(https.RequesterKey(net.ParseIP("192.0.2.1")), []string{"bridge 1", "bridge 2"})
+
+	r := httptest.NewRequest(http.MethodGet, "/bridges?transport=obfs4", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	b.RequestHandler(rec, r)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// powChallengeLifetime is how long a proof of work challenge can be
+	// solved and used
+	powChallengeLifetime = 10 * time.Minute
+	// powHeader is the header to send the proof of work solution in, as an
+	// alternative to the pow query parameter
+	powHeader = "X-Bridges-Pow"
+)
+
+var (
+	errPowMissing  = errors.New("no proof of work solution")
+	errPowInvalid  = errors.New("invalid proof of work challenge")
+	errPowExpired  = errors.New("expired proof of work challenge")
+	errPowReused   = errors.New("proof of work challenge already used")
+	errPowTooEasy  = errors.New("proof of work solution doesn't meet the difficulty")
+	errPowBadNonce = errors.New("malformed proof of work solution")
+)
+
+// proofOfWork issues challenges and validates their solutions.  Challenges
+// are signed, so we don't need to keep track of them until they are solved.
+// A solution is a nonce such that the SHA-256 of "<challenge>:<nonce>" starts
+// with at least difficulty zero bits.
+type proofOfWork struct {
+	sync.Mutex
+	key        []byte
+	difficulty int
+	// used maps the challenges already solved to their expiry time
+	used      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newProofOfWork(difficulty int) (*proofOfWork, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &proofOfWork{
+		key:        key,
+		difficulty: difficulty,
+		used:       make(map[string]time.Time),
+		lastPrune:  time.Now(),
+	}, nil
+}
+
+// challenge returns a new challenge for the client to solve
+func (p *proofOfWork) challenge() (string, error) {
+	payload := make([]byte, 8+16)
+	binary.BigEndian.PutUint64(payload, uint64(time.Now().Unix()))
+	if _, err := rand.Read(payload[8:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(p.mac(payload)), nil
+}
+
+// verify checks that the solution solves a valid challenge that was not used
+// before
+func (p *proofOfWork) verify(solution string) error {
+	if solution == "" {
+		return errPowMissing
+	}
+	separator := strings.LastIndex(solution, ":")
+	if separator == -1 {
+		return errPowBadNonce
+	}
+	challenge := solution[:separator]
+
+	encodedPayload, encodedMAC, found := strings.Cut(challenge, ".")
+	if !found {
+		return errPowInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil || len(payload) < 8 {
+		return errPowInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil || !hmac.Equal(mac, p.mac(payload)) {
+		return errPowInvalid
+	}
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0).Add(powChallengeLifetime)
+	if time.Now().After(expiry) {
+		return errPowExpired
+	}
+
+	hash := sha256.Sum256([]byte(solution))
+	if leadingZeroBits(hash[:]) < p.difficulty {
+		return errPowTooEasy
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if time.Since(p.lastPrune) > powChallengeLifetime {
+		p.prune()
+	}
+	if _, ok := p.used[challenge]; ok {
+		return errPowReused
+	}
+	p.used[challenge] = expiry
+	return nil
+}
+
+func (p *proofOfWork) mac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(payload)
+	return mac.Sum(nil)[:16]
+}
+
+// prune forgets the used challenges that are expired anyway.  It assumes that
+// the mutex is already locked.
+func (p *proofOfWork) prune() {
+	now := time.Now()
+	for challenge, expiry := range p.used {
+		if now.After(expiry) {
+			delete(p.used, challenge)
+		}
+	}
+	p.lastPrune = now
+}
+
+func leadingZeroBits(hash []byte) int {
+	zeros := 0
+	for _, b := range hash {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// powSolution returns the proof of work solution of the request, from the
+// pow query parameter or the X-Bridges-Pow header
+func powSolution(r *http.Request) string {
+	if solution := r.URL.Query().Get("pow"); solution != "" {
+		return solution
+	}
+	return r.Header.Get(powHeader)
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+const testPowDifficulty = 8
+
+func solvePow(challenge string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		solution := challenge + ":" + strconv.Itoa(nonce)
+		hash := sha256.Sum256([]byte(solution))
+		if leadingZeroBits(hash[:]) >= difficulty {
+			return solution
+		}
+	}
+}
+
+func TestPowValidSolution(t *testing.T) {
+	pow, err := newProofOfWork(testPowDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := pow.challenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	solution := solvePow(challenge, testPowDifficulty)
+	if err := pow.verify(solution); err != nil {
+		t.Errorf("Valid solution rejected: %s", err)
+	}
+	if err := pow.verify(solution); err != errPowReused {
+		t.Errorf("Expected %q reusing the solution, got %v", errPowReused, err)
+	}
+}
+
+func TestPowInvalidSolution(t *testing.T) {
+	pow, err := newProofOfWork(testPowDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := pow.challenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// find a nonce that doesn't meet the difficulty
+	nonce := 0
+	for ; ; nonce++ {
+		hash := sha256.Sum256([]byte(challenge + ":" + strconv.Itoa(nonce)))
+		if leadingZeroBits(hash[:]) < testPowDifficulty {
+			break
+		}
+	}
+	if err := pow.verify(challenge + ":" + strconv.Itoa(nonce)); err != errPowTooEasy {
+		t.Errorf("Expected %q, got %v", errPowTooEasy, err)
+	}
+
+	other, err := newProofOfWork(testPowDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherChallenge, err := other.challenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pow.verify(solvePow(otherChallenge, testPowDifficulty)); err != errPowInvalid {
+		t.Errorf("Expected %q for a challenge signed with another key, got %v", errPowInvalid, err)
+	}
+	if err := pow.verify(""); err != errPowMissing {
+		t.Errorf("Expected %q, got %v", errPowMissing, err)
+	}
+}
+
+func TestPowChallengePage(t *testing.T) {
+	b := bridgeRequestHandler{cfg: &internal.Config{}}
+	b.cfg.Distributors.Https.Resources = supportedTypes
+	var err error
+	b.pow, err = newProofOfWork(testPowDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		url    string
+		status int
+	}{
+		{"/bridges?transport=obfs4", http.StatusOK},
+		{"/bridges?transport=obfs4&pow=invalid:1", http.StatusForbidden},
+	} {
+		rec := httptest.NewRecorder()
+		b.RequestHandler(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != tc.status {
+			t.Errorf("Expected status %d for %s, got %d", tc.status, tc.url, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), "bridgedb-pow") {
+			t.Errorf("The response to %s is not a proof of work challenge", tc.url)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// countryRateLimiter allows a fixed number of requests per time window from
+// each country, to make it harder to enumerate bridges from a single country.
+type countryRateLimiter struct {
+	sync.Mutex
+	requestsPerWindow int
+	window            time.Duration
+	windowStart       time.Time
+	requests          map[string]int
+
+	// countryFromIP returns the country of the IP address, or an empty
+	// string if it's unknown.  All the requests of unknown countries share
+	// the same budget.
+	countryFromIP func(ip net.IP) string
+}
+
+func newCountryRateLimiter(requestsPerWindow int, window time.Duration, countryFromIP func(ip net.IP) string) *countryRateLimiter {
+	return &countryRateLimiter{
+		requestsPerWindow: requestsPerWindow,
+		window:            window,
+		windowStart:       time.Now(),
+		requests:          make(map[string]int),
+		countryFromIP:     countryFromIP,
+	}
+}
+
+// allow reports if a request from ip is allowed right now
+func (l *countryRateLimiter) allow(ip net.IP) bool {
+	country := strings.ToLower(l.countryFromIP(ip))
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.windowStart) >= l.window {
+		l.requests = make(map[string]int)
+		l.windowStart = now
+	}
+	if l.requests[country] >= l.requestsPerWindow {
+		return false
+	}
+	l.requests[country]++
+	return true
+}
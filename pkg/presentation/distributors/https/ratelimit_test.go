@@ -0,0 +1,98 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+var testCountries = map[string]string{
+	"192.0.2.1":    "AA",
+	"192.0.2.2":    "AA",
+	"198.51.100.1": "BB",
+}
+
+func testCountryFromIP(ip net.IP) string {
+	return testCountries[ip.String()]
+}
+
+func TestCountryRateLimit(t *testing.T) {
+	requestsPerWindow := 3
+	limiter := newCountryRateLimiter(requestsPerWindow, time.Hour, testCountryFromIP)
+
+	for i := 0; i < requestsPerWindow; i++ {
+		ip := "192.0.2.1"
+		if i%2 == 1 {
+			ip = "192.0.2.2"
+		}
+		if !limiter.allow(net.ParseIP(ip)) {
+			t.Fatalf("Request %d was limited", i)
+		}
+	}
+	if limiter.allow(net.ParseIP("192.0.2.2")) {
+		t.Error("The country budget was not exhausted")
+	}
+	if !limiter.allow(net.ParseIP("198.51.100.1")) {
+		t.Error("Another country was limited")
+	}
+
+	limiter.windowStart = time.Now().Add(-time.Hour)
+	if !limiter.allow(net.ParseIP("192.0.2.1")) {
+		t.Error("The budget was not renewed on the next window")
+	}
+}
+
+func TestCountryRateLimitedResponse(t *testing.T) {
+	b := bridgeRequestHandler{
+		cfg:     &internal.Config{},
+		dist:    testDistributor{},
+		limiter: newCountryRateLimiter(1, time.Hour, testCountryFromIP),
+	}
+	b.cfg.Distributors.Https.Resources = supportedTypes
+	if !b.limiter.allow(net.ParseIP("192.0.2.1")) {
+		t.Fatal("The first request was limited")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/bridges?transport=obfs4", nil)
+	r.RemoteAddr = "192.0.2.2:1234"
+	rec := httptest.NewRecorder()
+	b.RequestHandler(rec, r)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "bridgedb-rate-limited") {
+		t.Error("The response is not the rate limited page")
+	}
+}
+
+func TestCountryRateLimitNotChargedByChallenges(t *testing.T) {
+	b := bridgeRequestHandler{
+		cfg:     &internal.Config{},
+		dist:    testDistributor{},
+		limiter: newCountryRateLimiter(1, time.Hour, testCountryFromIP),
+	}
+	b.cfg.Distributors.Https.Resources = supportedTypes
+	var err error
+	b.pow, err = newProofOfWork(testPowDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/bridges?transport=obfs4", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		b.RequestHandler(httptest.NewRecorder(), r)
+	}
+	if !b.limiter.allow(net.ParseIP("192.0.2.2")) {
+		t.Error("Proof of work challenges were charged to the country limiter")
+	}
+}
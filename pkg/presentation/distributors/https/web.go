@@ -9,39 +9,115 @@ import (
 	"encoding/json"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"gitlab.torproject.org/tpo/anti-censorship/geoip"
 	"rsc.io/qr"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/locales"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/https"
 )
 
 var dist *https.HttpsDistributor
 
+// offeredLocales are the locales listed in the options page and advertised
+// in the locales endpoint
+var offeredLocales []string
+
+// staticPages caches the rendered pages that don't depend on the request
+var staticPages *pageCache
+
+// bridgeDistributor hands out the bridges of the bridge requests.
+type bridgeDistributor interface {
+	RequestNextBridgeSet(tpe string, ip net.IP, ipv6 bool, advance int) ([]string, string, error)
+	RequestBridgesByToken(token string, ipv6 bool) ([]string, error)
+	MaxNextSets() int
+}
+
 type bridgeRequestHandler struct {
-	cfg *internal.Config
+	cfg         *internal.Config
+	dist        bridgeDistributor
+	limiter     *countryRateLimiter
+	pow         *proofOfWork
+	enumeration *enumerationDetector
 }
 
 func (b *bridgeRequestHandler) RequestHandler(w http.ResponseWriter, r *http.Request) {
-	bridgeRequest, err := extractRequestInfoForBridge(r)
+	bridgeRequest, err := extractRequestInfoForBridge(r, b.cfg.Distributors.Https.Resources)
 	if err != nil {
-		http.RedirectHandler("static/error.html", http.StatusTemporaryRedirect).ServeHTTP(w, r)
-		log.Printf("Error extracting request info for bridge: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		renderPage(w, r, "bridges.html", map[string]interface{}{
+			"Error": err.Error(),
+		})
 		return
 	}
+	if b.pow != nil {
+		if err := b.pow.verify(powSolution(r)); err != nil {
+			b.powChallenge(w, r, err)
+			return
+		}
+	}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
+	ip := common.IpFromRequest(r, b.cfg.Distributors.Https.TrustProxy)
+	requester := https.RequesterKey(ip)
+	if b.enumeration != nil && b.cfg.Distributors.Https.ThrottleEnumeration && b.enumeration.exceeded(requester) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		renderPage(w, r, "bridges.html", map[string]interface{}{
+			"RateLimited": true,
+		})
+		return
+	}
 
-	resources, err := dist.RequestBridges(bridgeRequest.BridgeType, common.IpFromRequest(r, b.cfg.Distributors.Https.TrustProxy), bridgeRequest.IPv6Requested)
+	if bridgeRequest.NextSet > b.dist.MaxNextSets() {
+		w.WriteHeader(http.StatusBadRequest)
+		renderPage(w, r, "bridges.html", map[string]interface{}{
+			"Error": errTooManyNextSets.Error(),
+		})
+		return
+	}
+
+	var resources []string
+	token := bridgeRequest.Token
+	if token != "" {
+		resources, err = b.dist.RequestBridgesByToken(token, bridgeRequest.IPv6Requested)
+	} else {
+		resources, token, err = b.dist.RequestNextBridgeSet(bridgeRequest.BridgeType, ip, bridgeRequest.IPv6Requested, bridgeRequest.NextSet)
+	}
+	if err == https.InvalidBridgeSetToken {
+		w.WriteHeader(http.StatusBadRequest)
+		renderPage(w, r, "bridges.html", map[string]interface{}{
+			"Error": err.Error(),
+		})
+		return
+	}
 	if err != nil {
 		http.RedirectHandler("static/error.html", http.StatusTemporaryRedirect).ServeHTTP(w, r)
 		log.Printf("Error requesting bridges: %s", err)
 		return
 	}
+
+	// The country budget is only charged for requests that get bridges, so
+	// challenges and rejected requests don't use it up.
+	if b.limiter != nil && !b.limiter.allow(ip) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		renderPage(w, r, "bridges.html", map[string]interface{}{
+			"RateLimited": true,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if b.enumeration != nil {
+		b.enumeration.record(requester, resources)
+	}
 	data, err := json.Marshal(resources)
 	if err != nil {
 		http.RedirectHandler("static/error.html", http.StatusTemporaryRedirect).ServeHTTP(w, r)
@@ -58,9 +134,51 @@ func (b *bridgeRequestHandler) RequestHandler(w http.ResponseWriter, r *http.Req
 		resources = []string{"No bridges available"}
 	}
 	qrcodeInPNGInBase64 := base64.StdEncoding.EncodeToString(qrcode.PNG())
+	input := map[string]interface{}{
+		"BridgeLines":  resources,
+		"QRCode":       qrcodeInPNGInBase64,
+		"BridgeSetURL": bridgeSetURL(r, token),
+	}
+	if bridgeRequest.Token == "" && bridgeRequest.NextSet < b.dist.MaxNextSets() {
+		input["NextSetURL"] = nextSetURL(r, bridgeRequest.NextSet+1)
+	}
+	renderPage(w, r, "bridges.html", input)
+}
+
+// nextSetURL returns the URL of the request asking for the given next set of
+// bridges instead of the current one.
+func nextSetURL(r *http.Request, next int) string {
+	query := r.URL.Query()
+	query.Del("pow")
+	query.Set("next", strconv.Itoa(next))
+	return r.URL.Path + "?" + query.Encode()
+}
+
+// bridgeSetURL returns the URL of the request asking for the set of bridges of
+// the given token, so the requester can get the same bridges later.
+func bridgeSetURL(r *http.Request, token string) string {
+	query := r.URL.Query()
+	query.Del("pow")
+	query.Del("next")
+	query.Set("token", token)
+	return r.URL.Path + "?" + query.Encode()
+}
+
+// powChallenge responds with a page with a new proof of work challenge, that
+// the client needs to solve to get bridges.
+func (b *bridgeRequestHandler) powChallenge(w http.ResponseWriter, r *http.Request, verifyErr error) {
+	challenge, err := b.pow.challenge()
+	if err != nil {
+		http.RedirectHandler("static/error.html", http.StatusTemporaryRedirect).ServeHTTP(w, r)
+		log.Printf("Error creating a proof of work challenge: %s", err)
+		return
+	}
+	if verifyErr != errPowMissing {
+		w.WriteHeader(http.StatusForbidden)
+	}
 	renderPage(w, r, "bridges.html", map[string]interface{}{
-		"BridgeLines": resources,
-		"QRCode":      qrcodeInPNGInBase64,
+		"PowChallenge":  challenge,
+		"PowDifficulty": b.pow.difficulty,
 	})
 }
 
@@ -85,10 +203,64 @@ func renderPage(w http.ResponseWriter, r *http.Request, page string, input map[s
 	}
 }
 
+// allowedLocales returns the translated locales that are included in the
+// allowlist, or all of them if the allowlist is empty.
+func allowedLocales(allowlist []string) ([]string, error) {
+	available, err := locales.AvailableLocales()
+	if err != nil {
+		return nil, err
+	}
+	if len(allowlist) == 0 {
+		return available, nil
+	}
+
+	allowed := []string{}
+	for _, locale := range available {
+		for _, l := range allowlist {
+			if strings.EqualFold(l, locale) {
+				allowed = append(allowed, locale)
+				break
+			}
+		}
+	}
+	return allowed, nil
+}
+
+func localesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(offeredLocales); err != nil {
+		log.Printf("Error encoding the locales: %s", err)
+	}
+}
+
+func optionsHandler(w http.ResponseWriter, r *http.Request) {
+	renderStaticPage(w, r, "options.html", map[string]interface{}{
+		"Locales": offeredLocales,
+	})
+}
+
+// renderStaticPage serves the page from the cache of static pages, the input
+// must be the same for all requests.
+func renderStaticPage(w http.ResponseWriter, r *http.Request, page string, input map[string]interface{}) {
+	request, err := extractRequestInfo(r)
+	if err != nil {
+		http.RedirectHandler("static/error.html", http.StatusTemporaryRedirect).ServeHTTP(w, r)
+		log.Printf("Error extracting request info: %s", err)
+		return
+	}
+	content, err := staticPages.get(page, request.LanguagePreference, input)
+	if err != nil {
+		http.RedirectHandler("static/error.html", http.StatusTemporaryRedirect).ServeHTTP(w, r)
+		log.Printf("Error rendering template: %s", err)
+		return
+	}
+	w.Write(content)
+}
+
 func RequestHandleWith(path string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		path = strings.TrimPrefix(path, "/")
-		renderPage(w, r, path, nil)
+		renderStaticPage(w, r, path, nil)
 	}
 }
 
@@ -96,11 +268,52 @@ func RequestHandleWith(path string) func(w http.ResponseWriter, r *http.Request)
 // Web server and then waits until it receives a SIGINT.
 func InitFrontend(cfg *internal.Config) {
 
+	var err error
+	offeredLocales, err = allowedLocales(cfg.Distributors.Https.Locales)
+	if err != nil {
+		log.Fatalf("Error loading the available locales: %s", err)
+	}
+	if len(offeredLocales) == 0 {
+		log.Printf("None of the configured locales %v is translated", cfg.Distributors.Https.Locales)
+	}
+	staticPages, err = newPageCache()
+	if err != nil {
+		log.Fatalf("Error loading the locale bundle: %s", err)
+	}
+
 	dist = &https.HttpsDistributor{}
-	bridgeReq := bridgeRequestHandler{cfg: cfg}
+	bridgeReq := bridgeRequestHandler{cfg: cfg, dist: dist}
+	httpsCfg := &cfg.Distributors.Https
+	if httpsCfg.PowDifficulty > 0 {
+		bridgeReq.pow, err = newProofOfWork(httpsCfg.PowDifficulty)
+		if err != nil {
+			log.Fatalf("Error initialising the proof of work: %s", err)
+		}
+	}
+	if httpsCfg.EnumerationThreshold > 0 {
+		window := time.Duration(httpsCfg.EnumerationWindowMinutes) * time.Minute
+		if window <= 0 {
+			window = defaultEnumerationWindow
+		}
+		bridgeReq.enumeration = newEnumerationDetector(httpsCfg.EnumerationThreshold, window)
+	}
+	if httpsCfg.CountryRequestsPerWindow > 0 {
+		geoipdb, err := geoip.New(httpsCfg.GeoipDB, httpsCfg.Geoip6DB)
+		if err != nil {
+			log.Fatal("Can't load geoip databases", httpsCfg.GeoipDB, httpsCfg.Geoip6DB, ":", err)
+		}
+		bridgeReq.limiter = newCountryRateLimiter(
+			httpsCfg.CountryRequestsPerWindow,
+			time.Duration(httpsCfg.CountryRateLimitWindowMinutes)*time.Minute,
+			func(ip net.IP) string {
+				country, _ := geoipdb.GetCountryByAddr(ip)
+				return country
+			})
+	}
 	handlers := map[string]http.HandlerFunc{
 		"/":        http.HandlerFunc(RequestHandleWith("homepage.html")),
-		"/options": http.HandlerFunc(RequestHandleWith("options.html")),
+		"/options": optionsHandler,
+		"/locales": localesHandler,
 		"/bridges": http.HandlerFunc(bridgeReq.RequestHandler),
 		"/static/": func(writer http.ResponseWriter, request *http.Request) {
 			subEmbeddedFS, _ := fs.Sub(embedfs, "embedded")
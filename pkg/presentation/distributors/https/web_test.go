@@ -0,0 +1,134 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/locales"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/https"
+)
+
+// testDistributor gives a bridge named after the requested type and set, and
+// tokens made of them.
+type testDistributor struct{}
+
+func (testDistributor) RequestNextBridgeSet(tpe string, ip net.IP, ipv6 bool, advance int) ([]string, string, error) {
+	return []string{tpe + " bridge " + strconv.Itoa(advance)}, tpe + "-" + strconv.Itoa(advance), nil
+}
+
+func (testDistributor) RequestBridgesByToken(token string, ipv6 bool) ([]string, error) {
+	tpe, advance, found := strings.Cut(token, "-")
+	if !found {
+		return nil, https.InvalidBridgeSetToken
+	}
+	return []string{tpe + " bridge " + advance}, nil
+}
+
+func (testDistributor) MaxNextSets() int {
+	return 1
+}
+
+func TestLocales(t *testing.T) {
+	available, err := locales.AvailableLocales()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offeredLocales, err = allowedLocales([]string{"EN", "es", "xx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, locale := range offeredLocales {
+		if !contains(available, locale) {
+			t.Errorf("Locale %s is not in the bundle", locale)
+		}
+	}
+	if !contains(offeredLocales, locales.DefaultLanguage) {
+		t.Errorf("Allowed locale %s is not offered", locales.DefaultLanguage)
+	}
+
+	rec := httptest.NewRecorder()
+	localesHandler(rec, httptest.NewRequest(http.MethodGet, "/locales", nil))
+	var advertised []string
+	if err := json.NewDecoder(rec.Body).Decode(&advertised); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(advertised, ",") != strings.Join(offeredLocales, ",") {
+		t.Errorf("Advertised locales %v, expected %v", advertised, offeredLocales)
+	}
+
+	staticPages, err = newPageCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	optionsHandler(rec, httptest.NewRequest(http.MethodGet, "/options", nil))
+	if !strings.Contains(rec.Body.String(), "?lang="+locales.DefaultLanguage) {
+		t.Errorf("Locale %s is not listed in the options page", locales.DefaultLanguage)
+	}
+	if strings.Contains(rec.Body.String(), "?lang=es") {
+		t.Error("Locale es without translation is listed in the options page")
+	}
+
+	all, err := allowedLocales(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(all, ",") != strings.Join(available, ",") {
+		t.Errorf("Empty allowlist offers %v, expected %v", all, available)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBridgeSetURL(t *testing.T) {
+	b := bridgeRequestHandler{cfg: &internal.Config{}, dist: testDistributor{}}
+	b.cfg.Distributors.Https.Resources = supportedTypes
+
+	rec := httptest.NewRecorder()
+	b.RequestHandler(rec, httptest.NewRequest(http.MethodGet, "/bridges?transport=obfs4&next=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "obfs4 bridge 1") {
+		t.Error("The response doesn't have the requested bridges")
+	}
+	if !strings.Contains(rec.Body.String(), "token=obfs4-1") {
+		t.Error("The response doesn't link to the bridge set")
+	}
+
+	rec = httptest.NewRecorder()
+	b.RequestHandler(rec, httptest.NewRequest(http.MethodGet, "/bridges?transport=obfs4&token=obfs4-1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "obfs4 bridge 1") {
+		t.Error("The token didn't give the same bridges")
+	}
+	if strings.Contains(rec.Body.String(), "bridgedb-next-set") {
+		t.Error("The response to a token offers the next set of bridges")
+	}
+
+	rec = httptest.NewRecorder()
+	b.RequestHandler(rec, httptest.NewRequest(http.MethodGet, "/bridges?transport=obfs4&token=invalid", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid token, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
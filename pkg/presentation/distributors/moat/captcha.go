@@ -6,17 +6,64 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strings"
 
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
 )
 
 //go:embed captcha.jpg
 var captchaImage []byte
 
+// CaptchaProvider generates the captchas handed out by moat and verifies their
+// solutions.  The id of the captcha is sent to the user as part of the
+// challenge, and it comes back together with the solution.
+type CaptchaProvider interface {
+	// Generate returns a new captcha identified by id.
+	Generate() (id string, image []byte, err error)
+	// Verify returns true if solution solves the captcha identified by id.
+	Verify(id, solution string) bool
+}
+
+// captchaProviders maps the names of the captcha providers that can be
+// selected in the configuration to their constructors.
+var captchaProviders = map[string]func(cfg *internal.MoatDistConfig) (CaptchaProvider, error){
+	"static": newStaticCaptcha,
+}
+
+// newCaptchaProvider returns the captcha provider selected in the
+// configuration.
+func newCaptchaProvider(cfg *internal.MoatDistConfig) (CaptchaProvider, error) {
+	name := cfg.CaptchaProvider
+	if name == "" {
+		name = "static"
+	}
+	newProvider, exists := captchaProviders[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown captcha provider %q", name)
+	}
+	return newProvider(cfg)
+}
+
+// staticCaptcha always hands out the same image and accepts any solution.
+type staticCaptcha struct{}
+
+func newStaticCaptcha(*internal.MoatDistConfig) (CaptchaProvider, error) {
+	return staticCaptcha{}, nil
+}
+
+func (staticCaptcha) Generate() (string, []byte, error) {
+	return "", captchaImage, nil
+}
+
+func (staticCaptcha) Verify(id, solution string) bool {
+	return true
+}
+
 type captchaFetchRequest struct {
 	Data []captchaFetchRequestData `json:"data"`
 }
@@ -74,6 +121,13 @@ func (mh moatHandler) captchaFetchHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	id, image, err := mh.captcha.Generate()
+	if err != nil {
+		log.Println("Error generating captcha:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	response := captchaFetchResponse{
 		Data: []captchaFetchResponseData{
 			{
@@ -81,8 +135,8 @@ func (mh moatHandler) captchaFetchHandler(w http.ResponseWriter, r *http.Request
 				Type:      "moat-challenge",
 				Version:   "0.1.0",
 				Transport: transports,
-				Image:     base64.StdEncoding.EncodeToString(captchaImage),
-				Challenge: strings.Join(transports, "|"),
+				Image:     base64.StdEncoding.EncodeToString(image),
+				Challenge: makeChallenge(id, transports),
 			},
 		},
 	}
@@ -100,6 +154,7 @@ type captchaCheckRequest struct {
 
 type captchaCheckRequestData struct {
 	Challenge string `json:"challenge"`
+	Solution  string `json:"solution"`
 }
 
 type captchaCheckResponse struct {
@@ -136,12 +191,20 @@ func (mh moatHandler) captchaCheckHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	transports := strings.Split(request.Data[0].Challenge, "|")
+	id, transports := parseChallenge(request.Data[0].Challenge)
 	if len(transports) == 0 {
 		log.Println("No transports in captcha check:", request)
 		err = enc.Encode(invalidRequest)
 		return
 	}
+	if !mh.captcha.Verify(id, request.Data[0].Solution) {
+		err = enc.Encode(captchaIncorrect)
+		if err != nil {
+			log.Println("Error encoding jsonError:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
 	ip := common.IpFromRequest(r, mh.cfg.TrustProxy)
 	bridges := mh.dist.GetBridges(transports[0], ip)
 
@@ -162,3 +225,24 @@ func (mh moatHandler) captchaCheckHandler(w http.ResponseWriter, r *http.Request
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
+
+// makeChallenge builds the challenge sent to the user, it holds the captcha id
+// followed by the transports, like "id:obfs4|vanilla".  Captchas without id
+// only hold the transports.
+func makeChallenge(id string, transports []string) string {
+	challenge := strings.Join(transports, "|")
+	if id != "" {
+		challenge = id + ":" + challenge
+	}
+	return challenge
+}
+
+// parseChallenge returns the captcha id and the transports of a challenge
+// built by makeChallenge.
+func parseChallenge(challenge string) (id string, transports []string) {
+	if i := strings.Index(challenge, ":"); i >= 0 {
+		id = challenge[:i]
+		challenge = challenge[i+1:]
+	}
+	return id, strings.Split(challenge, "|")
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moat
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ipRateLimiter keeps a token bucket per requester IP address
+type ipRateLimiter struct {
+	sync.Mutex
+	limit     rate.Limit
+	burst     int
+	limiters  map[string]*ipLimiter
+	lastPrune time.Time
+}
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newIPRateLimiter creates a rate limiter that allows requestsPerMinute
+// requests per minute and IP address, with bursts of up to requestsPerMinute
+// requests
+func newIPRateLimiter(requestsPerMinute int) *ipRateLimiter {
+	return &ipRateLimiter{
+		limit:     rate.Limit(float64(requestsPerMinute) / 60),
+		burst:     requestsPerMinute,
+		limiters:  make(map[string]*ipLimiter),
+		lastPrune: time.Now(),
+	}
+}
+
+// allow reports if a request from ip is allowed right now
+func (l *ipRateLimiter) allow(ip net.IP) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > l.refillTime() {
+		l.prune(now)
+	}
+
+	key := ip.String()
+	il, ok := l.limiters[key]
+	if !ok {
+		il = &ipLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = il
+	}
+	il.lastSeen = now
+	return il.limiter.AllowN(now, 1)
+}
+
+// refillTime is the time it takes for an empty bucket to be full again
+func (l *ipRateLimiter) refillTime() time.Duration {
+	return time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+}
+
+// prune removes the limiters of the requesters we haven't seen for long
+// enough for their bucket to be full again, as they are equivalent to a new
+// limiter.  It assumes that the mutex is already locked.
+func (l *ipRateLimiter) prune(now time.Time) {
+	refill := l.refillTime()
+	for key, il := range l.limiters {
+		if now.Sub(il.lastSeen) > refill {
+			delete(l.limiters, key)
+		}
+	}
+	l.lastPrune = now
+}
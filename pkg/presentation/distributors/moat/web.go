@@ -26,6 +26,8 @@ type moatHandler struct {
 	dist    *moat.MoatDistributor
 	geoipdb *geoip.Geoip
 	cfg     *internal.MoatDistConfig
+	limiter *ipRateLimiter
+	captcha CaptchaProvider
 }
 
 type jsonError struct {
@@ -50,6 +52,14 @@ var (
 		Code:   404,
 		Detail: "No provided transport is available for this country",
 	}}}
+	tooManyRequests = jsonError{[]jsonErrorEntry{{
+		Code:   429,
+		Detail: "Too many requests, try again later",
+	}}}
+	captchaIncorrect = jsonError{[]jsonErrorEntry{{
+		Code:   419,
+		Detail: "The CAPTCHA solution was incorrect",
+	}}}
 )
 
 // InitFrontend is the entry point to HTTPS's Web frontend.  It spins up the
@@ -80,6 +90,13 @@ func InitFrontend(cfg *internal.Config) {
 	if err != nil {
 		log.Fatal("Can't load geoip databases", mh.cfg.GeoipDB, mh.cfg.Geoip6DB, ":", err)
 	}
+	mh.captcha, err = newCaptchaProvider(mh.cfg)
+	if err != nil {
+		log.Fatal("Can't initialize the captcha provider:", err)
+	}
+	if mh.cfg.CaptchaRequestsPerMinute > 0 {
+		mh.limiter = newIPRateLimiter(mh.cfg.CaptchaRequestsPerMinute)
+	}
 
 	handlers := map[string]http.HandlerFunc{
 		"/moat/circumvention/map":            http.HandlerFunc(mh.circumventionMapHandler),
@@ -93,10 +110,10 @@ func InitFrontend(cfg *internal.Config) {
 		"/meek/moat/circumvention/builtin":   http.HandlerFunc(mh.builtinHandler),
 		"/meek/moat/circumvention/defaults":  http.HandlerFunc(mh.circumventionDefaultsHandler),
 
-		"/moat/fetch":      http.HandlerFunc(mh.captchaFetchHandler),
-		"/moat/check":      http.HandlerFunc(mh.captchaCheckHandler),
-		"/meek/moat/fetch": http.HandlerFunc(mh.captchaFetchHandler),
-		"/meek/moat/check": http.HandlerFunc(mh.captchaCheckHandler),
+		"/moat/fetch":      mh.rateLimited(mh.captchaFetchHandler),
+		"/moat/check":      mh.rateLimited(mh.captchaCheckHandler),
+		"/meek/moat/fetch": mh.rateLimited(mh.captchaFetchHandler),
+		"/meek/moat/check": mh.rateLimited(mh.captchaCheckHandler),
 
 		"/metrics": promhttp.Handler().ServeHTTP,
 	}
@@ -109,6 +126,28 @@ func InitFrontend(cfg *internal.Config) {
 	)
 }
 
+// rateLimited wraps the handler to reply with an HTTP 429 to requesters that
+// exceed the configured requests per minute
+func (mh moatHandler) rateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	if mh.limiter == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := common.IpFromRequest(r, mh.cfg.TrustProxy)
+		if mh.limiter.allow(ip) {
+			handler(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		err := json.NewEncoder(w).Encode(tooManyRequests)
+		if err != nil {
+			log.Println("Error encoding jsonError:", err)
+		}
+	}
+}
+
 func loadFile(path string, loadFn func(r io.Reader) error) error {
 	f, err := os.Open(path)
 	if err != nil {
@@ -170,7 +209,7 @@ func (mh moatHandler) circumventionSettingsHandler(w http.ResponseWriter, r *htt
 	ip := common.IpFromRequest(r, mh.cfg.TrustProxy)
 	if request.Country == "" {
 		request.Country = mh.countryFromIP(ip)
-		if request.Country == "" {
+		if request.Country == "" && !mh.cfg.FallbackToDefaultsOnGeoipMiss {
 			log.Println("Could not find country code for cicrumvention settings")
 			err = enc.Encode(countryNotFound)
 			if err != nil {
@@ -182,7 +221,13 @@ func (mh moatHandler) circumventionSettingsHandler(w http.ResponseWriter, r *htt
 	}
 
 	shimToken := r.Header.Get("shim-token")
-	s, err := mh.dist.GetCircumventionSettings(request.Country, request.Transports, ip, shimToken)
+	var s *moat.CircumventionSettings
+	if request.Country == "" {
+		log.Println("Could not find country code for circumvention settings, falling back to the defaults")
+		s, err = mh.dist.GetCircumventionDefaults(request.Transports, ip, shimToken)
+	} else {
+		s, err = mh.dist.GetCircumventionSettings(request.Country, request.Transports, ip, shimToken)
+	}
 	if err != nil {
 		if errors.Is(err, moat.NoTransportError) {
 			err = enc.Encode(transportNotFound)
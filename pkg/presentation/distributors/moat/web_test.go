@@ -0,0 +1,195 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/geoip"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/moat"
+)
+
+func TestRateLimited(t *testing.T) {
+	const requestsPerMinute = 3
+	mh := moatHandler{
+		cfg:     &internal.MoatDistConfig{CaptchaRequestsPerMinute: requestsPerMinute},
+		limiter: newIPRateLimiter(requestsPerMinute),
+	}
+	handler := mh.rateLimited(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	})
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/moat/fetch", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	for i := 0; i < requestsPerMinute; i++ {
+		if rr := request("1.2.3.4:1234"); rr.Code != http.StatusOK {
+			t.Fatalf("request %d was rejected with %d", i, rr.Code)
+		}
+	}
+
+	rr := request("1.2.3.4:1234")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected HTTP return code 429 but got %d", rr.Code)
+	}
+	var jsonErr jsonError
+	if err := json.Unmarshal(rr.Body.Bytes(), &jsonErr); err != nil {
+		t.Fatalf("failed to unmarshal error: %s", err)
+	}
+	if len(jsonErr.Errors) != 1 || jsonErr.Errors[0].Code != http.StatusTooManyRequests {
+		t.Errorf("unexpected error response: %v", jsonErr)
+	}
+
+	if rr := request("5.6.7.8:1234"); rr.Code != http.StatusOK {
+		t.Errorf("request from a different IP was rejected with %d", rr.Code)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := newIPRateLimiter(60)
+	l.allow(net.IPv4(1, 2, 3, 4))
+	l.allow(net.IPv4(5, 6, 7, 8))
+
+	l.Lock()
+	l.limiters["1.2.3.4"].lastSeen = time.Now().Add(-2 * time.Minute)
+	l.prune(time.Now())
+	l.Unlock()
+
+	if _, ok := l.limiters["1.2.3.4"]; ok {
+		t.Error("idle limiter was not pruned")
+	}
+	if _, ok := l.limiters["5.6.7.8"]; !ok {
+		t.Error("active limiter was pruned")
+	}
+}
+
+func TestCircumventionSettingsGeoipMiss(t *testing.T) {
+	// Empty geoip databases don't resolve any IP address.
+	dir := t.TempDir()
+	geoipFile := filepath.Join(dir, "geoip")
+	if err := os.WriteFile(geoipFile, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	geoipdb, err := geoip.New(geoipFile, geoipFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dist := &moat.MoatDistributor{}
+	defaults := `{"settings": [{"bridges": {"type": "obfs4", "source": "builtin", "bridge_strings": ["obfs4 1.2.3.4:1234"]}}]}`
+	if err := dist.LoadCircumventionDefaults(strings.NewReader(defaults)); err != nil {
+		t.Fatal(err)
+	}
+	mh := moatHandler{
+		dist:    dist,
+		geoipdb: geoipdb,
+		cfg:     &internal.MoatDistConfig{},
+	}
+
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/moat/circumvention/settings", nil)
+		req.RemoteAddr = "1.2.3.4:1234"
+		rr := httptest.NewRecorder()
+		mh.circumventionSettingsHandler(rr, req)
+		return rr
+	}
+
+	var jsonErr jsonError
+	if err := json.Unmarshal(request().Body.Bytes(), &jsonErr); err != nil {
+		t.Fatalf("failed to unmarshal error: %s", err)
+	}
+	if len(jsonErr.Errors) != 1 || jsonErr.Errors[0].Code != http.StatusNotAcceptable {
+		t.Errorf("expected a 406 error without fallback but got: %v", jsonErr)
+	}
+
+	mh.cfg.FallbackToDefaultsOnGeoipMiss = true
+	var settings moat.CircumventionSettings
+	if err := json.Unmarshal(request().Body.Bytes(), &settings); err != nil {
+		t.Fatalf("failed to unmarshal settings: %s", err)
+	}
+	if len(settings.Settings) != 1 || settings.Settings[0].Bridges.BridgeStrings[0] != "obfs4 1.2.3.4:1234" {
+		t.Errorf("expected the circumvention defaults but got: %v", settings)
+	}
+}
+
+// mockCaptcha is a captcha provider with a single captcha.
+type mockCaptcha struct{}
+
+func (mockCaptcha) Generate() (string, []byte, error) {
+	return "mock-id", []byte("mock image"), nil
+}
+
+func (mockCaptcha) Verify(id, solution string) bool {
+	return id == "mock-id" && solution == "solution"
+}
+
+func TestCaptchaProvider(t *testing.T) {
+	cfg := &internal.Config{}
+	cfg.Backend.WebApi.ApiAddress = "127.0.0.1:1"
+	cfg.Distributors.Moat.Resources = []string{"obfs4"}
+	dist := &moat.MoatDistributor{
+		FetchBridges: func(string) (map[string][]string, error) { return nil, nil },
+	}
+	dist.Init(cfg)
+	defer dist.Shutdown()
+	mh := moatHandler{
+		dist:    dist,
+		cfg:     &cfg.Distributors.Moat,
+		captcha: mockCaptcha{},
+	}
+
+	rr := httptest.NewRecorder()
+	mh.captchaFetchHandler(rr, httptest.NewRequest("POST", "/moat/fetch", strings.NewReader(`{"data": [{"supported": ["obfs4"]}]}`)))
+	var fetchResponse captchaFetchResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &fetchResponse); err != nil {
+		t.Fatalf("failed to unmarshal fetch response: %s", err)
+	}
+	if len(fetchResponse.Data) != 1 || fetchResponse.Data[0].Challenge != "mock-id:obfs4" ||
+		fetchResponse.Data[0].Image != base64.StdEncoding.EncodeToString([]byte("mock image")) {
+		t.Fatalf("unexpected fetch response: %v", fetchResponse)
+	}
+
+	check := func(solution string) []byte {
+		body := fmt.Sprintf(`{"data": [{"id": "2", "challenge": %q, "solution": %q}]}`,
+			fetchResponse.Data[0].Challenge, solution)
+		req := httptest.NewRequest("POST", "/moat/check", strings.NewReader(body))
+		req.RemoteAddr = "1.2.3.4:1234"
+		rr := httptest.NewRecorder()
+		mh.captchaCheckHandler(rr, req)
+		return rr.Body.Bytes()
+	}
+
+	var jsonErr jsonError
+	if err := json.Unmarshal(check("wrong"), &jsonErr); err != nil {
+		t.Fatalf("failed to unmarshal error: %s", err)
+	}
+	if len(jsonErr.Errors) != 1 || jsonErr.Errors[0].Code != 419 {
+		t.Errorf("expected a 419 error for a wrong solution but got: %v", jsonErr)
+	}
+
+	var checkResponse captchaCheckResponse
+	if err := json.Unmarshal(check("solution"), &checkResponse); err != nil {
+		t.Fatalf("failed to unmarshal check response: %s", err)
+	}
+	if len(checkResponse.Data) != 1 || checkResponse.Data[0].Bridges == nil {
+		t.Errorf("unexpected check response: %v", checkResponse)
+	}
+}
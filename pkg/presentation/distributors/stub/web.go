@@ -5,7 +5,9 @@
 package stub
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
@@ -31,6 +33,15 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// StatsHandler handles requests for /stats, reporting the resources we got
+// over the resource stream.
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dist.Stats()); err != nil {
+		log.Printf("Error encoding the stream stats: %s", err)
+	}
+}
+
 // InitFrontend is the entry point to stub's Web frontend.  It spins up a Web
 // server and then waits until it receives a SIGINT.  Note that we can
 // implement all sorts of user-facing frontends here.  It doesn't have to be a
@@ -42,7 +53,8 @@ func InitFrontend(cfg *internal.Config) {
 	// logic.  This file implements the user-facing distribution code.
 	dist = &stub.StubDistributor{}
 	handlers := map[string]http.HandlerFunc{
-		"/": http.HandlerFunc(RequestHandler),
+		"/":      http.HandlerFunc(RequestHandler),
+		"/stats": http.HandlerFunc(StatsHandler),
 	}
 
 	common.StartWebServer(
@@ -6,6 +6,7 @@ package telegram
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -16,6 +17,8 @@ import (
 	"time"
 
 	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/locales"
@@ -29,6 +32,13 @@ const (
 	TelegramPollTimeout = 10 * time.Second
 )
 
+var authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "telegram_auth_failures_total",
+	Help: "The total number of update requests that failed authentication by reason",
+},
+	[]string{"reason", "endpoint"},
+)
+
 type TBot struct {
 	bot          *tb.Bot
 	dist         *telegram.TelegramDistributor
@@ -42,6 +52,8 @@ type TBot struct {
 // InitFrontend is the entry point to telegram'ss frontend.  It connects to telegram over
 // the bot API and waits for user commands.
 func InitFrontend(cfg *internal.Config) {
+	persistence.InitMetrics("telegram", "")
+
 	newBridgesStore := make(map[string]persistence.Mechanism, len(cfg.Distributors.Telegram.UpdaterTokens))
 	for updater := range cfg.Distributors.Telegram.UpdaterTokens {
 		newBridgesStore[updater] = pjson.New(updater, cfg.Distributors.Telegram.StorageDir)
@@ -74,6 +86,7 @@ func InitFrontend(cfg *internal.Config) {
 	}()
 
 	http.HandleFunc("/update", tbot.updateHandler)
+	http.HandleFunc("/test-results", tbot.testResultsHandler)
 	http.Handle("/metrics", promhttp.Handler())
 	go http.ListenAndServe(cfg.Distributors.Telegram.ApiAddress, nil)
 
@@ -203,7 +216,16 @@ func (t *TBot) getHelp(c tb.Context) error {
 			Other: helpmsg,
 		},
 	})
-	return c.Send(msg, menu)
+	typesMsg, _ := localizer.Localize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "TelegramSupportedTypes",
+			Other: "The bridges I hand out are of type: {{.Types}}",
+		},
+		TemplateData: map[string]string{
+			"Types": strings.Join(t.dist.SupportedTypes(), ", "),
+		},
+	})
+	return c.Send(msg+"\n\n"+typesMsg, menu)
 }
 
 func (t *TBot) getLoxHelp(c tb.Context) error {
@@ -353,25 +375,69 @@ func (t *TBot) updateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	err := t.dist.LoadNewBridges(name, r.Body)
-	if err != nil {
+	report, err := t.dist.LoadNewBridges(name, r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case errors.Is(err, telegram.UpdateTooLarge):
+		log.Printf("Rejecting the update of %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, telegram.MalformedUpdate):
+		log.Printf("Rejecting the update of %s: %v", name, err)
+		if report == nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	case err != nil:
 		log.Printf("Error loading bridges: %v", err)
 		http.Error(w, "error while loading bridges", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("Error encoding the update report: %v", err)
+	}
+}
+
+func (t *TBot) testResultsHandler(w http.ResponseWriter, r *http.Request) {
+	name := t.getTokenName(w, r)
+	if name == "" {
+		return
+	}
+	defer r.Body.Close()
+
+	updated, err := t.dist.SetNewBridgesTestResults(r.Body)
+	switch {
+	case errors.Is(err, telegram.UpdateTooLarge):
+		log.Printf("Rejecting the test results of %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, telegram.MalformedUpdate):
+		log.Printf("Rejecting the test results of %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("Error setting the test results: %v", err)
+		http.Error(w, "error while setting the test results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"updated_bridges\": %d}\n", updated)
 }
 
 func (t *TBot) getTokenName(w http.ResponseWriter, r *http.Request) string {
 	tokenLine := r.Header.Get("Authorization")
 	if tokenLine == "" {
 		log.Printf("Request carries no 'Authorization' HTTP header.")
+		authFailures.WithLabelValues("no_header", r.URL.Path).Inc()
 		http.Error(w, "request carries no 'Authorization' HTTP header", http.StatusBadRequest)
 		return ""
 	}
 	if !strings.HasPrefix(tokenLine, "Bearer ") {
 		log.Printf("Authorization header contains no bearer token.")
+		authFailures.WithLabelValues("no_bearer", r.URL.Path).Inc()
 		http.Error(w, "authorization header contains no bearer token", http.StatusBadRequest)
 		return ""
 	}
@@ -385,6 +451,7 @@ func (t *TBot) getTokenName(w http.ResponseWriter, r *http.Request) string {
 	}
 
 	log.Printf("Invalid authentication token.")
+	authFailures.WithLabelValues("invalid_token", r.URL.Path).Inc()
 	http.Error(w, "invalid authentication token", http.StatusUnauthorized)
 	return ""
 }
@@ -0,0 +1,45 @@
+// Copyright (c) 2021-2023, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGetTokenNameAuthFailures(t *testing.T) {
+	bot := TBot{updateTokens: map[string]string{"updater": "secret"}}
+
+	for reason, authHeader := range map[string]string{
+		"no_header":     "",
+		"no_bearer":     "Basic foo",
+		"invalid_token": "Bearer invalid",
+	} {
+		counter := authFailures.WithLabelValues(reason, "/update")
+		before := testutil.ToFloat64(counter)
+
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/update", nil)
+		if authHeader != "" {
+			r.Header.Set("Authorization", authHeader)
+		}
+		if name := bot.getTokenName(rr, r); name != "" {
+			t.Errorf("broken request got token name %s: %q", name, authHeader)
+		}
+		if after := testutil.ToFloat64(counter); after != before+1 {
+			t.Errorf("expected the %s auth failure counter to increase, got %f", reason, after)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/update", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	if name := bot.getTokenName(rr, r); name != "updater" {
+		t.Errorf("expected token name updater but got %q", name)
+	}
+}
@@ -12,13 +12,18 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/mdp/qrterminal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/gettor"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 	"go.mau.fi/whatsmeow"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/store/sqlstore"
@@ -32,13 +37,43 @@ const (
 	DistName = "whatsapp"
 )
 
+var (
+	reconnectCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "whatsapp_reconnect_attempts_total",
+		Help: "The total number of attempts to reconnect to WhatsApp",
+	},
+		[]string{"status"},
+	)
+
+	// minReconnectDelay and maxReconnectDelay bound the time to wait before
+	// retrying to reconnect to WhatsApp
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 5 * time.Minute
+)
+
+// waClient is the part of the WhatsApp client used to keep the connection
+// alive, so it can be replaced in the tests.
+type waClient interface {
+	Connect() error
+	IsConnected() bool
+}
+
 type whatsapp struct {
 	client      *whatsmeow.Client
+	conn        waClient
 	distributor *gettor.GettorDistributor
+	cfg         *internal.WhatsAppConfig
+
+	// reconnecting is locked while there is a reconnection loop running
+	reconnecting    sync.Mutex
+	timeBeforeRetry time.Duration
+	stop            chan struct{}
 }
 
 func InitFrontend(cfg *internal.Config) {
 	var w whatsapp
+	w.cfg = &cfg.Distributors.Whatsapp
+	w.stop = make(chan struct{})
 	w.distributor = &gettor.GettorDistributor{}
 	w.distributor.Init(cfg)
 
@@ -78,7 +113,10 @@ func (w *whatsapp) connect(cfg *internal.Config) error {
 	// Initialize the client
 	clientLog := waLog.Stdout("Client", "INFO", true)
 	w.client = whatsmeow.NewClient(device, clientLog)
+	// we handle the reconnections ourselves to back off between attempts
+	w.client.EnableAutoReconnect = false
 	w.client.AddEventHandler(w.eventHandler)
+	w.conn = w.client
 
 	// Connect to WhatsApp
 	if w.client.Store.ID == nil {
@@ -102,25 +140,68 @@ func (w *whatsapp) connect(cfg *internal.Config) error {
 			}
 		}
 	} else {
-		// Already logged in, just connect
-		err = w.client.Connect()
+		// Already logged in, recover the stored session
+		w.reconnect()
 		log.Println("Login Success")
-		if err != nil {
-			return err
-		}
 	}
 
 	return nil
 }
 
 func (w *whatsapp) disconnect() {
+	close(w.stop)
 	w.client.Disconnect()
 }
 
+// reconnect tries to connect to WhatsApp with the stored session until it
+// succeeds or the distributor is stopped, backing off exponentially between
+// attempts.
+func (w *whatsapp) reconnect() {
+	if !w.reconnecting.TryLock() {
+		return
+	}
+	defer w.reconnecting.Unlock()
+
+	w.timeBeforeRetry = minReconnectDelay
+	for !w.conn.IsConnected() {
+		err := w.conn.Connect()
+		if err == nil {
+			reconnectCount.WithLabelValues("success").Inc()
+			return
+		}
+		reconnectCount.WithLabelValues("error").Inc()
+
+		delay := w.expBackoff()
+		log.Printf("Can't connect to WhatsApp, retrying in %s: %s", delay, err)
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// expBackoff returns an exponentially increasing time duration with each
+// subsequent call; starting at minReconnectDelay and maxing out at
+// maxReconnectDelay.
+func (w *whatsapp) expBackoff() time.Duration {
+	ret := w.timeBeforeRetry
+	w.timeBeforeRetry *= 2
+	if w.timeBeforeRetry > maxReconnectDelay {
+		w.timeBeforeRetry = maxReconnectDelay
+	}
+	return ret
+}
+
 func (w *whatsapp) eventHandler(evt interface{}) {
-	supportedPlatforms := w.distributor.SupportedPlatforms()
 	switch v := evt.(type) {
+	case *events.Disconnected:
+		log.Println("Disconnected from WhatsApp, reconnecting")
+		go w.reconnect()
+	case *events.LoggedOut:
+		log.Printf("The WhatsApp session was logged out (%s), the device needs to be linked again", v.Reason)
 	case *events.Message:
+		supportedPlatforms := w.distributor.SupportedPlatforms()
 		platform := strings.ToLower(v.Message.GetConversation())
 
 		// Check if the platform is one of the supported platforms
@@ -128,8 +209,8 @@ func (w *whatsapp) eventHandler(evt interface{}) {
 			log.Println("Requested platform:", platform)
 			links := w.distributor.GetAliasedLinks(platform)
 			// Send the links to the recipient via WhatsApp
-			for _, link := range links {
-				if err := w.sendMessage(link.Link, v.Info.Chat); err != nil {
+			for _, message := range linksMessages(links, w.cfg.MaxLinks, w.cfg.LinksPerMessage) {
+				if err := w.sendMessage(message, v.Info.Chat); err != nil {
 					log.Println("Error sending the links message:", err)
 				}
 			}
@@ -154,6 +235,32 @@ func (w *whatsapp) sendMessage(message string, receiver types.JID) error {
 	return nil
 }
 
+// linksMessages returns the messages to send the links, with at most maxLinks
+// links and linksPerMessage links in each message.  If they are 0 all the
+// links are sent, each in its own message.
+func linksMessages(links []*resources.TBLink, maxLinks int, linksPerMessage int) []string {
+	if maxLinks > 0 && len(links) > maxLinks {
+		links = links[:maxLinks]
+	}
+	if linksPerMessage <= 0 {
+		linksPerMessage = 1
+	}
+
+	messages := []string{}
+	for i := 0; i < len(links); i += linksPerMessage {
+		end := i + linksPerMessage
+		if end > len(links) {
+			end = len(links)
+		}
+		linkList := []string{}
+		for _, link := range links[i:end] {
+			linkList = append(linkList, link.Link)
+		}
+		messages = append(messages, strings.Join(linkList, "\n"))
+	}
+	return messages
+}
+
 func contains(platformSlice []string, elem string) bool {
 	for _, platform := range platformSlice {
 		if platform == elem {
@@ -0,0 +1,107 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package whatsapp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// fakeClient fails the first failures connection attempts
+type fakeClient struct {
+	sync.Mutex
+	failures  int
+	attempts  int
+	connected bool
+	done      chan struct{}
+}
+
+func (c *fakeClient) Connect() error {
+	c.Lock()
+	defer c.Unlock()
+	c.attempts++
+	if c.attempts <= c.failures {
+		return errors.New("connection failed")
+	}
+	c.connected = true
+	close(c.done)
+	return nil
+}
+
+func (c *fakeClient) IsConnected() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.connected
+}
+
+func TestReconnectOnDisconnect(t *testing.T) {
+	defer func(min time.Duration) { minReconnectDelay = min }(minReconnectDelay)
+	minReconnectDelay = time.Millisecond
+	conn := &fakeClient{failures: 2, done: make(chan struct{})}
+	w := whatsapp{conn: conn, stop: make(chan struct{})}
+	defer close(w.stop)
+
+	w.eventHandler(&events.Disconnected{})
+	select {
+	case <-conn.done:
+	case <-time.After(time.Second):
+		t.Fatal("The disconnection didn't trigger a reconnection")
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+	if conn.attempts != 3 {
+		t.Errorf("Expected 3 connection attempts, got %d", conn.attempts)
+	}
+	if w.timeBeforeRetry != 4*time.Millisecond {
+		t.Errorf("Expected the retry delay to back off to 4ms, got %s", w.timeBeforeRetry)
+	}
+}
+
+func TestLinksMessages(t *testing.T) {
+	links := []*resources.TBLink{}
+	for i := 0; i < 10; i++ {
+		links = append(links, &resources.TBLink{Link: fmt.Sprintf("https://example.com/%d", i)})
+	}
+
+	testCases := []struct {
+		maxLinks        int
+		linksPerMessage int
+		messages        int
+		linksSent       int
+	}{
+		{0, 0, 10, 10},
+		{3, 0, 3, 3},
+		{0, 4, 3, 10},
+		{5, 2, 3, 5},
+		{20, 20, 1, 10},
+	}
+	for _, testCase := range testCases {
+		messages := linksMessages(links, testCase.maxLinks, testCase.linksPerMessage)
+		if len(messages) != testCase.messages {
+			t.Errorf("expected %d messages with max links %d and %d links per message, got %d: %q",
+				testCase.messages, testCase.maxLinks, testCase.linksPerMessage, len(messages), messages)
+		}
+		linksSent := 0
+		for _, message := range messages {
+			linksSent += len(strings.Split(message, "\n"))
+		}
+		if linksSent != testCase.linksSent {
+			t.Errorf("expected %d links sent with max links %d and %d links per message, got %d",
+				testCase.linksSent, testCase.maxLinks, testCase.linksPerMessage, linksSent)
+		}
+	}
+
+	if messages := linksMessages(nil, 3, 2); len(messages) != 0 {
+		t.Errorf("unexpected messages without links: %q", messages)
+	}
+}
@@ -5,7 +5,12 @@
 package gettor
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -14,6 +19,7 @@ import (
 	"os/signal"
 	"path"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -26,14 +32,17 @@ import (
 )
 
 const (
-	downloadsURL    = "https://aus1.torproject.org/torbrowser/update_3/release/"
 	updateFrequency = time.Hour
 	releaseName     = "Tor Browser %s-%s"
 	multilocale     = "ALL"
+	// sumsFile is published next to the Tor Browser binaries with the
+	// sha256 of each of them
+	sumsFile = "sha256sums-signed-build.txt"
 )
 
 var (
-	releaseBody = "These releases were uploaded to be distributed with gettor."
+	downloadsURL = "https://aus1.torproject.org/torbrowser/update_3/"
+	releaseBody  = "These releases were uploaded to be distributed with gettor."
 
 	versionDownloadCount = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -56,12 +65,37 @@ var (
 			Help: "counts the version update per platform",
 		},
 		[]string{"platform", "provider"})
+
+	downloadLinksErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gettor_download_links_error_count",
+			Help: "the total number of errors fetching the downloads json per platform",
+		},
+		[]string{"platform"})
+
+	sentLinks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gettor_sent_links_count",
+			Help: "the total number of links sent to the backend per result (accepted, rejected or error)",
+		},
+		[]string{"status"})
+
+	checksumFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gettor_checksum_failures_count",
+			Help: "the total number of downloaded binaries that failed the checksum verification per platform",
+		},
+		[]string{"platform"})
 )
 
 // updatedLinks keeps the links to be sent to the backend
 // we want to keep them as a global variable to be able to retry if the backend fails
 var updatedLinks = []*resources.TBLink{}
 
+// updatedLinksLock protects updatedLinks, as an abandoned update cycle might
+// still be running when the next one starts
+var updatedLinksLock sync.Mutex
+
 // platforms map the url json name to the platform name we use in gettor
 var platforms = map[string]string{
 	"download-android-aarch64.json": "android-aarch64",
@@ -75,22 +109,35 @@ var platforms = map[string]string{
 	"download-windows-x86_64.json":  "win64",
 }
 
+// channels map the Tor Browser update channels to the suffix we add to the
+// platform names of their links, so e.g. the alpha links for win64 are
+// distributed as win64-alpha
+var channels = map[string]string{
+	"release": "",
+	"alpha":   "-alpha",
+}
+
+const defaultChannel = "release"
+
 type (
 	uploadFileFunc func(binaryPath string, sigPath string) *resources.TBLink
 	provider       interface {
-		needsUpdate(platform string, version resources.Version) bool
-		newRelease(platform string, version resources.Version) uploadFileFunc
+		needsUpdate(ctx context.Context, platform string, version resources.Version) bool
+		newRelease(ctx context.Context, platform string, version resources.Version) uploadFileFunc
 	}
 )
 
 type providerExtRefreshLink interface {
-	needsUpdateRefreshOnly(platform string, version resources.Version) bool
+	needsUpdateRefreshOnly(ctx context.Context, platform string, version resources.Version) bool
 }
 
 type downloadsLinks struct {
 	Version string `json:"version"`
 	Binary  string `json:"binary"`
 	Sig     string `json:"sig"`
+	// Sha256 is the hex encoded checksum of the binary, if it's not present
+	// the checksum is fetched from the sums file of the release
+	Sha256 string `json:"sha256"`
 }
 
 func InitUpdater(cfg *internal.Config) {
@@ -132,23 +179,73 @@ func InitUpdater(cfg *internal.Config) {
 		s3Provider, err := newS3Updater(&s3Config)
 		if err != nil {
 			log.Printf("cannot create S3 provider: %v", err)
+			continue
 		}
 		providers = append(providers, s3Provider)
 	}
 
-	updateIfNeeded(updater, providers)
+	enabledChannels := []string{}
+	for _, channel := range cfg.Updaters.Gettor.Channels {
+		if _, ok := channels[channel]; !ok {
+			log.Printf("Unknown Tor Browser channel %q, ignoring it", channel)
+			continue
+		}
+		enabledChannels = append(enabledChannels, channel)
+	}
+	if len(enabledChannels) == 0 {
+		enabledChannels = []string{defaultChannel}
+	}
+
+	timeout := time.Duration(cfg.Updaters.Gettor.UpdateTimeoutMinutes) * time.Minute
+	if timeout <= 0 {
+		timeout = updateFrequency
+	}
+
+	runUpdate(updater, providers, enabledChannels, timeout)
 
 	for {
 		select {
 		case <-stop:
 			return
 		case <-time.After(updateFrequency):
-			updateIfNeeded(updater, providers)
+			runUpdate(updater, providers, enabledChannels, timeout)
+		}
+	}
+}
+
+// runUpdate runs an update cycle and cancels it if it doesn't finish before
+// the timeout, so a stuck provider doesn't stall the next cycles
+func runUpdate(updater *gettor.GettorUpdater, providers []provider, enabledChannels []string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		updateIfNeeded(ctx, updater, providers, enabledChannels)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Update cycle didn't finish after %s, cancelling it", timeout)
+		<-done
+	}
+}
+
+// downloadsJSONs returns a map of the downloads json urls of the given
+// channels to the platform name we use in gettor for them
+func downloadsJSONs(enabledChannels []string) map[string]string {
+	jsons := make(map[string]string)
+	for _, channel := range enabledChannels {
+		for platformJSON, platform := range platforms {
+			jsons[downloadsURL+channel+"/"+platformJSON] = platform + channels[channel]
 		}
 	}
+	return jsons
 }
 
-func updateIfNeeded(updater *gettor.GettorUpdater, providers []provider) {
+func updateIfNeeded(ctx context.Context, updater *gettor.GettorUpdater, providers []provider, enabledChannels []string) {
 	tmpDir, err := ioutil.TempDir("", "gettor-")
 	if err != nil {
 		log.Println("Can't create temporary file:", err)
@@ -156,25 +253,30 @@ func updateIfNeeded(updater *gettor.GettorUpdater, providers []provider) {
 	}
 	defer os.RemoveAll(tmpDir)
 
-	for platformJSON, platform := range platforms {
-		downloads, version, err := getDownloadLinks(platformJSON)
-		if err != nil {
-			log.Println("Error fetching downloads.json:", err)
+	for jsonURL, platform := range downloadsJSONs(enabledChannels) {
+		if ctx.Err() != nil {
 			return
 		}
 
+		downloads, version, err := getDownloadLinks(ctx, jsonURL)
+		if err != nil {
+			log.Printf("Error fetching downloads json, skipping %s: %v", platform, err)
+			downloadLinksErrors.WithLabelValues(platform).Inc()
+			continue
+		}
+
 		shouldDownload := false
 		uploadFuncs := []uploadFileFunc{}
 		for _, p := range providers {
-			if p.needsUpdate(platform, version) {
+			if p.needsUpdate(ctx, platform, version) {
 				if refreshOnly, ok := p.(providerExtRefreshLink); ok {
-					if !refreshOnly.needsUpdateRefreshOnly(platform, version) {
+					if !refreshOnly.needsUpdateRefreshOnly(ctx, platform, version) {
 						shouldDownload = true
 					}
 				} else {
 					shouldDownload = true
 				}
-				fn := p.newRelease(platform, version)
+				fn := p.newRelease(ctx, platform, version)
 				if fn != nil {
 					uploadFuncs = append(uploadFuncs, fn)
 				}
@@ -192,50 +294,88 @@ func updateIfNeeded(updater *gettor.GettorUpdater, providers []provider) {
 		if !shouldDownload {
 			getAssetPath = constructAssetPath
 		}
-		binaryPath, err := getAssetPath(downloads.Binary, tmpDir)
+		binaryPath, err := getAssetPath(ctx, downloads.Binary, tmpDir)
 		if err != nil {
 			log.Println("Error getting asset:", err)
 			continue
 		}
-		sigPath, err := getAssetPath(downloads.Sig, tmpDir)
+		sigPath, err := getAssetPath(ctx, downloads.Sig, tmpDir)
 		if err != nil {
 			log.Println("Error getting asset:", err)
+			os.Remove(binaryPath)
 			continue
 		}
 
+		if shouldDownload {
+			err = verifyBinary(ctx, downloads, binaryPath)
+			if err != nil {
+				log.Printf("Checksum verification failed, skipping upload of %s: %v", platform, err)
+				checksumFailures.WithLabelValues(platform).Inc()
+				os.Remove(binaryPath)
+				os.Remove(sigPath)
+				continue
+			}
+		}
+
+		links := []*resources.TBLink{}
 		for _, fn := range uploadFuncs {
 			link := fn(binaryPath, sigPath)
 			if link != nil {
-				updatedLinks = append(updatedLinks, link)
+				links = append(links, link)
 			}
 		}
 
 		os.Remove(binaryPath)
 		os.Remove(sigPath)
 
-		if len(updatedLinks) == 0 {
-			return
-		}
+		sendLinks(ctx, updater, links, platform, version)
+	}
+}
 
-		err = updater.AddLinks(updatedLinks)
-		if err != nil {
-			log.Println("Error sending links to the backend:", err)
-		} else {
-			log.Println("Updated links for", platform, version.String(), "in the backend")
-			updatedLinks = nil
+// sendLinks sends the new links together with any links that failed to be
+// sent before to the backend
+func sendLinks(ctx context.Context, updater *gettor.GettorUpdater, links []*resources.TBLink, platform string, version resources.Version) {
+	updatedLinksLock.Lock()
+	defer updatedLinksLock.Unlock()
+
+	updatedLinks = append(updatedLinks, links...)
+	if len(updatedLinks) == 0 {
+		return
+	}
+
+	results, err := updater.AddLinks(ctx, updatedLinks)
+	if err != nil {
+		log.Println("Error sending links to the backend:", err)
+		sentLinks.WithLabelValues("error").Add(float64(len(updatedLinks)))
+		return
+	}
+
+	// The links rejected by the backend would be rejected again, so they are
+	// dropped and only retried if the backend could not be reached.
+	rejected := 0
+	for _, result := range results {
+		if result.Accepted {
+			sentLinks.WithLabelValues("accepted").Inc()
+			continue
 		}
+		log.Printf("The backend rejected the %s link for %s: %s", result.Link.Provider, result.Link.Platform, result.Reason)
+		sentLinks.WithLabelValues("rejected").Inc()
+		rejected++
 	}
+	log.Printf("Sent links for %s %s to the backend, %d accepted and %d rejected",
+		platform, version.String(), len(results)-rejected, rejected)
+	updatedLinks = nil
 }
 
-func constructAssetPath(url string, tmpDir string) (filePath string, err error) {
+func constructAssetPath(ctx context.Context, url string, tmpDir string) (filePath string, err error) {
 	segments := strings.Split(url, "/")
 	fileName := segments[len(segments)-1]
 	filePath = path.Join(tmpDir, fileName)
 	return fileName, nil
 }
 
-func getAsset(url string, tmpDir string) (filePath string, err error) {
-	filePath, err = constructAssetPath(url, tmpDir)
+func getAsset(ctx context.Context, url string, tmpDir string) (filePath string, err error) {
+	filePath, err = constructAssetPath(ctx, url, tmpDir)
 	if err != nil {
 		return
 	}
@@ -245,7 +385,7 @@ func getAsset(url string, tmpDir string) (filePath string, err error) {
 	}
 	defer file.Close()
 
-	resp, err := http.Get(url)
+	resp, err := httpGet(ctx, url)
 	if err != nil {
 		return
 	}
@@ -255,13 +395,80 @@ func getAsset(url string, tmpDir string) (filePath string, err error) {
 	return
 }
 
-func getDownloadLinks(platformJSON string) (downloads downloadsLinks, version resources.Version, err error) {
-	resp, err := http.Get(downloadsURL + platformJSON)
+// verifyBinary checks the sha256 of the downloaded binary against the one in
+// the downloads json or, if it's not there, in the sums file of the release
+func verifyBinary(ctx context.Context, downloads downloadsLinks, binaryPath string) error {
+	expected := downloads.Sha256
+	if expected == "" {
+		var err error
+		expected, err = getChecksum(ctx, downloads.Binary)
+		if err != nil {
+			return err
+		}
+	}
+	return verifyChecksum(binaryPath, expected)
+}
+
+func verifyChecksum(filePath string, expected string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(sum, expected) {
+		return fmt.Errorf("%s has sha256 %s but %s was expected", path.Base(filePath), sum, expected)
+	}
+	return nil
+}
+
+// getChecksum looks for the sha256 of the binary in the sums file published
+// in the same directory
+func getChecksum(ctx context.Context, binaryURL string) (string, error) {
+	sumsURL := binaryURL[:strings.LastIndex(binaryURL, "/")+1] + sumsFile
+	resp, err := httpGet(ctx, sumsURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code fetching %s: %s", sumsURL, resp.Status)
+	}
+
+	fileName := path.Base(binaryURL)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == fileName {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%s is not listed in %s", fileName, sumsURL)
+}
+
+func getDownloadLinks(ctx context.Context, jsonURL string) (downloads downloadsLinks, version resources.Version, err error) {
+	resp, err := httpGet(ctx, jsonURL)
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected status code fetching %s: %s", jsonURL, resp.Status)
+		return
+	}
+
 	d := json.NewDecoder(resp.Body)
 	err = d.Decode(&downloads)
 	if err != nil {
@@ -272,3 +479,11 @@ func getDownloadLinks(platformJSON string) (downloads downloadsLinks, version re
 	versionDownloadCount.WithLabelValues(version.String()).Inc()
 	return
 }
+
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,343 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/updaters/gettor"
+)
+
+type dummyProvider struct {
+	checked map[string]bool
+}
+
+func (p *dummyProvider) needsUpdate(ctx context.Context, platform string, version resources.Version) bool {
+	p.checked[platform] = true
+	return false
+}
+
+func (p *dummyProvider) newRelease(ctx context.Context, platform string, version resources.Version) uploadFileFunc {
+	return nil
+}
+
+// blockingProvider blocks checking if an update is needed until the context is
+// cancelled
+type blockingProvider struct {
+	cancelled bool
+}
+
+func (p *blockingProvider) needsUpdate(ctx context.Context, platform string, version resources.Version) bool {
+	<-ctx.Done()
+	p.cancelled = true
+	return false
+}
+
+func (p *blockingProvider) newRelease(ctx context.Context, platform string, version resources.Version) uploadFileFunc {
+	return nil
+}
+
+// refreshProvider needs to update all platforms without downloading the
+// binaries, but only produces a link for linkPlatform
+type refreshProvider struct {
+	linkPlatform string
+}
+
+func (p *refreshProvider) needsUpdate(ctx context.Context, platform string, version resources.Version) bool {
+	return true
+}
+
+func (p *refreshProvider) needsUpdateRefreshOnly(ctx context.Context, platform string, version resources.Version) bool {
+	return true
+}
+
+func (p *refreshProvider) newRelease(ctx context.Context, platform string, version resources.Version) uploadFileFunc {
+	return func(binaryPath string, sigPath string) *resources.TBLink {
+		if platform != p.linkPlatform {
+			return nil
+		}
+		link := resources.NewTBLink()
+		link.Platform = platform
+		link.Version = version
+		link.Link = "https://example.com/" + binaryPath
+		return link
+	}
+}
+
+// uploadProvider needs to download and upload all platforms and records the
+// platforms uploaded
+type uploadProvider struct {
+	sync.Mutex
+	uploaded map[string]bool
+}
+
+func (p *uploadProvider) needsUpdate(ctx context.Context, platform string, version resources.Version) bool {
+	return true
+}
+
+func (p *uploadProvider) newRelease(ctx context.Context, platform string, version resources.Version) uploadFileFunc {
+	return func(binaryPath string, sigPath string) *resources.TBLink {
+		p.Lock()
+		defer p.Unlock()
+		p.uploaded[platform] = true
+		return nil
+	}
+}
+
+func serveDownloadsJSON(missingJSON string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, missingJSON) {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/alpha/") {
+			w.Write([]byte(`{"version": "14.0a1", "binary": "https://example.com/tor-alpha.bin", "sig": "https://example.com/tor-alpha.bin.asc"}`))
+			return
+		}
+		w.Write([]byte(`{"version": "13.0.1", "binary": "https://example.com/tor.bin", "sig": "https://example.com/tor.bin.asc"}`))
+	}))
+}
+
+func serveBackend(t *testing.T, received *[]*resources.TBLink) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var links []*resources.TBLink
+		err := json.NewDecoder(r.Body).Decode(&links)
+		assert.NoError(t, err)
+		*received = append(*received, links...)
+		w.Write([]byte("{}"))
+	}))
+}
+
+func newTestUpdater(backendURL string) *gettor.GettorUpdater {
+	cfg := &internal.Config{}
+	cfg.Backend.WebApi.ApiAddress = strings.TrimPrefix(backendURL, "http://")
+	cfg.Backend.ResourcesEndpoint = "/resources"
+	updater := &gettor.GettorUpdater{}
+	updater.Init(cfg)
+	return updater
+}
+
+func TestUpdateSkipsMissingPlatform(t *testing.T) {
+	const missingJSON = "download-macos.json"
+	missingPlatform := platforms[missingJSON]
+
+	ts := serveDownloadsJSON(missingJSON)
+	defer ts.Close()
+
+	oldURL := downloadsURL
+	downloadsURL = ts.URL + "/"
+	defer func() { downloadsURL = oldURL }()
+
+	errorsBefore := testutil.ToFloat64(downloadLinksErrors.WithLabelValues(missingPlatform))
+
+	p := &dummyProvider{checked: make(map[string]bool)}
+	updateIfNeeded(context.Background(), nil, []provider{p}, []string{"release"})
+
+	for _, platform := range platforms {
+		if platform == missingPlatform {
+			assert.False(t, p.checked[platform], "platform with a missing downloads json was processed")
+		} else {
+			assert.True(t, p.checked[platform], "platform %s was not processed", platform)
+		}
+	}
+	assert.Equal(t, errorsBefore+1, testutil.ToFloat64(downloadLinksErrors.WithLabelValues(missingPlatform)))
+}
+
+func TestUpdateDeliversLinksOnError(t *testing.T) {
+	ts := serveDownloadsJSON("download-macos.json")
+	defer ts.Close()
+
+	oldURL := downloadsURL
+	downloadsURL = ts.URL + "/"
+	defer func() { downloadsURL = oldURL }()
+
+	var received []*resources.TBLink
+	backend := serveBackend(t, &received)
+	defer backend.Close()
+	updater := newTestUpdater(backend.URL)
+
+	updatedLinks = nil
+	defer func() { updatedLinks = nil }()
+	updateIfNeeded(context.Background(), updater, []provider{&refreshProvider{linkPlatform: "linux64"}}, []string{"release"})
+
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, "linux64", received[0].Platform)
+	}
+	assert.Empty(t, updatedLinks)
+}
+
+func TestRunUpdateTimeout(t *testing.T) {
+	ts := serveDownloadsJSON("none.json")
+	defer ts.Close()
+
+	oldURL := downloadsURL
+	downloadsURL = ts.URL + "/"
+	defer func() { downloadsURL = oldURL }()
+
+	p := &blockingProvider{}
+
+	timeout := 100 * time.Millisecond
+	start := time.Now()
+	runUpdate(nil, []provider{p}, []string{"release"}, timeout)
+	elapsed := time.Since(start)
+
+	assert.GreaterOrEqual(t, elapsed, timeout)
+	assert.Less(t, elapsed, 10*timeout, "update cycle was not cancelled at the timeout")
+	assert.True(t, p.cancelled, "runUpdate returned before the update cycle finished")
+}
+
+func TestUpdateAlphaChannel(t *testing.T) {
+	ts := serveDownloadsJSON("none.json")
+	defer ts.Close()
+
+	oldURL := downloadsURL
+	downloadsURL = ts.URL + "/"
+	defer func() { downloadsURL = oldURL }()
+
+	var received []*resources.TBLink
+	backend := serveBackend(t, &received)
+	defer backend.Close()
+	updater := newTestUpdater(backend.URL)
+
+	updatedLinks = nil
+	defer func() { updatedLinks = nil }()
+	updateIfNeeded(context.Background(), updater, []provider{&refreshProvider{linkPlatform: "win64-alpha"}}, []string{"release", "alpha"})
+
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, "win64-alpha", received[0].Platform)
+		assert.Equal(t, "14.0.0a1", received[0].Version.String())
+		assert.Equal(t, "https://example.com/tor-alpha.bin", received[0].Link)
+	}
+}
+
+func TestUpdateVerifiesChecksum(t *testing.T) {
+	const (
+		binary       = "tor browser binary"
+		sumsVerified = "linux64"
+	)
+	sum := sha256.Sum256([]byte(binary))
+	checksum := hex.EncodeToString(sum[:])
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, ".json"):
+			platform := platforms[path.Base(r.URL.Path)]
+			binaryURL := ts.URL + "/dist/" + platform + "/tor-" + platform + ".bin"
+			downloads := downloadsLinks{
+				Version: "13.0.1",
+				Binary:  binaryURL,
+				Sig:     binaryURL + ".asc",
+				Sha256:  strings.Repeat("0", 64),
+			}
+			if platform == sumsVerified {
+				downloads.Sha256 = ""
+			}
+			json.NewEncoder(w).Encode(downloads)
+		case strings.HasSuffix(r.URL.Path, sumsFile):
+			w.Write([]byte(checksum + "  tor-" + sumsVerified + ".bin\n"))
+		default:
+			w.Write([]byte(binary))
+		}
+	}))
+	defer ts.Close()
+
+	oldURL := downloadsURL
+	downloadsURL = ts.URL + "/"
+	defer func() { downloadsURL = oldURL }()
+
+	failuresBefore := testutil.ToFloat64(checksumFailures.WithLabelValues("win64"))
+
+	p := &uploadProvider{uploaded: make(map[string]bool)}
+	updatedLinks = nil
+	defer func() { updatedLinks = nil }()
+	updateIfNeeded(context.Background(), nil, []provider{p}, []string{"release"})
+
+	for _, platform := range platforms {
+		if platform == sumsVerified {
+			assert.True(t, p.uploaded[platform], "platform with a valid checksum was not uploaded")
+		} else {
+			assert.False(t, p.uploaded[platform], "platform %s with a mismatched checksum was uploaded", platform)
+		}
+	}
+	assert.Equal(t, failuresBefore+1, testutil.ToFloat64(checksumFailures.WithLabelValues("win64")))
+}
+
+func TestSendLinksDropsRejected(t *testing.T) {
+	rejectPlatform := "win64"
+	unavailable := false
+	var received []*resources.TBLink
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unavailable {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var links []*resources.TBLink
+		err := json.NewDecoder(r.Body).Decode(&links)
+		assert.NoError(t, err)
+
+		resp := internal.PostResourcesResponse{}
+		for i, link := range links {
+			if link.Platform == rejectPlatform {
+				resp.Rejected = append(resp.Rejected, internal.RejectedResource{Index: i, Reason: "rejected"})
+			} else {
+				received = append(received, link)
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer backend.Close()
+	updater := newTestUpdater(backend.URL)
+
+	newLink := func(platform string) *resources.TBLink {
+		link := resources.NewTBLink()
+		link.Platform = platform
+		link.Link = "https://example.com/" + platform
+		return link
+	}
+
+	acceptedBefore := testutil.ToFloat64(sentLinks.WithLabelValues("accepted"))
+	rejectedBefore := testutil.ToFloat64(sentLinks.WithLabelValues("rejected"))
+
+	updatedLinks = nil
+	defer func() { updatedLinks = nil }()
+	sendLinks(context.Background(), updater, []*resources.TBLink{newLink("linux64"), newLink("win64"), newLink("macos")}, "linux64", resources.Version{})
+
+	assert.Len(t, received, 2)
+	assert.Empty(t, updatedLinks)
+	assert.Equal(t, acceptedBefore+2, testutil.ToFloat64(sentLinks.WithLabelValues("accepted")))
+	assert.Equal(t, rejectedBefore+1, testutil.ToFloat64(sentLinks.WithLabelValues("rejected")))
+
+	// The rejected link is not sent again
+	received = nil
+	rejectPlatform = ""
+	sendLinks(context.Background(), updater, nil, "linux64", resources.Version{})
+	assert.Empty(t, received)
+
+	// The links are kept if the backend is unavailable and sent once it's back
+	unavailable = true
+	sendLinks(context.Background(), updater, []*resources.TBLink{newLink("linux64")}, "linux64", resources.Version{})
+	assert.Len(t, updatedLinks, 1)
+	unavailable = false
+	sendLinks(context.Background(), updater, nil, "linux64", resources.Version{})
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, "linux64", received[0].Platform)
+	}
+	assert.Empty(t, updatedLinks)
+}
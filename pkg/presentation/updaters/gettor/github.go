@@ -15,7 +15,6 @@ import (
 	"github.com/google/go-github/v61/github"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
-	"golang.org/x/oauth2"
 )
 
 const (
@@ -24,22 +23,16 @@ const (
 
 type githubProvider struct {
 	client *github.Client
-	ctx    context.Context
 	cfg    *internal.Github
 }
 
 func newGithubProvider(cfg *internal.Github) *githubProvider {
-	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: cfg.AuthToken},
-	)
-	tc := oauth2.NewClient(ctx, ts)
-	client := github.NewClient(tc)
-	return &githubProvider{client, ctx, cfg}
+	client := github.NewClient(nil).WithAuthToken(cfg.AuthToken)
+	return &githubProvider{client, cfg}
 }
 
-func (gh *githubProvider) needsUpdate(platform string, version resources.Version) bool {
-	releases, err := gh.getReleases(platform)
+func (gh *githubProvider) needsUpdate(ctx context.Context, platform string, version resources.Version) bool {
+	releases, err := gh.getReleases(ctx, platform)
 	if err != nil {
 		log.Println("[Github] Error fetching latest release:", err)
 		return false
@@ -70,8 +63,8 @@ func (gh *githubProvider) needsUpdate(platform string, version resources.Version
 	return true
 }
 
-func (gh *githubProvider) newRelease(platform string, version resources.Version) uploadFileFunc {
-	oldReleases, err := gh.getReleases(platform)
+func (gh *githubProvider) newRelease(ctx context.Context, platform string, version resources.Version) uploadFileFunc {
+	oldReleases, err := gh.getReleases(ctx, platform)
 	if err != nil {
 		log.Println("[Github] Error fetching releases:", err)
 		return nil
@@ -84,14 +77,14 @@ func (gh *githubProvider) newRelease(platform string, version resources.Version)
 		Name:    &name,
 		Body:    &releaseBody,
 	}
-	repositoryRelease, _, err := gh.client.Repositories.CreateRelease(gh.ctx, gh.cfg.Owner, gh.cfg.Repo, &release)
+	repositoryRelease, _, err := gh.client.Repositories.CreateRelease(ctx, gh.cfg.Owner, gh.cfg.Repo, &release)
 	if err != nil {
 		log.Println("[Github] Error creating repository:", err)
 		return nil
 	}
 
 	for _, release := range oldReleases {
-		_, err := gh.client.Repositories.DeleteRelease(gh.ctx, gh.cfg.Owner, gh.cfg.Repo, *release.ID)
+		_, err := gh.client.Repositories.DeleteRelease(ctx, gh.cfg.Owner, gh.cfg.Repo, *release.ID)
 		if err != nil {
 			log.Println("[Github] Error deleting a release", release.TagName, ":", err)
 		}
@@ -113,7 +106,7 @@ func (gh *githubProvider) newRelease(platform string, version resources.Version)
 			defer file.Close()
 
 			asset, _, err := gh.client.Repositories.UploadReleaseAsset(
-				gh.ctx, gh.cfg.Owner, gh.cfg.Repo,
+				ctx, gh.cfg.Owner, gh.cfg.Repo,
 				*repositoryRelease.ID, &options, file)
 			if err != nil {
 				log.Println("[Github] Couldn't upload the file", filename, ":", err)
@@ -135,8 +128,8 @@ func (gh *githubProvider) newRelease(platform string, version resources.Version)
 	}
 }
 
-func (gh *githubProvider) getReleases(platform string) ([]*github.RepositoryRelease, error) {
-	releases, _, err := gh.client.Repositories.ListReleases(gh.ctx, gh.cfg.Owner, gh.cfg.Repo, nil)
+func (gh *githubProvider) getReleases(ctx context.Context, platform string) ([]*github.RepositoryRelease, error) {
+	releases, _, err := gh.client.Repositories.ListReleases(ctx, gh.cfg.Owner, gh.cfg.Repo, nil)
 	if err != nil {
 		return nil, err
 	}
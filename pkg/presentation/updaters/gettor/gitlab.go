@@ -1,12 +1,13 @@
 package gettor
 
 import (
-	"encoding/base64"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/xanzy/go-gitlab"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
@@ -14,7 +15,9 @@ import (
 )
 
 const (
-	gitlabPlatform = "gitlab"
+	gitlabPlatform = "GitLab"
+	// gitlabRef is the branch the release tags are created from
+	gitlabRef = "main"
 )
 
 type gitlabProvider struct {
@@ -23,89 +26,108 @@ type gitlabProvider struct {
 }
 
 func newGitlabProvider(cfg *internal.Gitlab) (*gitlabProvider, error) {
-	client, err := gitlab.NewClient(cfg.AuthToken)
+	options := []gitlab.ClientOptionFunc{}
+	if cfg.BaseURL != "" {
+		options = append(options, gitlab.WithBaseURL(cfg.BaseURL))
+	}
+	client, err := gitlab.NewClient(cfg.AuthToken, options...)
 	return &gitlabProvider{client, cfg}, err
 }
 
-func (gl *gitlabProvider) needsUpdate(platform string, version resources.Version) bool {
-	project, _, err := gl.client.Projects.GetProject(gl.getProjectId(platform), nil)
+func (gl *gitlabProvider) needsUpdate(ctx context.Context, platform string, version resources.Version) bool {
+	releases, err := gl.getReleases(ctx, platform)
 	if err != nil {
-		log.Println("[Gitlab] Error fetching project:", err)
-		return true
+		log.Println("[Gitlab] Error fetching releases:", err)
+		return false
 	}
-
-	releaseVersion, err := resources.Str2Version(project.Description)
-	if err != nil {
-		log.Println("[Gitlab] The previous version is not valid:", project.Description)
+	if len(releases) == 0 {
+		log.Println("[Gitlab] There is no previous releases for", platform, "let's create one")
 		return true
 	}
 
-	if version.Compare(releaseVersion) == 1 {
-		log.Println("[Gitlab] needs update for", platform)
-		return true
+	for _, release := range releases {
+		releaseVersion, err := resources.Str2Version(strings.TrimPrefix(release.TagName, platform+"-"))
+		if err != nil {
+			continue
+		}
+
+		// If the same version or higher exist we don't need to update
+		if version.Compare(releaseVersion) != 1 {
+			return false
+		}
 	}
 
-	return false
+	log.Println("[Gitlab] needs update for", platform)
+	return true
 }
 
-func (gl *gitlabProvider) newRelease(platform string, version resources.Version) uploadFileFunc {
-	branch := "main"
-
-	_, err := gl.client.Projects.DeleteProject(gl.getProjectId(platform))
+func (gl *gitlabProvider) newRelease(ctx context.Context, platform string, version resources.Version) uploadFileFunc {
+	oldReleases, err := gl.getReleases(ctx, platform)
 	if err != nil {
-		log.Println("[Gitlab] Can't delete project", platform, ":", err)
+		log.Println("[Gitlab] Error fetching releases:", err)
+		return nil
 	}
 
-	description := version.String()
-	visibility := gitlab.PublicVisibility
-	projectOptions := gitlab.CreateProjectOptions{
-		Name:          &platform,
-		Description:   &description,
-		DefaultBranch: &branch,
-		Visibility:    &visibility,
+	tag := fmt.Sprintf("%s-%s", platform, version.String())
+	name := fmt.Sprintf(releaseName, platform, version.String())
+	ref := gitlabRef
+	releaseOptions := gitlab.CreateReleaseOptions{
+		TagName:     &tag,
+		Name:        &name,
+		Description: &releaseBody,
+		Ref:         &ref,
 	}
-	_, _, err = gl.client.Projects.CreateProject(&projectOptions)
+	_, _, err = gl.client.Releases.CreateRelease(gl.projectID(), &releaseOptions, gitlab.WithContext(ctx))
 	if err != nil {
-		log.Println("[Gitlab] Can't create project", platform, ":", err)
+		log.Println("[Gitlab] Error creating release:", err)
 		return nil
 	}
 
+	for _, release := range oldReleases {
+		_, _, err := gl.client.Releases.DeleteRelease(gl.projectID(), release.TagName, gitlab.WithContext(ctx))
+		if err != nil {
+			log.Println("[Gitlab] Error deleting a release", release.TagName, ":", err)
+		}
+	}
+	gl.deleteOldPackages(ctx, platform, version)
+
 	return func(binaryPath string, sigPath string) *resources.TBLink {
 		link := resources.NewTBLink()
 
 		for i, filePath := range []string{binaryPath, sigPath} {
-			f, err := os.Open(filePath)
+			filename := path.Base(filePath)
+			file, err := os.Open(filePath)
 			if err != nil {
-				log.Println("[Gitlab] Couldn't open file", filePath, ":", err)
+				log.Println("[Gitlab] Couldn't open the file", filePath, "to upload:", err)
 				return nil
 			}
-			defer f.Close()
-			b, err := ioutil.ReadAll(f)
+			defer file.Close()
+
+			_, _, err = gl.client.GenericPackages.PublishPackageFile(
+				gl.projectID(), platform, version.String(), filename,
+				file, &gitlab.PublishPackageFileOptions{}, gitlab.WithContext(ctx))
 			if err != nil {
-				log.Println("[Gitlab] Couldn't read file", filePath, ":", err)
+				log.Println("[Gitlab] Couldn't upload the file", filename, ":", err)
 				return nil
 			}
-			content := base64.StdEncoding.EncodeToString(b)
 
-			filename := path.Base(filePath)
-			encoding := "base64"
-			fileOptions := gitlab.CreateFileOptions{
-				Branch:        &branch,
-				CommitMessage: &filename,
-				Encoding:      &encoding,
-				Content:       &content,
+			assetURL := gl.packageURL(platform, version, filename)
+			linkType := gitlab.PackageLinkType
+			linkOptions := gitlab.CreateReleaseLinkOptions{
+				Name:     &filename,
+				URL:      &assetURL,
+				LinkType: &linkType,
 			}
-			_, _, err = gl.client.RepositoryFiles.CreateFile(gl.getProjectId(platform), filename, &fileOptions)
+			_, _, err = gl.client.ReleaseLinks.CreateReleaseLink(gl.projectID(), tag, &linkOptions, gitlab.WithContext(ctx))
 			if err != nil {
-				log.Println("[Gitlab] Couldn't upload file", filePath, ":", err)
+				log.Println("[Gitlab] Couldn't add the file", filename, "to the release:", err)
 				return nil
 			}
 
-			url := fmt.Sprintf("https://gitlab.com/%s/%s/-/raw/%s/%s?inline=false", gl.cfg.Owner, platform, branch, filename)
 			if i == 0 {
-				link.Link = url
+				link.Link = assetURL
 			} else {
-				link.SigLink = url
+				link.SigLink = assetURL
 			}
 		}
 
@@ -117,6 +139,63 @@ func (gl *gitlabProvider) newRelease(platform string, version resources.Version)
 	}
 }
 
-func (gl *gitlabProvider) getProjectId(platform string) string {
-	return gl.cfg.Owner + "/" + platform
+func (gl *gitlabProvider) getReleases(ctx context.Context, platform string) ([]*gitlab.Release, error) {
+	options := gitlab.ListReleasesOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	releases, _, err := gl.client.Releases.ListReleases(gl.projectID(), &options, gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	// Tags are the platform followed by the version, we parse the version to
+	// not mix e.g. the win64 and win64-alpha releases
+	platformReleases := []*gitlab.Release{}
+	for _, release := range releases {
+		if !strings.HasPrefix(release.TagName, platform+"-") {
+			continue
+		}
+		_, err := resources.Str2Version(strings.TrimPrefix(release.TagName, platform+"-"))
+		if err == nil {
+			platformReleases = append(platformReleases, release)
+		}
+	}
+	return platformReleases, nil
+}
+
+// deleteOldPackages removes the files of previous versions of the platform,
+// as the releases pointing to them are gone
+func (gl *gitlabProvider) deleteOldPackages(ctx context.Context, platform string, version resources.Version) {
+	packageType := "generic"
+	options := gitlab.ListProjectPackagesOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 100},
+		PackageName: &platform,
+		PackageType: &packageType,
+	}
+	packages, _, err := gl.client.Packages.ListProjectPackages(gl.projectID(), &options, gitlab.WithContext(ctx))
+	if err != nil {
+		log.Println("[Gitlab] Error fetching packages:", err)
+		return
+	}
+
+	for _, p := range packages {
+		// the package name filter also matches other names containing it
+		if p.Name != platform || p.Version == version.String() {
+			continue
+		}
+		_, err := gl.client.Packages.DeleteProjectPackage(gl.projectID(), p.ID, gitlab.WithContext(ctx))
+		if err != nil {
+			log.Println("[Gitlab] Error deleting package", p.Name, p.Version, ":", err)
+		}
+	}
+}
+
+// packageURL is the download url of a file uploaded to the generic packages
+// registry of the project
+func (gl *gitlabProvider) packageURL(platform string, version resources.Version, filename string) string {
+	return fmt.Sprintf("%sprojects/%s/packages/generic/%s/%s/%s",
+		gl.client.BaseURL().String(), url.PathEscape(gl.projectID()),
+		url.PathEscape(platform), url.PathEscape(version.String()), url.PathEscape(filename))
+}
+
+func (gl *gitlabProvider) projectID() string {
+	return gl.cfg.Owner + "/" + gl.cfg.Repo
 }
@@ -0,0 +1,143 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const mockGitlabProject = "/api/v4/projects/TheTorProject/gettorbrowser"
+
+// mockGitlab implements the parts of the GitLab API used by the gitlab
+// provider
+type mockGitlab struct {
+	sync.Mutex
+	releases        []string
+	releaseLinks    map[string][]string
+	packages        map[string][]byte
+	deletedPackages []string
+}
+
+func (m *mockGitlab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+
+	p := strings.TrimPrefix(r.URL.Path, mockGitlabProject)
+	switch {
+	case r.Method == http.MethodGet && p == "/releases":
+		releases := []map[string]string{}
+		for _, tag := range m.releases {
+			releases = append(releases, map[string]string{"tag_name": tag})
+		}
+		json.NewEncoder(w).Encode(releases)
+
+	case r.Method == http.MethodPost && p == "/releases":
+		var release map[string]string
+		json.NewDecoder(r.Body).Decode(&release)
+		m.releases = append(m.releases, release["tag_name"])
+		json.NewEncoder(w).Encode(release)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(p, "/releases/"):
+		tag := strings.TrimPrefix(p, "/releases/")
+		for i, t := range m.releases {
+			if t == tag {
+				m.releases = append(m.releases[:i], m.releases[i+1:]...)
+				break
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]string{"tag_name": tag})
+
+	case r.Method == http.MethodPost && strings.HasSuffix(p, "/assets/links"):
+		tag := strings.TrimSuffix(strings.TrimPrefix(p, "/releases/"), "/assets/links")
+		var link map[string]string
+		json.NewDecoder(r.Body).Decode(&link)
+		m.releaseLinks[tag] = append(m.releaseLinks[tag], link["url"])
+		json.NewEncoder(w).Encode(link)
+
+	case r.Method == http.MethodPut && strings.HasPrefix(p, "/packages/generic/"):
+		content, _ := io.ReadAll(r.Body)
+		m.packages[strings.TrimPrefix(p, "/packages/generic/")] = content
+		w.Write([]byte(`{"id": 2}`))
+
+	case r.Method == http.MethodGet && p == "/packages":
+		w.Write([]byte(`[{"id": 1, "name": "linux64", "version": "13.0.0", "package_type": "generic"},
+			{"id": 3, "name": "linux64-alpha", "version": "14.0a1", "package_type": "generic"}]`))
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(p, "/packages/"):
+		m.deletedPackages = append(m.deletedPackages, strings.TrimPrefix(p, "/packages/"))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestGitlab(t *testing.T) {
+	m := &mockGitlab{
+		releases:     []string{"linux64-13.0.0", "linux64-alpha-14.0a1"},
+		releaseLinks: make(map[string][]string),
+		packages:     make(map[string][]byte),
+	}
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	gl, err := newGitlabProvider(&internal.Gitlab{
+		AuthToken: "token",
+		Owner:     "TheTorProject",
+		Repo:      "gettorbrowser",
+		BaseURL:   ts.URL,
+	})
+	assert.NoError(t, err)
+
+	oldVersion := resources.Version{Major: 13}
+	newVersion := resources.Version{Major: 13, Patch: 1}
+	assert.False(t, gl.needsUpdate(context.Background(), "linux64", oldVersion))
+	assert.True(t, gl.needsUpdate(context.Background(), "linux64", newVersion))
+	assert.True(t, gl.needsUpdate(context.Background(), "win64", oldVersion))
+
+	tmpDir := t.TempDir()
+	binaryPath := filepath.Join(tmpDir, "tor.bin")
+	sigPath := filepath.Join(tmpDir, "tor.bin.asc")
+	assert.NoError(t, os.WriteFile(binaryPath, []byte("binary"), 0600))
+	assert.NoError(t, os.WriteFile(sigPath, []byte("signature"), 0600))
+
+	upload := gl.newRelease(context.Background(), "linux64", newVersion)
+	if !assert.NotNil(t, upload) {
+		return
+	}
+	link := upload(binaryPath, sigPath)
+	if !assert.NotNil(t, link) {
+		return
+	}
+
+	packageURL := ts.URL + "/api/v4/projects/TheTorProject%2Fgettorbrowser/packages/generic/linux64/13.0.1/"
+	assert.Equal(t, gitlabPlatform, link.Provider)
+	assert.Equal(t, "linux64", link.Platform)
+	assert.Equal(t, newVersion, link.Version)
+	assert.Equal(t, "tor.bin", link.FileName)
+	assert.Equal(t, packageURL+"tor.bin", link.Link)
+	assert.Equal(t, packageURL+"tor.bin.asc", link.SigLink)
+
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, []string{"linux64-alpha-14.0a1", "linux64-13.0.1"}, m.releases)
+	assert.Equal(t, []string{link.Link, link.SigLink}, m.releaseLinks["linux64-13.0.1"])
+	assert.Equal(t, []byte("binary"), m.packages["linux64/13.0.1/tor.bin"])
+	assert.Equal(t, []byte("signature"), m.packages["linux64/13.0.1/tor.bin.asc"])
+	assert.Equal(t, []string{"1"}, m.deletedPackages)
+}
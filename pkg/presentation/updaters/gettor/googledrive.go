@@ -24,20 +24,19 @@ import (
 )
 
 func newGoogleDriveUpdater(cfg *internal.GoogleDriveUpdater) (provider, error) {
-	updater := googleDriveUpdater{config: cfg, ctx: context.Background()}
+	updater := googleDriveUpdater{config: cfg}
 	var err error
 	updater.drive, err = updater.createApiClientFromConfig()
 	return &updater, err
 }
 
 type googleDriveUpdater struct {
-	ctx    context.Context
 	config *internal.GoogleDriveUpdater
 	drive  *drive.Service
 }
 
-func (g googleDriveUpdater) needsUpdate(platform string, version resources.Version) bool {
-	folders, err := g.getPlatformFolders(platform)
+func (g googleDriveUpdater) needsUpdate(ctx context.Context, platform string, version resources.Version) bool {
+	folders, err := g.getPlatformFolders(ctx, platform)
 	if err != nil {
 		log.Println("[Google Drive] unable to check for update", err)
 		return false
@@ -67,22 +66,22 @@ func (g googleDriveUpdater) needsUpdate(platform string, version resources.Versi
 	return false
 }
 
-func (g googleDriveUpdater) newRelease(platform string, version resources.Version) uploadFileFunc {
-	oldFolders, err := g.getPlatformFolders(platform)
+func (g googleDriveUpdater) newRelease(ctx context.Context, platform string, version resources.Version) uploadFileFunc {
+	oldFolders, err := g.getPlatformFolders(ctx, platform)
 	if err != nil {
 		log.Println("[Google Drive] unable to get platform folders", err)
 		return nil
 	}
 
 	folderName := fmt.Sprintf("%s-%s", platform, version.String())
-	folderID, err := g.mkdir(folderName)
+	folderID, err := g.mkdir(ctx, folderName)
 	if err != nil {
 		log.Println("[Google Drive] can't create folder", folderName, err)
 		return nil
 	}
 
 	for _, folder := range oldFolders {
-		err := g.rmdir(folder)
+		err := g.rmdir(ctx, folder)
 		if err != nil {
 			log.Println("[Google Drive] Error deleting a folder", folder.Name, ":", err)
 		}
@@ -93,7 +92,7 @@ func (g googleDriveUpdater) newRelease(platform string, version resources.Versio
 
 		{
 			var err error
-			link.Link, err = g.createLinkFromPath(folderID, binaryPath)
+			link.Link, err = g.createLinkFromPath(ctx, folderID, binaryPath)
 			if err != nil {
 				log.Println("[Google Drive] Unable to create link for binary ", err)
 				return nil
@@ -101,7 +100,7 @@ func (g googleDriveUpdater) newRelease(platform string, version resources.Versio
 		}
 		{
 			var err error
-			link.SigLink, err = g.createLinkFromPath(folderID, sigPath)
+			link.SigLink, err = g.createLinkFromPath(ctx, folderID, sigPath)
 			if err != nil {
 				log.Println("[Google Drive] Unable to create link for binary ", err)
 				return nil
@@ -117,7 +116,7 @@ func (g googleDriveUpdater) newRelease(platform string, version resources.Versio
 
 }
 
-func (g googleDriveUpdater) createLinkFromPath(folderID string, filePath string) (string, error) {
+func (g googleDriveUpdater) createLinkFromPath(ctx context.Context, folderID string, filePath string) (string, error) {
 	filename := path.Base(filePath)
 	fd, err := os.Open(filePath)
 	if err != nil {
@@ -126,7 +125,7 @@ func (g googleDriveUpdater) createLinkFromPath(folderID string, filePath string)
 	}
 	defer fd.Close()
 
-	downloadLink, err := g.uploadFileAndGetLink(folderID, filename, fd)
+	downloadLink, err := g.uploadFileAndGetLink(ctx, folderID, filename, fd)
 	if err != nil {
 		log.Println("[Google Drive] Unable to get file link ", err)
 		return "", err
@@ -186,8 +185,10 @@ func (g googleDriveUpdater) createApiClientFromConfig() (*drive.Service, error)
 		return nil, err
 	}
 
-	client := config.Client(g.ctx, userToken)
-	srv, err := drive.NewService(g.ctx, option.WithHTTPClient(client))
+	// the client outlives the update cycles, each request gets the context of
+	// its cycle
+	client := config.Client(context.Background(), userToken)
+	srv, err := drive.NewService(context.Background(), option.WithHTTPClient(client))
 	if err != nil {
 		return nil, err
 	}
@@ -195,45 +196,45 @@ func (g googleDriveUpdater) createApiClientFromConfig() (*drive.Service, error)
 	return srv, nil
 }
 
-func (g googleDriveUpdater) getPlatformFolders(platform string) ([]*drive.File, error) {
+func (g googleDriveUpdater) getPlatformFolders(ctx context.Context, platform string) ([]*drive.File, error) {
 	query := fmt.Sprintf("'%v' in parents and name contains '%v' and mimeType = 'application/vnd.google-apps.folder'", g.config.ParentFolderID, platform)
-	fileList, err := g.drive.Files.List().Q(query).Do()
+	fileList, err := g.drive.Files.List().Q(query).Context(ctx).Do()
 	if err != nil {
 		return nil, err
 	}
 	return fileList.Files, nil
 }
 
-func (g googleDriveUpdater) mkdir(folderName string) (folderID string, err error) {
+func (g googleDriveUpdater) mkdir(ctx context.Context, folderName string) (folderID string, err error) {
 	file := &drive.File{
 		Name:     folderName,
 		Parents:  []string{g.config.ParentFolderID},
 		MimeType: "application/vnd.google-apps.folder",
 	}
-	folder, err := g.drive.Files.Create(file).Do()
+	folder, err := g.drive.Files.Create(file).Context(ctx).Do()
 	if err != nil {
 		return "", err
 	}
 	return folder.Id, nil
 }
 
-func (g googleDriveUpdater) rmdir(file *drive.File) error {
-	return g.drive.Files.Delete(file.Id).Do()
+func (g googleDriveUpdater) rmdir(ctx context.Context, file *drive.File) error {
+	return g.drive.Files.Delete(file.Id).Context(ctx).Do()
 }
 
-func (g googleDriveUpdater) uploadFileAndGetLink(folderID string, filename string, reader io.Reader) (string, error) {
+func (g googleDriveUpdater) uploadFileAndGetLink(ctx context.Context, folderID string, filename string, reader io.Reader) (string, error) {
 	file := &drive.File{Name: filename, Parents: []string{folderID}}
-	result, err := g.drive.Files.Create(file).Media(reader).Do()
+	result, err := g.drive.Files.Create(file).Media(reader).Context(ctx).Do()
 	if err != nil {
 		return "", err
 	}
 
-	_, err = g.drive.Permissions.Create(result.Id, &drive.Permission{Type: "anyone", Role: "reader"}).Do()
+	_, err = g.drive.Permissions.Create(result.Id, &drive.Permission{Type: "anyone", Role: "reader"}).Context(ctx).Do()
 	if err != nil {
 		return "", err
 	}
 
-	getResult, err := g.drive.Files.Get(result.Id).Fields("webContentLink").Do()
+	getResult, err := g.drive.Files.Get(result.Id).Fields("webContentLink").Context(ctx).Do()
 	if err != nil {
 		return "", err
 	}
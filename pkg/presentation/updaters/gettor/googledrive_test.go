@@ -6,6 +6,7 @@ package gettor
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"math/rand"
 	"net/http"
@@ -58,7 +59,7 @@ func TestUploadFile(t *testing.T) {
 	io.ReadFull(rand.New(rand.NewSource(time.Now().Unix())), buf)
 
 	t.Run("upload", func(t *testing.T) {
-		link, err := updaterInternal.uploadFileAndGetLink(updaterInternal.config.ParentFolderID, "testing", bytes.NewReader(buf))
+		link, err := updaterInternal.uploadFileAndGetLink(context.Background(), updaterInternal.config.ParentFolderID, "testing", bytes.NewReader(buf))
 		assert.NoError(t, err)
 		t.Run("download from link", func(t *testing.T) {
 			resp, err := http.Get(link)
@@ -90,9 +91,9 @@ func TestGoogleDrive(t *testing.T) {
 		Major: int(time.Now().Unix()),
 	}
 
-	needUpdate := updater.needsUpdate("toros", version)
+	needUpdate := updater.needsUpdate(context.Background(), "toros", version)
 	assert.True(t, needUpdate)
-	releaseFunc := updater.newRelease("toros", version)
+	releaseFunc := updater.newRelease(context.Background(), "toros", version)
 	t.Run("upload files", func(t *testing.T) {
 		for fileIndex := 0; fileIndex <= 5; fileIndex++ {
 			strFileIndex := strconv.FormatInt(int64(fileIndex), 10)
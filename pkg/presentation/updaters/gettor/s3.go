@@ -16,33 +16,80 @@ import (
 	"log"
 	"os"
 	"path"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
+const (
+	defaultS3PresignExpiry = time.Hour * 24 * 6
+	defaultS3LinkExpiry    = time.Hour * 24
+	// maxS3PresignExpiry is the longest expiry allowed by S3 for presigned URLs
+	maxS3PresignExpiry = time.Hour * 24 * 7
+
+	defaultS3MultipartThreshold   = 16 << 20
+	defaultS3MultipartPartSize    = 8 << 20
+	defaultS3MultipartConcurrency = 4
+	// minS3MultipartPartSize is the smallest part size allowed by S3, except
+	// for the last part
+	minS3MultipartPartSize = 5 << 20
+	// maxS3PartRetries is how many times a failed part is retried before
+	// giving up on the upload
+	maxS3PartRetries = 3
+)
+
 func newS3Updater(cfg *internal.S3Updater) (provider, error) {
+	if cfg.PresignExpiryHours < 0 || cfg.LinkExpiryHours < 0 {
+		return nil, fmt.Errorf("negative expiry configured for S3 provider %s", cfg.Name)
+	}
+	if time.Duration(cfg.PresignExpiryHours)*time.Hour > maxS3PresignExpiry {
+		return nil, fmt.Errorf("presign expiry of %d hours for S3 provider %s is longer than the maximum of %s",
+			cfg.PresignExpiryHours, cfg.Name, maxS3PresignExpiry)
+	}
 	s3Client := constructS3ClientFromConfig(*cfg)
-	return s3updater{config: cfg, s3: s3Client, ctx: context.Background()}, nil
+	updater := s3updater{config: cfg, s3: s3Client}
+	// the links need to be refreshed before they expire and expire before the
+	// presigned URL does
+	if updater.linkExpiry() >= updater.presignExpiry() {
+		return nil, fmt.Errorf("link expiry of %s for S3 provider %s is not shorter than the presign expiry of %s",
+			updater.linkExpiry(), cfg.Name, updater.presignExpiry())
+	}
+	if updater.linkExpiry() <= updateFrequency {
+		return nil, fmt.Errorf("link expiry of %s for S3 provider %s is not longer than the update frequency of %s",
+			updater.linkExpiry(), cfg.Name, updateFrequency)
+	}
+	if cfg.MultipartThresholdMB < 0 || cfg.MultipartPartSizeMB < 0 || cfg.MultipartConcurrency < 0 {
+		return nil, fmt.Errorf("negative multipart upload option configured for S3 provider %s", cfg.Name)
+	}
+	if cfg.MultipartPartSizeMB != 0 && cfg.MultipartPartSizeMB<<20 < minS3MultipartPartSize {
+		return nil, fmt.Errorf("multipart part size of %d MB for S3 provider %s is smaller than the minimum of %d MB",
+			cfg.MultipartPartSizeMB, cfg.Name, minS3MultipartPartSize>>20)
+	}
+
+	return updater, nil
 }
 
 type s3updater struct {
 	config *internal.S3Updater
 	s3     *s3.Client
-	ctx    context.Context
 }
 
-func (s s3updater) needsUpdate(platform string, version resources.Version) bool {
-	// Links will expire in 1 day, timely update to the link is required
+func (s s3updater) needsUpdate(ctx context.Context, platform string, version resources.Version) bool {
+	// Links expire, refresh them on every update so the distributor gets new
+	// ones before the old ones expire
 	return true
 }
 
-func (s s3updater) needsUpdateRefreshOnly(platform string, version resources.Version) bool {
+func (s s3updater) needsUpdateRefreshOnly(ctx context.Context, platform string, version resources.Version) bool {
 	existenceObject := s.formatNameForExistenceObject(platform, version)
-	if s.checkObjectExistence(existenceObject) == nil {
+	if s.checkObjectExistence(ctx, existenceObject) == nil {
 		log.Println("[S3] refresh links for", platform)
 		return true
 	}
@@ -51,12 +98,12 @@ func (s s3updater) needsUpdateRefreshOnly(platform string, version resources.Ver
 	return false
 }
 
-func (s s3updater) newRelease(platform string, version resources.Version) uploadFileFunc {
+func (s s3updater) newRelease(ctx context.Context, platform string, version resources.Version) uploadFileFunc {
 	existenceObject := s.formatNameForExistenceObject(platform, version)
 	var updateLinkOnly = false
-	if s.checkObjectExistence(existenceObject) == nil {
+	if s.checkObjectExistence(ctx, existenceObject) == nil {
 		updateLinkOnly = true
-	} else if err := s.createObject(existenceObject, bytes.NewReader([]byte{0x00})); err != nil {
+	} else if err := s.createObject(ctx, existenceObject, bytes.NewReader([]byte{0x00})); err != nil {
 		log.Println("[S3] Unable to create existence object", err)
 		return nil
 	}
@@ -77,13 +124,13 @@ func (s s3updater) newRelease(platform string, version resources.Version) upload
 				}
 				defer fd.Close()
 
-				err = s.createObject(objectName, fd)
+				err = s.createObjectFromFile(ctx, objectName, fd)
 				if err != nil {
 					log.Println("[S3] Unable to upload file ", err)
 					return nil
 				}
 			}
-			downloadLink, err := s.createLink(objectName)
+			downloadLink, err := s.createLink(ctx, objectName)
 			if err != nil {
 				log.Println("[S3] Unable to get file link ", err)
 				return nil
@@ -104,22 +151,19 @@ func (s s3updater) newRelease(platform string, version resources.Version) upload
 		link.Platform = platform
 		link.FileName = path.Base(binaryPath)
 
-		if s.config.SigningMethod != "archive_org_dangerous_workaround" {
-			var duration = time.Hour * 24
-			link.CustomExpiry = &duration
-		}
+		s.setLinkExpiry(link)
 
 		fileid := fmt.Sprintf("version:%v, provider: %v, plafrorm: %v, filename: %v",
 			link.Version, link.Provider, link.Platform, link.FileName)
-		var oid = core.NewHashkey(fileid)
-		link.CustomOid = &oid
+		var uid = core.NewHashkey(fileid)
+		link.CustomUid = &uid
 		return link
 	}
 }
 
-func (s s3updater) checkObjectExistence(obj s3Object) error {
+func (s s3updater) checkObjectExistence(ctx context.Context, obj s3Object) error {
 	{
-		_, err := s.s3.HeadBucket(s.ctx, &s3.HeadBucketInput{
+		_, err := s.s3.HeadBucket(ctx, &s3.HeadBucketInput{
 			Bucket: &obj.bucket,
 		})
 		if err != nil {
@@ -127,7 +171,7 @@ func (s s3updater) checkObjectExistence(obj s3Object) error {
 		}
 	}
 	{
-		_, err := s.s3.HeadObject(s.ctx, &s3.HeadObjectInput{
+		_, err := s.s3.HeadObject(ctx, &s3.HeadObjectInput{
 			Bucket: &obj.bucket,
 			Key:    &obj.name,
 		})
@@ -138,50 +182,218 @@ func (s s3updater) checkObjectExistence(obj s3Object) error {
 	return nil
 }
 
-func (s s3updater) ensureBucketExist(bucket string) error {
+func (s s3updater) ensureBucketExist(ctx context.Context, bucket string) error {
 	{
-		_, err := s.s3.HeadBucket(s.ctx, &s3.HeadBucketInput{
+		_, err := s.s3.HeadBucket(ctx, &s3.HeadBucketInput{
 			Bucket: &bucket,
 		})
 		if err != nil {
-			_, errCreateBucket := s.s3.CreateBucket(s.ctx, &s3.CreateBucketInput{Bucket: &bucket})
+			_, errCreateBucket := s.s3.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: &bucket})
 			return errCreateBucket
 		}
 	}
 	return nil
 }
 
-func (s s3updater) createObject(obj s3Object, content io.Reader) error {
-	if err := s.ensureBucketExist(obj.bucket); err != nil &&
+func (s s3updater) createObject(ctx context.Context, obj s3Object, content io.Reader) error {
+	if err := s.ensureBucketExist(ctx, obj.bucket); err != nil &&
 		// This is a workaround to compensate for archive.org's API's lack of read-after-write consistency
 		s.config.SigningMethod != "archive_org_dangerous_workaround" {
 		return err
 	}
 
-	_, err := s.s3.PutObject(s.ctx,
+	_, err := s.s3.PutObject(ctx,
 		&s3.PutObjectInput{Key: &obj.name, Bucket: &obj.bucket, Body: content})
 	return err
 }
 
+// createObjectFromFile uploads the file in several parts if it's bigger than
+// the multipart threshold, so a failure only needs to upload again the failed
+// part and not the whole file
+func (s s3updater) createObjectFromFile(ctx context.Context, obj s3Object, fd *os.File) error {
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	// archive.org doesn't support multipart uploads over its S3 API
+	if s.config.SigningMethod == "archive_org_dangerous_workaround" || info.Size() <= s.multipartThreshold() {
+		return s.createObject(ctx, obj, fd)
+	}
+
+	if err := s.ensureBucketExist(ctx, obj.bucket); err != nil {
+		return err
+	}
+	return s.createMultipartObject(ctx, obj, fd, info.Size())
+}
+
+func (s s3updater) createMultipartObject(ctx context.Context, obj s3Object, content io.ReaderAt, size int64) error {
+	upload, err := s.s3.CreateMultipartUpload(ctx,
+		&s3.CreateMultipartUploadInput{Key: &obj.name, Bucket: &obj.bucket})
+	if err != nil {
+		return err
+	}
+
+	partSize := s.multipartPartSize()
+	parts := make(chan types.CompletedPart)
+	go func() {
+		defer close(parts)
+		for partNumber, offset := int32(1), int64(0); offset < size; partNumber, offset = partNumber+1, offset+partSize {
+			parts <- types.CompletedPart{PartNumber: aws.Int32(partNumber)}
+		}
+	}()
+
+	var (
+		wg        sync.WaitGroup
+		lock      sync.Mutex
+		completed []types.CompletedPart
+		uploadErr error
+	)
+	for i := 0; i < s.multipartConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range parts {
+				lock.Lock()
+				failed := uploadErr != nil
+				lock.Unlock()
+				if failed {
+					continue
+				}
+
+				offset := int64(*part.PartNumber-1) * partSize
+				length := partSize
+				if offset+length > size {
+					length = size - offset
+				}
+				etag, err := s.uploadPart(ctx, obj, *upload.UploadId, *part.PartNumber, io.NewSectionReader(content, offset, length), length)
+
+				lock.Lock()
+				if err != nil {
+					uploadErr = err
+				} else {
+					part.ETag = etag
+					completed = append(completed, part)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if uploadErr != nil {
+		_, err := s.s3.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Key:      &obj.name,
+			Bucket:   &obj.bucket,
+			UploadId: upload.UploadId,
+		})
+		if err != nil {
+			log.Println("[S3] Unable to abort multipart upload", err)
+		}
+		return uploadErr
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return *completed[i].PartNumber < *completed[j].PartNumber
+	})
+	_, err = s.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Key:             &obj.name,
+		Bucket:          &obj.bucket,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+// uploadPart uploads a part of a multipart upload retrying it if it fails
+func (s s3updater) uploadPart(ctx context.Context, obj s3Object, uploadID string, partNumber int32, content *io.SectionReader, length int64) (etag *string, err error) {
+	for i := 0; i <= maxS3PartRetries; i++ {
+		if i != 0 {
+			log.Printf("[S3] Retrying part %d of %s: %v", partNumber, obj.name, err)
+			content.Seek(0, io.SeekStart)
+		}
+
+		var output *s3.UploadPartOutput
+		output, err = s.s3.UploadPart(ctx, &s3.UploadPartInput{
+			Key:           &obj.name,
+			Bucket:        &obj.bucket,
+			UploadId:      &uploadID,
+			PartNumber:    aws.Int32(partNumber),
+			Body:          content,
+			ContentLength: aws.Int64(length),
+		})
+		if err == nil {
+			return output.ETag, nil
+		}
+	}
+	return nil, err
+}
+
+func (s s3updater) multipartThreshold() int64 {
+	if s.config.MultipartThresholdMB == 0 {
+		return defaultS3MultipartThreshold
+	}
+	return int64(s.config.MultipartThresholdMB) << 20
+}
+
+func (s s3updater) multipartPartSize() int64 {
+	if s.config.MultipartPartSizeMB == 0 {
+		return defaultS3MultipartPartSize
+	}
+	return int64(s.config.MultipartPartSizeMB) << 20
+}
+
+func (s s3updater) multipartConcurrency() int {
+	if s.config.MultipartConcurrency == 0 {
+		return defaultS3MultipartConcurrency
+	}
+	return s.config.MultipartConcurrency
+}
+
 func (s s3updater) withPersigner(options *s3.PresignOptions) {
 	options.Presigner = newS3ConfigAdaptor(*s.config)
+	options.Expires = s.presignExpiry()
 }
 
-func (s s3updater) createLink(obj s3Object) (string, error) {
+func (s s3updater) createLink(ctx context.Context, obj s3Object) (string, error) {
 	if s.config.SigningMethod == "archive_org_dangerous_workaround" {
 		// This is a workaround to compensate for archive.org's API's low performance on s3 endpoint
 		// https://archive.org/services/docs/api/ias3.html#fast-get-downloads
 		return fmt.Sprintf("https://archive.org/download/%v/%v", obj.bucket, obj.name), nil
 	}
 	persignClient := s3.NewPresignClient(s.s3, s.withPersigner)
-	presignedResult, err := persignClient.PresignGetObject(s.ctx,
-		&s3.GetObjectInput{Key: &obj.name, Bucket: &obj.bucket}, s3.WithPresignExpires(time.Hour*24*6))
+	presignedResult, err := persignClient.PresignGetObject(ctx,
+		&s3.GetObjectInput{Key: &obj.name, Bucket: &obj.bucket})
 	if err != nil {
 		return "", err
 	}
 	return presignedResult.URL, nil
 }
 
+func (s s3updater) presignExpiry() time.Duration {
+	if s.config.PresignExpiryHours == 0 {
+		return defaultS3PresignExpiry
+	}
+	return time.Duration(s.config.PresignExpiryHours) * time.Hour
+}
+
+func (s s3updater) linkExpiry() time.Duration {
+	if s.config.LinkExpiryHours == 0 {
+		return defaultS3LinkExpiry
+	}
+	return time.Duration(s.config.LinkExpiryHours) * time.Hour
+}
+
+// setLinkExpiry sets the expiry of the link so the backend drops it before
+// the presigned URL expires
+func (s s3updater) setLinkExpiry(link *resources.TBLink) {
+	if s.config.SigningMethod == "archive_org_dangerous_workaround" {
+		// archive.org links are not presigned and don't expire
+		return
+	}
+	var duration = s.linkExpiry()
+	link.CustomExpiry = &duration
+}
+
 func (s s3updater) formatNameForExistenceObject(platform string, version resources.Version) s3Object {
 	filename := fmt.Sprintf("%v-%v.exist-gettor", platform, version.String())
 	return s.formatNameForFile(platform, version, filename)
@@ -6,6 +6,7 @@ package gettor
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"math/rand"
 	"net/http"
@@ -15,6 +16,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/stretchr/testify/assert"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
@@ -68,17 +70,17 @@ func TestS3(t *testing.T) {
 		}
 
 		t.Run("create object", func(t *testing.T) {
-			err := updaterInternal.createObject(dataObject, bytes.NewReader(buf))
+			err := updaterInternal.createObject(context.Background(), dataObject, bytes.NewReader(buf))
 			assert.NoError(t, err)
 		})
 
 		t.Run("object exists", func(t *testing.T) {
-			err := updaterInternal.checkObjectExistence(dataObject)
+			err := updaterInternal.checkObjectExistence(context.Background(), dataObject)
 			assert.NoError(t, err)
 		})
 
 		t.Run("create link", func(t *testing.T) {
-			link, err := updaterInternal.createLink(dataObject)
+			link, err := updaterInternal.createLink(context.Background(), dataObject)
 			assert.NoError(t, err)
 			t.Log(link)
 
@@ -100,12 +102,88 @@ func TestS3(t *testing.T) {
 			name:   "test" + time.Now().String(),
 		}
 
-		err := updaterInternal.checkObjectExistence(missingObject)
+		err := updaterInternal.checkObjectExistence(context.Background(), missingObject)
 		assert.Error(t, err)
 	})
 
 }
 
+func TestS3Multipart(t *testing.T) {
+	strFromEnv := func(key string) string {
+		env, envOk := os.LookupEnv(key)
+		if !envOk {
+			t.Skipf("no %v, s3 test aborted", key)
+		}
+		return env
+	}
+	updater := internal.S3Updater{
+		AccessKey:            strFromEnv("S3_TEST_ACCESS_KEY"),
+		AccessSecret:         strFromEnv("S3_TEST_ACCESS_SECRET"),
+		EndpointUrl:          strFromEnv("S3_TEST_ENDPOINT"),
+		SigningMethod:        strFromEnv("S3_TEST_SIGNINGMETHOD"),
+		EndpointRegion:       os.Getenv("S3_TEST_ENDPOINT_REGION"),
+		Name:                 "testing",
+		MultipartThresholdMB: 5,
+		MultipartPartSizeMB:  5,
+		MultipartConcurrency: 2,
+	}
+	s3Bucket := strFromEnv("S3_TEST_BUCKET")
+	if updater.SigningMethod == "archive_org_dangerous_workaround" {
+		t.Skip("archive.org doesn't use multipart uploads, s3 test aborted")
+	}
+
+	s3Updater, err := newS3Updater(&updater)
+	assert.NoError(t, err)
+	updaterInternal := s3Updater.(s3updater)
+
+	// 12 MB are uploaded as two parts of 5 MB and a last one of 2 MB
+	buf := make([]byte, 12<<20)
+	io.ReadFull(rand.New(rand.NewSource(time.Now().Unix())), buf)
+
+	tmpfile, err := os.CreateTemp("", "gettor-test-")
+	assert.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+	_, err = tmpfile.Write(buf)
+	assert.NoError(t, err)
+
+	dataObject := s3Object{
+		bucket: s3Bucket,
+		name:   "test-multipart",
+	}
+	err = updaterInternal.createObjectFromFile(context.Background(), dataObject, tmpfile)
+	assert.NoError(t, err)
+
+	link, err := updaterInternal.createLink(context.Background(), dataObject)
+	assert.NoError(t, err)
+	resp, err := http.Get(link)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, buf, body)
+}
+
+func TestS3MultipartConfig(t *testing.T) {
+	updater := internal.S3Updater{SigningMethod: "v4"}
+	s3Updater, err := newS3Updater(&updater)
+	assert.NoError(t, err)
+	updaterInternal := s3Updater.(s3updater)
+	assert.Equal(t, int64(16<<20), updaterInternal.multipartThreshold())
+	assert.Equal(t, int64(8<<20), updaterInternal.multipartPartSize())
+	assert.Equal(t, 4, updaterInternal.multipartConcurrency())
+
+	t.Run("too small parts", func(t *testing.T) {
+		updater := internal.S3Updater{
+			SigningMethod:       "v4",
+			MultipartPartSizeMB: 4,
+		}
+		_, err := newS3Updater(&updater)
+		assert.Error(t, err)
+	})
+}
+
 func TestNameGeneration(t *testing.T) {
 	updater := internal.S3Updater{
 		Name:                         "testing",
@@ -139,6 +217,71 @@ func TestNameGeneration(t *testing.T) {
 	})
 }
 
+func TestS3Expiry(t *testing.T) {
+	updater := internal.S3Updater{
+		SigningMethod:      "v4",
+		Name:               "testing",
+		PresignExpiryHours: 48,
+		LinkExpiryHours:    12,
+	}
+	s3Updater, err := newS3Updater(&updater)
+	assert.NoError(t, err)
+	updaterInternal := s3Updater.(s3updater)
+
+	var options s3.PresignOptions
+	updaterInternal.withPersigner(&options)
+	assert.Equal(t, 48*time.Hour, options.Expires)
+
+	link := resources.NewTBLink()
+	updaterInternal.setLinkExpiry(link)
+	assert.Equal(t, 12*time.Hour, link.Expiry())
+
+	t.Run("defaults", func(t *testing.T) {
+		updater := internal.S3Updater{
+			SigningMethod: "v4",
+		}
+		s3Updater, err := newS3Updater(&updater)
+		assert.NoError(t, err)
+		updaterInternal := s3Updater.(s3updater)
+
+		var options s3.PresignOptions
+		updaterInternal.withPersigner(&options)
+		assert.Equal(t, 6*24*time.Hour, options.Expires)
+
+		link := resources.NewTBLink()
+		updaterInternal.setLinkExpiry(link)
+		assert.Equal(t, 24*time.Hour, link.Expiry())
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		updater := internal.S3Updater{
+			SigningMethod:      "v4",
+			PresignExpiryHours: 7*24 + 1,
+		}
+		_, err := newS3Updater(&updater)
+		assert.Error(t, err)
+	})
+
+	t.Run("link outlives presign", func(t *testing.T) {
+		updater := internal.S3Updater{
+			SigningMethod:      "v4",
+			PresignExpiryHours: 12,
+			LinkExpiryHours:    12,
+		}
+		_, err := newS3Updater(&updater)
+		assert.Error(t, err)
+	})
+
+	t.Run("link expires before refresh", func(t *testing.T) {
+		updater := internal.S3Updater{
+			SigningMethod:   "v4",
+			LinkExpiryHours: 1,
+		}
+		_, err := newS3Updater(&updater)
+		assert.Error(t, err)
+	})
+}
+
 func TestArchiveOrg(t *testing.T) {
 	// WARNING: This test takes significant times. ~3 mins
 	if testing.Short() {
@@ -165,9 +308,9 @@ func TestArchiveOrg(t *testing.T) {
 		Major: int(time.Now().Unix()),
 	}
 	s3Updater, _ := newS3Updater(&updater)
-	needUpdate := s3Updater.needsUpdate("toros", version)
+	needUpdate := s3Updater.needsUpdate(context.Background(), "toros", version)
 	assert.True(t, needUpdate)
-	releaseFunc := s3Updater.newRelease("toros", version)
+	releaseFunc := s3Updater.newRelease(context.Background(), "toros", version)
 
 	t.Run("upload files", func(t *testing.T) {
 		{
@@ -267,9 +410,9 @@ func TestStandardS3(t *testing.T) {
 				Major: int(time.Now().Unix()),
 			}
 			s3Updater, _ := newS3Updater(&updater)
-			needUpdate := s3Updater.needsUpdate("toros", version)
+			needUpdate := s3Updater.needsUpdate(context.Background(), "toros", version)
 			assert.True(t, needUpdate)
-			releaseFunc := s3Updater.newRelease("toros", version)
+			releaseFunc := s3Updater.newRelease(context.Background(), "toros", version)
 			t.Run("upload files", func(t *testing.T) {
 				for fileIndex := 0; fileIndex <= 5; fileIndex++ {
 					strFileIndex := strconv.FormatInt(int64(fileIndex), 10)
@@ -316,7 +459,7 @@ func TestStandardS3(t *testing.T) {
 						})
 
 						t.Run("update link only release test", func(t *testing.T) {
-							releaseFuncUpdateOnly := s3Updater.newRelease("toros", version)
+							releaseFuncUpdateOnly := s3Updater.newRelease(context.Background(), "toros", version)
 							release_data_updateOnly := releaseFuncUpdateOnly(filename, filesigname)
 
 							t.Run("data file links works", func(t *testing.T) {
@@ -341,7 +484,7 @@ func TestStandardS3(t *testing.T) {
 
 							assert.NotEqual(t, release_data.Link, release_data_updateOnly.Link)
 							assert.NotEqual(t, release_data.SigLink, release_data_updateOnly.SigLink)
-							assert.Equal(t, release_data.Oid(), release_data_updateOnly.Oid())
+							assert.Equal(t, release_data.Uid(), release_data_updateOnly.Uid())
 						})
 
 					})
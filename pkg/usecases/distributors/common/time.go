@@ -5,9 +5,17 @@
 package common
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -29,10 +37,18 @@ type TimeDistribution struct {
 	wg         sync.WaitGroup
 	shutdown   chan bool
 	ipc        delivery.Mechanism
+	tokenAEAD  cipher.AEAD
 }
 
+var InvalidBridgeSetToken = errors.New("invalid bridge set token")
+
+var TooManyPeriodAdvances = errors.New("no more sets of bridges are available in this rotation period")
+
 func (td *TimeDistribution) Start() {
 	td.shutdown = make(chan bool)
+	if err := td.initTokenAEAD(td.Cfg.BridgeSetTokenKey); err != nil {
+		log.Fatalf("Can't initialise the bridge set token key: %s", err)
+	}
 	proportions := td.makeProportions()
 	collectionConfig := core.CollectionConfig{
 		StorageDir: td.Cfg.StorageDir,
@@ -92,14 +108,68 @@ func (td *TimeDistribution) GetBridges(tpe string, ip net.IP) []string {
 }
 
 func (td *TimeDistribution) GetFilteredBridges(tpe string, ip net.IP, filter core.FilterFunc) []string {
-	hashring := td.collection.GetHashring(td.getProportionIndex(), tpe)
+	return td.getBridges(td.getProportionIndex(), tpe, IpHashkey(ip), filter)
+}
+
+// GetNextFilteredBridges behaves like GetFilteredBridges, but it gives the
+// bridges of advance periods ahead.  Requesters whose bridges got blocked can
+// get a different set without waiting for the rotation.  advance can't be
+// bigger than MaxPeriodAdvances, so requesters can only get a bounded number
+// of sets in each period.
+func (td *TimeDistribution) GetNextFilteredBridges(tpe string, ip net.IP, advance int, filter core.FilterFunc) ([]string, error) {
+	if advance < 0 || advance > td.MaxPeriodAdvances() {
+		return nil, TooManyPeriodAdvances
+	}
+	return td.getBridges(td.advancedProportionIndex(advance), tpe, IpHashkey(ip), filter), nil
+}
+
+// MaxPeriodAdvances returns how many times a requester can ask for the next
+// set of bridges in a rotation period.
+func (td *TimeDistribution) MaxPeriodAdvances() int {
+	if td.Cfg.NumPeriods == 0 || td.Cfg.RotationPeriodHours == 0 {
+		return 0
+	}
+	if td.Cfg.MaxPeriodAdvances >= td.Cfg.NumPeriods {
+		return td.Cfg.NumPeriods - 1
+	}
+	return td.Cfg.MaxPeriodAdvances
+}
+
+// GetNextFilteredBridgeSet behaves like GetNextFilteredBridges, but it also
+// returns an opaque token that can be presented to GetBridgeSet to get the
+// same set of bridges later, even after the rotation period is over.
+func (td *TimeDistribution) GetNextFilteredBridgeSet(tpe string, ip net.IP, advance int, filter core.FilterFunc) ([]string, string, error) {
+	if advance < 0 || advance > td.MaxPeriodAdvances() {
+		return nil, "", TooManyPeriodAdvances
+	}
+	partition := td.advancedProportionIndex(advance)
+	hashkey := IpHashkey(ip)
+	token, err := td.bridgeSetToken(partition, tpe, hashkey)
+	if err != nil {
+		return nil, "", err
+	}
+	return td.getBridges(partition, tpe, hashkey, filter), token, nil
+}
+
+// GetBridgeSet returns the set of bridges identified by the token.  Bridges
+// that are gone since the token was created are replaced by other ones.
+func (td *TimeDistribution) GetBridgeSet(token string, filter core.FilterFunc) ([]string, error) {
+	partition, tpe, hashkey, err := td.parseBridgeSetToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return td.getBridges(partition, tpe, hashkey, filter), nil
+}
+
+func (td *TimeDistribution) getBridges(partition string, tpe string, hashkey core.Hashkey, filter core.FilterFunc) []string {
+	hashring := td.collection.GetHashring(partition, tpe)
 
 	var resources []core.Resource
 	if hashring.Len() <= td.Cfg.NumBridgesPerRequest {
 		resources = hashring.GetAll()
 	} else {
 		var err error
-		resources, err = hashring.GetManyFiltered(IpHashkey(ip), filter, td.Cfg.NumBridgesPerRequest)
+		resources, err = hashring.GetManyFiltered(hashkey, filter, td.Cfg.NumBridgesPerRequest)
 		if err != nil {
 			log.Println("Error getting resources from the subhashring:", err)
 		}
@@ -111,6 +181,60 @@ func (td *TimeDistribution) GetFilteredBridges(tpe string, ip net.IP, filter cor
 	return bridgestrings
 }
 
+// initTokenAEAD sets up the cipher of the bridge set tokens with a key
+// derived from the given secret, or with a random key if it's empty.
+func (td *TimeDistribution) initTokenAEAD(secret string) error {
+	var key [32]byte
+	if secret == "" {
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+	} else {
+		key = sha256.Sum256([]byte(secret))
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	td.tokenAEAD, err = cipher.NewGCM(block)
+	return err
+}
+
+// bridgeSetToken encrypts the partition, type and hashkey of a set of bridges,
+// so clients can't learn the hashkey of the requester nor craft tokens to
+// enumerate bridges.
+func (td *TimeDistribution) bridgeSetToken(partition string, tpe string, hashkey core.Hashkey) (string, error) {
+	payload := fmt.Sprintf("%s|%s|%d", partition, tpe, uint64(hashkey))
+	nonce := make([]byte, td.tokenAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := td.tokenAEAD.Seal(nonce, nonce, []byte(payload), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (td *TimeDistribution) parseBridgeSetToken(token string) (partition string, tpe string, hashkey core.Hashkey, err error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(sealed) < td.tokenAEAD.NonceSize() {
+		return "", "", 0, InvalidBridgeSetToken
+	}
+	nonce, ciphertext := sealed[:td.tokenAEAD.NonceSize()], sealed[td.tokenAEAD.NonceSize():]
+	payload, err := td.tokenAEAD.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", "", 0, InvalidBridgeSetToken
+	}
+
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 3 {
+		return "", "", 0, InvalidBridgeSetToken
+	}
+	key, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return "", "", 0, InvalidBridgeSetToken
+	}
+	return fields[0], fields[1], core.Hashkey(key), nil
+}
+
 func (td *TimeDistribution) makeProportions() map[string]int {
 	proportions := make(map[string]int)
 	for i := 0; i < td.Cfg.NumPeriods; i++ {
@@ -120,13 +244,19 @@ func (td *TimeDistribution) makeProportions() map[string]int {
 }
 
 func (td *TimeDistribution) getProportionIndex() string {
+	return td.advancedProportionIndex(0)
+}
+
+// advancedProportionIndex returns the proportion index of advance periods
+// after the current one.
+func (td *TimeDistribution) advancedProportionIndex(advance int) string {
 	if td.Cfg.NumPeriods == 0 || td.Cfg.RotationPeriodHours == 0 {
 		return ""
 	}
 
 	now := int(time.Now().Unix() / (60 * 60))
 	period := now / td.Cfg.RotationPeriodHours
-	return strconv.Itoa(period % td.Cfg.NumPeriods)
+	return strconv.Itoa((period + advance) % td.Cfg.NumPeriods)
 }
 
 func IpHashkey(ip net.IP) core.Hashkey {
@@ -0,0 +1,179 @@
+// Copyright (c) 2023, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"encoding/base64"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func newTestTimeDistribution() *TimeDistribution {
+	td := &TimeDistribution{
+		Cfg: &internal.TimeDistributionConfig{
+			NumBridgesPerRequest: 3,
+			RotationPeriodHours:  24,
+			NumPeriods:           2,
+		},
+	}
+	if err := td.initTokenAEAD("secret"); err != nil {
+		panic(err)
+	}
+	td.collection = core.NewCollection(&core.CollectionConfig{
+		Types: []core.TypeConfig{{
+			Type:        "dummy",
+			NewResource: func() core.Resource { return core.NewDummy(0, 0) },
+			Proportions: td.makeProportions(),
+		}},
+	})
+	for i := 1; i <= 100; i++ {
+		td.collection.Add(core.NewDummy(core.Hashkey(i), core.Hashkey(i)))
+	}
+	return td
+}
+
+func TestBridgeSetToken(t *testing.T) {
+	td := newTestTimeDistribution()
+	all := func(core.Resource) bool { return true }
+	ip := net.ParseIP("1.2.3.4")
+
+	bridges, token, err := td.GetNextFilteredBridgeSet("dummy", ip, 0, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bridges) != 3 {
+		t.Fatalf("expected 3 bridges but got %v", bridges)
+	}
+	if !reflect.DeepEqual(bridges, td.GetFilteredBridges("dummy", ip, all)) {
+		t.Error("the bridge set is not the one given to the ip")
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(decoded), strconv.FormatUint(uint64(IpHashkey(ip)), 10)) {
+		t.Error("the token reveals the hashkey of the requester")
+	}
+
+	sameBridges, err := td.GetBridgeSet(token, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bridges, sameBridges) {
+		t.Errorf("the token gave %v instead of %v", sameBridges, bridges)
+	}
+
+	// Tokens of other periods give the bridges of their partition
+	partition := td.getProportionIndex()
+	otherPartition := "0"
+	if partition == "0" {
+		otherPartition = "1"
+	}
+	otherToken, err := td.bridgeSetToken(otherPartition, "dummy", IpHashkey(ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherToken == token {
+		t.Error("got the same token for different periods")
+	}
+	otherBridges, err := td.GetBridgeSet(otherToken, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(bridges, otherBridges) {
+		t.Error("got the same bridges for different periods")
+	}
+}
+
+func TestInvalidBridgeSetToken(t *testing.T) {
+	td := newTestTimeDistribution()
+	all := func(core.Resource) bool { return true }
+	_, token, err := td.GetNextFilteredBridgeSet("dummy", net.ParseIP("1.2.3.4"), 0, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := []byte(token)
+	tampered[len(tampered)/2] ^= 1
+
+	otherKey := &TimeDistribution{}
+	if err := otherKey.initTokenAEAD("other secret"); err != nil {
+		t.Fatal(err)
+	}
+	forged, err := otherKey.bridgeSetToken("0", "dummy", core.Hashkey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, invalid := range []string{"", "token", token[:8], string(tampered), forged} {
+		if _, err := td.GetBridgeSet(invalid, all); err != InvalidBridgeSetToken {
+			t.Errorf("token %q was not rejected: %v", invalid, err)
+		}
+	}
+}
+
+func TestNextBridges(t *testing.T) {
+	td := newTestTimeDistribution()
+	td.Cfg.MaxPeriodAdvances = 1
+	all := func(core.Resource) bool { return true }
+	ip := net.ParseIP("1.2.3.4")
+
+	bridges, err := td.GetNextFilteredBridges("dummy", ip, 0, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bridges, td.GetFilteredBridges("dummy", ip, all)) {
+		t.Error("the current set is not the one given to the ip")
+	}
+
+	nextBridges, err := td.GetNextFilteredBridges("dummy", ip, 1, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nextBridges) != 3 {
+		t.Fatalf("expected 3 bridges but got %v", nextBridges)
+	}
+	if reflect.DeepEqual(bridges, nextBridges) {
+		t.Error("got the same bridges for the next set")
+	}
+	sameBridges, _ := td.GetNextFilteredBridges("dummy", ip, 1, all)
+	if !reflect.DeepEqual(nextBridges, sameBridges) {
+		t.Errorf("the next set changed from %v to %v", nextBridges, sameBridges)
+	}
+}
+
+func TestTooManyPeriodAdvances(t *testing.T) {
+	td := newTestTimeDistribution()
+	all := func(core.Resource) bool { return true }
+	ip := net.ParseIP("1.2.3.4")
+
+	for _, test := range []struct {
+		maxAdvances int
+		advance     int
+		allowed     bool
+	}{
+		{0, 1, false},
+		{1, 1, true},
+		{1, 2, false},
+		{1, -1, false},
+		// capped at NumPeriods-1, as later periods repeat the sets
+		{5, 2, false},
+	} {
+		td.Cfg.MaxPeriodAdvances = test.maxAdvances
+		_, err := td.GetNextFilteredBridges("dummy", ip, test.advance, all)
+		if test.allowed && err != nil {
+			t.Errorf("advance %d with max %d failed: %v", test.advance, test.maxAdvances, err)
+		}
+		if !test.allowed && err != TooManyPeriodAdvances {
+			t.Errorf("advance %d with max %d was not rejected: %v", test.advance, test.maxAdvances, err)
+		}
+	}
+}
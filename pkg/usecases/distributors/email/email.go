@@ -108,6 +108,11 @@ func (d *EmailDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 	}
 }
 
+// SupportedTypes returns the resource types that the distributor hands out.
+func (d *EmailDistributor) SupportedTypes() []string {
+	return d.cfg.Resources
+}
+
 func (d *EmailDistributor) Shutdown() {
 	log.Printf("Shutting down %s distributor.", DistName)
 
@@ -179,6 +184,50 @@ func (d *EmailDistributor) ParseAddress(emailAddress string) (string, error) {
 	return address, nil
 }
 
+// SplitReply splits the body of a reply in parts of at most MaxBodyBytes,
+// so each of them can be sent as a separate reply.  It splits on paragraphs
+// if possible, otherwise on lines.  A single line longer than the limit is
+// not split.
+func (d *EmailDistributor) SplitReply(body string) []string {
+	return splitBody(body, d.cfg.MaxBodyBytes)
+}
+
+func splitBody(body string, maxBytes int) []string {
+	if maxBytes <= 0 || len(body) <= maxBytes {
+		return []string{body}
+	}
+
+	parts := []string{}
+	current := ""
+	add := func(chunk, sep string) {
+		if current == "" {
+			current = chunk
+		} else if len(current)+len(sep)+len(chunk) <= maxBytes {
+			current += sep + chunk
+		} else {
+			parts = append(parts, current)
+			current = chunk
+		}
+	}
+	for _, paragraph := range strings.Split(body, "\n\n") {
+		if len(paragraph) <= maxBytes {
+			add(paragraph, "\n\n")
+			continue
+		}
+		for i, line := range strings.Split(paragraph, "\n") {
+			if i == 0 {
+				add(line, "\n\n")
+			} else {
+				add(line, "\n")
+			}
+		}
+	}
+	if current != "" {
+		parts = append(parts, current)
+	}
+	return parts
+}
+
 func (d *EmailDistributor) ParseCommand(body io.Reader) *Command {
 	command := Command{
 		Type: d.cfg.Resources[0],
@@ -5,9 +5,19 @@
 package email
 
 import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"io"
+	"net/mail"
+	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 )
 
@@ -64,3 +74,174 @@ func TestParseCommand(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitReply(t *testing.T) {
+	d := EmailDistributor{cfg: &internal.EmailDistConfig{MaxBodyBytes: 100}}
+	paragraph := strings.Repeat("a", 60)
+	body := strings.Join([]string{paragraph, paragraph, paragraph}, "\n\n")
+
+	parts := d.SplitReply(body)
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 replies but got %d: %q", len(parts), parts)
+	}
+	for _, part := range parts {
+		if part != paragraph {
+			t.Errorf("unexpected reply %q", part)
+		}
+	}
+
+	// A paragraph longer than the limit is split on lines.
+	line := strings.Repeat("b", 40)
+	body = strings.Join([]string{line, line, line, line}, "\n")
+	parts = d.SplitReply(body)
+	if len(parts) != 2 {
+		t.Fatalf("expected 2 replies but got %d: %q", len(parts), parts)
+	}
+	if parts[0] != line+"\n"+line {
+		t.Errorf("unexpected reply %q", parts[0])
+	}
+
+	d.cfg.MaxBodyBytes = 0
+	if parts = d.SplitReply(body); len(parts) != 1 || parts[0] != body {
+		t.Errorf("the reply should not be split without a limit: %q", parts)
+	}
+}
+
+func TestEncryptReply(t *testing.T) {
+	// Set the preferred hash of the key, like PGP implementations do.  The
+	// preference is only included in the signatures once they are re-signed
+	// by SerializePrivate.
+	config := &packet.Config{DefaultHash: crypto.SHA256}
+	entity, err := openpgp.NewEntity("Alice", "", "alice@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(io.Discard, config); err != nil {
+		t.Fatal(err)
+	}
+	var armoredKey bytes.Buffer
+	w, err := armor.Encode(&armoredKey, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	d := EmailDistributor{cfg: &internal.EmailDistConfig{
+		Email: internal.EmailConfig{EncryptReplies: true},
+	}}
+	inline := []byte("get transport obfs4\n\n" + armoredKey.String() + "\n")
+	attachment := []byte("--boundary\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"get transport obfs4\r\n" +
+		"--boundary\r\n" +
+		"Content-Type: application/pgp-keys\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(armoredKey.Bytes()) + "\r\n" +
+		"--boundary--\r\n")
+	requests := []struct {
+		header mail.Header
+		body   []byte
+	}{
+		{mail.Header{}, inline},
+		{mail.Header{"Content-Type": []string{`multipart/mixed; boundary="boundary"`}}, attachment},
+	}
+
+	bridgeLines := "obfs4 1.2.3.4:1234 FINGERPRINT cert=foo iat-mode=0"
+	for _, request := range requests {
+		key := d.ParsePublicKey(request.header, request.body)
+		if key == nil {
+			t.Fatalf("no public key found in %q", request.body)
+		}
+		encrypted, err := EncryptReply(key, bridgeLines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(encrypted, bridgeLines) {
+			t.Fatal("the reply is not encrypted")
+		}
+
+		block, err := armor.Decode(strings.NewReader(encrypted))
+		if err != nil {
+			t.Fatal(err)
+		}
+		md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := io.ReadAll(md.UnverifiedBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decrypted) != bridgeLines {
+			t.Errorf("unexpected decrypted reply %q", decrypted)
+		}
+	}
+
+	if key := d.ParsePublicKey(mail.Header{}, []byte("get transport obfs4")); key != nil {
+		t.Error("found a public key in a request without it")
+	}
+	d.cfg.Email.EncryptReplies = false
+	if key := d.ParsePublicKey(mail.Header{}, inline); key != nil {
+		t.Error("found a public key with encrypted replies disabled")
+	}
+}
+
+func TestSplitEncryptedReply(t *testing.T) {
+	entity, err := openpgp.NewEntity("Alice", "", "alice@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := openpgp.EntityList{entity}
+
+	d := EmailDistributor{cfg: &internal.EmailDistConfig{MaxBodyBytes: 2000}}
+	line := "obfs4 1.2.3.4:1234 FINGERPRINT cert=foo iat-mode=0"
+	lines := []string{}
+	for i := 0; i < 40; i++ {
+		lines = append(lines, line)
+	}
+	body := strings.Join(lines, "\n")
+	if parts := d.SplitReply(body); len(parts) != 2 {
+		t.Fatalf("expected the plaintext to be split in 2 replies but got %d", len(parts))
+	}
+
+	parts, err := d.SplitEncryptedReply(key, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) <= 2 {
+		t.Errorf("expected the encrypted reply to be split in more than 2 parts but got %d", len(parts))
+	}
+	decryptedLines := 0
+	for _, part := range parts {
+		if len(part) > d.cfg.MaxBodyBytes {
+			t.Errorf("encrypted reply of %d bytes is bigger than the limit", len(part))
+		}
+		block, err := armor.Decode(strings.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		md, err := openpgp.ReadMessage(block.Body, key, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := io.ReadAll(md.UnverifiedBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decryptedLines += len(strings.Split(string(decrypted), "\n"))
+	}
+	if decryptedLines != len(lines) {
+		t.Errorf("expected %d lines in the encrypted replies but got %d", len(lines), decryptedLines)
+	}
+}
+
+func TestSupportedTypes(t *testing.T) {
+	if types := dist.SupportedTypes(); !reflect.DeepEqual(types, dist.cfg.Resources) {
+		t.Errorf("Expected the configured types %v, got %v", dist.cfg.Resources, types)
+	}
+}
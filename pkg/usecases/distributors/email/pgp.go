@@ -0,0 +1,152 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+const (
+	publicKeyBegin = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	publicKeyEnd   = "-----END PGP PUBLIC KEY BLOCK-----"
+)
+
+// ParsePublicKey looks for an armored PGP public key in the request, inline
+// in the body or as an attachment.  It returns nil if encrypting replies is
+// disabled or the request doesn't include a valid key.
+func (d *EmailDistributor) ParsePublicKey(header mail.Header, body []byte) openpgp.EntityList {
+	if !d.cfg.Email.EncryptReplies {
+		return nil
+	}
+
+	for _, text := range textParts(header.Get("Content-Type"), header.Get("Content-Transfer-Encoding"), body) {
+		begin := strings.Index(text, publicKeyBegin)
+		if begin == -1 {
+			continue
+		}
+		end := strings.Index(text[begin:], publicKeyEnd)
+		if end == -1 {
+			continue
+		}
+		armored := text[begin : begin+end+len(publicKeyEnd)]
+		key, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+		if err != nil {
+			log.Println("Error parsing the PGP public key of the request:", err)
+			continue
+		}
+		return key
+	}
+	return nil
+}
+
+// EncryptReply encrypts the body of the reply to the given key and returns
+// it armored, so it can be sent as an inline PGP message.
+func EncryptReply(key openpgp.EntityList, body string) (string, error) {
+	var buf bytes.Buffer
+	armored, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openpgp.Encrypt(armored, key, nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(plaintext, body); err != nil {
+		return "", err
+	}
+	if err := plaintext.Close(); err != nil {
+		return "", err
+	}
+	if err := armored.Close(); err != nil {
+		return "", err
+	}
+	return buf.String() + "\n", nil
+}
+
+// SplitEncryptedReply splits the body of a reply like SplitReply and encrypts
+// each part to the given key.  As encrypting and armoring makes the parts
+// bigger, the plaintext is split in smaller parts until all the encrypted ones
+// fit in MaxBodyBytes.  Parts can still be bigger than the limit if they
+// include a single line that doesn't fit once encrypted.
+func (d *EmailDistributor) SplitEncryptedReply(key openpgp.EntityList, body string) ([]string, error) {
+	limit := d.cfg.MaxBodyBytes
+	for {
+		parts := splitBody(body, limit)
+		encrypted := make([]string, 0, len(parts))
+		biggest := 0
+		for _, part := range parts {
+			e, err := EncryptReply(key, part)
+			if err != nil {
+				return nil, err
+			}
+			encrypted = append(encrypted, e)
+			if len(e) > biggest {
+				biggest = len(e)
+			}
+		}
+		if d.cfg.MaxBodyBytes <= 0 || biggest <= d.cfg.MaxBodyBytes {
+			return encrypted, nil
+		}
+
+		// Shrink the limit by the overhead of the biggest part.
+		next := limit - (biggest - d.cfg.MaxBodyBytes)
+		if next <= 0 {
+			return encrypted, nil
+		}
+		limit = next
+	}
+}
+
+// textParts returns the decoded content of the body and, for multipart
+// bodies, of each of its parts.
+func textParts(contentType, transferEncoding string, body []byte) []string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return []string{string(decodeTransferEncoding(transferEncoding, body))}
+	}
+
+	texts := []string{}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			break
+		}
+		texts = append(texts, textParts(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), content)...)
+	}
+	return texts
+}
+
+func decodeTransferEncoding(transferEncoding string, content []byte) []byte {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(transferEncoding)) {
+	case "base64":
+		reader = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(bytes.ReplaceAll(content, []byte("\r\n"), nil)))
+	case "quoted-printable":
+		reader = quotedprintable.NewReader(bytes.NewReader(content))
+	default:
+		return content
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return content
+	}
+	return decoded
+}
@@ -41,6 +41,13 @@ var (
 	},
 		[]string{"platform"},
 	)
+
+	providersPerPlatform = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gettor_providers_per_platform",
+		Help: "The number of distinct providers serving links for each platform",
+	},
+		[]string{"platform"},
+	)
 )
 
 var platformAliases = map[string]string{
@@ -59,6 +66,7 @@ type GettorDistributor struct {
 	wg       sync.WaitGroup
 	shutdown chan bool
 	tblinks  TBLinkList
+	types    []string
 
 	// latest version of Tor Browser per platform
 	version map[string]resources.Version
@@ -74,12 +82,20 @@ type Command struct {
 	Command  string
 }
 
+// GetLinks returns the links for the platform that have not expired yet
 func (d *GettorDistributor) GetLinks(platform string) []*resources.TBLink {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 
 	linkResponseCount.WithLabelValues(platform).Inc()
-	return d.tblinks[platform]
+	links := []*resources.TBLink{}
+	for _, link := range d.tblinks[platform] {
+		if link.Expired() {
+			continue
+		}
+		links = append(links, link)
+	}
+	return links
 }
 
 func (d *GettorDistributor) GetAliasedLinks(platform string) []*resources.TBLink {
@@ -175,6 +191,7 @@ func (d *GettorDistributor) Init(cfg *internal.Config) {
 	d.shutdown = make(chan bool)
 	d.tblinks = make(TBLinkList)
 	d.version = make(map[string]resources.Version)
+	d.types = cfg.Distributors.Gettor.Resources
 
 	d.ipc = mechanisms.NewHttpsIpc(
 		cfg.Backend.ResourceStreamURL(),
@@ -192,12 +209,18 @@ func (d *GettorDistributor) Init(cfg *internal.Config) {
 	go d.housekeeping(rStream)
 }
 
+// SupportedTypes returns the resource types that the distributor hands out.
+func (d *GettorDistributor) SupportedTypes() []string {
+	return d.types
+}
+
 func (d *GettorDistributor) Shutdown() {
 	close(d.shutdown)
 	d.wg.Wait()
 }
 
-// applyDiff to tblinks. Ignore changes, links should not change, just appear new or be gone
+// applyDiff to tblinks. Changed links, like refreshed presigned links, replace
+// the link with the same Uid.
 func (d *GettorDistributor) applyDiff(diff *core.ResourceDiff) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
@@ -208,7 +231,45 @@ func (d *GettorDistributor) applyDiff(diff *core.ResourceDiff) {
 	}
 
 	needsCleanUp := map[string]struct{}{}
-	for rType, resourceQueue := range diff.New {
+	for _, resourceMap := range []core.ResourceMap{diff.New, diff.Changed} {
+		d.addLinks(resourceMap, needsCleanUp)
+	}
+
+	for rType, resourceQueue := range diff.Gone {
+		if rType != "tblink" {
+			continue
+		}
+		for _, r := range resourceQueue {
+			link, ok := r.(*resources.TBLink)
+			if !ok {
+				log.Println("Not valid tblink resource", r)
+				continue
+			}
+			_, ok = d.tblinks[link.Platform]
+			if !ok {
+				continue
+			}
+			for i, l := range d.tblinks[link.Platform] {
+				if l.Link == link.Link {
+					linklist := d.tblinks[link.Platform]
+					d.tblinks[link.Platform] = append(linklist[:i], linklist[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	for platform := range needsCleanUp {
+		d.deleteOldVersions(platform)
+	}
+
+	d.updateProvidersMetric()
+}
+
+// addLinks from the resource map, a link replaces the existing one with the
+// same Uid. It assumes that the mutex is already locked
+func (d *GettorDistributor) addLinks(resourceMap core.ResourceMap, needsCleanUp map[string]struct{}) {
+	for rType, resourceQueue := range resourceMap {
 		if rType != "tblink" {
 			continue
 		}
@@ -233,41 +294,26 @@ func (d *GettorDistributor) applyDiff(diff *core.ResourceDiff) {
 				d.version[link.Platform] = link.Version
 			}
 
-			for _, l := range d.tblinks[link.Platform] {
+			for i, l := range d.tblinks[link.Platform] {
 				if l.Uid() == link.Uid() {
+					d.tblinks[link.Platform][i] = link
 					continue processResource
 				}
 			}
 			d.tblinks[link.Platform] = append(d.tblinks[link.Platform], link)
 		}
 	}
+}
 
-	for rType, resourceQueue := range diff.Gone {
-		if rType != "tblink" {
-			continue
-		}
-		for _, r := range resourceQueue {
-			link, ok := r.(*resources.TBLink)
-			if !ok {
-				log.Println("Not valid tblink resource", r)
-				continue
-			}
-			_, ok = d.tblinks[link.Platform]
-			if !ok {
-				continue
-			}
-			for i, l := range d.tblinks[link.Platform] {
-				if l.Link == link.Link {
-					linklist := d.tblinks[link.Platform]
-					d.tblinks[link.Platform] = append(linklist[:i], linklist[i+1:]...)
-					break
-				}
-			}
+// updateProvidersMetric assumes that the mutex is already locked
+func (d *GettorDistributor) updateProvidersMetric() {
+	providersPerPlatform.Reset()
+	for platform, links := range d.tblinks {
+		providers := make(map[string]struct{})
+		for _, link := range links {
+			providers[link.Provider] = struct{}{}
 		}
-	}
-
-	for platform := range needsCleanUp {
-		d.deleteOldVersions(platform)
+		providersPerPlatform.WithLabelValues(platform).Set(float64(len(providers)))
 	}
 }
 
@@ -11,7 +11,9 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
@@ -20,8 +22,8 @@ const (
 )
 
 func TestDeleteOldVersion(t *testing.T) {
-	lastVersion := resources.Version{1, 0, 0}
-	oldVersion := resources.Version{0, 1, 0}
+	lastVersion := resources.Version{Major: 1, Minor: 0, Patch: 0}
+	oldVersion := resources.Version{Major: 0, Minor: 1, Patch: 0}
 	newLink := "new"
 	oldLink := "old"
 	dist := GettorDistributor{
@@ -60,12 +62,12 @@ func TestDeleteOldVersion(t *testing.T) {
 func TestGetTBLinks(t *testing.T) {
 	var tbLinks = []*resources.TBLink{{
 		Platform: "win",
-		Version:  resources.Version{0, 0, 1},
+		Version:  resources.Version{Major: 0, Minor: 0, Patch: 1},
 		Link:     "https://www.torproject.org/dist/torbrowser/10.0.10/torbrowser-install-win64-10.0.10_en-US.exe",
 		Provider: "res",
 	}, {
 		Platform: "win",
-		Version:  resources.Version{0, 0, 1},
+		Version:  resources.Version{Major: 0, Minor: 0, Patch: 1},
 		Link:     "https://www.torproject.org/dist/torbrowser/10.0.10/torbrowser-install-win64-10.0.10_en-US.executives",
 		Provider: "resource",
 	},
@@ -82,6 +84,30 @@ func TestGetTBLinks(t *testing.T) {
 	}
 }
 
+// TestGetTBLinksExpired tests that GetLinks doesn't return expired links
+func TestGetTBLinksExpired(t *testing.T) {
+	expiry := time.Hour
+	validLink := resources.NewTBLink()
+	validLink.Link = "valid"
+	validLink.CustomExpiry = &expiry
+	expiredLink := resources.NewTBLink()
+	expiredLink.Link = "expired"
+	expiredLink.CustomExpiry = &expiry
+	expiredLink.Created = time.Now().Add(-2 * time.Hour)
+
+	dist := GettorDistributor{
+		tblinks: TBLinkList{
+			platform: {validLink, expiredLink},
+		},
+		version: map[string]resources.Version{},
+	}
+	got := dist.GetLinks(platform)
+	expected := []*resources.TBLink{validLink}
+	if !reflect.DeepEqual(got, expected) {
+		t.Error("expected:", expected, "got", got)
+	}
+}
+
 // TestParseCommand tests the ParseCommand method of the GettorDistributor
 func TestParseCommand(t *testing.T) {
 	t.Run("check that the distributor parses the command correctly", func(t *testing.T) {
@@ -94,11 +120,11 @@ func TestParseCommand(t *testing.T) {
 				platform: {
 					&resources.TBLink{
 						Link:    "link1",
-						Version: resources.Version{0, 0, 1},
+						Version: resources.Version{Major: 0, Minor: 0, Patch: 1},
 					},
 					&resources.TBLink{
 						Link:    "link2",
-						Version: resources.Version{1, 0, 1},
+						Version: resources.Version{Major: 1, Minor: 0, Patch: 1},
 					},
 				},
 			},
@@ -142,9 +168,9 @@ func TestParseCommand(t *testing.T) {
 
 // TestApplyDiff tests the applyDiff method of the GettorDistributor
 func TestApplyDiff(t *testing.T) {
-	Version1 := resources.Version{1, 0, 0}
-	Version2 := resources.Version{1, 1, 0}
-	Version3 := resources.Version{1, 2, 0}
+	Version1 := resources.Version{Major: 1, Minor: 0, Patch: 0}
+	Version2 := resources.Version{Major: 1, Minor: 1, Patch: 0}
+	Version3 := resources.Version{Major: 1, Minor: 2, Patch: 0}
 	link1 := "link1"
 	link2 := "link2"
 	link3 := "link3"
@@ -269,6 +295,38 @@ func TestApplyDiff(t *testing.T) {
 			t.Error("expected tblinks:", expectedtblinks, "got:", dist.tblinks[platform])
 		}
 	})
+	t.Run("check that changed tblinks replace the link with the same uid", func(t *testing.T) {
+		uid := core.NewHashkey("file")
+		oldLink := resources.NewTBLink()
+		oldLink.Platform = platform
+		oldLink.Version = Version2
+		oldLink.Link = link1
+		oldLink.CustomUid = &uid
+		refreshedLink := resources.NewTBLink()
+		refreshedLink.Platform = platform
+		refreshedLink.Version = Version2
+		refreshedLink.Link = link2
+		refreshedLink.CustomUid = &uid
+
+		dist := GettorDistributor{
+			tblinks: TBLinkList{
+				platform: {oldLink},
+			},
+			version: map[string]resources.Version{
+				platform: Version2,
+			},
+		}
+		diff := &core.ResourceDiff{
+			Changed: core.ResourceMap{resources.ResourceTypeTBLink: core.ResourceQueue{refreshedLink}},
+		}
+		expectedtblinks := []*resources.TBLink{
+			refreshedLink,
+		}
+		dist.applyDiff(diff)
+		if !reflect.DeepEqual(dist.tblinks[platform], expectedtblinks) {
+			t.Error("expected tblinks:", expectedtblinks, "got:", dist.tblinks[platform])
+		}
+	})
 
 }
 
@@ -299,3 +357,50 @@ func TestShutdown(t *testing.T) {
 		t.Error("expected channel to be closed")
 	}
 }
+
+func TestProvidersPerPlatform(t *testing.T) {
+	newLink := func(link, provider string) *resources.TBLink {
+		tbLink := resources.NewTBLink()
+		tbLink.Platform = platform
+		tbLink.Version = resources.Version{Major: 1}
+		tbLink.Link = link
+		tbLink.Provider = provider
+		return tbLink
+	}
+	diff := &core.ResourceDiff{
+		New: core.ResourceMap{resources.ResourceTypeTBLink: core.ResourceQueue{
+			newLink("link1", "github"),
+			newLink("link2", "gitlab"),
+			newLink("link3", "gitlab"),
+		}},
+	}
+
+	dist := GettorDistributor{
+		tblinks: TBLinkList{},
+		version: map[string]resources.Version{},
+	}
+	dist.applyDiff(diff)
+	if providers := testutil.ToFloat64(providersPerPlatform.WithLabelValues(platform)); providers != 2 {
+		t.Errorf("expected 2 providers for %s, got %f", platform, providers)
+	}
+
+	diff = &core.ResourceDiff{
+		Gone: core.ResourceMap{resources.ResourceTypeTBLink: core.ResourceQueue{newLink("link1", "github")}},
+	}
+	dist.applyDiff(diff)
+	if providers := testutil.ToFloat64(providersPerPlatform.WithLabelValues(platform)); providers != 1 {
+		t.Errorf("expected 1 provider for %s, got %f", platform, providers)
+	}
+}
+
+func TestSupportedTypes(t *testing.T) {
+	cfg := &internal.Config{}
+	cfg.Distributors.Gettor.Resources = []string{"tblink"}
+	dist := GettorDistributor{}
+	dist.Init(cfg)
+	defer dist.Shutdown()
+
+	if types := dist.SupportedTypes(); !reflect.DeepEqual(types, cfg.Distributors.Gettor.Resources) {
+		t.Errorf("Expected the configured types %v, got %v", cfg.Distributors.Gettor.Resources, types)
+	}
+}
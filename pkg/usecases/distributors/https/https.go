@@ -20,6 +20,10 @@ const (
 	BridgeReloadInterval = time.Minute * 10
 )
 
+// InvalidBridgeSetToken is returned by RequestBridgesByToken for tokens that
+// were not created by the distributor.
+var InvalidBridgeSetToken = common.InvalidBridgeSetToken
+
 // HttpsDistributor contains all the context that the distributor needs to run.
 type HttpsDistributor struct {
 	timeDistribution *common.TimeDistribution
@@ -31,16 +35,47 @@ type HttpsDistributor struct {
 // ip as the IP of the client, and ipv6 as whether IPv6 bridge is requested.
 // and return a slice of bridge lines.
 func (d *HttpsDistributor) RequestBridges(tpe string, ip net.IP, ipv6 bool) ([]string, error) {
-	r := d.timeDistribution.GetFilteredBridges(tpe, ip, func(r core.Resource) bool {
+	r := d.timeDistribution.GetFilteredBridges(tpe, ip, ipFilter(ipv6))
+	return r, nil
+}
+
+// RequestNextBridgeSet behaves like RequestBridges, but it gives the next set
+// of bridges, advance sets after the current one, and a token to get the same
+// bridges later with RequestBridgesByToken.  advance can be up to MaxNextSets.
+func (d *HttpsDistributor) RequestNextBridgeSet(tpe string, ip net.IP, ipv6 bool, advance int) ([]string, string, error) {
+	return d.timeDistribution.GetNextFilteredBridgeSet(tpe, ip, advance, ipFilter(ipv6))
+}
+
+// MaxNextSets returns how many times a requester can ask for the next set of
+// bridges before the rotation period is over.
+func (d *HttpsDistributor) MaxNextSets() int {
+	return d.timeDistribution.MaxPeriodAdvances()
+}
+
+// RequestBridgesByToken returns the bridges of the set identified by the
+// token, and ipv6 as whether IPv6 bridges are requested.
+func (d *HttpsDistributor) RequestBridgesByToken(token string, ipv6 bool) ([]string, error) {
+	return d.timeDistribution.GetBridgeSet(token, ipFilter(ipv6))
+}
+
+// RequesterKey returns the key that identifies the requester with the given IP
+// address.  Requesters with the same key get the same bridges.
+func RequesterKey(ip net.IP) core.Hashkey {
+	return common.IpHashkey(ip)
+}
+
+// ipFilter returns a filter for the bridges that match the requested IP
+// version
+func ipFilter(ipv6 bool) core.FilterFunc {
+	return func(r core.Resource) bool {
 		switch rTyped := r.(type) {
 		case *resources.Transport:
-			if !resources.ResourceMap[tpe].IsAddressDummy && ipv6 != (rTyped.Address.IP.To4() == nil) {
+			if !resources.ResourceMap[rTyped.Type()].IsAddressDummy && ipv6 != (rTyped.Address.IP.To4() == nil) {
 				return false
 			}
 		}
 		return true
-	})
-	return r, nil
+	}
 }
 
 // Init initialises the given HTTPS distributor.
@@ -59,6 +94,11 @@ func (d *HttpsDistributor) Init(cfg *internal.Config) {
 	d.timeDistribution.Start()
 }
 
+// SupportedTypes returns the resource types that the distributor hands out.
+func (d *HttpsDistributor) SupportedTypes() []string {
+	return d.cfg.Distributors.Https.Resources
+}
+
 // Shutdown shuts down the given HTTPS distributor.
 func (d *HttpsDistributor) Shutdown() {
 	log.Printf("Shutting down %s distributor.", DistName)
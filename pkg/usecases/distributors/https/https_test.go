@@ -0,0 +1,24 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"reflect"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+func TestSupportedTypes(t *testing.T) {
+	cfg := &internal.Config{}
+	cfg.Distributors.Https.Resources = []string{"obfs4", "vanilla"}
+	d := HttpsDistributor{}
+	d.Init(cfg)
+	defer d.Shutdown()
+
+	if types := d.SupportedTypes(); !reflect.DeepEqual(types, cfg.Distributors.Https.Resources) {
+		t.Errorf("Expected the configured types %v, got %v", cfg.Distributors.Https.Resources, types)
+	}
+}
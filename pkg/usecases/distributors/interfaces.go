@@ -12,4 +12,7 @@ import (
 type Distributor interface {
 	Init(*internal.Config)
 	Shutdown()
+	// SupportedTypes returns the resource types that the distributor hands
+	// out, as configured.  It must only be called after Init.
+	SupportedTypes() []string
 }
@@ -12,6 +12,7 @@ import (
 	"log"
 	mrand "math/rand"
 	"net"
+	"slices"
 	"sync"
 	"time"
 
@@ -61,6 +62,7 @@ type MoatDistributor struct {
 	timeDistribution      *common.TimeDistribution
 	dummyHashring         *core.Hashring
 	builtinBridges        map[string][]string
+	builtinBridgesByURL   map[string]map[string][]string
 	circumventionMap      CircumventionMap
 	circumventionDefaults CircumventionSettings
 	cfg                   *internal.MoatDistConfig
@@ -226,13 +228,35 @@ func (d *MoatDistributor) housekeeping() {
 	}
 }
 
+// fetchBuiltinBridges fetches the builtin bridges from each of the configured
+// URLs and merges them by transport type.  If a URL fails we keep using the
+// bridges we got from it last time.
 func (d *MoatDistributor) fetchBuiltinBridges() {
-	builtinBridges, err := d.FetchBridges(d.cfg.BuiltInBridgesURL)
-	if err != nil {
-		log.Println("Failed to fetch builtin bridges:", err)
-	} else {
-		d.builtinBridges = builtinBridges
+	urls := d.cfg.BuiltInBridgesURLs
+	if d.cfg.BuiltInBridgesURL != "" || len(urls) == 0 {
+		urls = append([]string{d.cfg.BuiltInBridgesURL}, urls...)
 	}
+
+	for _, url := range urls {
+		bridges, err := d.FetchBridges(url)
+		if err != nil {
+			log.Printf("Failed to fetch builtin bridges from %s: %v", url, err)
+			continue
+		}
+		d.builtinBridgesByURL[url] = bridges
+	}
+
+	builtinBridges := make(map[string][]string)
+	for _, url := range urls {
+		for bridgeType, bridgeLines := range d.builtinBridgesByURL[url] {
+			for _, line := range bridgeLines {
+				if !slices.Contains(builtinBridges[bridgeType], line) {
+					builtinBridges[bridgeType] = append(builtinBridges[bridgeType], line)
+				}
+			}
+		}
+	}
+	d.builtinBridges = builtinBridges
 }
 
 func (d *MoatDistributor) Init(cfg *internal.Config) {
@@ -241,6 +265,7 @@ func (d *MoatDistributor) Init(cfg *internal.Config) {
 	d.cfg = &cfg.Distributors.Moat
 	d.shutdown = make(chan bool)
 	d.builtinBridges = make(map[string][]string)
+	d.builtinBridgesByURL = make(map[string]map[string][]string)
 	d.fetchBuiltinBridges()
 
 	d.timeDistribution = &common.TimeDistribution{
@@ -256,6 +281,11 @@ func (d *MoatDistributor) Init(cfg *internal.Config) {
 	go d.housekeeping()
 }
 
+// SupportedTypes returns the resource types that the distributor hands out.
+func (d *MoatDistributor) SupportedTypes() []string {
+	return d.cfg.Resources
+}
+
 func (d *MoatDistributor) Shutdown() {
 	log.Printf("Shutting down %s distributor.", DistName)
 
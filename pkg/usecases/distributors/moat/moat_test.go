@@ -5,6 +5,8 @@
 package moat
 
 import (
+	"errors"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -242,3 +244,51 @@ func TestDummyBridges(t *testing.T) {
 		t.Fatal("Found bridgestrings for 'uk' when there are none in the collection")
 	}
 }
+
+func TestMergeBuiltinBridges(t *testing.T) {
+	cfg := config
+	cfg.Distributors.Moat.BuiltInBridgesURL = "https://example.com/pt_config.json"
+	cfg.Distributors.Moat.BuiltInBridgesURLs = []string{
+		"https://example.com/meek.json",
+		"https://example.com/broken.json",
+	}
+	d := MoatDistributor{
+		FetchBridges: func(url string) (map[string][]string, error) {
+			switch url {
+			case "https://example.com/pt_config.json":
+				return map[string][]string{
+					"snowflake": {"snowflake 192.0.2.3:1 2B280B23E1107BB62ABFC40DDCC8824814F80A72"},
+					"obfs4":     {"obfs4 192.0.2.4:443 A"},
+				}, nil
+			case "https://example.com/meek.json":
+				return map[string][]string{
+					"meek_lite": {"meek_lite 192.0.2.5:80 B"},
+					"obfs4":     {"obfs4 192.0.2.6:443 C", "obfs4 192.0.2.4:443 A"},
+				}, nil
+			}
+			return nil, errors.New("not found")
+		},
+	}
+	d.Init(&cfg)
+	defer d.Shutdown()
+
+	bridges := d.GetBuiltInBridges([]string{})
+	if len(bridges) != 3 {
+		t.Fatalf("Expected 3 types of builtin bridges but got: %v", bridges)
+	}
+	if len(bridges["snowflake"]) != 1 || len(bridges["meek_lite"]) != 1 {
+		t.Errorf("Unexpected builtin bridges: %v", bridges)
+	}
+	if len(bridges["obfs4"]) != 2 {
+		t.Errorf("Expected the obfs4 bridges to be merged without duplicates: %v", bridges["obfs4"])
+	}
+}
+
+func TestSupportedTypes(t *testing.T) {
+	d := initDistributor()
+	defer d.Shutdown()
+
+	if types := d.SupportedTypes(); !reflect.DeepEqual(types, config.Distributors.Moat.Resources) {
+		t.Errorf("Expected the configured types %v, got %v", config.Distributors.Moat.Resources, types)
+	}
+}
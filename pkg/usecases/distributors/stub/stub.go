@@ -8,6 +8,7 @@ import (
 	"errors"
 	"log"
 	"sync"
+	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
@@ -32,6 +33,26 @@ type StubDistributor struct {
 	shutdown chan bool
 	// wg is used to figure out when our housekeeping method is finished.
 	wg sync.WaitGroup
+	// lastDiff summarises the last diff we got from the backend.
+	lastDiff *DiffSummary
+	mutex    sync.RWMutex
+}
+
+// StreamStats reports what the distributor got over the resource stream, so
+// integration tests can check that the resources are delivered.
+type StreamStats struct {
+	// Resources is the number of resources of each type in the hashring.
+	Resources map[string]int `json:"resources"`
+	LastDiff  *DiffSummary   `json:"last_diff"`
+}
+
+// DiffSummary contains the number of resources of each type in a diff.
+type DiffSummary struct {
+	New        map[string]int `json:"new"`
+	Changed    map[string]int `json:"changed"`
+	Gone       map[string]int `json:"gone"`
+	FullUpdate bool           `json:"full_update"`
+	Received   time.Time      `json:"received"`
 }
 
 // housekeeping keeps track of periodic tasks.
@@ -46,7 +67,7 @@ func (d *StubDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 		case diff := <-rStream:
 			// We got a resource update from the backend.  Let's add it to our
 			// hashring.
-			d.ring.ApplyDiff(diff)
+			d.applyDiff(diff)
 		case <-d.shutdown:
 			// We are told to shut down.
 			log.Printf("Shutting down housekeeping.")
@@ -55,6 +76,42 @@ func (d *StubDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 	}
 }
 
+func (d *StubDistributor) applyDiff(diff *core.ResourceDiff) {
+	d.ring.ApplyDiff(diff)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.lastDiff = &DiffSummary{
+		New:        countByType(diff.New),
+		Changed:    countByType(diff.Changed),
+		Gone:       countByType(diff.Gone),
+		FullUpdate: diff.FullUpdate,
+		Received:   time.Now(),
+	}
+}
+
+// Stats returns how many resources of each type we have and a summary of the
+// last diff we got from the backend.
+func (d *StubDistributor) Stats() *StreamStats {
+	stats := &StreamStats{Resources: make(map[string]int)}
+	for _, r := range d.ring.GetAll() {
+		stats.Resources[r.Type()]++
+	}
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	stats.LastDiff = d.lastDiff
+	return stats
+}
+
+func countByType(m core.ResourceMap) map[string]int {
+	counts := make(map[string]int)
+	for rType, queue := range m {
+		counts[rType] = len(queue)
+	}
+	return counts
+}
+
 // RequestBridges takes as input a hashkey (it is the frontend's responsibility
 // to derive the hashkey) and uses it to return a slice of resources.
 func (d *StubDistributor) RequestBridges(key core.Hashkey) ([]core.Resource, error) {
@@ -98,6 +155,12 @@ func (d *StubDistributor) Init(cfg *internal.Config) {
 	go d.housekeeping(rStream)
 }
 
+// SupportedTypes returns the resource types that the distributor hands out.
+// This method is required to satisfy the Distributor interface.
+func (d *StubDistributor) SupportedTypes() []string {
+	return d.cfg.Distributors.Stub.Resources
+}
+
 // Shutdown shuts down the distributor.  This method is required to satisfy the
 // Distributor interface.
 func (d *StubDistributor) Shutdown() {
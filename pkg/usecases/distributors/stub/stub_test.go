@@ -0,0 +1,72 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stub
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func newObfs4(port uint16) *resources.Transport {
+	transport := resources.NewTransport()
+	transport.SetType("obfs4")
+	transport.Address = resources.IPAddr{IPAddr: net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	transport.Port = port
+	transport.Fingerprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+	return transport
+}
+
+func TestStats(t *testing.T) {
+	d := StubDistributor{ring: core.NewHashring()}
+
+	stats := d.Stats()
+	if len(stats.Resources) != 0 || stats.LastDiff != nil {
+		t.Errorf("Unexpected stats before getting any diff: %+v", stats)
+	}
+
+	gone := newObfs4(1000)
+	d.applyDiff(&core.ResourceDiff{
+		New: core.ResourceMap{
+			"obfs4": []core.Resource{gone, newObfs4(1001)},
+			"dummy": []core.Resource{core.NewDummy(core.NewHashkey("oid"), core.NewHashkey("uid"))},
+		},
+		FullUpdate: true,
+	})
+	stats = d.Stats()
+	if stats.Resources["obfs4"] != 2 || stats.Resources["dummy"] != 1 {
+		t.Errorf("Wrong number of resources: %v", stats.Resources)
+	}
+	if !stats.LastDiff.FullUpdate || stats.LastDiff.New["obfs4"] != 2 {
+		t.Errorf("Wrong summary of the diff: %+v", stats.LastDiff)
+	}
+
+	d.applyDiff(&core.ResourceDiff{
+		Gone: core.ResourceMap{"obfs4": []core.Resource{gone}},
+	})
+	stats = d.Stats()
+	if stats.Resources["obfs4"] != 1 || stats.Resources["dummy"] != 1 {
+		t.Errorf("Wrong number of resources after removing one: %v", stats.Resources)
+	}
+	if stats.LastDiff.FullUpdate || len(stats.LastDiff.New) != 0 || stats.LastDiff.Gone["obfs4"] != 1 {
+		t.Errorf("Wrong summary of the diff: %+v", stats.LastDiff)
+	}
+}
+
+func TestSupportedTypes(t *testing.T) {
+	cfg := &internal.Config{}
+	cfg.Distributors.Stub.Resources = []string{"obfs4", "vanilla"}
+	d := StubDistributor{}
+	d.Init(cfg)
+	defer d.Shutdown()
+
+	if types := d.SupportedTypes(); !reflect.DeepEqual(types, cfg.Distributors.Stub.Resources) {
+		t.Errorf("Expected the configured types %v, got %v", cfg.Distributors.Stub.Resources, types)
+	}
+}
@@ -6,6 +6,7 @@ package telegram
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -15,12 +16,40 @@ import (
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
-const InvitationRequestDayLimit int = 7
+const (
+	InvitationRequestDayLimit int = 7
+
+	// defaultMaxUpdateBytes is the maximum size of an update of new bridges,
+	// unless configured otherwise.
+	defaultMaxUpdateBytes = 1 << 20 // 1MB
+)
+
+var (
+	UpdateTooLarge  = errors.New("The update of new bridges is too large")
+	MalformedUpdate = errors.New("Malformed update of new bridges")
+)
 
 type bridgesJSON struct {
 	Bridgelines []string `json:"bridgelines"`
 }
 
+// testResultsJSON maps bridgelines to whether they are functional.
+type testResultsJSON struct {
+	Results map[string]bool `json:"results"`
+}
+
+// NewBridgesReport summarises an update of new bridges for the updater.
+type NewBridgesReport struct {
+	Accepted int                  `json:"accepted"`
+	Rejected []RejectedBridgeline `json:"rejected"`
+}
+
+// RejectedBridgeline is a bridgeline of an update that was not loaded.
+type RejectedBridgeline struct {
+	Bridgeline string `json:"bridgeline"`
+	Reason     string `json:"reason"`
+}
+
 func (d *TelegramDistributor) loadNewBridgesFromStore() {
 	d.newHashrightLock.Lock()
 	defer d.newHashrightLock.Unlock()
@@ -32,12 +61,34 @@ func (d *TelegramDistributor) loadNewBridgesFromStore() {
 			log.Println("Error loading updater", updater, ":", err)
 			continue
 		}
-		for _, r := range rs {
-			d.newHashring.Add(&r)
+		resourceList := make([]core.Resource, len(rs))
+		for i := range rs {
+			if rs[i].TestResult() == nil {
+				rs[i].ResourceBase.Test = &core.ResourceTest{State: core.StateUntested}
+			}
+			resourceList[i] = &rs[i]
 		}
+		resourceList = d.capNewBridges(updater, resourceList)
+		for _, r := range resourceList {
+			d.newHashring.Add(r)
+		}
+		d.dynamicBridges[updater] = resourceList
+		newBridgesGauge.WithLabelValues(updater).Set(float64(len(resourceList)))
 	}
 }
 
+// capNewBridges returns the given bridges of the updater, without the oldest
+// ones if there are more than MaxNewBridgesPerUpdater.  The bridges are
+// expected in the order they were pushed, so the first ones are the oldest.
+func (d *TelegramDistributor) capNewBridges(updater string, bridges []core.Resource) []core.Resource {
+	max := d.cfg.MaxNewBridgesPerUpdater
+	if max <= 0 || len(bridges) <= max {
+		return bridges
+	}
+	log.Printf("Evicting the %d oldest new bridges from %s, over the limit of %d.", len(bridges)-max, updater, max)
+	return bridges[len(bridges)-max:]
+}
+
 func (d *TelegramDistributor) loadIdsFromStore() {
 	var seenIDs map[int64]time.Time
 	err := d.IdStore.Load(&seenIDs)
@@ -54,49 +105,171 @@ func (d *TelegramDistributor) loadIdsFromStore() {
 
 // LoadNewBridges loads bridges in bridgesJSON format from the reader into the new bridges newHashring
 //
+// The bridgelines that can't be parsed, or are not of our resource type, are rejected and the rest
+// replace the bridges of the updater.  The returned report lists the rejected lines with the reason.
+// Updates over MaxUpdateBytes are rejected as a whole with UpdateTooLarge, and updates without a
+// single valid bridgeline with MalformedUpdate.
+//
 // This function locks a mutex when accessing the newHashring, we should be careful to don't make
 // a deadlock with the internal mutex in the hashring. Never call this function while holding the
 // newHashring mutex.
-func (d *TelegramDistributor) LoadNewBridges(name string, r io.Reader) error {
+func (d *TelegramDistributor) LoadNewBridges(name string, r io.Reader) (*NewBridgesReport, error) {
+	body, err := d.readUpdate(r)
+	if err != nil {
+		return nil, err
+	}
+
 	var updatedBridges bridgesJSON
-	dec := json.NewDecoder(r)
-	err := dec.Decode(&updatedBridges)
+	err = json.Unmarshal(body, &updatedBridges)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %s", MalformedUpdate, err)
 	}
 
-	resourceList := make([]core.Resource, len(updatedBridges.Bridgelines))
-	for i, bridgeline := range updatedBridges.Bridgelines {
+	report := &NewBridgesReport{Rejected: []RejectedBridgeline{}}
+	resourceList := []core.Resource{}
+	for _, bridgeline := range updatedBridges.Bridgelines {
 		resource, err := resources.FromBridgeline(bridgeline)
-		if err != nil {
-			return err
+		if err == nil && resource.Type() != d.cfg.Resource {
+			err = fmt.Errorf("Not valid bridge type %s", resource.Type())
 		}
-		if resource.Type() != d.cfg.Resource {
-			return fmt.Errorf("Not valid bridge type %s", resource.Type())
+		if err != nil {
+			report.Rejected = append(report.Rejected, RejectedBridgeline{Bridgeline: bridgeline, Reason: err.Error()})
+			continue
 		}
-
-		resourceList[i] = resource
+		resource.ResourceBase.Test = &core.ResourceTest{State: core.StateUntested}
+		resourceList = append(resourceList, resource)
+	}
+	report.Accepted = len(resourceList)
+	if len(resourceList) == 0 && len(report.Rejected) != 0 {
+		return report, fmt.Errorf("%w: all the %d bridgelines were rejected", MalformedUpdate, len(report.Rejected))
 	}
+	resourceList = d.capNewBridges(name, resourceList)
 
 	d.newHashrightLock.Lock()
+	// The bridges that were already there keep their test results.
+	oldResources := make(map[core.Hashkey]core.Resource)
 	for _, resource := range d.dynamicBridges[name] {
+		oldResources[resource.Uid()] = resource
 		d.newHashring.Remove(resource)
 	}
+	for _, resource := range resourceList {
+		if old, ok := oldResources[resource.Uid()]; ok {
+			*resource.TestResult() = *old.TestResult()
+		}
+	}
 	d.dynamicBridges[name] = resourceList
 
 	for _, resource := range resourceList {
 		d.newHashring.Add(resource)
 	}
+	snapshot := snapshotNewBridges(resourceList)
 	d.newHashrightLock.Unlock()
 
 	numBridges := len(resourceList)
-	log.Println("Got", numBridges, "new bridges from", name)
+	log.Println("Got", numBridges, "new bridges from", name, "and rejected", len(report.Rejected))
 	newBridgesGauge.WithLabelValues(name).Set(float64(numBridges))
 
 	persistence := d.NewBridgesStore[name]
 	if persistence != nil {
-		return d.NewBridgesStore[name].Save(resourceList)
+		return report, persistence.Save(snapshot)
 	}
 
-	return nil
+	return report, nil
+}
+
+// SetNewBridgesTestResults sets the test results of the new bridges from the reader, in
+// testResultsJSON format.  If TestNewBridges is configured only the bridges that are marked as
+// functional are distributed.  It returns the number of bridges that got a test result.
+func (d *TelegramDistributor) SetNewBridgesTestResults(r io.Reader) (int, error) {
+	body, err := d.readUpdate(r)
+	if err != nil {
+		return 0, err
+	}
+	var testResults testResultsJSON
+	err = json.Unmarshal(body, &testResults)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", MalformedUpdate, err)
+	}
+
+	// Bridgelines are compared once parsed, so they don't need to be written
+	// exactly as the updaters pushed them.
+	functional := make(map[core.Hashkey]bool)
+	for bridgeline, isFunctional := range testResults.Results {
+		resource, err := resources.FromBridgeline(bridgeline)
+		if err != nil {
+			log.Println("Ignoring the test result of", bridgeline, ":", err)
+			continue
+		}
+		functional[resource.Uid()] = isFunctional
+	}
+
+	updated := 0
+	updatedLists := make(map[string][]resources.Transport)
+	now := time.Now().UTC()
+	d.newHashrightLock.Lock()
+	for updater, resourceList := range d.dynamicBridges {
+		for _, resource := range resourceList {
+			isFunctional, ok := functional[resource.Uid()]
+			if !ok {
+				continue
+			}
+			test := resource.TestResult()
+			test.State = core.StateDysfunctional
+			if isFunctional {
+				test.State = core.StateFunctional
+				test.LastPassed = now
+			}
+			test.LastTested = now
+			updatedLists[updater] = nil
+			updated++
+		}
+	}
+	for updater := range updatedLists {
+		updatedLists[updater] = snapshotNewBridges(d.dynamicBridges[updater])
+	}
+	d.newHashrightLock.Unlock()
+	log.Println("Got test results for", updated, "new bridges")
+
+	for updater, resourceList := range updatedLists {
+		if persistence := d.NewBridgesStore[updater]; persistence != nil {
+			if err := persistence.Save(resourceList); err != nil {
+				return updated, err
+			}
+		}
+	}
+	return updated, nil
+}
+
+// snapshotNewBridges copies the given new bridges with their test results, so
+// they can be saved after releasing newHashrightLock.  The caller must hold
+// newHashrightLock.
+func snapshotNewBridges(resourceList []core.Resource) []resources.Transport {
+	snapshot := make([]resources.Transport, 0, len(resourceList))
+	for _, resource := range resourceList {
+		transport, ok := resource.(*resources.Transport)
+		if !ok {
+			continue
+		}
+		copied := *transport
+		test := *transport.TestResult()
+		copied.ResourceBase.Test = &test
+		snapshot = append(snapshot, copied)
+	}
+	return snapshot
+}
+
+// readUpdate reads the body of an update from the reader, up to MaxUpdateBytes.
+func (d *TelegramDistributor) readUpdate(r io.Reader) ([]byte, error) {
+	maxBytes := d.cfg.MaxUpdateBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxUpdateBytes
+	}
+	body, err := io.ReadAll(io.LimitReader(r, int64(maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBytes {
+		return nil, fmt.Errorf("%w: over %d bytes", UpdateTooLarge, maxBytes)
+	}
+	return body, nil
 }
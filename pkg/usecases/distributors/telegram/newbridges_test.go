@@ -5,10 +5,17 @@
 package telegram
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
 	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
@@ -43,7 +50,7 @@ func TestLoadNewResources(t *testing.T) {
 			"Bridge %s %s:%d %s cert=%s iat-mode=%s"
 		]
 		}`, tpe, ip, port, fingerprint, params["cert"], params["iat-mode"]))
-	err := d.LoadNewBridges("updater", r)
+	_, err := d.LoadNewBridges("updater", r)
 	if err != nil {
 		t.Fatalf("Error loading new bridges: %v", err)
 	}
@@ -93,7 +100,7 @@ func TestUpdateNewResources(t *testing.T) {
 			"Bridge %s %s:%d %s cert=%s iat-mode=%s"
 		]
 		}`, tpe, ip, port, fingerprint, params["cert"], params["iat-mode"]))
-	err := d.LoadNewBridges("updater", r)
+	_, err := d.LoadNewBridges("updater", r)
 	if err != nil {
 		t.Fatalf("Error loading new bridges: %v", err)
 	}
@@ -103,7 +110,7 @@ func TestUpdateNewResources(t *testing.T) {
 			"Bridge %s %s:%d %s cert=%s iat-mode=%s"
 		]
 		}`, tpe, ip, port, fingerprint2, params["cert"], params["iat-mode"]))
-	err = d.LoadNewBridges("updater", r)
+	_, err = d.LoadNewBridges("updater", r)
 	if err != nil {
 		t.Fatalf("Error loading new bridges: %v", err)
 	}
@@ -135,7 +142,7 @@ func TestLoadNewResourcesMultipleUpdaters(t *testing.T) {
 			"Bridge %s %s:%d %s cert=%s iat-mode=%s"
 		]
 		}`, tpe, ip, port, fingerprint, params["cert"], params["iat-mode"]))
-	err := d.LoadNewBridges("updater", r)
+	_, err := d.LoadNewBridges("updater", r)
 	if err != nil {
 		t.Fatalf("Error loading new bridges: %v", err)
 	}
@@ -145,7 +152,7 @@ func TestLoadNewResourcesMultipleUpdaters(t *testing.T) {
 			"Bridge %s %s:%d %s cert=%s iat-mode=%s"
 		]
 		}`, tpe, ip, port, fingerprint2, params["cert"], params["iat-mode"]))
-	err = d.LoadNewBridges("updater2", r)
+	_, err = d.LoadNewBridges("updater2", r)
 	if err != nil {
 		t.Fatalf("Error loading new bridges: %v", err)
 	}
@@ -170,7 +177,7 @@ func TestLoadSeenIds(t *testing.T) {
 			"Bridge %s %s:%d %s cert=%s iat-mode=%s"
 		]
 		}`, tpe, ip, port, fingerprint, params["cert"], params["iat-mode"]))
-	err := d.LoadNewBridges("updater", r)
+	_, err := d.LoadNewBridges("updater", r)
 	if err != nil {
 		t.Fatalf("Error loading new bridges: %v", err)
 	}
@@ -180,7 +187,7 @@ func TestLoadSeenIds(t *testing.T) {
 			"Bridge %s %s:%d %s cert=%s iat-mode=%s"
 		]
 		}`, tpe, ip, port, fingerprint2, params["cert"], params["iat-mode"]))
-	err = d.LoadNewBridges("updater2", r)
+	_, err = d.LoadNewBridges("updater2", r)
 	if err != nil {
 		t.Fatalf("Error loading new bridges: %v", err)
 	}
@@ -189,3 +196,197 @@ func TestLoadSeenIds(t *testing.T) {
 		t.Fatalf("Wrong number of resources: %d", len(rs))
 	}
 }
+
+func TestLoadNewResourcesCap(t *testing.T) {
+	d := TelegramDistributor{
+		IdStore: pjson.New("seen_ids", t.TempDir()),
+	}
+	c := config
+	c.Distributors.Telegram.Resource = tpe
+	c.Distributors.Telegram.MaxNewBridgesPerUpdater = 2
+	d.Init(&c)
+	defer d.Shutdown()
+
+	fingerprints := []string{fingerprint, fingerprint2, "BBBBB47E84DA8F6D1030F370F2E308D574281E77"}
+	bridgelines := []string{}
+	for _, fp := range fingerprints {
+		bridgelines = append(bridgelines, fmt.Sprintf(`"Bridge %s %s:%d %s cert=%s iat-mode=%s"`, tpe, ip, port, fp, params["cert"], params["iat-mode"]))
+	}
+	r := strings.NewReader(`{"bridgelines": [` + strings.Join(bridgelines, ",") + `]}`)
+	if _, err := d.LoadNewBridges("updater", r); err != nil {
+		t.Fatalf("Error loading new bridges: %v", err)
+	}
+
+	got := make(map[string]bool)
+	for _, r := range d.newHashring.GetAll() {
+		got[r.(*resources.Transport).Fingerprint] = true
+	}
+	expected := map[string]bool{fingerprints[1]: true, fingerprints[2]: true}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the oldest bridge to be evicted, got %v", got)
+	}
+	if count := testutil.ToFloat64(newBridgesGauge.WithLabelValues("updater")); count != 2 {
+		t.Errorf("Expected the gauge to report 2 new bridges, got %v", count)
+	}
+}
+
+func TestLoadNewResourcesTooLarge(t *testing.T) {
+	d := TelegramDistributor{
+		IdStore: pjson.New("seen_ids", t.TempDir()),
+	}
+	c := config
+	c.Distributors.Telegram.Resource = tpe
+	c.Distributors.Telegram.MaxUpdateBytes = 100
+	d.Init(&c)
+	defer d.Shutdown()
+
+	r := strings.NewReader(fmt.Sprintf(`{
+		"bridgelines": [
+			"Bridge %s %s:%d %s cert=%s iat-mode=%s"
+		]
+		}`, tpe, ip, port, fingerprint, params["cert"], params["iat-mode"]))
+	_, err := d.LoadNewBridges("updater", r)
+	if !errors.Is(err, UpdateTooLarge) {
+		t.Fatalf("Expected the update to be too large, got %v", err)
+	}
+	if rs := d.newHashring.GetAll(); len(rs) != 0 {
+		t.Errorf("Bridges of a too large update were loaded: %v", rs)
+	}
+}
+
+func TestLoadNewResourcesRejectedLines(t *testing.T) {
+	d := TelegramDistributor{
+		IdStore: pjson.New("seen_ids", t.TempDir()),
+	}
+	c := config
+	c.Distributors.Telegram.Resource = tpe
+	d.Init(&c)
+	defer d.Shutdown()
+
+	valid := fmt.Sprintf("Bridge %s %s:%d %s cert=%s iat-mode=%s", tpe, ip, port, fingerprint, params["cert"], params["iat-mode"])
+	malformed := fmt.Sprintf("Bridge %s %s %s", tpe, ip, fingerprint2)
+	wrongType := fmt.Sprintf("Bridge webtunnel %s:%d %s url=https://example.com", ip, port, fingerprint2)
+	body, _ := json.Marshal(bridgesJSON{Bridgelines: []string{valid, malformed, wrongType}})
+	report, err := d.LoadNewBridges("updater", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error loading new bridges: %v", err)
+	}
+	if report.Accepted != 1 || len(report.Rejected) != 2 {
+		t.Fatalf("Expected 1 accepted and 2 rejected bridgelines, got %+v", report)
+	}
+	for i, bridgeline := range []string{malformed, wrongType} {
+		if report.Rejected[i].Bridgeline != bridgeline || report.Rejected[i].Reason == "" {
+			t.Errorf("Wrong rejected bridgeline %+v, expected %q with a reason", report.Rejected[i], bridgeline)
+		}
+	}
+	if rs := d.newHashring.GetAll(); len(rs) != 1 {
+		t.Errorf("Wrong number of resources: %d", len(rs))
+	}
+
+	// An update without any valid bridgeline doesn't replace the bridges.
+	body, _ = json.Marshal(bridgesJSON{Bridgelines: []string{malformed}})
+	report, err = d.LoadNewBridges("updater", bytes.NewReader(body))
+	if !errors.Is(err, MalformedUpdate) || report == nil || len(report.Rejected) != 1 {
+		t.Errorf("Expected a malformed update with a report, got %v %+v", err, report)
+	}
+	if rs := d.newHashring.GetAll(); len(rs) != 1 {
+		t.Errorf("Wrong number of resources: %d", len(rs))
+	}
+}
+
+func TestNewBridgesWithheldUntilTested(t *testing.T) {
+	d := TelegramDistributor{
+		IdStore: pjson.New("seen_ids", t.TempDir()),
+	}
+	c := config
+	c.Distributors.Telegram.Resource = tpe
+	c.Distributors.Telegram.TestNewBridges = true
+	d.Init(&c)
+	defer d.Shutdown()
+
+	bridgeline := fmt.Sprintf("%s %s:%d %s cert=%s iat-mode=%s", tpe, ip, port, fingerprint, params["cert"], params["iat-mode"])
+	body, _ := json.Marshal(bridgesJSON{Bridgelines: []string{"Bridge " + bridgeline}})
+	if _, err := d.LoadNewBridges("updater", bytes.NewReader(body)); err != nil {
+		t.Fatalf("Error loading new bridges: %v", err)
+	}
+	newID := c.Distributors.Telegram.MinUserID + 1
+	if res := d.GetResources(newID); len(res) != 0 {
+		t.Fatalf("Untested new bridges were distributed: %v", res)
+	}
+
+	body, _ = json.Marshal(testResultsJSON{Results: map[string]bool{bridgeline: true}})
+	updated, err := d.SetNewBridgesTestResults(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error setting the test results: %v", err)
+	}
+	if updated != 1 {
+		t.Errorf("Expected 1 bridge to be updated, got %d", updated)
+	}
+	res := d.GetResources(newID)
+	if len(res) != 1 || res[0].(*resources.Transport).Fingerprint != fingerprint {
+		t.Fatalf("The functional new bridge was not distributed: %v", res)
+	}
+
+	// Pushing the same bridge again keeps its test result.
+	body, _ = json.Marshal(bridgesJSON{Bridgelines: []string{bridgeline}})
+	if _, err := d.LoadNewBridges("updater", bytes.NewReader(body)); err != nil {
+		t.Fatalf("Error loading new bridges: %v", err)
+	}
+	if res := d.GetResources(newID); len(res) != 1 {
+		t.Errorf("The functional new bridge was withheld after being pushed again")
+	}
+
+	body, _ = json.Marshal(testResultsJSON{Results: map[string]bool{bridgeline: false}})
+	if _, err := d.SetNewBridgesTestResults(bytes.NewReader(body)); err != nil {
+		t.Fatalf("Error setting the test results: %v", err)
+	}
+	if res := d.GetResources(newID); len(res) != 0 {
+		t.Errorf("Dysfunctional new bridges were distributed: %v", res)
+	}
+}
+
+func TestNewBridgesSavedConcurrently(t *testing.T) {
+	store := pjson.New("updater", t.TempDir())
+	d := TelegramDistributor{
+		IdStore:         pjson.New("seen_ids", t.TempDir()),
+		NewBridgesStore: map[string]persistence.Mechanism{"updater": store},
+	}
+	c := config
+	c.Distributors.Telegram.Resource = tpe
+	d.Init(&c)
+	defer d.Shutdown()
+
+	bridgeline := fmt.Sprintf("%s %s:%d %s cert=%s iat-mode=%s", tpe, ip, port, fingerprint, params["cert"], params["iat-mode"])
+	bridges, _ := json.Marshal(bridgesJSON{Bridgelines: []string{bridgeline}})
+	if _, err := d.LoadNewBridges("updater", bytes.NewReader(bridges)); err != nil {
+		t.Fatalf("Error loading new bridges: %v", err)
+	}
+
+	// The test results change while the other updates are being saved.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(functional bool) {
+			defer wg.Done()
+			body, _ := json.Marshal(testResultsJSON{Results: map[string]bool{bridgeline: functional}})
+			if _, err := d.SetNewBridgesTestResults(bytes.NewReader(body)); err != nil {
+				t.Errorf("Error setting the test results: %v", err)
+			}
+		}(i%2 == 0)
+		go func() {
+			defer wg.Done()
+			if _, err := d.LoadNewBridges("updater", bytes.NewReader(bridges)); err != nil {
+				t.Errorf("Error loading new bridges: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var saved []resources.Transport
+	if err := store.Load(&saved); err != nil {
+		t.Fatalf("Error loading the saved bridges: %v", err)
+	}
+	if len(saved) != 1 || saved[0].Fingerprint != fingerprint {
+		t.Errorf("Unexpected saved bridges: %v", saved)
+	}
+}
@@ -23,8 +23,18 @@ import (
 
 const (
 	DistName = "telegram"
+
+	defaultLoxRetries        = 2
+	defaultLoxTimeoutSeconds = 10
+	// invitationCacheTime is how long we keep handing out the same invitation
+	// to a user, so users retrying don't produce duplicated invitations
+	invitationCacheTime = 30 * time.Second
 )
 
+// loxRetryBackoff is the time to wait before retrying a failed request to the
+// Lox server, it doubles on each retry
+var loxRetryBackoff = time.Second
+
 var (
 	bridgeRequestsCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "telegram_bridges_request_total",
@@ -58,6 +68,15 @@ type TelegramDistributor struct {
 	dynamicBridges map[string][]core.Resource
 	seenIDs        map[int64]time.Time
 
+	loxClient       *http.Client
+	invitationCache map[int64]cachedInvitation
+	// pendingInvitations are the invitations being requested to the Lox server,
+	// so concurrent requests of the same user wait for it instead of
+	// requesting their own
+	pendingInvitations map[int64]*pendingInvitation
+	// invitationLock protects seenIDs, invitationCache and pendingInvitations
+	invitationLock sync.Mutex
+
 	// newHashrightLock is used to block read access when an update is happening in the newHashring
 	newHashrightLock sync.RWMutex
 
@@ -75,7 +94,13 @@ func (d *TelegramDistributor) GetResources(id int64) []core.Resource {
 	md := metricsData{hashKey: hashKey}
 
 	d.newHashrightLock.RLock()
-	resources, err := d.newHashring.GetMany(hashKey, d.cfg.NumBridgesPerRequest)
+	var resources []core.Resource
+	var err error
+	if d.cfg.TestNewBridges {
+		resources, err = d.newHashring.GetManyFiltered(hashKey, isFunctional, d.cfg.NumBridgesPerRequest)
+	} else {
+		resources, err = d.newHashring.GetMany(hashKey, d.cfg.NumBridgesPerRequest)
+	}
 	d.newHashrightLock.RUnlock()
 	if err != nil {
 		log.Println("Error getting resources from the hashring:", err)
@@ -97,6 +122,11 @@ func (d *TelegramDistributor) GetResources(id int64) []core.Resource {
 	return resources
 }
 
+// isFunctional returns true if the resource passed its last test.
+func isFunctional(r core.Resource) bool {
+	return r.TestResult().State == core.StateFunctional
+}
+
 type IdFreshnessError struct {
 }
 
@@ -112,6 +142,19 @@ func (e *InvitationLimitError) Error() string {
 	return fmt.Sprintf("%s ", e.ClaimTime.String())
 }
 
+type cachedInvitation struct {
+	invitation []byte
+	created    time.Time
+}
+
+// pendingInvitation is an invitation request to the Lox server in flight, done
+// is closed when invitation and err are set
+type pendingInvitation struct {
+	done       chan struct{}
+	invitation []byte
+	err        error
+}
+
 type LoxRequestError struct {
 	Err string
 }
@@ -124,23 +167,75 @@ func (d *TelegramDistributor) GetInvitation(id int64) ([]byte, error) {
 	if id > d.cfg.MinUserID {
 		return nil, &IdFreshnessError{}
 	}
+
+	d.invitationLock.Lock()
+	if cached, ok := d.invitationCache[id]; ok && time.Since(cached.created) < invitationCacheTime {
+		d.invitationLock.Unlock()
+		return cached.invitation, nil
+	}
 	if added, ok := d.seenIDs[id]; ok {
 		if (added.AddDate(0, 0, InvitationRequestDayLimit)).After(time.Now()) {
+			d.invitationLock.Unlock()
 			claim_time := added.AddDate(0, 0, InvitationRequestDayLimit)
 			return nil, &InvitationLimitError{ClaimTime: claim_time}
 		}
 	}
-	response, err := GetLoxInvitation(d.cfg.LoxServerAddress)
-	if err == nil {
-		d.seenIDs[id] = time.Now()
-		d.IdStore.Save(d.seenIDs)
-		return response, nil
+	if pending, ok := d.pendingInvitations[id]; ok {
+		d.invitationLock.Unlock()
+		<-pending.done
+		return pending.invitation, pending.err
+	}
+	pending := &pendingInvitation{done: make(chan struct{})}
+	d.pendingInvitations[id] = pending
+	d.invitationLock.Unlock()
+
+	response, err := GetLoxInvitation(d.loxClient, d.cfg.LoxServerAddress, d.loxRetries())
+
+	d.invitationLock.Lock()
+	defer d.invitationLock.Unlock()
+	delete(d.pendingInvitations, id)
+	defer close(pending.done)
+	if err != nil {
+		pending.err = &LoxRequestError{Err: err.Error()}
+		return nil, pending.err
+	}
+
+	now := time.Now()
+	d.seenIDs[id] = now
+	d.IdStore.Save(d.seenIDs)
+	for cachedID, cached := range d.invitationCache {
+		if now.Sub(cached.created) >= invitationCacheTime {
+			delete(d.invitationCache, cachedID)
+		}
+	}
+	d.invitationCache[id] = cachedInvitation{invitation: response, created: now}
+	pending.invitation = response
+	return response, nil
+}
+
+func (d *TelegramDistributor) loxRetries() int {
+	if d.cfg.LoxRetries == nil || *d.cfg.LoxRetries < 0 {
+		return defaultLoxRetries
+	}
+	return *d.cfg.LoxRetries
+}
+
+// GetLoxInvitation requests an invitation to the Lox server, retrying with an
+// exponential backoff up to retries times if it fails.
+func GetLoxInvitation(client *http.Client, loxserver string, retries int) ([]byte, error) {
+	backoff := loxRetryBackoff
+	for i := 0; ; i++ {
+		invitation, err := getLoxInvitation(client, loxserver)
+		if err == nil || i >= retries {
+			return invitation, err
+		}
+		log.Printf("Lox invitation request failed, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	return nil, &LoxRequestError{Err: err.Error()}
 }
 
-func GetLoxInvitation(loxserver string) ([]byte, error) {
-	client := &http.Client{}
+func getLoxInvitation(client *http.Client, loxserver string) ([]byte, error) {
 	req, err := http.NewRequest("POST", loxserver+"/invite", nil)
 	if err != nil {
 		log.Println("error making http request: ", err)
@@ -156,10 +251,11 @@ func GetLoxInvitation(loxserver string) ([]byte, error) {
 		log.Println("error getting http response: ", err)
 		return nil, err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		log.Println("client: bad request:", err)
-		return nil, err
+		log.Println("client: bad request:", res.Status)
+		return nil, fmt.Errorf("lox server responded with %s", res.Status)
 	}
 	resBody, err := ioutil.ReadAll(res.Body)
 	if err != nil {
@@ -190,11 +286,19 @@ func (d *TelegramDistributor) Init(cfg *internal.Config) {
 	d.cfg = &cfg.Distributors.Telegram
 	d.shutdown = make(chan bool)
 	d.oldHashring = core.NewHashring()
+	d.oldHashring.SetNewResourceBias(time.Duration(d.cfg.NewBridgeBiasHours)*time.Hour, d.cfg.NewBridgeBias)
 	d.newHashring = core.NewHashring()
 	d.seenIDs = make(map[int64]time.Time)
+	d.invitationCache = make(map[int64]cachedInvitation)
+	d.pendingInvitations = make(map[int64]*pendingInvitation)
+	loxTimeout := d.cfg.LoxTimeoutSeconds
+	if loxTimeout <= 0 {
+		loxTimeout = defaultLoxTimeoutSeconds
+	}
+	d.loxClient = &http.Client{Timeout: time.Duration(loxTimeout) * time.Second}
+	d.dynamicBridges = make(map[string][]core.Resource)
 	d.loadNewBridgesFromStore()
 	d.loadIdsFromStore()
-	d.dynamicBridges = make(map[string][]core.Resource)
 
 	metricsChan := make(chan metricsData)
 	d.metricsChan = metricsChan
@@ -217,6 +321,11 @@ func (d *TelegramDistributor) Init(cfg *internal.Config) {
 	go d.housekeeping(rStream)
 }
 
+// SupportedTypes returns the resource type that the distributor hands out.
+func (d *TelegramDistributor) SupportedTypes() []string {
+	return []string{d.cfg.Resource}
+}
+
 func (d *TelegramDistributor) Shutdown() {
 	log.Printf("Shutting down %s distributor.", DistName)
 
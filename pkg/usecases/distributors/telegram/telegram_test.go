@@ -5,7 +5,14 @@
 package telegram
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
@@ -64,3 +71,128 @@ func TestGetResources(t *testing.T) {
 		t.Errorf("Wrong resource: %v", res[1])
 	}
 }
+
+func TestGetInvitationRetries(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "invitation")
+	}))
+	defer ts.Close()
+
+	oldBackoff := loxRetryBackoff
+	loxRetryBackoff = time.Millisecond
+	defer func() { loxRetryBackoff = oldBackoff }()
+
+	cfg := config
+	cfg.Distributors.Telegram.LoxServerAddress = ts.URL
+	retries := 2
+	cfg.Distributors.Telegram.LoxRetries = &retries
+	d := TelegramDistributor{IdStore: pjson.New("seen_ids", t.TempDir())}
+	d.Init(&cfg)
+	defer d.Shutdown()
+
+	invitation, err := d.GetInvitation(10)
+	if err != nil {
+		t.Fatalf("Unexpected error getting the invitation: %v", err)
+	}
+	if string(invitation) != "invitation" {
+		t.Errorf("Unexpected invitation: %s", invitation)
+	}
+	if requests != 3 {
+		t.Errorf("Expected 3 requests to the lox server, got %d", requests)
+	}
+
+	invitation, err = d.GetInvitation(10)
+	if err != nil {
+		t.Fatalf("Unexpected error getting the cached invitation: %v", err)
+	}
+	if string(invitation) != "invitation" {
+		t.Errorf("Unexpected cached invitation: %s", invitation)
+	}
+	if requests != 3 {
+		t.Errorf("The cached invitation should not request the lox server, got %d requests", requests)
+	}
+}
+
+func TestGetInvitationNoRetries(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	cfg := config
+	cfg.Distributors.Telegram.LoxServerAddress = ts.URL
+	retries := 0
+	cfg.Distributors.Telegram.LoxRetries = &retries
+	d := TelegramDistributor{IdStore: pjson.New("seen_ids", t.TempDir())}
+	d.Init(&cfg)
+	defer d.Shutdown()
+
+	_, err := d.GetInvitation(10)
+	if err == nil {
+		t.Fatal("Expected an error getting the invitation")
+	}
+	if requests != 1 {
+		t.Errorf("Expected a single request to the lox server, got %d", requests)
+	}
+}
+
+func TestGetInvitationConcurrently(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		fmt.Fprint(w, "invitation")
+	}))
+	defer ts.Close()
+
+	cfg := config
+	cfg.Distributors.Telegram.LoxServerAddress = ts.URL
+	d := TelegramDistributor{IdStore: pjson.New("seen_ids", t.TempDir())}
+	d.Init(&cfg)
+	defer d.Shutdown()
+
+	var wg sync.WaitGroup
+	invitations := make([][]byte, 5)
+	errs := make([]error, len(invitations))
+	for i := range invitations {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			invitations[i], errs[i] = d.GetInvitation(10)
+		}(i)
+	}
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	for i := range invitations {
+		if errs[i] != nil {
+			t.Fatalf("Unexpected error getting the invitation: %v", errs[i])
+		}
+		if string(invitations[i]) != "invitation" {
+			t.Errorf("Unexpected invitation: %s", invitations[i])
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected 1 request to the lox server, got %d", requests)
+	}
+}
+
+func TestSupportedTypes(t *testing.T) {
+	d := initDistributor()
+	defer d.Shutdown()
+
+	if types := d.SupportedTypes(); !reflect.DeepEqual(types, []string{"dummy"}) {
+		t.Errorf("Expected the configured type dummy, got %v", types)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"log"
 	"net"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -77,6 +78,24 @@ type Flags struct {
 	Valid   bool `json:"valid"`
 }
 
+// Has returns if the flag with the given name, as written in the
+// networkstatus, is set.  It returns an error for flags we don't keep track
+// of.
+func (f Flags) Has(name string) (bool, error) {
+	switch strings.ToLower(name) {
+	case "fast":
+		return f.Fast, nil
+	case "stable":
+		return f.Stable, nil
+	case "running":
+		return f.Running, nil
+	case "valid":
+		return f.Valid, nil
+	default:
+		return false, fmt.Errorf("unknown flag %s", name)
+	}
+}
+
 // Bridge represents a Tor bridge.
 type Bridge struct {
 	BridgeBase
@@ -170,12 +189,23 @@ func (b *Bridge) String() string {
 	return b.GetBridgeLine()
 }
 
+func (b *Bridge) TestString() string {
+	return b.String()
+}
+
 func (b *Bridge) Expiry() time.Duration {
 	return time.Duration(time.Hour * 3)
 }
 
 func GetTorBridgeTypes() []string {
-	return []string{ResourceTypeVanilla, ResourceTypeObfs4}
+	types := []string{}
+	for name, opts := range transportTypes {
+		if opts.TorBridge {
+			types = append(types, name)
+		}
+	}
+	sort.Strings(types)
+	return append([]string{ResourceTypeVanilla}, types...)
 }
 
 // PrintTorAddr takes as input a *IPAddr object and if it contains an IPv6
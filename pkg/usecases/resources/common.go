@@ -21,6 +21,7 @@ const (
 	ResourceTypeWebSocket    = "websocket"
 	ResourceTypeFTE          = "fte"
 	ResourceTypeWebtunnel    = "webtunnel"
+	ResourceTypeConjure      = "conjure"
 	ResourceTypeTBLink       = "tblink"
 )
 
@@ -32,23 +33,88 @@ type ResourceInfo struct {
 	// Some transports like webtunnel will have a address placeholder because is not used to connect to the transport.
 	IsAddressDummy bool
 
+	// AddressParam is the transport parameter with the URL clients connect to,
+	// for transports like conjure that use a registration server instead of
+	// the address on the resource.
+	AddressParam string
+
 	// NeedsPersistantStore indicates if the resource is generated and needs to be stored between rdsys runs.
 	// Bridges comming from the bridge descriptors don't need storage, but resources generated by updaters do.
 	NeedsPersistantStore bool
+
+	// Validate checks the parameters of a transport, it's only set for
+	// transport types.
+	Validate func(t *Transport) error
 }
 
 var ResourceMap = map[string]ResourceInfo{
-	ResourceTypeVanilla:      {New: func() core.Resource { return NewBridge() }, IsAddressDummy: false},
-	ResourceTypeObfs2:        {New: func() core.Resource { return NewTransport() }, IsAddressDummy: false},
-	ResourceTypeObfs3:        {New: func() core.Resource { return NewTransport() }, IsAddressDummy: false},
-	ResourceTypeObfs4:        {New: func() core.Resource { return NewTransport() }, IsAddressDummy: false},
-	ResourceTypeScrambleSuit: {New: func() core.Resource { return NewTransport() }, IsAddressDummy: false},
-	ResourceTypeMeek:         {New: func() core.Resource { return NewTransport() }, IsAddressDummy: true},
-	ResourceTypeSnowflake:    {New: func() core.Resource { return NewTransport() }, IsAddressDummy: true},
-	ResourceTypeWebSocket:    {New: func() core.Resource { return NewTransport() }, IsAddressDummy: false},
-	ResourceTypeFTE:          {New: func() core.Resource { return NewTransport() }, IsAddressDummy: false},
-	ResourceTypeWebtunnel:    {New: func() core.Resource { return NewTransport() }, IsAddressDummy: true},
-	ResourceTypeTBLink:       {New: func() core.Resource { return NewTBLink() }, NeedsPersistantStore: true},
+	ResourceTypeVanilla: {New: func() core.Resource { return NewBridge() }, IsAddressDummy: false},
+	ResourceTypeTBLink:  {New: func() core.Resource { return NewTBLink() }, NeedsPersistantStore: true},
+}
+
+// TransportTypeOptions describe how a pluggable transport type is handled.
+type TransportTypeOptions struct {
+	// IsAddressDummy indicates if the address of the transport is a dummy
+	// placeholder.
+	IsAddressDummy bool
+
+	// AddressParam is the transport parameter with the URL clients connect
+	// to, if they don't use the address of the transport.
+	AddressParam string
+
+	// Validate, if set, checks the parameters of the transport.  Transports
+	// that fail it are rejected like the ones with an invalid address.
+	Validate func(t *Transport) error
+
+	// TorBridge indicates if the transport is one of the types returned by
+	// GetTorBridgeTypes.
+	TorBridge bool
+}
+
+// transportTypes are the pluggable transport types registered with
+// RegisterTransportType.
+var transportTypes = make(map[string]TransportTypeOptions)
+
+func init() {
+	RegisterTransportType(ResourceTypeObfs2, TransportTypeOptions{})
+	RegisterTransportType(ResourceTypeObfs3, TransportTypeOptions{})
+	RegisterTransportType(ResourceTypeObfs4, TransportTypeOptions{TorBridge: true})
+	RegisterTransportType(ResourceTypeScrambleSuit, TransportTypeOptions{})
+	RegisterTransportType(ResourceTypeMeek, TransportTypeOptions{IsAddressDummy: true})
+	RegisterTransportType(ResourceTypeSnowflake, TransportTypeOptions{IsAddressDummy: true})
+	RegisterTransportType(ResourceTypeWebSocket, TransportTypeOptions{})
+	RegisterTransportType(ResourceTypeFTE, TransportTypeOptions{})
+	RegisterTransportType(ResourceTypeWebtunnel, TransportTypeOptions{IsAddressDummy: true})
+	RegisterTransportType(ResourceTypeConjure, TransportTypeOptions{IsAddressDummy: true, AddressParam: "url"})
+}
+
+// RegisterTransportType adds a pluggable transport type to the resource types
+// known by rdsys.  It's not safe for concurrent use, types need to be
+// registered before the backend and distributors start, e.g. in an init
+// function.
+func RegisterTransportType(name string, opts TransportTypeOptions) {
+	transportTypes[name] = opts
+	ResourceMap[name] = ResourceInfo{
+		New:            func() core.Resource { return NewTransport() },
+		IsAddressDummy: opts.IsAddressDummy,
+		AddressParam:   opts.AddressParam,
+		Validate:       opts.Validate,
+	}
+}
+
+// UnregisterTransportType removes a pluggable transport type added with
+// RegisterTransportType.  Like RegisterTransportType, it's not safe for
+// concurrent use.
+func UnregisterTransportType(name string) {
+	delete(transportTypes, name)
+	delete(ResourceMap, name)
+}
+
+// IsTransportType returns true if the given type was registered as a
+// pluggable transport type.
+func IsTransportType(name string) bool {
+	_, ok := transportTypes[name]
+	return ok
 }
 
 type TmpResourceDiff struct {
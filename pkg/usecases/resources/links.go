@@ -17,9 +17,20 @@ type Version struct {
 	Major int `json:"major"`
 	Minor int `json:"minor"`
 	Patch int `json:"patch"`
+	// Alpha is the alpha release number (e.g. 1 for 14.0a1), 0 for stable
+	// releases
+	Alpha int `json:"alpha,omitempty"`
 }
 
 func Str2Version(s string) (version Version, err error) {
+	if i := strings.Index(s, "a"); i != -1 {
+		version.Alpha, err = strconv.Atoi(s[i+1:])
+		if err != nil {
+			return
+		}
+		s = s[:i]
+	}
+
 	parts := strings.Split(s, ".")
 	version.Major, err = strconv.Atoi(parts[0])
 	if err != nil {
@@ -40,6 +51,9 @@ func Str2Version(s string) (version Version, err error) {
 }
 
 func (v Version) String() string {
+	if v.Alpha != 0 {
+		return fmt.Sprintf("%d.%d.%da%d", v.Major, v.Minor, v.Patch, v.Alpha)
+	}
 	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
 }
 
@@ -64,7 +78,17 @@ func (v Version) Compare(v2 Version) int {
 		return -1
 	}
 
-	return 0
+	// a stable release is higher than its alphas
+	if v.Alpha == v2.Alpha {
+		return 0
+	} else if v.Alpha == 0 {
+		return 1
+	} else if v2.Alpha == 0 {
+		return -1
+	} else if v.Alpha > v2.Alpha {
+		return 1
+	}
+	return -1
 }
 
 // TBLink stores a link to download Tor Browser for a certain platform
@@ -76,8 +100,11 @@ type TBLink struct {
 	FileName     string         `json:"file_name"`
 	Link         string         `json:"link"`
 	SigLink      string         `json:"sig_link"`
-	CustomOid    *core.Hashkey  `json:"custom_oid"`
+	CustomUid    *core.Hashkey  `json:"custom_uid"`
 	CustomExpiry *time.Duration `json:"custom_expiry"`
+	// Created is when the link was created, the link stops being valid after
+	// its Expiry
+	Created time.Time `json:"created"`
 }
 
 // NewTBLink allocates and returns a new TBLink object.
@@ -87,6 +114,7 @@ func NewTBLink() *TBLink {
 	ratio := 1.0
 	tl.TestResult().Ratio = &ratio
 	tl.SetType(ResourceTypeTBLink)
+	tl.Created = time.Now().UTC()
 	return tl
 }
 
@@ -94,14 +122,18 @@ func (tl *TBLink) IsValid() bool {
 	return true
 }
 
+// Oid changes when the link changes, e.g. when a presigned link gets
+// refreshed
 func (tl *TBLink) Oid() core.Hashkey {
-	if tl.CustomOid != nil {
-		return *tl.CustomOid
-	}
 	return core.NewHashkey(tl.Link)
 }
 
+// Uid identifies the file being linked, if the link has a CustomUid it's kept
+// when the link is refreshed
 func (tl *TBLink) Uid() core.Hashkey {
+	if tl.CustomUid != nil {
+		return *tl.CustomUid
+	}
 	return tl.Oid()
 }
 
@@ -116,6 +148,10 @@ func (tl *TBLink) String() string {
 	return tl.Link
 }
 
+func (tl *TBLink) TestString() string {
+	return tl.String()
+}
+
 // Expiry TBLinks that are older than a year, a newer version should have already being released
 func (tl *TBLink) Expiry() time.Duration {
 	if tl.CustomExpiry != nil {
@@ -124,6 +160,12 @@ func (tl *TBLink) Expiry() time.Duration {
 	return time.Duration(time.Hour * 24 * 365)
 }
 
+// Expired returns true if the link is older than its expiry.  Links without
+// creation time don't expire.
+func (tl *TBLink) Expired() bool {
+	return !tl.Created.IsZero() && time.Since(tl.Created) > tl.Expiry()
+}
+
 // Distributor set for this link
 func (tl *TBLink) Distributor() string {
 	return ""
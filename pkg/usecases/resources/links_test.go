@@ -0,0 +1,41 @@
+// Copyright (c) 2024, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resources
+
+import (
+	"testing"
+)
+
+func TestAlphaVersion(t *testing.T) {
+	alpha, err := Str2Version("14.0a1")
+	if err != nil {
+		t.Fatalf("failed to parse alpha version: %s", err)
+	}
+	if alpha != (Version{Major: 14, Minor: 0, Alpha: 1}) {
+		t.Errorf("alpha version parsed incorrectly: %+v", alpha)
+	}
+	if alpha.String() != "14.0.0a1" {
+		t.Errorf("unexpected alpha version string: %s", alpha.String())
+	}
+
+	nextAlpha, _ := Str2Version("14.0a2")
+	stable, _ := Str2Version("14.0")
+	previous, _ := Str2Version("13.5.7")
+	for _, c := range []struct {
+		v1, v2   Version
+		expected int
+	}{
+		{alpha, alpha, 0},
+		{nextAlpha, alpha, 1},
+		{alpha, nextAlpha, -1},
+		{stable, nextAlpha, 1},
+		{alpha, stable, -1},
+		{alpha, previous, 1},
+	} {
+		if r := c.v1.Compare(c.v2); r != c.expected {
+			t.Errorf("comparing %s to %s returned %d, expected %d", c.v1, c.v2, r, c.expected)
+		}
+	}
+}
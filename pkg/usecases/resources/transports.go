@@ -5,8 +5,11 @@
 package resources
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,6 +20,19 @@ import (
 
 const (
 	bridgelinePrefix = "Bridge"
+
+	// fingerprintLength is the number of hex characters of a bridge's
+	// fingerprint.
+	fingerprintLength = 40
+)
+
+var (
+	// MalformedBridgeline is wrapped by the errors of FromBridgeline for
+	// lines that are not bridge lines.
+	MalformedBridgeline = errors.New("Malformed bridge line")
+	// UnsupportedTransport is wrapped by the errors of FromBridgeline for
+	// bridge lines of a transport that we don't know about.
+	UnsupportedTransport = errors.New("Unsupported transport")
 )
 
 // TestFunc takes as input a resource and tests it.
@@ -39,38 +55,66 @@ func NewTransport() *Transport {
 	return t
 }
 
-// FromBridgeline parses the bridgeline to create a Transport struct
+// FromBridgeline parses the bridgeline to create a Transport struct.  It
+// tolerates the variants that users tend to send: an optional "Bridge" prefix
+// in any case, transport names and fingerprints in any case and runs of
+// whitespace between the fields.  The returned error wraps
+// UnsupportedTransport if the line is well formed but its transport is not
+// one we know, and MalformedBridgeline otherwise.
 func FromBridgeline(bridgeline string) (*Transport, error) {
-	bridgeline = strings.TrimPrefix(bridgeline, bridgelinePrefix)
-	bridgeline = strings.TrimSpace(bridgeline)
-	bridgeParts := strings.Split(bridgeline, " ")
+	bridgeParts := strings.Fields(bridgeline)
+	if len(bridgeParts) > 0 && strings.EqualFold(bridgeParts[0], bridgelinePrefix) {
+		bridgeParts = bridgeParts[1:]
+	}
+	if len(bridgeParts) == 0 {
+		return nil, fmt.Errorf("%w: empty line", MalformedBridgeline)
+	}
+
+	rType := strings.ToLower(bridgeParts[0])
+	if _, _, err := net.SplitHostPort(rType); err == nil {
+		return nil, fmt.Errorf("%w: the line has no transport", UnsupportedTransport)
+	}
+	if len(bridgeParts) < 3 {
+		return nil, fmt.Errorf("%w: expected a transport, an address and a fingerprint", MalformedBridgeline)
+	}
 
 	var bridge Transport
-	bridge.RType = bridgeParts[0]
-	bridge.Fingerprint = bridgeParts[2]
+	bridge.RType = rType
 
-	addrParts := strings.Split(bridgeParts[1], ":")
-	if len(addrParts) != 2 {
-		return nil, fmt.Errorf("Malformed address %s", bridgeParts[1])
-	}
-	addr, err := net.ResolveIPAddr("", addrParts[0])
+	host, portStr, err := net.SplitHostPort(bridgeParts[1])
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: address %s: %s", MalformedBridgeline, bridgeParts[1], err)
 	}
-	bridge.Address = IPAddr{IPAddr: *addr}
-	port, err := strconv.Atoi(addrParts[1])
-	if err != nil {
-		return nil, fmt.Errorf("Can't convert port to integer: %s", err)
+	// Bridge lines carry IP addresses, never host names.
+	addr := net.ParseIP(host)
+	if addr == nil {
+		return nil, fmt.Errorf("%w: invalid IP address %s", MalformedBridgeline, host)
+	}
+	bridge.Address = IPAddr{IPAddr: net.IPAddr{IP: addr}}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("%w: invalid port %s", MalformedBridgeline, portStr)
 	}
 	bridge.Port = uint16(port)
 
+	fingerprint := strings.ToUpper(bridgeParts[2])
+	if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != fingerprintLength {
+		return nil, fmt.Errorf("%w: invalid fingerprint %s", MalformedBridgeline, bridgeParts[2])
+	}
+	bridge.Fingerprint = fingerprint
+
 	bridge.Parameters = make(map[string]string)
 	for _, param := range bridgeParts[3:] {
-		paramParts := strings.Split(param, "=")
-		if len(paramParts) != 2 {
-			return nil, fmt.Errorf("Malformed param %s", param)
+		// Values, like base64 encoded certificates, might have an '='.
+		key, value, found := strings.Cut(param, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("%w: param %s", MalformedBridgeline, param)
 		}
-		bridge.Parameters[paramParts[0]] = paramParts[1]
+		bridge.Parameters[key] = value
+	}
+
+	if !IsTransportType(bridge.RType) {
+		return nil, fmt.Errorf("%w: %s", UnsupportedTransport, bridge.RType)
 	}
 	return &bridge, nil
 }
@@ -103,10 +147,39 @@ func (t *Transport) String() string {
 	return strings.TrimSpace(strRep)
 }
 
+func (t *Transport) TestString() string {
+	return t.String()
+}
+
 func (t *Transport) IsValid() bool {
 	return t.Type() != "" && t.Address.String() != "" && t.Port != 0
 }
 
+// HasInvalidAddress returns true if clients can't connect to the transport
+// with the address it carries.  Transports with a dummy address are not
+// checked, unless their address is in one of their parameters.
+func (t *Transport) HasInvalidAddress() bool {
+	info := ResourceMap[t.Type()]
+	if info.AddressParam != "" {
+		u, err := url.Parse(t.Parameters[info.AddressParam])
+		return err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == ""
+	}
+	return !info.IsAddressDummy && t.Address.Invalid()
+}
+
+// Validate returns an error if the transport can't be distributed, because
+// its address is not valid or its parameters don't pass the validation of its
+// transport type.
+func (t *Transport) Validate() error {
+	if t.HasInvalidAddress() {
+		return fmt.Errorf("its address is not valid: %s", t.Address.String())
+	}
+	if validate := ResourceMap[t.Type()].Validate; validate != nil {
+		return validate(t)
+	}
+	return nil
+}
+
 func (t *Transport) Expiry() time.Duration {
 	return time.Duration(time.Hour * 3)
 }
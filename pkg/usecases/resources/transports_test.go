@@ -5,7 +5,11 @@
 package resources
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -55,3 +59,137 @@ func TestFromBridgeline(t *testing.T) {
 		}
 	}
 }
+
+func TestFromBridgelineVariants(t *testing.T) {
+	cert := params["cert"]
+	for _, test := range []struct {
+		name       string
+		bridgeline string
+		err        error
+	}{
+		{"plain", fmt.Sprintf("obfs4 %s:%d %s cert=%s iat-mode=0", ip, port, fingerprint, cert), nil},
+		{"prefix", fmt.Sprintf("Bridge obfs4 %s:%d %s cert=%s iat-mode=0", ip, port, fingerprint, cert), nil},
+		{"lowercase prefix", fmt.Sprintf("bridge obfs4 %s:%d %s cert=%s iat-mode=0", ip, port, fingerprint, cert), nil},
+		{"uppercase transport", fmt.Sprintf("Bridge OBFS4 %s:%d %s cert=%s iat-mode=0", ip, port, fingerprint, cert), nil},
+		{"lowercase fingerprint", fmt.Sprintf("obfs4 %s:%d %s cert=%s iat-mode=0", ip, port, strings.ToLower(fingerprint), cert), nil},
+		{"extra whitespace", fmt.Sprintf("  Bridge\tobfs4  %s:%d   %s cert=%s \t iat-mode=0 \r\n", ip, port, fingerprint, cert), nil},
+
+		{"empty", "", MalformedBridgeline},
+		{"only prefix", "Bridge ", MalformedBridgeline},
+		{"no fingerprint", fmt.Sprintf("obfs4 %s:%d", ip, port), MalformedBridgeline},
+		{"no port", fmt.Sprintf("obfs4 %s %s", ip, fingerprint), MalformedBridgeline},
+		{"bad port", fmt.Sprintf("obfs4 %s:70000 %s", ip, fingerprint), MalformedBridgeline},
+		{"bad address", fmt.Sprintf("obfs4 300.1.2.3:%d %s", port, fingerprint), MalformedBridgeline},
+		{"bad fingerprint", fmt.Sprintf("obfs4 %s:%d %s", ip, port, fingerprint[1:]), MalformedBridgeline},
+		{"bad param", fmt.Sprintf("obfs4 %s:%d %s cert", ip, port, fingerprint), MalformedBridgeline},
+		{"prefix without space", fmt.Sprintf("Bridgeobfs4 %s:%d %s", ip, port, fingerprint), UnsupportedTransport},
+		{"unknown transport", fmt.Sprintf("foo %s:%d %s", ip, port, fingerprint), UnsupportedTransport},
+		{"vanilla", fmt.Sprintf("Bridge %s:%d %s", ip, port, fingerprint), UnsupportedTransport},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bridge, err := FromBridgeline(test.bridgeline)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error loading bridge %q: %v", test.bridgeline, err)
+			}
+			if bridge.Type() != tpe || bridge.Address.String() != ip || bridge.Port != port || bridge.Fingerprint != fingerprint {
+				t.Errorf("Wrong bridge: %s", bridge)
+			}
+			if !reflect.DeepEqual(bridge.Parameters, params) {
+				t.Errorf("Wrong parameters: %v", bridge.Parameters)
+			}
+		})
+	}
+}
+
+func TestConjure(t *testing.T) {
+	const registrar = "https://registration.refraction.network/api"
+	bridgeline := fmt.Sprintf("conjure 143.110.214.222:80 %s url=%s front=cdn.sstatic.net", fingerprint, registrar)
+	bridge, err := FromBridgeline(bridgeline)
+	if err != nil {
+		t.Fatalf("Error loading bridge %s: %v", bridgeline, err)
+	}
+	if bridge.Type() != ResourceTypeConjure {
+		t.Errorf("Wrong type: %s", bridge.Type())
+	}
+	if bridge.Parameters["url"] != registrar {
+		t.Errorf("Wrong registration server: %s", bridge.Parameters["url"])
+	}
+	if bridge.HasInvalidAddress() {
+		t.Error("Conjure transport with a registration server has an invalid address")
+	}
+
+	// The address of conjure transports is a placeholder, the registration
+	// server is what matters.
+	bridge.Address = IPAddr{}
+	if bridge.HasInvalidAddress() {
+		t.Error("Conjure transport address should not be checked")
+	}
+	for _, u := range []string{"", "registration.refraction.network", "ftp://registration.refraction.network"} {
+		bridge.Parameters["url"] = u
+		if !bridge.HasInvalidAddress() {
+			t.Errorf("Conjure transport with registration server %q has a valid address", u)
+		}
+	}
+	bridge.Parameters["url"] = registrar
+
+	b, err := json.Marshal(bridge)
+	if err != nil {
+		t.Fatalf("Error marshalling conjure transport: %v", err)
+	}
+	r := ResourceMap[ResourceTypeConjure].New()
+	if err := json.Unmarshal(b, r); err != nil {
+		t.Fatalf("Error unmarshalling conjure transport: %v", err)
+	}
+	if r.String() != bridge.String() {
+		t.Errorf("Unmarshalled conjure transport %q doesn't match %q", r.String(), bridge.String())
+	}
+	if r.Type() != ResourceTypeConjure {
+		t.Errorf("Wrong unmarshalled type: %s", r.Type())
+	}
+}
+
+func TestRegisterTransportType(t *testing.T) {
+	const custom = "custom"
+	RegisterTransportType(custom, TransportTypeOptions{
+		Validate: func(t *Transport) error {
+			if t.Parameters["key"] == "" {
+				return errors.New("missing key")
+			}
+			return nil
+		},
+		TorBridge: true,
+	})
+	defer UnregisterTransportType(custom)
+
+	if !IsTransportType(custom) {
+		t.Error("Registered transport type is not a transport type")
+	}
+	if IsTransportType(ResourceTypeVanilla) {
+		t.Error("Vanilla bridges are not a transport type")
+	}
+	expected := []string{ResourceTypeVanilla, custom, ResourceTypeObfs4}
+	if types := GetTorBridgeTypes(); !reflect.DeepEqual(types, expected) {
+		t.Errorf("Wrong Tor bridge types %v, expected %v", types, expected)
+	}
+
+	bridge, err := FromBridgeline(fmt.Sprintf("%s %s:%d %s key=value", custom, ip, port, fingerprint))
+	if err != nil {
+		t.Fatalf("Error loading custom bridge: %v", err)
+	}
+	if _, ok := ResourceMap[custom].New().(*Transport); !ok {
+		t.Error("Registered transport type doesn't create transports")
+	}
+	if err := bridge.Validate(); err != nil {
+		t.Errorf("Valid custom transport failed validation: %v", err)
+	}
+	delete(bridge.Parameters, "key")
+	if err := bridge.Validate(); err == nil {
+		t.Error("Custom transport without key passed validation")
+	}
+}
@@ -5,6 +5,8 @@
 package gettor
 
 import (
+	"context"
+
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
@@ -29,6 +31,32 @@ func (u *GettorUpdater) Init(cfg *internal.Config) {
 func (u *GettorUpdater) Shutdown() {
 }
 
-func (u *GettorUpdater) AddLinks(links []*resources.TBLink) error {
-	return u.ipc.MakeJsonRequest(&links, nil)
+// LinkResult is the outcome of sending a link to the backend.
+type LinkResult struct {
+	Link     *resources.TBLink
+	Accepted bool
+	// Reason is why the backend rejected the link.
+	Reason string
+}
+
+// AddLinks sends the links to the backend and returns which of them the
+// backend accepted.  If the request fails no link was added.
+func (u *GettorUpdater) AddLinks(ctx context.Context, links []*resources.TBLink) ([]LinkResult, error) {
+	var resp internal.PostResourcesResponse
+	if err := u.ipc.MakeJsonRequest(ctx, &links, &resp); err != nil {
+		return nil, err
+	}
+
+	results := make([]LinkResult, len(links))
+	for i, link := range links {
+		results[i] = LinkResult{Link: link, Accepted: true}
+	}
+	for _, rejected := range resp.Rejected {
+		if rejected.Index < 0 || rejected.Index >= len(links) {
+			continue
+		}
+		results[rejected.Index].Accepted = false
+		results[rejected.Index].Reason = rejected.Reason
+	}
+	return results, nil
 }